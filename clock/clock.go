@@ -0,0 +1,137 @@
+// Package clock abstracts the wall clock, so that time-dependent behavior such
+// as expiration and republishing can be tested by advancing a mock clock
+// instead of sleeping.
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock tells the time and creates tickers.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker delivers ticks at intervals on its channel, like time.Ticker.
+type Ticker interface {
+	Chan() <-chan time.Time
+	Stop()
+}
+
+// Real is the clock of the system.
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return FromTicker(time.NewTicker(d))
+}
+
+// FromTicker wraps a ticker of the time package.
+func FromTicker(t *time.Ticker) Ticker {
+	return realTicker{t}
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) Chan() <-chan time.Time { return t.C }
+
+// Mock is a clock that only moves when advanced. It's safe for concurrent use.
+type Mock struct {
+	sync.Mutex
+	now     time.Time
+	tickers []*mockTicker
+}
+
+// NewMock creates a mock clock set to the time.
+func NewMock(now time.Time) *Mock {
+	return &Mock{now: now}
+}
+
+// Now returns the time of the mock clock.
+func (m *Mock) Now() time.Time {
+	m.Lock()
+	defer m.Unlock()
+	return m.now
+}
+
+// NewTicker creates a ticker that ticks whenever the mock clock is advanced
+// past the next tick. Like time.Ticker, ticks are dropped if the receiver
+// doesn't keep up, a tick that is still pending is replaced by the latest one
+// so that the receiver always sees the time it was advanced to.
+func (m *Mock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	t := &mockTicker{
+		m:      m,
+		c:      make(chan time.Time, 1),
+		period: d,
+		next:   m.now.Add(d),
+	}
+	m.tickers = append(m.tickers, t)
+	return t
+}
+
+// Advance moves the mock clock forward by the duration, and ticks the tickers
+// whose next tick has passed, in the order of their ticks.
+func (m *Mock) Advance(d time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.now = m.now.Add(d)
+
+	tickers := append([]*mockTicker{}, m.tickers...)
+	sort.Slice(tickers, func(i, j int) bool {
+		return tickers[i].next.Before(tickers[j].next)
+	})
+
+	for _, t := range tickers {
+		if t.next.After(m.now) {
+			continue
+		}
+
+		select {
+		case <-t.c: // Replace the pending tick.
+		default:
+		}
+		t.c <- m.now
+
+		for !t.next.After(m.now) {
+			t.next = t.next.Add(t.period)
+		}
+	}
+}
+
+type mockTicker struct {
+	m      *Mock
+	c      chan time.Time
+	period time.Duration
+	next   time.Time
+}
+
+func (t *mockTicker) Chan() <-chan time.Time { return t.c }
+
+// Stop removes the ticker from the mock clock, no more ticks are delivered.
+func (t *mockTicker) Stop() {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	for i, other := range t.m.tickers {
+		if other == t {
+			t.m.tickers = append(t.m.tickers[:i], t.m.tickers[i+1:]...)
+			return
+		}
+	}
+}
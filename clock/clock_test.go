@@ -0,0 +1,57 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMock_Advance(t *testing.T) {
+	start := time.Now()
+	m := NewMock(start)
+
+	ticker := m.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	m.Advance(30 * time.Second)
+	select {
+	case <-ticker.Chan():
+		t.Error("ticked before the interval passed")
+	default:
+	}
+
+	m.Advance(time.Minute)
+	m.Advance(time.Hour)
+	select {
+	case now := <-ticker.Chan():
+		if !now.Equal(start.Add(time.Hour + 90*time.Second)) {
+			t.Errorf("unexpected tick time: %v", now)
+		}
+	default:
+		t.Error("expected a tick")
+	}
+
+	// Ticks missed by the receiver are replaced by the latest.
+	select {
+	case <-ticker.Chan():
+		t.Error("expected only one tick")
+	default:
+	}
+
+	if m.Now().Sub(start) != time.Hour+90*time.Second {
+		t.Errorf("unexpected time: %v", m.Now())
+	}
+}
+
+func TestMock_Stop(t *testing.T) {
+	m := NewMock(time.Now())
+
+	ticker := m.NewTicker(time.Second)
+	ticker.Stop()
+
+	m.Advance(time.Minute)
+	select {
+	case <-ticker.Chan():
+		t.Error("stopped ticker ticked")
+	default:
+	}
+}
@@ -27,8 +27,8 @@ func TestHTTPHandler(t *testing.T) {
 		},
 	}
 
-	nw, _ := network.NewUDPNetwork(me)
-	dht, _ := dht.New(me, others, nw)
+	nw, _ := network.NewUDPNetwork(me, network.Config{})
+	dht, _ := dht.New(me, others, nw, dht.Config{})
 
 	go func() {
 		err := nw.Listen()
@@ -88,8 +88,8 @@ func TestNewHTTPHandler(t *testing.T) {
 		},
 	}
 
-	nw, _ := network.NewUDPNetwork(me)
-	dht, _ := dht.New(me, others, nw)
+	nw, _ := network.NewUDPNetwork(me, network.Config{})
+	dht, _ := dht.New(me, others, nw, dht.Config{})
 
 	go func() {
 		err := nw.Listen()
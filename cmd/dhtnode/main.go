@@ -1,9 +1,12 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	stdlog "log"
 	"net"
 	"os"
@@ -13,6 +16,7 @@ import (
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/diode"
 	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ed25519"
 
 	"github.com/optmzr/d7024e-dht/dht"
 	"github.com/optmzr/d7024e-dht/network"
@@ -34,6 +38,37 @@ func flagSplit(flag string) (string, string) {
 	return nodeID, address
 }
 
+// loadKey reads the hex encoded Ed25519 seed from the file, a new seed is
+// generated and saved if the file doesn't exist.
+func loadKey(path string) (ed25519.PrivateKey, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		seed := make([]byte, ed25519.SeedSize)
+		if _, err := rand.Read(seed); err != nil {
+			return nil, fmt.Errorf("cannot generate seed: %w", err)
+		}
+
+		err = ioutil.WriteFile(path, []byte(hex.EncodeToString(seed)), 0600)
+		if err != nil {
+			return nil, fmt.Errorf("cannot save seed: %w", err)
+		}
+
+		return ed25519.NewKeyFromSeed(seed), nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	seed, err := hex.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode seed: %w", err)
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("seed must be %d bytes", ed25519.SeedSize)
+	}
+
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
 func setupLogger(debug bool, logFilepath string) zerolog.Logger {
 	var console io.Writer
 	if debug {
@@ -75,6 +110,16 @@ func main() {
 	otherFlag := flag.String("other", "", "Waits for incoming connections if not supplied")
 	debugFlag := flag.Bool("debug", false, "Print debug logs")
 	logFilepathFlag := flag.String("log", "/tmp/dhtnode.log", "File to output logs to")
+	logLevelFlag := flag.String("log-level", "error", "Verbosity of the logs of routine requests, either error, info or debug, -debug implies debug")
+	tableFlag := flag.String("table", "", "File to persist the routing table to, disabled if not supplied")
+	storeFlag := flag.String("store", "", "File to persist the stored values to, disabled if not supplied")
+	codecFlag := flag.String("codec", "proto", "Wire format of the packets, either proto or json (for debugging)")
+	keyFlag := flag.String("key", "", "File with the Ed25519 seed used to sign packets, created if missing, the node ID is derived from it")
+	requireSignaturesFlag := flag.Bool("require-signatures", false, "Drop requests that are not signed by the owner of the sender ID")
+	verifyContactsFlag := flag.Bool("verify-contacts", true, "Ping the senders of requests before adding them to the routing table")
+	noTCPFlag := flag.Bool("no-tcp", false, "Send large packets as UDP chunks instead of over TCP")
+	namespaceFlag := flag.String("namespace", "", "Namespace the keys of the values are derived in, isolates the keys from other networks")
+	listenFlag := flag.String("listen", "", "Address to bind to if it differs from the address in -me, e.g. behind NAT, the -me address is then advertised to other nodes")
 	flag.Parse()
 
 	logger := setupLogger(*debugFlag, *logFilepathFlag)
@@ -138,18 +183,67 @@ func main() {
 		}
 	}
 
+	var key ed25519.PrivateKey
+	if *keyFlag != "" {
+		key, err = loadKey(*keyFlag)
+		if err != nil {
+			log.Fatal().Err(err).Msgf("Unable to load key from: %s", *keyFlag)
+		}
+
+		// The node ID is bound to the public key.
+		me.NodeID = node.IDFromPublicKey(key.Public().(ed25519.PublicKey))
+	}
+
 	// Add the short node ID to the logger.
 	log.Logger = logger.With().Str("nodeid", me.NodeID.String()[:6]).Logger()
 
 	// Print the whole ID:
 	log.Info().Msgf("My ID is: %v", me.NodeID)
 
-	nw, err := network.NewUDPNetwork(me)
+	var codec network.Codec
+	switch *codecFlag {
+	case "proto":
+		codec = network.ProtoCodec{}
+	case "json":
+		codec = network.JSONCodec{}
+	default:
+		log.Fatal().Msgf("Unknown codec: %s", *codecFlag)
+	}
+
+	logLevel, err := dht.ParseLogLevel(*logLevelFlag)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid log level")
+	}
+	if *debugFlag {
+		logLevel = dht.LogDebug
+	}
+
+	var listenAddress *net.UDPAddr
+	if *listenFlag != "" {
+		listenAddress, err = net.ResolveUDPAddr("udp", *listenFlag)
+		if err != nil {
+			log.Fatal().Err(err).Msgf("Unable to resolve UDP address: %s", *listenFlag)
+		}
+	}
+
+	nw, err := network.NewUDPNetwork(me, network.Config{
+		Codec:         codec,
+		PrivateKey:    key,
+		DisableTCP:    *noTCPFlag,
+		ListenAddress: listenAddress,
+	})
 	if err != nil {
 		log.Fatal().Err(err).Msg("Failed to initialize network")
 	}
 
-	dht, err := dht.New(me, others, nw)
+	dht, err := dht.New(me, others, nw, dht.Config{
+		TablePath:                  *tableFlag,
+		StorePath:                  *storeFlag,
+		RequireSignatures:          *requireSignaturesFlag,
+		DisableContactVerification: !*verifyContactsFlag,
+		Namespace:                  []byte(*namespaceFlag),
+		LogLevel:                   logLevel,
+	})
 	if err != nil {
 		log.Fatal().Err(err).Msg("Failed to initialize DHT")
 	}
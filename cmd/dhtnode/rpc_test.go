@@ -25,8 +25,8 @@ func TestRPCServe(t *testing.T) {
 		},
 	}
 
-	nw, _ := network.NewUDPNetwork(me)
-	dht, _ := dht.New(me, others, nw)
+	nw, _ := network.NewUDPNetwork(me, network.Config{})
+	dht, _ := dht.New(me, others, nw, dht.Config{})
 
 	go func() {
 		err := nw.Listen()
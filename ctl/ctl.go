@@ -75,6 +75,12 @@ func (a *API) Exit(exit Exit, ok *bool) error {
 
 	go func() {
 		time.Sleep(5 * time.Second)
+
+		err := a.dht.Close()
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to close the DHT")
+		}
+
 		os.Exit(0)
 	}()
 
@@ -0,0 +1,110 @@
+package dht
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// alphaWindow is the number of lookup requests the degree of parallelism is
+// adapted after.
+const alphaWindow = 20
+
+// alphaBackoff is the fraction of timed out requests in a window at which the
+// degree of parallelism is halved.
+const alphaBackoff = 0.2
+
+// alphaSlowdown is how much slower than the smoothed round-trip time the
+// responses of a window can be on average and still be considered fast.
+const alphaSlowdown = 1.5
+
+// adaptiveAlpha adapts the degree of parallelism of lookups to the recent
+// requests, and a Mutex lock for the datastructure. It's raised by one after a
+// window of fast responses without timeouts, and halved when the timeouts
+// spike, within the bounds. A nil adaptiveAlpha keeps the static α.
+type adaptiveAlpha struct {
+	sync.Mutex
+	min, max int
+	alpha    int
+
+	srtt     time.Duration // Smoothed round-trip time of every response.
+	baseline time.Duration // Smoothed round-trip time when the window started.
+	requests int           // Requests in the current window.
+	timeouts int           // Timed out requests in the current window.
+	elapsed  time.Duration // Sum of the round-trip times in the current window.
+}
+
+func newAdaptiveAlpha(alpha, min, max int) *adaptiveAlpha {
+	return &adaptiveAlpha{
+		min:   min,
+		max:   max,
+		alpha: alpha,
+	}
+}
+
+// get returns the current degree of parallelism, or the static α if nil.
+func (a *adaptiveAlpha) get(static int) int {
+	if a == nil {
+		return static
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	return a.alpha
+}
+
+// observe records the outcome of a lookup request, the round-trip time is
+// ignored if it timed out.
+func (a *adaptiveAlpha) observe(rtt time.Duration, timedOut bool) {
+	if a == nil {
+		return
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	a.requests++
+	if timedOut {
+		a.timeouts++
+	} else {
+		a.elapsed += rtt
+		if a.srtt == 0 {
+			a.srtt = rtt
+		} else {
+			a.srtt += time.Duration(rttGain * float64(rtt-a.srtt))
+		}
+	}
+
+	if a.requests < alphaWindow {
+		return
+	}
+
+	old := a.alpha
+	responses := a.requests - a.timeouts
+
+	base := a.baseline
+	if base == 0 {
+		base = a.srtt // The first window is compared with itself.
+	}
+
+	switch {
+	case float64(a.timeouts) >= alphaBackoff*float64(a.requests):
+		a.alpha /= 2
+		if a.alpha < a.min {
+			a.alpha = a.min
+		}
+	case a.timeouts == 0 && a.elapsed/time.Duration(responses) <= time.Duration(alphaSlowdown*float64(base)):
+		if a.alpha < a.max {
+			a.alpha++
+		}
+	}
+
+	if a.alpha != old {
+		log.Debug().Msgf("Adapted lookup parallelism from %d to %d, %d of %d requests timed out",
+			old, a.alpha, a.timeouts, a.requests)
+	}
+
+	a.requests, a.timeouts, a.elapsed = 0, 0, 0
+	a.baseline = a.srtt
+}
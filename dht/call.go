@@ -2,6 +2,7 @@ package dht
 
 import (
 	"net"
+	"time"
 
 	"github.com/optmzr/d7024e-dht/route"
 
@@ -10,8 +11,11 @@ import (
 	"github.com/optmzr/d7024e-dht/store"
 )
 
+// Call is a lookup performed by walk. Result is only called by the goroutine
+// running the walk, so the state of a call doesn't need to be synchronized and
+// is safe to read once the walk has returned.
 type Call interface {
-	Do(nw network.Network, address net.UDPAddr) (ch chan network.FindResult, err error)
+	Do(nw network.Network, address net.UDPAddr, timeout time.Duration, deadline time.Time) (ch chan network.FindResult, err error)
 	Result(result network.FindResult, callee route.Contact) (stop bool)
 	Target() (target node.ID)
 }
@@ -26,8 +30,8 @@ type FindNodesCall struct {
 	target node.ID
 }
 
-func (q *FindNodesCall) Do(nw network.Network, address net.UDPAddr) (chan network.FindResult, error) {
-	return nw.FindNodes(q.target, address)
+func (q *FindNodesCall) Do(nw network.Network, address net.UDPAddr, timeout time.Duration, deadline time.Time) (chan network.FindResult, error) {
+	return nw.FindNodes(q.target, address, timeout, deadline)
 }
 
 func (q *FindNodesCall) Result(_ network.FindResult, _ route.Contact) (_ bool) { return }
@@ -39,29 +43,150 @@ func NewFindValueCall(hash store.Key) *FindValueCall {
 	}
 }
 
+// NewConvergingFindValueCall creates a find value call that doesn't stop at the
+// first callee that responds with the value, but continues until the lookup
+// converges and keeps the value of the holder closest to the hash.
+func NewConvergingFindValueCall(hash store.Key) *FindValueCall {
+	return &FindValueCall{
+		hash:     hash,
+		converge: true,
+	}
+}
+
+// NewHasValueCall creates a find value call where the callees only respond if
+// they hold the value, without the value.
+func NewHasValueCall(hash store.Key) *FindValueCall {
+	return &FindValueCall{
+		hash:   hash,
+		exists: true,
+	}
+}
+
 type FindValueCall struct {
-	hash   store.Key
-	value  string
-	sender node.ID
+	hash     store.Key
+	exists   bool // Only ask if the value is held.
+	converge bool // Keep the value of the closest holder instead of stopping at the first.
+	value    []byte
+	meta     store.Meta
+	found    bool // Any callee responded with the value.
+	from     route.Contact
+	holders  []route.Contact // Callees that responded with the value.
+	misses   []route.Contact
+	explicit bool                    // The hash was chosen by the publisher, see DHT.PutAtKey.
+	valid    func(value []byte) bool // Checks the received values against the hash, nil accepts any value.
 }
 
-func (q *FindValueCall) Do(nw network.Network, address net.UDPAddr) (chan network.FindResult, error) {
-	return nw.FindValue(q.hash, address)
+func (q *FindValueCall) Do(nw network.Network, address net.UDPAddr, timeout time.Duration, deadline time.Time) (chan network.FindResult, error) {
+	if q.exists {
+		return nw.HasValue(q.hash, address, timeout, deadline)
+	}
+	return nw.FindValue(q.hash, address, timeout, deadline)
 }
 
 func (q *FindValueCall) Result(result network.FindResult, callee route.Contact) (stop bool) {
-	// TODO: Value validation could be added here, where the value received is
-	// checked towards the expected hash.
+	// Nodes that doesn't set the found flag only signal found values by a
+	// non-empty value.
+	if result.Found() || len(result.Value()) > 0 {
+		if !q.exists && q.valid != nil && !q.valid(result.Value()) {
+			// Neither a holder nor a miss, the value doesn't match the hash,
+			// e.g. corrupted or forged by the callee.
+			return false
+		}
+
+		q.holders = append(q.holders, callee)
 
-	q.value = result.Value()
-	q.sender = callee.NodeID
-	if q.value != "" {
-		stop = true
+		if q.found && q.converge && !closer(q.Target(), callee, q.from) {
+			return false // A closer holder already responded.
+		}
+
+		q.value = result.Value()
+		q.meta = result.Meta()
+		q.found = true
+		q.from = callee
+		stop = !q.converge
 	} else {
+		// Remember the nodes that responded without the value, the closest
+		// of them is used for caching.
+		q.misses = append(q.misses, callee)
 		stop = false
 	}
 
 	return
 }
 
+// closestMiss returns the closest contact to the hash that responded without
+// the value. It returns false if every queried node had the value.
+func (q *FindValueCall) closestMiss() (contact route.Contact, ok bool) {
+	misses := q.nearMisses()
+	if len(misses) == 0 {
+		return
+	}
+	return misses[0], true
+}
+
+// nearMisses returns the contacts that responded without the value, sorted by
+// distance to the hash.
+func (q *FindValueCall) nearMisses() []route.Contact {
+	return route.NewCandidates(q.Target(), q.misses...).SortedContacts()
+}
+
 func (q *FindValueCall) Target() node.ID { return node.ID(q.hash) }
+
+// closer returns true if a is closer than b to the target by XOR distance.
+func closer(target node.ID, a, b route.Contact) bool {
+	return route.DistanceBetween(a.NodeID, target).Less(route.DistanceBetween(b.NodeID, target))
+}
+
+// NewQuorumCall creates a call that looks up the value for the hash like a find
+// value call, but continues until min callees have responded with a value.
+func NewQuorumCall(hash store.Key, min int) *QuorumCall {
+	return &QuorumCall{
+		hash:   hash,
+		min:    min,
+		values: make(map[string][]route.Contact),
+	}
+}
+
+type QuorumCall struct {
+	hash    store.Key
+	min     int
+	holders int
+	values  map[string][]route.Contact // Holders of each distinct value.
+	valid   func(value []byte) bool    // Checks the received values against the hash, nil accepts any value.
+}
+
+func (q *QuorumCall) Do(nw network.Network, address net.UDPAddr, timeout time.Duration, deadline time.Time) (chan network.FindResult, error) {
+	return nw.FindValue(q.hash, address, timeout, deadline)
+}
+
+func (q *QuorumCall) Result(result network.FindResult, callee route.Contact) (stop bool) {
+	if !result.Found() && len(result.Value()) == 0 {
+		return false
+	}
+	if q.valid != nil && !q.valid(result.Value()) {
+		return false // Doesn't match the hash, e.g. corrupted or forged by the callee.
+	}
+
+	q.add(string(result.Value()), callee)
+	return q.holders >= q.min
+}
+
+// add records the value held by the contact.
+func (q *QuorumCall) add(value string, holder route.Contact) {
+	q.values[value] = append(q.values[value], holder)
+	q.holders++
+}
+
+// majority returns the value held by the most holders, together with the
+// number of holders.
+func (q *QuorumCall) majority() (value string, agreement int) {
+	for v, holders := range q.values {
+		if len(holders) > agreement || (len(holders) == agreement && v < value) {
+			value = v
+			agreement = len(holders)
+		}
+	}
+	return
+}
+
+func (q *QuorumCall) Target() node.ID { return node.ID(q.hash) }
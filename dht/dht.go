@@ -2,109 +2,1350 @@ package dht
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rs/zerolog/log"
 
+	"github.com/optmzr/d7024e-dht/clock"
 	"github.com/optmzr/d7024e-dht/network"
 	"github.com/optmzr/d7024e-dht/node"
 	"github.com/optmzr/d7024e-dht/route"
 	"github.com/optmzr/d7024e-dht/store"
 )
 
-const α = 3                // Degree of parallelism.
-const k = route.BucketSize // Bucket size.
+const α = 3                // Default degree of parallelism.
+const k = route.BucketSize // Default replication factor (bucket size).
+const maxHops = 20         // Default maximum number of rounds of requests in a lookup.
+const maxPeers = 2 * k     // Default maximum number of contacts exchanged when warming the routing table.
 
 const tExpire = 86410 * time.Second    // Time after which a key/value pair expires (TTL).
 const tReplicate = 3600 * time.Second  // Interval between replication events.
 const tRepublish = 86400 * time.Second // Time after which the original publisher must republish a key/value pair.
 const tRefresh = 3600 * time.Second    // Time after which the routing table requests a refresh of an untouched bucket.
+const tCache = 3600 * time.Second      // Time after which a cached key/value pair expires (TTL).
+
+const maxValueSize = 64 * 1024 // Default maximum size of a value (bytes).
+
+const sweepInterval = 1 * time.Second // Default interval between removals of expired values.
+
+const jitter = 0.1 // Default fraction the replication and republish intervals are randomized by.
+
+const expiryGrace = 60 * time.Second // Default time expired values are kept in case a republish is imminent.
+
+const maxHandoffItems = 1024             // Default maximum number of values handed off by leaving publishers.
+const maxHandoffBytes = 16 * 1024 * 1024 // Default maximum total size of the values handed off by leaving publishers.
+
+const keepaliveContacts = α // Default number of contacts pinged every keepalive round.
+
+const getManyWorkers = 8 // Maximum number of concurrent lookups of GetMany.
+
+const joinRetries = 10                  // Default number of join attempts.
+const joinBackoff = 1 * time.Second     // Interval before the first join retry, doubled after every attempt.
+const joinBackoffMax = 60 * time.Second // Maximum interval between join attempts.
+
+// ErrClosed is returned by operations on a DHT that has been closed.
+var ErrClosed = errors.New("dht is closed")
+
+// ErrNotFound is returned by Get when no node holds the value for the key.
+var ErrNotFound = errors.New("value not found")
+
+// ErrLookupExhausted is returned together with the best contacts found when a
+// lookup didn't converge within the maximum number of hops.
+var ErrLookupExhausted = errors.New("lookup exhausted")
+
+// ErrNoQuorum is returned by GetQuorum when fewer holders than required
+// returned the value.
+var ErrNoQuorum = errors.New("quorum not reached")
+
+// ErrMetaTooLarge is returned when storing a value with metadata larger than
+// store.MaxMetaSize.
+var ErrMetaTooLarge = errors.New("metadata too large")
+
+// ErrValueTooLarge is returned when storing a value larger than the maximum
+// value size.
+var ErrValueTooLarge = errors.New("value too large")
+
+// ErrUnsigned is returned by Delete when the packets of the network are not
+// signed, the nodes only drop values on signed requests.
+var ErrUnsigned = errors.New("packets are not signed")
 
 type DHT struct {
-	rt *route.Table
-	nw network.Network
-	me route.Contact
-	db *store.Database
+	rt     *route.Table
+	nw     network.Network
+	me     route.Contact
+	db     *store.Database
+	config Config
+	rtts   rtts
+	alpha  *adaptiveAlpha // Nil if the degree of parallelism is static.
+
+	started time.Time
+	rpcs    *rpcCounters // Allocated, so that the counters are 64-bit aligned.
+
+	done      chan struct{}
+	closeOnce sync.Once
+
+	joined  chan struct{} // Closed when the initial join is done.
+	joinErr error         // Error of the initial join, set before joined is closed.
+}
+
+// Config contains the tunable parameters of a DHT instance. Fields left as
+// zero values are set to their defaults.
+type Config struct {
+	K           int // Replication factor, number of nodes a value is stored at.
+	Alpha       int // Degree of parallelism in lookups.
+	JoinRetries int // Number of join attempts before giving up.
+	MaxHops     int // Maximum number of rounds of requests in a lookup.
+	MaxPeers    int // Maximum number of contacts exchanged by WarmFrom.
+
+	// AlphaMin and AlphaMax bound the degree of parallelism of lookups when it
+	// adapts to the recent requests, starting from Alpha. It's raised while
+	// the responses are fast and lowered when the timeouts spike. Lookups use
+	// the static Alpha if AlphaMax is zero. AlphaMin defaults to 1.
+	AlphaMin int
+	AlphaMax int
+
+	// TablePath is the file the routing table is persisted to on Close and
+	// loaded from in New. Persistence is disabled if empty.
+	TablePath string
+
+	// StorePath is the file the stored values are persisted to on Close and
+	// restored from in New, values that expired in between are dropped.
+	// Persistence is disabled if empty.
+	StorePath string
+
+	// StoreLimits bounds the number and total size of the values other nodes
+	// can store at this node. Unbounded if zero, except for the values handed
+	// off to this node by leaving publishers, which default to 1024 values and
+	// 16 MiB.
+	StoreLimits store.Limits
+
+	// SweepInterval is the interval between the removals of expired values,
+	// defaults to a second.
+	SweepInterval time.Duration
+
+	// ReplicationCheckInterval is the interval between checks of how many of
+	// the k closest nodes holds each value published by this node, see
+	// CheckReplication. Disabled if zero, as every check is a lookup per
+	// value.
+	ReplicationCheckInterval time.Duration
+
+	// KeepaliveInterval is the interval between rounds of pings to the
+	// KeepaliveContacts least recently seen contacts of the routing table,
+	// which evicts the contacts that have silently left the network. Disabled
+	// if zero.
+	KeepaliveInterval time.Duration
+
+	// KeepaliveContacts is the number of contacts pinged every keepalive
+	// round, which bounds the traffic of the keepalive. Defaults to α.
+	KeepaliveContacts int
+
+	// Jitter is the fraction the replication and republish intervals are
+	// randomized by in either direction, which spreads out the load when many
+	// nodes are started at the same time. Defaults to 10 percent.
+	Jitter float64
+
+	// ExpiryGrace is the time values stored by other nodes are kept, and
+	// served, after they expire, so that a republish arriving just after the
+	// expiration doesn't briefly lose the value. Values with an expiration set
+	// by the publisher, and cached values, have no grace period. Defaults to a
+	// minute.
+	ExpiryGrace time.Duration
+
+	// ConflictPolicy decides which value is kept when another node stores a
+	// different value at a key already stored at this node, e.g. two nodes
+	// using PutAtKey on the same key. Values are stamped with the time they
+	// are published, by the clock of the publisher. Defaults to
+	// store.LastWriteWins, which relies on the clocks of the publishers being
+	// roughly in sync.
+	ConflictPolicy store.ConflictPolicy
+
+	// Timeout is the time to wait for a response to a ping or lookup before
+	// the callee is considered dead, raise it on high-latency links. Uses the
+	// default of the network if zero.
+	Timeout time.Duration
+
+	// MaxValueSize is the maximum size of a stored value in bytes, larger
+	// values are rejected both when published and when received.
+	MaxValueSize int
+
+	// Handoff republishes the values published by this node on Close, and asks
+	// the receivers to take over republishing them, so that the values doesn't
+	// expire when this node leaves the network. This delays Close by one store
+	// of every published value. The receivers only take over values that this
+	// node has stored at them, from packets signed by this node, see
+	// network.Config.PrivateKey.
+	Handoff bool
+
+	// DisableContactVerification adds the senders of requests that are not in
+	// the routing table without pinging them first. By default they are only
+	// added if they respond, e.g. instead of a spoofed source address, which
+	// delays the insertion of new contacts by a round trip. Contacts learned
+	// from responses to lookups and pings are always added, and known contacts
+	// at another address are always pinged before their address is replaced.
+	DisableContactVerification bool
+
+	// RequireSignatures drops requests that are not signed by the owner of
+	// the sender ID, before the sender is added to the routing table.
+	RequireSignatures bool
+
+	// Metrics receives measurements of lookups, stores, timeouts and the
+	// routing table. Measurements are discarded if nil.
+	Metrics Metrics
+
+	// Events is notified of handled requests and learned contacts. The events
+	// are written to the global logger if nil, see LogLevel.
+	Events EventHandler
+
+	// LogLevel is the verbosity of the logs of routine requests, stores and
+	// lookups, which are too chatty for a busy node. Defaults to LogError,
+	// errors and changes to the routing table are logged at every level. A
+	// callee that fails to respond during a lookup is routine, and only logged
+	// at LogDebug. The global level of the logger still applies.
+	LogLevel LogLevel
+
+	// Namespace keys the hash of the published values, so that the same value
+	// maps to different keys in isolated networks. It must be at most
+	// store.MaxNamespaceSize bytes. The values are hashed without a key if
+	// empty.
+	Namespace []byte
+
+	// Comparator orders the shortlist of lookups, e.g. to break ties by round
+	// trip time. Contacts are ordered by XOR distance if nil.
+	Comparator route.Comparator
+
+	// Trace is called with every request sent and response received by
+	// lookups, e.g. to verify the requests made in tests. Disabled if nil.
+	Trace Trace
+
+	// Clock tells the time of the database and the replication monitor, e.g.
+	// to expire and republish values in tests without waiting. Defaults to
+	// the system clock.
+	Clock clock.Clock
+}
+
+// withDefaults returns a copy of the config where every zero value field is
+// set to its default, or an error if the config is invalid.
+func (c Config) withDefaults() (Config, error) {
+	if c.K == 0 {
+		c.K = k
+	}
+	if c.K < 0 {
+		return c, fmt.Errorf("k must be positive, got: %d", c.K)
+	}
+
+	if c.Alpha == 0 {
+		c.Alpha = α
+		if c.Alpha > c.K {
+			c.Alpha = c.K
+		}
+	}
+	if c.Alpha < 0 || c.Alpha > c.K {
+		return c, fmt.Errorf("alpha must be positive and at most k (%d), got: %d", c.K, c.Alpha)
+	}
+
+	if c.AlphaMax != 0 && c.AlphaMin == 0 {
+		c.AlphaMin = 1
+	}
+	if c.AlphaMax != 0 && (c.AlphaMin < 1 || c.AlphaMin > c.Alpha || c.AlphaMax < c.Alpha || c.AlphaMax > c.K) {
+		return c, fmt.Errorf("alpha bounds must be positive and around alpha (%d) and at most k (%d), got: %d to %d",
+			c.Alpha, c.K, c.AlphaMin, c.AlphaMax)
+	}
+	if c.AlphaMax == 0 && c.AlphaMin != 0 {
+		return c, fmt.Errorf("alpha min requires alpha max, got: %d", c.AlphaMin)
+	}
+
+	if c.JoinRetries == 0 {
+		c.JoinRetries = joinRetries
+	}
+	if c.JoinRetries < 0 {
+		return c, fmt.Errorf("join retries must be positive, got: %d", c.JoinRetries)
+	}
+
+	if c.MaxHops == 0 {
+		c.MaxHops = maxHops
+	}
+	if c.MaxHops < 0 {
+		return c, fmt.Errorf("max hops must be positive, got: %d", c.MaxHops)
+	}
+
+	if c.MaxPeers == 0 {
+		c.MaxPeers = maxPeers
+	}
+	if c.MaxPeers < 0 {
+		return c, fmt.Errorf("max peers must be positive, got: %d", c.MaxPeers)
+	}
+
+	if c.MaxValueSize == 0 {
+		c.MaxValueSize = maxValueSize
+	}
+	if c.MaxValueSize < 0 {
+		return c, fmt.Errorf("max value size must be positive, got: %d", c.MaxValueSize)
+	}
+
+	if c.Timeout < 0 {
+		return c, fmt.Errorf("timeout must be positive, got: %v", c.Timeout)
+	}
+
+	if c.SweepInterval == 0 {
+		c.SweepInterval = sweepInterval
+	}
+	if c.SweepInterval < 0 {
+		return c, fmt.Errorf("sweep interval must be positive, got: %v", c.SweepInterval)
+	}
+
+	if c.ReplicationCheckInterval < 0 {
+		return c, fmt.Errorf("replication check interval must be positive, got: %v", c.ReplicationCheckInterval)
+	}
+
+	if c.KeepaliveInterval < 0 {
+		return c, fmt.Errorf("keepalive interval must be positive, got: %v", c.KeepaliveInterval)
+	}
+
+	if c.KeepaliveContacts == 0 {
+		c.KeepaliveContacts = keepaliveContacts
+	}
+	if c.KeepaliveContacts < 0 {
+		return c, fmt.Errorf("keepalive contacts must be positive, got: %d", c.KeepaliveContacts)
+	}
+
+	if c.Jitter == 0 {
+		c.Jitter = jitter
+	}
+	if c.Jitter < 0 || c.Jitter >= 1 {
+		return c, fmt.Errorf("jitter must be positive and less than 1, got: %v", c.Jitter)
+	}
+
+	if c.ExpiryGrace == 0 {
+		c.ExpiryGrace = expiryGrace
+	}
+	if c.ExpiryGrace < 0 {
+		return c, fmt.Errorf("expiry grace must be positive, got: %v", c.ExpiryGrace)
+	}
+
+	if c.StoreLimits.MaxHandoffItems == 0 {
+		c.StoreLimits.MaxHandoffItems = maxHandoffItems
+	}
+	if c.StoreLimits.MaxHandoffBytes == 0 {
+		c.StoreLimits.MaxHandoffBytes = maxHandoffBytes
+	}
+	if c.StoreLimits.MaxItems < 0 || c.StoreLimits.MaxBytes < 0 ||
+		c.StoreLimits.MaxHandoffItems < 0 || c.StoreLimits.MaxHandoffBytes < 0 {
+		return c, fmt.Errorf("store limits must be positive, got: %+v", c.StoreLimits)
+	}
+
+	if len(c.Namespace) > store.MaxNamespaceSize {
+		return c, fmt.Errorf("namespace must be at most %d bytes, got: %d", store.MaxNamespaceSize, len(c.Namespace))
+	}
+
+	if c.Metrics == nil {
+		c.Metrics = nopMetrics{}
+	}
+
+	if c.Clock == nil {
+		c.Clock = clock.Real
+	}
+
+	if c.LogLevel < LogError || c.LogLevel > LogDebug {
+		return c, fmt.Errorf("unknown log level: %d", c.LogLevel)
+	}
+
+	if c.Events == nil {
+		c.Events = logEvents{level: c.LogLevel}
+	}
+
+	return c, nil
+}
+
+func New(me route.Contact, others []route.Contact, nw network.Network, config Config) (dht *DHT, err error) {
+	config, err = config.withDefaults()
+	if err != nil {
+		err = fmt.Errorf("invalid config: %w", err)
+		return
+	}
+
+	refreshTicker := time.NewTicker(60 * time.Second)
+
+	dht = new(DHT)
+	dht.config = config
+	dht.done = make(chan struct{})
+	dht.joined = make(chan struct{})
+	dht.rtts = rtts{m: make(map[node.ID]time.Duration)}
+	if config.AlphaMax > 0 {
+		dht.alpha = newAdaptiveAlpha(config.Alpha, config.AlphaMin, config.AlphaMax)
+	}
+	dht.started = config.Clock.Now()
+	dht.rpcs = new(rpcCounters)
+	loaded, err := loadContacts(config.TablePath)
+	if err != nil {
+		err = fmt.Errorf("cannot load routing table: %w", err)
+		return
+	}
+
+	bootstrap := append(append([]route.Contact{}, others...), loaded...)
+
+	dht.rt, err = route.NewTable(me, bootstrap, tRefresh, refreshTicker)
+	if err != nil {
+		err = fmt.Errorf("cannot initialize routing table: %w", err)
+		return
+	}
+
+	dht.db = store.NewDatabaseWithClock(tExpire, tReplicate, tRepublish, config.StoreLimits, config.Clock, config.SweepInterval, time.Second)
+	dht.db.SetJitter(config.Jitter)
+	dht.db.SetGracePeriod(config.ExpiryGrace)
+	dht.db.SetConflictPolicy(config.ConflictPolicy)
+
+	err = restoreDatabase(dht.db, config.StorePath)
+	if err != nil {
+		dht.rt.Close()
+		dht.db.Close()
+		err = fmt.Errorf("cannot restore database: %w", err)
+		return
+	}
+
+	dht.nw = nw
+	dht.me = me
+
+	go func(dht *DHT, me route.Contact, others []route.Contact) {
+		// Wait for network.
+		select {
+		case <-dht.nw.ReadyCh():
+		case err := <-dht.nw.ErrCh():
+			dht.joinErr = fmt.Errorf("network failed to become ready: %w", err)
+			close(dht.joined)
+			dht.config.Events.OnJoin(0, dht.joinErr)
+			return
+		case <-dht.done:
+			return
+		}
+
+		// Evict the loaded contacts that are no longer alive.
+		dht.sweep(loaded)
+
+		retryInterval := joinBackoff
+		for i := 1; ; i++ {
+			// Failures are reported to the caller through the events and
+			// WaitReady, the process must not be terminated by the DHT.
+			err := dht.Join(me, others)
+			if err == nil {
+				close(dht.joined)
+				dht.config.Events.OnJoin(i, nil)
+				break // Join successful, exit retry loop.
+			}
+
+			if i >= dht.config.JoinRetries {
+				dht.joinErr = fmt.Errorf("cannot join after %d attempts: %w", i, err)
+				close(dht.joined)
+				dht.config.Events.OnJoin(i, dht.joinErr)
+				return
+			}
+
+			log.Error().Err(err).Msgf("Failed to join the DHT network, retrying in %v", retryInterval)
+
+			select {
+			case <-time.After(retryInterval):
+			case <-dht.done:
+				return
+			}
+
+			// Exponential backoff.
+			retryInterval *= 2
+			if retryInterval > joinBackoffMax {
+				retryInterval = joinBackoffMax
+			}
+		}
+	}(dht, me, others)
+
+	go dht.findNodesRequestHandler()
+	go dht.getPeersRequestHandler()
+	go dht.findValueRequestHandler()
+	go dht.storeRequestHandler()
+	go dht.deleteRequestHandler()
+	go dht.pongRequestHandler()
+	go dht.republishRequestHandler()
+	go dht.replicateRequestHandler()
+	go dht.refreshRequestHandler()
+
+	if config.ReplicationCheckInterval > 0 {
+		go dht.replicationMonitor(config.ReplicationCheckInterval)
+	}
+
+	if config.KeepaliveInterval > 0 {
+		go dht.keepaliveMonitor(config.KeepaliveInterval)
+	}
+
+	return
+}
+
+// WaitReady blocks until the initial join of the DHT network, started by New,
+// is done and the DHT is ready to be used. Returns the error of the join if
+// every attempt failed, ErrClosed if the DHT is closed before that, or the
+// error of the context if it's done first.
+func (dht *DHT) WaitReady(ctx context.Context) error {
+	select {
+	case <-dht.joined:
+		return dht.joinErr
+	case <-dht.done:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops all the background goroutines of the DHT and closes the
+// underlying network. Operations that require the network returns ErrClosed
+// after the DHT has been closed. The network is closed last, which waits for
+// the requests still pending, e.g. of lookups in progress, to be answered.
+func (dht *DHT) Close() (err error) {
+	err = ErrClosed
+	dht.closeOnce.Do(func() {
+		err = nil
+
+		if dht.config.Handoff {
+			dht.handoff()
+		}
+
+		close(dht.done)
+		dht.rt.Close()
+		dht.db.Close()
+
+		// Persist the table before the network is closed, as closing the
+		// network stops the listener that may be keeping the process alive.
+		if dht.config.TablePath != "" {
+			if e := saveFile(dht.config.TablePath, dht.rt.Save); e != nil {
+				log.Error().Err(e).Msgf("Failed to save routing table to: %s", dht.config.TablePath)
+				err = fmt.Errorf("cannot save routing table: %w", e)
+			}
+		}
+
+		if dht.config.StorePath != "" {
+			if e := saveFile(dht.config.StorePath, dht.db.SnapshotTo); e != nil {
+				log.Error().Err(e).Msgf("Failed to save database to: %s", dht.config.StorePath)
+				err = fmt.Errorf("cannot save database: %w", e)
+			}
+		}
+
+		if e := dht.nw.Close(); e != nil {
+			err = e
+		}
+	})
+	return
+}
+
+// handoff stores every value published by this node at the k closest nodes,
+// which takes over republishing them.
+func (dht *DHT) handoff() {
+	for _, item := range dht.db.LocalItems() {
+		stored, err := dht.iterativeStore(context.Background(), item.Key, []byte(item.Value), item.Meta, item.Written, network.StoreClassHandoff, 0)
+		if err != nil || len(stored) == 0 {
+			log.Error().Err(err).Msgf("Failed to hand off value with hash: %v", item.Key)
+			continue
+		}
+		log.Debug().Msgf("Handed off value with hash %v to:\n%s", item.Key, tabbedContactList(stored...))
+	}
+}
+
+// saveFile persists the output of save to the file at the path. The output is
+// written to a temporary file first, so that a failed write doesn't destroy
+// the previously saved file.
+func saveFile(path string, save func(w io.Writer) error) error {
+	tmp := path + ".tmp"
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	err = save(f)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// loadContacts reads the contacts of a routing table persisted at the path. No
+// contacts are returned if the path is empty or if the file doesn't exist.
+func loadContacts(path string) ([]route.Contact, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return route.ReadContacts(f)
+}
+
+// restoreDatabase restores the database from a snapshot persisted at the path.
+// Nothing is restored if the path is empty or if the file doesn't exist.
+func restoreDatabase(db *store.Database, path string) error {
+	if path == "" {
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return db.RestoreFrom(f)
+}
+
+// sweep pings the contacts, at most k at a time, and removes those that don't
+// respond from the routing table. Returns the number of removed contacts.
+func (dht *DHT) sweep(contacts []route.Contact) int {
+	var evicted int64
+	fanOut(contacts, dht.config.K, func(_ int, contact route.Contact) {
+		if _, err := dht.ping(contact); err != nil {
+			log.Debug().Err(err).Msgf("Evicting unresponsive contact: %v", contact.NodeID)
+			dht.evict(contact)
+			atomic.AddInt64(&evicted, 1)
+		}
+	})
+
+	dht.config.Metrics.TableSize(dht.rt.Len())
+
+	return int(evicted)
+}
+
+// Rebuild recovers the routing table, e.g. after a long partition. Every
+// contact is pinged and the unresponsive contacts are evicted, then the
+// buckets are refilled from the responding contacts with a lookup of the local
+// node and of a random ID in the range of every bucket, like Join. Returns the
+// number of contacts dropped and added. An error is returned if no contact
+// responded, the network must then be joined again from the bootstrap contacts.
+// This is a heavy operation, a round of pings and a lookup per bucket.
+func (dht *DHT) Rebuild() (dropped, added int, err error) {
+	if dht.closed() {
+		return 0, 0, ErrClosed
+	}
+
+	dropped = dht.sweep(dht.rt.AllContacts())
+	if dht.rt.Len() == 0 {
+		return dropped, 0, fmt.Errorf("none of the contacts responded, %d dropped", dropped)
+	}
+
+	alive := make(map[node.ID]bool)
+	for _, c := range dht.rt.AllContacts() {
+		alive[c.NodeID] = true
+	}
+
+	// Keep refilling after failed lookups, the other buckets might still be
+	// reachable.
+	if _, e := dht.iterativeFindNodes(context.Background(), dht.me.NodeID); e != nil {
+		err = e
+	}
+	for id := range node.IDWithPrefixGenerator(dht.me.NodeID) {
+		if _, e := dht.iterativeFindNodes(context.Background(), id); e != nil {
+			err = e
+		}
+	}
+
+	for _, c := range dht.rt.AllContacts() {
+		if !alive[c.NodeID] {
+			added++
+		}
+	}
+
+	log.Info().Msgf("Rebuilt the routing table, dropped %d and added %d contacts", dropped, added)
+
+	if err != nil {
+		err = fmt.Errorf("cannot refill the routing table: %w", err)
+	}
+	return
+}
+
+// closed returns true if the DHT has been closed.
+func (dht *DHT) closed() bool {
+	select {
+	case <-dht.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Ban removes the node from the routing table and prevents it from being added
+// again, e.g. for known malicious nodes. Responses from banned nodes are
+// ignored in lookups.
+func (dht *DHT) Ban(id node.ID) {
+	dht.rt.Ban(id)
+	dht.config.Metrics.TableSize(dht.rt.Len())
+}
+
+// Unban allows the node to be added to the routing table again.
+func (dht *DHT) Unban(id node.ID) {
+	dht.rt.Unban(id)
+}
+
+// Buckets returns a copy of the contacts in every bucket of the routing table,
+// indexed by the bucket index.
+func (dht *DHT) Buckets() []route.Contacts {
+	return dht.rt.Buckets()
+}
+
+// LocalClosest returns up to n contacts of the routing table closest to the key,
+// sorted by distance. Unlike a lookup no requests are sent, the contacts are
+// only the best guess of this node of who holds the value.
+func (dht *DHT) LocalClosest(key store.Key, n int) []route.Contact {
+	return dht.rt.NClosest(node.ID(key), n).SortedContacts()
+}
+
+// StoreStats returns the number of values other nodes have stored at this
+// node, their total size and the number of values evicted to stay within the
+// store limits.
+func (dht *DHT) StoreStats() (items, bytes int, evictions uint64) {
+	items, bytes = dht.db.Size()
+	evictions = dht.db.Evictions()
+	return
+}
+
+// Forget removes the key and associated value from the local items DB and
+// therefore stop republishing it on the network.
+func (dht *DHT) Forget(hash store.Key) {
+	dht.db.ForgetItem(hash)
+}
+
+// Get retrieves the value for a specified key. The value is served from the
+// local database if held by this node, otherwise it's retrieved from the
+// network.
+func (dht *DHT) Get(hash store.Key) (value string, sender node.ID, err error) {
+	value, from, err := dht.GetWithSource(hash)
+	sender = from.NodeID
+	return
+}
+
+// GetWithSource retrieves the value for a specified key and returns the
+// contact of the node that served it. If the value is held in the local
+// database, either published by or stored at this node, the local contact is
+// returned.
+func (dht *DHT) GetWithSource(hash store.Key) (value string, from route.Contact, err error) {
+	b, from, err := dht.getWithSource(context.Background(), hash)
+	value = string(b)
+	return
+}
+
+// GetAtKey retrieves the value stored under a key chosen by the publisher, see
+// PutAtKey, like Get. Unlike Get, the values served by other nodes can't be
+// checked against the key, since the key isn't derived from the value.
+func (dht *DHT) GetAtKey(key store.Key) (value string, sender node.ID, err error) {
+	call := NewFindValueCall(key)
+	call.explicit = true
+
+	b, _, from, err := dht.getWithCall(context.Background(), call)
+	return string(b), from.NodeID, err
+}
+
+// GetContext retrieves the value for a specified key like Get. The lookup is
+// abandoned with the error of the context once it's done, and the requests
+// sent are capped by the deadline of the context so that no single slow
+// request exceeds it.
+func (dht *DHT) GetContext(ctx context.Context, hash store.Key) (value string, sender node.ID, err error) {
+	b, from, err := dht.getWithSource(ctx, hash)
+	value = string(b)
+	sender = from.NodeID
+	return
+}
+
+// GetBytes retrieves the binary value for a specified key, like Get.
+func (dht *DHT) GetBytes(hash store.Key) (value []byte, err error) {
+	value, _, err = dht.getWithSource(context.Background(), hash)
+	return
+}
+
+// GetAndRefresh retrieves the value for a specified key like Get, and on a hit
+// asks the node that served the value to reset its expiration, so that popular
+// values doesn't expire. The value isn't sent again.
+func (dht *DHT) GetAndRefresh(hash store.Key) (value string, err error) {
+	value, from, err := dht.GetWithSource(hash)
+	if err != nil {
+		return
+	}
+
+	if from.NodeID.Equal(dht.me.NodeID) {
+		dht.db.RefreshItem(hash)
+		return
+	}
+
+	if e := dht.nw.Store(hash, false, nil, nil, time.Time{}, network.StoreClassRefresh, 0, from.Address, dht.config.Timeout, time.Time{}); e != nil {
+		log.Warn().Err(e).Msgf("Failed to refresh value with hash %v at: %v", hash, from.NodeID)
+	}
+	return
+}
+
+// Exists returns true if the value for the key is held by this node or by any
+// node in the network. Unlike Get the value isn't transferred.
+func (dht *DHT) Exists(hash store.Key) (bool, error) {
+	if dht.closed() {
+		return false, ErrClosed
+	}
+
+	if _, e := dht.db.GetLocalItem(hash); e == nil {
+		return true, nil
+	}
+	if _, e := dht.db.GetItem(hash); e == nil {
+		return true, nil
+	}
+
+	call := NewHasValueCall(hash)
+	if _, _, err := dht.walk(context.Background(), call); err != nil && !call.found {
+		return false, err
+	}
+	return call.found, nil
+}
+
+// ConflictError is returned by GetQuorumAtKey when the holders of a key returned
+// different values, with the holders of each value.
+type ConflictError struct {
+	Key    store.Key
+	Values map[string][]route.Contact
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%d conflicting values for: %v", len(e.Values), e.Key)
+}
+
+// GetQuorum retrieves the value for the key like Get, but continues the lookup
+// until at least min holders have returned the value, instead of trusting the
+// first. A copy held by this node counts as one of the holders. Returns the
+// value and the number of holders that agreed on it. If fewer than min holders
+// responded the error wraps ErrNoQuorum. Values that don't match the key are
+// ignored, see GetQuorumAtKey for keys chosen by the publisher.
+func (dht *DHT) GetQuorum(hash store.Key, min int) (value string, agreement int, err error) {
+	return dht.getQuorum(hash, min, dht.keyedBy(hash))
+}
+
+// GetQuorumAtKey retrieves the value stored under a key chosen by the
+// publisher, see PutAtKey, like GetQuorum. Since the values can't be checked
+// against the key, the holders might return different values. The error is
+// then a ConflictError while the value held by the most holders is still
+// returned.
+func (dht *DHT) GetQuorumAtKey(key store.Key, min int) (value string, agreement int, err error) {
+	return dht.getQuorum(key, min, nil)
+}
+
+// getQuorum looks up the value with a quorum call, where valid checks the
+// values returned by the holders, see GetQuorum.
+func (dht *DHT) getQuorum(hash store.Key, min int, valid func(value []byte) bool) (value string, agreement int, err error) {
+	if dht.closed() {
+		return "", 0, ErrClosed
+	}
+	if min <= 0 {
+		return "", 0, fmt.Errorf("quorum must be positive, got: %d", min)
+	}
+
+	call := NewQuorumCall(hash, min)
+	call.valid = valid
+	if item, e := dht.db.GetLocalItem(hash); e == nil {
+		call.add(item.Value, dht.me)
+	} else if item, e := dht.db.GetItem(hash); e == nil {
+		call.add(item.Value, dht.me)
+	}
+
+	if call.holders < min {
+		if _, _, err = dht.walk(context.Background(), call); err != nil && call.holders == 0 {
+			return "", 0, err
+		}
+	}
+
+	if call.holders == 0 {
+		return "", 0, fmt.Errorf("%w: couldn't find any value with the hash: %v", ErrNotFound, hash)
+	}
+
+	value, agreement = call.majority()
+	if len(call.values) > 1 {
+		return value, agreement, &ConflictError{Key: hash, Values: call.values}
+	}
+	if call.holders < min {
+		return value, agreement, fmt.Errorf("%w: %d of %d holders returned the value with the hash: %v", ErrNoQuorum, call.holders, min, hash)
+	}
+	return value, agreement, nil
+}
+
+// KeyErrors is returned by GetMany with the error of every key that couldn't be
+// retrieved.
+type KeyErrors map[store.Key]error
+
+func (e KeyErrors) Error() string {
+	return fmt.Sprintf("cannot get %d keys", len(e))
+}
+
+// GetMany retrieves the values for the keys like Get, with the lookups run
+// concurrently. The values that were retrieved are returned even if some keys
+// failed, the error is then a KeyErrors with the error of each failed key. Keys
+// that are still pending when the context is canceled fail with the error of
+// the context.
+func (dht *DHT) GetMany(ctx context.Context, keys []store.Key) (values map[store.Key]string, err error) {
+	if dht.closed() {
+		return nil, ErrClosed
+	}
+
+	type result struct {
+		key   store.Key
+		value []byte
+		err   error
+	}
+
+	pending := make(map[store.Key]bool)
+	jobs := make(chan store.Key, len(keys))
+	for _, key := range keys {
+		if !pending[key] {
+			pending[key] = true
+			jobs <- key
+		}
+	}
+	close(jobs)
+
+	workers := getManyWorkers
+	if len(pending) < workers {
+		workers = len(pending)
+	}
+
+	// Buffered, so that the workers can finish even if the results are no
+	// longer read.
+	results := make(chan result, len(pending))
+	for i := 0; i < workers; i++ {
+		go func() {
+			for key := range jobs {
+				if e := ctx.Err(); e != nil {
+					results <- result{key: key, err: e}
+					continue
+				}
+
+				value, _, e := dht.getWithSource(ctx, key)
+				results <- result{key: key, value: value, err: e}
+			}
+		}()
+	}
+
+	values = make(map[store.Key]string)
+	errs := make(KeyErrors)
+
+	for len(pending) > 0 {
+		select {
+		case r := <-results:
+			delete(pending, r.key)
+			if r.err != nil {
+				errs[r.key] = r.err
+			} else {
+				values[r.key] = string(r.value)
+			}
+		case <-ctx.Done():
+			for key := range pending {
+				errs[key] = ctx.Err()
+			}
+			pending = nil
+		}
+	}
+
+	if len(errs) > 0 {
+		err = errs
+	}
+	return
+}
+
+func (dht *DHT) getWithSource(ctx context.Context, hash store.Key) (value []byte, from route.Contact, err error) {
+	value, _, from, err = dht.getWithMeta(ctx, hash)
+	return
+}
+
+func (dht *DHT) getWithMeta(ctx context.Context, hash store.Key) (value []byte, meta store.Meta, from route.Contact, err error) {
+	return dht.getWithCall(ctx, NewFindValueCall(hash))
+}
+
+// getWithCall returns the value from the local database if it's held, and
+// otherwise looks it up with the find value call.
+func (dht *DHT) getWithCall(ctx context.Context, call *FindValueCall) (value []byte, meta store.Meta, from route.Contact, err error) {
+	hash := call.hash
+
+	if dht.closed() {
+		err = ErrClosed
+		return
+	}
+
+	if item, e := dht.db.GetLocalItem(hash); e == nil {
+		return []byte(item.Value), item.Meta, dht.me, nil
+	}
+	if item, e := dht.db.GetItem(hash); e == nil {
+		return []byte(item.Value), item.Meta, dht.me, nil
+	}
+
+	return dht.findValue(ctx, call)
+}
+
+// GetVerbose retrieves the value for a specified key like Get, together with
+// the nodes that responded with the value and the nodes that responded without
+// it, sorted by distance to the key. The near misses are where the value is
+// worth caching or storing again. The lookup stops at the first hit like Get,
+// so there's usually a single holder. If the value is held in the local
+// database the local contact is the only holder, and no lookup is made.
+func (dht *DHT) GetVerbose(hash store.Key) (value string, holders []route.Contact, nearMisses []route.Contact, err error) {
+	call := NewFindValueCall(hash)
+	b, _, from, err := dht.getWithCall(context.Background(), call)
+	if err != nil {
+		return
+	}
+
+	value = string(b)
+	if from.NodeID.Equal(dht.me.NodeID) {
+		return value, []route.Contact{dht.me}, nil, nil
+	}
+
+	holders = route.NewCandidates(node.ID(hash), call.holders...).SortedContacts()
+	return value, holders, call.nearMisses(), nil
 }
 
-func New(me route.Contact, others []route.Contact, nw network.Network) (dht *DHT, err error) {
-	refreshTicker := time.NewTicker(60 * time.Second)
+// GetOptions chooses between the latency and the accuracy of a read, see
+// GetWithOptions.
+type GetOptions struct {
+	// FirstHitWins returns the value of the first node that responds with it,
+	// which is how Get reads a value. Otherwise the lookup continues until it
+	// converges, and the value of the holder closest to the key is returned,
+	// at the cost of waiting for the remaining responses. See GetQuorum to
+	// compare the values of several holders.
+	FirstHitWins bool
 
-	dht = new(DHT)
-	dht.rt, err = route.NewTable(me, others, tRefresh, refreshTicker)
+	// Explicit looks up a value stored under a key chosen by the publisher,
+	// see PutAtKey. The values served by other nodes are then not checked
+	// against the key.
+	Explicit bool
+}
+
+// GetWithOptions retrieves the value for a specified key like GetContext, where
+// the lookup stops as chosen by the options. The contact of the node that
+// served the value is returned, see GetWithSource.
+func (dht *DHT) GetWithOptions(ctx context.Context, hash store.Key, opts GetOptions) (value string, from route.Contact, err error) {
+	call := NewConvergingFindValueCall(hash)
+	if opts.FirstHitWins {
+		call = NewFindValueCall(hash)
+	}
+	call.explicit = opts.Explicit
+
+	b, _, from, err := dht.getWithCall(ctx, call)
+	return string(b), from, err
+}
+
+// GetWithMeta retrieves the value for a specified key like Get, together with
+// the metadata it was stored with. The metadata is nil if there is none.
+func (dht *DHT) GetWithMeta(hash store.Key) (value string, meta store.Meta, err error) {
+	b, meta, _, err := dht.getWithMeta(context.Background(), hash)
+	value = string(b)
+	return
+}
+
+// Put stores the provided value in the network and returns a key.
+func (dht *DHT) Put(value string) (hash store.Key, err error) {
+	return dht.PutBytes([]byte(value))
+}
+
+// PutBytes stores the provided binary value in the network and returns a key,
+// like Put.
+func (dht *DHT) PutBytes(value []byte) (hash store.Key, err error) {
+	return dht.putBytes(context.Background(), value)
+}
+
+// PutContext stores the provided value in the network like Put, where the
+// lookup and stores are bounded by the context like GetContext.
+func (dht *DHT) PutContext(ctx context.Context, value string) (hash store.Key, err error) {
+	return dht.putBytes(ctx, []byte(value))
+}
+
+func (dht *DHT) putBytes(ctx context.Context, value []byte) (hash store.Key, err error) {
+	hash = dht.keyOf(value)
+	written := dht.config.Clock.Now()
+	_, err = dht.iterativeStore(ctx, hash, value, nil, written, network.StoreClassPublish, 0)
+	if err != nil {
+		return
+	}
+	dht.db.AddLocalItemAt(hash, string(value), nil, written)
+	return
+}
+
+// PutWithMeta stores the provided value in the network like Put, together with
+// metadata that is retrieved alongside the value by GetWithMeta. The total size
+// of the metadata is bounded by store.MaxMetaSize.
+func (dht *DHT) PutWithMeta(value string, meta store.Meta) (hash store.Key, err error) {
+	if size := meta.Size(); size > store.MaxMetaSize {
+		err = fmt.Errorf("%w: %d bytes, the maximum is %d bytes", ErrMetaTooLarge, size, store.MaxMetaSize)
+		return
+	}
+
+	hash = dht.keyOf([]byte(value))
+	written := dht.config.Clock.Now()
+	_, err = dht.iterativeStore(context.Background(), hash, []byte(value), meta, written, network.StoreClassPublish, 0)
 	if err != nil {
-		err = fmt.Errorf("cannot initialize routing table: %w", err)
 		return
 	}
+	dht.db.AddLocalItemAt(hash, value, meta, written)
+	return
+}
 
-	iHTicker := time.NewTicker(time.Second)
-	rHTicker := time.NewTicker(time.Second)
+// PutAndVerify stores the provided value in the network like Put, and then
+// reads it back from the network to verify that it's retrievable. An error is
+// returned if the value can't be read back, e.g. if every node silently
+// dropped the store. This doubles the latency of Put.
+func (dht *DHT) PutAndVerify(value string) (hash store.Key, err error) {
+	hash, err = dht.Put(value)
+	if err != nil {
+		return
+	}
 
-	dht.db = store.NewDatabase(tExpire, tReplicate, tRepublish, iHTicker, rHTicker)
+	// Bypass the local database, where the value was just added.
+	stored, _, err := dht.iterativeFindValue(context.Background(), hash)
+	if err != nil {
+		err = fmt.Errorf("cannot verify value with hash %v: %w", hash, err)
+		return
+	}
 
-	dht.nw = nw
-	dht.me = me
+	if !bytes.Equal(stored, []byte(value)) {
+		err = fmt.Errorf("cannot verify value with hash %v: value read back differs", hash)
+	}
+	return
+}
 
-	go func(dht *DHT, me route.Contact) {
-		<-dht.nw.ReadyCh() // Wait for network.
+// PutAtKey stores the provided value in the network under the key chosen by the
+// caller, instead of the hash of the value. This allows storing mutable or
+// externally keyed records. The caller is responsible for the uniqueness of the
+// key, a value stored by another node at the same key is replaced if allowed by
+// the conflict policy, see Config.ConflictPolicy.
+func (dht *DHT) PutAtKey(key store.Key, value string) (err error) {
+	written := dht.config.Clock.Now()
+	_, err = dht.iterativeStore(context.Background(), key, []byte(value), nil, written, network.StoreClassPublish, 0)
+	if err != nil {
+		return
+	}
+	dht.db.AddLocalItemAt(key, value, nil, written)
+	return
+}
 
-		retryInterval := 1 * time.Second
-		for {
-			err := dht.Join(me)
-			if err != nil {
-				log.Error().Err(err).Msgf("Failed to join the DHT network, retrying in %v", retryInterval)
-			} else {
-				break // Join successful, exit retry loop.
-			}
+// PutLocal stores the provided value in the local database only, without any
+// requests to the network, and returns its key. The value is published by this
+// node like a value stored with Put, it's served by Get at once and is
+// published to the network as soon as the DHT has joined it. This allows
+// seeding a node with known values before it has joined the network.
+func (dht *DHT) PutLocal(value string) store.Key {
+	hash := dht.keyOf([]byte(value))
+	dht.db.AddLocalItem(hash, value)
 
-			time.Sleep(retryInterval)
+	go func() {
+		select {
+		case <-dht.joined:
+		case <-dht.done:
+			return
+		}
+		if dht.joinErr != nil {
+			return // Left to the regular republish.
 		}
-	}(dht, me)
 
-	go dht.findNodesRequestHandler()
-	go dht.findValueRequestHandler()
-	go dht.storeRequestHandler()
-	go dht.pongRequestHandler()
-	go dht.republishRequestHandler()
-	go dht.replicateRequestHandler()
-	go dht.refreshRequestHandler()
+		dht.db.RetryRepublish(hash, 0)
+	}()
 
-	return
+	return hash
 }
 
-// Forget removes the key and associated value from the local items DB and
-// therefore stop republishing it on the network.
-func (dht *DHT) Forget(hash store.Key) {
-	dht.db.ForgetItem(hash)
+// PutIfAbsent stores the value under the key like PutAtKey, unless a value for
+// the key is already held by this node or found in the network. The existing
+// value is then returned and nothing is stored.
+//
+// This is a best-effort guarantee only, the check and the store are separate
+// lookups. Two nodes that put the same key at the same time can both find it
+// absent and both store their value, the holders then keep the value chosen by
+// the conflict policy. A value that is only held by nodes that didn't respond to the
+// check is also considered absent.
+func (dht *DHT) PutIfAbsent(key store.Key, value string) (stored bool, existing string, err error) {
+	existing, _, err = dht.GetAtKey(key)
+	if err == nil {
+		return false, existing, nil
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return false, "", err
+	}
+
+	if err = dht.PutAtKey(key, value); err != nil {
+		return false, "", err
+	}
+	return true, "", nil
 }
 
-// Get retrieves the value for a specified key from the network.
-func (dht *DHT) Get(hash store.Key) (value string, sender node.ID, err error) {
-	value, sender, err = dht.iterativeFindValue(hash)
+// PutWithReplicas stores the provided value in the network and returns a key
+// together with the contacts that the value was stored at. An error is
+// returned if no node accepted the value.
+func (dht *DHT) PutWithReplicas(value string) (hash store.Key, replicas []route.Contact, err error) {
+	hash = dht.keyOf([]byte(value))
+	written := dht.config.Clock.Now()
+	replicas, err = dht.iterativeStore(context.Background(), hash, []byte(value), nil, written, network.StoreClassPublish, 0)
+	if err != nil {
+		return
+	}
+
+	if len(replicas) == 0 {
+		err = fmt.Errorf("value with hash %v was not stored at any node", hash)
+		return
+	}
+
+	dht.db.AddLocalItemAt(hash, value, nil, written)
 	return
 }
 
-// Put stores the provided value in the network and returns a key.
-func (dht *DHT) Put(value string) (hash store.Key, err error) {
-	hash, err = dht.iterativeStore(value, network.StoreClassPublish)
+// PutWithTTL stores the provided value in the network with an expiration set
+// by the TTL and returns a key. The value is not republished by the local node,
+// so it ceases to exist once the TTL has passed. A zero TTL falls back to the
+// default behavior of Put.
+func (dht *DHT) PutWithTTL(value string, ttl time.Duration) (hash store.Key, err error) {
+	if ttl == 0 {
+		return dht.Put(value)
+	}
+
+	hash = dht.keyOf([]byte(value))
+	_, err = dht.iterativeStore(context.Background(), hash, []byte(value), nil, dht.config.Clock.Now(), network.StoreClassPublish, ttl)
+	return
+}
+
+// keyOf returns the key of the value in the namespace of the DHT.
+func (dht *DHT) keyOf(value []byte) store.Key {
+	key, _ := store.KeyFromBytesIn(dht.config.Namespace, value) // Validated by New.
+	return key
+}
+
+// explicit returns true if the key isn't derived from the value, i.e. it was
+// chosen by the publisher with PutAtKey.
+func (dht *DHT) explicit(key store.Key, value []byte) bool {
+	return dht.keyOf(value) != key
+}
+
+// keyedBy returns a check of whether a value is keyed by the key in the
+// namespace of the DHT.
+func (dht *DHT) keyedBy(key store.Key) func(value []byte) bool {
+	return func(value []byte) bool { return !dht.explicit(key, value) }
+}
+
+// Delete removes the value for a specified key from the network by
+// instructing the k closest nodes to drop it. The value is also removed from
+// the local items DB, so it won't be republished. The nodes only drop the value
+// if this node has stored it there, and its requests are signed, ErrUnsigned is
+// returned without deleting anything unless network.Config.PrivateKey is set.
+// An error is returned if the request couldn't be sent to some of the nodes,
+// the nodes don't acknowledge deletes.
+func (dht *DHT) Delete(hash store.Key) (err error) {
+	if !dht.nw.Signed() {
+		return fmt.Errorf("cannot delete: %v: %w", hash, ErrUnsigned)
+	}
+
+	dht.db.RemoveItem(hash)
+
+	contacts, err := dht.iterativeFindNodes(context.Background(), node.ID(hash))
 	if err != nil {
 		return
 	}
-	dht.db.AddLocalItem(hash, value)
+
+	if len(contacts) > dht.config.K {
+		contacts = contacts[:dht.config.K]
+	}
+
+	contacts = dht.withoutSelf(contacts) // Local copy already removed.
+
+	var failed int
+	var last error
+	for _, contact := range contacts {
+		if e := dht.nw.Delete(hash, contact.Address); e != nil {
+			log.Error().Err(e).Msgf("Failed to delete at %v (%v)", contact.NodeID, contact.Address)
+			failed, last = failed+1, e
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("delete failed at %d of %d nodes: %w", failed, len(contacts), last)
+	}
 	return
 }
 
-// Join initiates a node lookup of itself to bootstrap the node into the
-// network.
-func (dht *DHT) Join(me route.Contact) (err error) {
-	_, err = dht.iterativeFindNodes(me.NodeID)
+// FindNode performs a node lookup and returns the k closest live contacts to
+// the target node ID, sorted by distance. The best contacts found are returned
+// together with ErrLookupExhausted if the lookup didn't converge.
+func (dht *DHT) FindNode(target node.ID) (contacts []route.Contact, err error) {
+	contacts, err = dht.iterativeFindNodes(context.Background(), target)
+	if err != nil && !errors.Is(err, ErrLookupExhausted) {
+		return
+	}
+
+	if len(contacts) > dht.config.K {
+		contacts = contacts[:dht.config.K]
+	}
+	return
+}
+
+// FindNodeVerbose performs a node lookup like FindNode, and also returns the
+// number of rounds of requests (hops) and the time the lookup took.
+func (dht *DHT) FindNodeVerbose(target node.ID) (contacts []route.Contact, hops int, elapsed time.Duration, err error) {
+	start := time.Now()
+	contacts, hops, err = dht.walk(context.Background(), NewFindNodesCall(target))
+	elapsed = time.Since(start)
+	if err != nil && !errors.Is(err, ErrLookupExhausted) {
+		return
+	}
+
+	if len(contacts) > dht.config.K {
+		contacts = contacts[:dht.config.K]
+	}
+	return
+}
+
+// Join pings the bootstrap contacts, in order, until one of them responds and
+// then initiates a node lookup of itself to bootstrap the node into the
+// network. An error is returned if none of the bootstrap contacts responds.
+func (dht *DHT) Join(me route.Contact, others []route.Contact) (err error) {
+	bootstrapped := false
+	for _, other := range others {
+		if _, e := dht.ping(other); e != nil {
+			log.Warn().Err(e).Msgf("Bootstrap contact %v (%v) did not respond", other.NodeID, other.Address)
+
+			// Do not use the dead contact in the lookups.
+			dht.evict(other)
+			dht.config.Metrics.TableSize(dht.rt.Len())
+			continue
+		}
+
+		dht.addNode(other)
+		bootstrapped = true
+
+		// Converge faster on large networks by starting out with the contacts
+		// of the bootstrap contact, the lookups below fill in the rest.
+		if e := dht.WarmFrom(other); e != nil {
+			log.Warn().Err(e).Msgf("Unable to warm the routing table from: %v", other.NodeID)
+		}
+		break
+	}
+
+	if !bootstrapped {
+		return fmt.Errorf("none of the %d bootstrap contacts responded", len(others))
+	}
+
+	_, err = dht.iterativeFindNodes(context.Background(), me.NodeID)
 	if err != nil {
 		return
 	}
 
 	for id := range node.IDWithPrefixGenerator(me.NodeID) {
-		_, err = dht.iterativeFindNodes(id)
+		_, err = dht.iterativeFindNodes(context.Background(), id)
 		if err != nil {
 			return
 		}
@@ -113,8 +1354,72 @@ func (dht *DHT) Join(me route.Contact) (err error) {
 	return
 }
 
+// WarmFrom asks the contact for a random sample of the contacts in its routing
+// table, and adds them to the routing table. At most MaxPeers contacts are
+// requested and added. The contacts are pinged first, and only added if they
+// respond, since the contacts are only as trustworthy as the callee.
+func (dht *DHT) WarmFrom(contact route.Contact) error {
+	if dht.closed() {
+		return ErrClosed
+	}
+
+	ch, err := dht.nw.GetPeers(dht.config.MaxPeers, contact.Address, dht.config.Timeout)
+	if err != nil {
+		return fmt.Errorf("get peers from: %v: %w", contact.NodeID, err)
+	}
+
+	result := <-ch
+	if result == nil {
+		return fmt.Errorf("get peers from: %v: %w", contact.NodeID, network.ErrTimeout)
+	}
+
+	// Do not trust the callee to respect the requested count.
+	peers := result.Closest()
+	if len(peers) > dht.config.MaxPeers {
+		peers = peers[:dht.config.MaxPeers]
+	}
+
+	var unknown []route.Contact
+	for _, peer := range peers {
+		if peer.NodeID.Equal(dht.me.NodeID) {
+			continue
+		}
+		if _, _, known := dht.rt.ContactInfo(peer.NodeID); known {
+			continue // Keep the address the contact was heard from.
+		}
+		unknown = append(unknown, peer)
+	}
+
+	ok := make([]bool, len(unknown))
+	fanOut(unknown, dht.config.Alpha, func(i int, peer route.Contact) {
+		if _, err := dht.ping(peer); err != nil {
+			log.Debug().Err(err).Msgf("Dropped unresponsive peer: %v", peer.NodeID)
+			return
+		}
+
+		dht.addNode(peer)
+		_, _, ok[i] = dht.rt.ContactInfo(peer.NodeID)
+	})
+
+	added := 0
+	for _, o := range ok {
+		if o {
+			added++
+		}
+	}
+
+	log.Info().Msgf("Added %d of %d peers from: %v", added, len(peers), contact.NodeID)
+	dht.config.Metrics.TableSize(dht.rt.Len())
+
+	return nil
+}
+
 // Ping pings a specified node ID.
 func (dht *DHT) Ping(target node.ID) (chal []byte, err error) {
+	if dht.closed() {
+		return nil, ErrClosed
+	}
+
 	sl := dht.rt.NClosest(target, 1)
 
 	contacts := sl.SortedContacts()
@@ -124,7 +1429,47 @@ func (dht *DHT) Ping(target node.ID) (chal []byte, err error) {
 
 	contact := contacts[0]
 
-	resultCh, challenge, err := dht.nw.Ping(contact.Address)
+	chal, err = dht.ping(contact)
+	if err != nil {
+		return nil, err
+	}
+
+	go dht.addNode(contact)
+
+	return chal, nil
+}
+
+// PingContact probes the liveness of the contact, it sends a ping and waits for
+// the pong. Returns the round-trip time, or an error if the response timed out
+// or the challenge didn't match. A responding contact is added to the routing
+// table, a failing contact is removed from it if evict is set.
+func (dht *DHT) PingContact(contact route.Contact, evict bool) (rtt time.Duration, err error) {
+	if dht.closed() {
+		return 0, ErrClosed
+	}
+
+	start := time.Now()
+	_, err = dht.ping(contact)
+	if err != nil {
+		if evict {
+			dht.evict(contact)
+			dht.config.Metrics.TableSize(dht.rt.Len())
+		}
+		return 0, err
+	}
+	rtt = time.Since(start)
+
+	go dht.addNode(contact)
+
+	return rtt, nil
+}
+
+// ping sends a ping to the contact and waits for the pong. An error is
+// returned if the response times out or if the challenge doesn't match.
+func (dht *DHT) ping(contact route.Contact) ([]byte, error) {
+	sent := time.Now()
+
+	resultCh, challenge, err := dht.nw.Ping(contact.Address, dht.config.Timeout)
 	if err != nil {
 		return nil, fmt.Errorf("ping request failed for: %v: %w",
 			contact.NodeID, err)
@@ -132,12 +1477,12 @@ func (dht *DHT) Ping(target node.ID) (chal []byte, err error) {
 
 	response := <-resultCh
 	if response == nil {
-		return nil, fmt.Errorf("ping response from: %v timed out", contact.NodeID)
+		dht.config.Metrics.Timeout()
+		return nil, fmt.Errorf("ping response from: %v: %w", contact.NodeID, network.ErrTimeout)
 	}
 
-	go dht.addNode(contact)
-
 	if bytes.Equal(challenge, response.Challenge) {
+		dht.rtts.observe(contact.NodeID, time.Since(sent))
 		return response.Challenge, nil
 	}
 	return nil, fmt.Errorf("challenge mismatch")
@@ -146,102 +1491,307 @@ func (dht *DHT) Ping(target node.ID) (chal []byte, err error) {
 // addNode attempts to add a node to the routing table. If the bucket is full
 // for the given node, the least recently seen node will be pinged and evicted
 // if it doesn't respond. If the bucket already contain the node, it'll be moved
-// to the top of the bucket.
+// to the top of the bucket at the address of the contact.
 func (dht *DHT) addNode(contact route.Contact) {
-	rt := dht.rt
+	// The least recently seen contact is only pinged when the bucket is full,
+	// and evicted if it fails to respond.
+	var evicted *route.Contact
+	alive := func(c route.Contact) bool {
+		_, err := dht.ping(c)
+		if err != nil {
+			evicted = &c
+		}
+		return err == nil
+	}
+
+	// The address of the contact has been confirmed by the callers, e.g. by a
+	// response, and replaces the known address.
+	old, _, known := dht.rt.ContactInfo(contact.NodeID)
+	if known && !sameAddress(old.Address, contact.Address) {
+		dht.rt.Readdress(contact)
+	}
+
+	added := dht.rt.AddWithPing(contact, alive)
+	if !added {
+		log.Debug().Msgf("Bucket full, dropped new node: %v", contact.NodeID)
+	}
+
+	if known && added && !sameAddress(old.Address, contact.Address) {
+		dht.config.Events.OnAddressChange(old, contact)
+	}
+
+	if evicted != nil {
+		if added {
+			dht.config.Events.OnEvict(*evicted, contact)
+		} else {
+			dht.config.Events.OnEvict(*evicted, route.Contact{})
+		}
+	}
+
+	dht.config.Metrics.TableSize(dht.rt.Len())
+}
 
-	ok := rt.Add(contact)
-	if ok {
+// evict removes the unresponsive contact from the routing table, and notifies
+// the event handler if the contact was in the table.
+func (dht *DHT) evict(contact route.Contact) {
+	if _, _, known := dht.rt.ContactInfo(contact.NodeID); !known {
 		return
 	}
 
-	old := rt.Head(contact.NodeID).NodeID
-	// Check if the oldest node is still alive.
-	// If the node answers, it'll be moved to the top of the bucket by the Ping
-	// method.
-	_, err := dht.Ping(old)
+	dht.rt.Remove(contact.NodeID)
+	dht.config.Events.OnEvict(contact, route.Contact{})
+}
 
-	if err != nil {
-		// Either challenge mismatch or dead node, remove it.
-		rt.Remove(old)
+// addSender adds the sender of a request to the routing table like addNode. A
+// known contact at a new address is pinged at the new address first, and the
+// known address is kept unless it responds, so that a spoofed source address
+// can't replace the address of the contact. Unless DisableContactVerification
+// is set, senders that are not in the routing table are pinged first as well.
+func (dht *DHT) addSender(contact route.Contact) {
+	old, _, known := dht.rt.ContactInfo(contact.NodeID)
+	moved := known && !sameAddress(old.Address, contact.Address)
 
-		// Re-try to add new node.
-		ok = rt.Add(contact)
-		if !ok {
-			log.Warn().Msg("Unable to add new node even after old node was evicted")
+	if moved || !known && !dht.config.DisableContactVerification {
+		if _, err := dht.ping(contact); err != nil {
+			log.Debug().Err(err).Msgf("Dropped unverified node: %v", contact.NodeID)
+			return
 		}
+	}
+
+	dht.addNode(contact)
+}
+
+// addRequester adds the sender of a request to the routing table like
+// addSender. A sender that advertised an address, e.g. behind NAT, is added at
+// the advertised address instead of the source address, but only if the
+// request was signed by the sender or the sender answers a ping at the
+// advertised address.
+func (dht *DHT) addRequester(from route.Contact, advertised net.UDPAddr, verified bool) {
+	if advertised.IP == nil {
+		dht.addSender(from)
 		return
 	}
+
+	contact := route.NewContact(from.NodeID, advertised)
+	if !verified {
+		if _, err := dht.ping(contact); err != nil {
+			log.Debug().Err(err).Msgf("Dropped node at unverified advertised address: %v", contact.NodeID)
+			return
+		}
+	}
+
+	dht.addNode(contact)
+}
+
+// sameAddress returns true if the addresses are equal.
+func sameAddress(a, b net.UDPAddr) bool {
+	return a.IP.Equal(b.IP) && a.Port == b.Port && a.Zone == b.Zone
+}
+
+func (dht *DHT) iterativeFindNodes(ctx context.Context, target node.ID) ([]route.Contact, error) {
+	contacts, _, err := dht.walk(ctx, NewFindNodesCall(target))
+	return contacts, err
 }
 
-func (dht *DHT) iterativeFindNodes(target node.ID) ([]route.Contact, error) {
-	return dht.walk(NewFindNodesCall(target))
+// iterativeFindNodesBatch looks up the targets one at a time like
+// iterativeFindNodes, and returns the contacts found for each target. The
+// lookups share the contacts learned and queried, which saves requests when the
+// targets are close to each other, e.g. the refresh IDs of Join, at the risk of
+// less accurate results for the later targets. Experimental.
+func (dht *DHT) iterativeFindNodesBatch(ctx context.Context, targets []node.ID) (results [][]route.Contact, err error) {
+	b := newBatch()
+	for _, target := range targets {
+		contacts, _, err := dht.walkBatch(ctx, NewFindNodesCall(target), b)
+		if err != nil {
+			return results, fmt.Errorf("lookup of %v: %w", target, err)
+		}
+		results = append(results, contacts)
+	}
+	return results, nil
 }
 
-func (dht *DHT) iterativeStore(value string, class network.StoreClass) (hash store.Key, err error) {
-	hash = store.KeyFromValue(value)
+func (dht *DHT) iterativeStore(ctx context.Context, hash store.Key, value []byte, meta store.Meta, written time.Time, class network.StoreClass, ttl time.Duration) (stored []route.Contact, err error) {
+	if len(value) > dht.config.MaxValueSize {
+		err = fmt.Errorf("%w: %d bytes, the maximum is %d bytes",
+			ErrValueTooLarge, len(value), dht.config.MaxValueSize)
+		return
+	}
 
-	contacts, err := dht.iterativeFindNodes(node.ID(hash))
+	contacts, err := dht.iterativeFindNodes(ctx, node.ID(hash))
 	if err != nil {
 		return
 	}
 
-	// Do not replicate the value over more than k nodes.
-	if len(contacts) > k {
-		contacts = contacts[:k]
+	// Never send a store to the local node, e.g. if it was returned by
+	// another node. The local node can't be among the k closest when it's
+	// handing off its values before leaving.
+	contacts = dht.withoutSelf(contacts)
+	local := class != network.StoreClassHandoff && dht.amongClosest(node.ID(hash), contacts)
+
+	// Do not replicate the value over more than k nodes, including the local
+	// node which stores the value without a network round trip.
+	n := dht.config.K
+	if local {
+		n--
+	}
+	if len(contacts) > n {
+		contacts = contacts[:n]
 	}
 
-	var stored []route.Contact
-	for _, contact := range contacts {
-		if e := dht.nw.Store(hash, value, class, contact.Address); e != nil {
+	if local {
+		dht.storeLocal(hash, value, meta, written, class, ttl)
+	}
+
+	explicit := dht.explicit(hash, value)
+
+	ok := make([]bool, len(contacts))
+	fanOut(contacts, dht.config.Alpha, func(i int, contact route.Contact) {
+		timeout, deadline := dht.rpcTimeout(ctx)
+		if e := dht.nw.Store(hash, explicit, value, meta, written, class, ttl, contact.Address, timeout, deadline); e != nil {
 			logFailedStoreAt(contact, e)
+			dht.config.Metrics.Store(false)
 		} else {
+			ok[i] = true
+			dht.config.Metrics.Store(true)
+		}
+	})
+
+	// Keep the stored contacts sorted by distance.
+	for i, contact := range contacts {
+		if local && closer(node.ID(hash), dht.me, contact) {
+			stored = append(stored, dht.me)
+			local = false
+		}
+		if ok[i] {
 			stored = append(stored, contact)
 		}
 	}
+	if local {
+		stored = append(stored, dht.me)
+	}
 
 	if len(stored) > 0 {
-		logStoredAt(hash, stored...)
+		dht.config.Events.OnStored(hash, stored)
 	}
 
 	return
 }
 
-func (dht *DHT) iterativeFindValue(hash store.Key) (value string, sender node.ID, err error) {
-	call := NewFindValueCall(hash)
-	closest, err := dht.walk(call)
+// fanOut calls fn with every contact and its index, concurrently with at most n
+// calls running at a time. Returns once every call has returned.
+func fanOut(contacts []route.Contact, n int, fn func(i int, contact route.Contact)) {
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, n)
 
-	if err != nil {
-		return
+	for i, contact := range contacts {
+		wg.Add(1)
+		sem <- struct{}{}
+
+		go func(i int, contact route.Contact) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			fn(i, contact)
+		}(i, contact)
 	}
 
-	if call.value != "" {
-		value = call.value
-		sender = call.sender
-	} else {
-		err = fmt.Errorf("couldn't find any value with the hash: %v", hash)
-		return
+	wg.Wait()
+}
+
+// withoutSelf returns the contacts except the local node.
+func (dht *DHT) withoutSelf(contacts []route.Contact) []route.Contact {
+	others := contacts[:0:0]
+	for _, c := range contacts {
+		if !c.NodeID.Equal(dht.me.NodeID) {
+			others = append(others, c)
+		}
 	}
+	return others
+}
 
-	// Store at the closest node that did not return any value.
-	if len(closest) > 0 {
-		first := closest[0]
-		if e := dht.nw.Store(hash, value, network.StoreClassReplicate, first.Address); e != nil {
-			logFailedStoreAt(first, e)
-		} else {
-			logStoredAt(hash, first)
+// amongClosest returns true if the local node is one of the k closest nodes to
+// the target, given the contacts closest to the target sorted by distance.
+func (dht *DHT) amongClosest(target node.ID, contacts []route.Contact) bool {
+	if len(contacts) < dht.config.K {
+		return true
+	}
+	return closer(target, dht.me, contacts[dht.config.K-1])
+}
+
+// storeLocal stores the value at the local node like a store request of the
+// class from another node, instead of sending the request to itself. The
+// metadata is only set if the value was stored, so that a rejected value can't
+// replace the metadata of the value that is kept.
+func (dht *DHT) storeLocal(hash store.Key, value []byte, meta store.Meta, written time.Time, class network.StoreClass, ttl time.Duration) {
+	var stored bool
+	switch {
+	case class == network.StoreClassCache:
+		if ttl <= 0 {
+			ttl = tCache
 		}
+		stored = dht.db.AddCachedItem(hash, string(value), ttl)
+	case ttl > 0:
+		stored = dht.db.AddItemWithTTLAt(hash, string(value), written, ttl, class != network.StoreClassReplicate)
+	default:
+		centrality := dht.rt.Centrality(node.ID(hash))
+		stored = dht.db.AddItemAt(hash, string(value), written, centrality, dht.config.K, class != network.StoreClassReplicate)
+	}
+
+	if stored && len(meta) > 0 {
+		dht.db.SetMeta(hash, meta)
 	}
+}
 
+func (dht *DHT) iterativeFindValue(ctx context.Context, hash store.Key) (value []byte, from route.Contact, err error) {
+	value, _, from, err = dht.iterativeFindValueWithMeta(ctx, hash)
 	return
 }
 
-func logFailedStoreAt(contact route.Contact, err error) {
-	log.Error().Err(err).Msgf("Failed to store at %v (%v)", contact.NodeID, contact.Address)
+func (dht *DHT) iterativeFindValueWithMeta(ctx context.Context, hash store.Key) (value []byte, meta store.Meta, from route.Contact, err error) {
+	return dht.findValue(ctx, NewFindValueCall(hash))
 }
 
-func logStoredAt(hash store.Key, contacts ...route.Contact) {
-	log.Info().Msgf("Stored value with hash %v at %d nodes:\n%s", hash.String(), len(contacts), tabbedContactList(contacts...))
+// findValue looks up the value with the find value call, and caches the value
+// at the closest node that didn't hold it.
+func (dht *DHT) findValue(ctx context.Context, call *FindValueCall) (value []byte, meta store.Meta, from route.Contact, err error) {
+	hash := call.hash
+	if !call.explicit {
+		call.valid = dht.keyedBy(hash)
+	}
+
+	// A value that was found is returned even if the lookup failed to
+	// converge afterwards, e.g. at the deadline of the context.
+	_, _, err = dht.walk(ctx, call)
+	if !call.found {
+		if err == nil {
+			err = fmt.Errorf("%w: couldn't find any value with the hash: %v", ErrNotFound, hash)
+		}
+		return
+	}
+
+	value = call.value
+	meta = call.meta
+	from = call.from
+	err = nil
+
+	// Cache at the closest node that did not return any value. Caching is
+	// best-effort, the caller doesn't wait for the acknowledgment.
+	if miss, ok := call.closestMiss(); ok {
+		timeout, deadline := dht.rpcTimeout(ctx)
+		explicit := dht.explicit(hash, value)
+		go func() {
+			if e := dht.nw.Store(hash, explicit, value, meta, time.Time{}, network.StoreClassCache, tCache, miss.Address, timeout, deadline); e != nil {
+				logFailedStoreAt(miss, e)
+			} else {
+				dht.config.Events.OnStored(hash, []route.Contact{miss})
+			}
+		}()
+	}
+
+	return
+}
+
+func logFailedStoreAt(contact route.Contact, err error) {
+	log.Error().Err(err).Msgf("Failed to store at %v (%v)", contact.NodeID, contact.Address)
 }
 
 func tabbedContactList(contacts ...route.Contact) (cl string) {
@@ -2,16 +2,28 @@ package dht
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	stdlog "log"
+	"math/bits"
 	"math/rand" // Insecure on purpose due to testing.
 	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 
+	"github.com/optmzr/d7024e-dht/clock"
 	"github.com/optmzr/d7024e-dht/network"
 	"github.com/optmzr/d7024e-dht/node"
 	"github.com/optmzr/d7024e-dht/route"
@@ -31,8 +43,16 @@ func (r *findNodesResult) Closest() []route.Contact {
 	return r.closest
 }
 
-func (r *findNodesResult) Value() string {
-	return ""
+func (r *findNodesResult) Value() []byte {
+	return nil
+}
+
+func (r *findNodesResult) Meta() store.Meta {
+	return nil
+}
+
+func (r *findNodesResult) Found() bool {
+	return false
 }
 
 // findValueResult is a mock that fulfills the network.Result interface.
@@ -40,14 +60,24 @@ type findValueResult struct {
 	from    route.Contact
 	closest []route.Contact
 	value   string
+	meta    store.Meta
+	found   bool
 }
 
 func (r *findValueResult) Closest() []route.Contact {
 	return r.closest
 }
 
-func (r *findValueResult) Value() string {
-	return r.value
+func (r *findValueResult) Value() []byte {
+	return []byte(r.value)
+}
+
+func (r *findValueResult) Meta() store.Meta {
+	return r.meta
+}
+
+func (r *findValueResult) Found() bool {
+	return r.found || r.value != ""
 }
 
 // Accessed by multiple goroutines, must not be changed except by init().
@@ -112,7 +142,7 @@ func randomFindNodesResult(address net.UDPAddr) (node.ID, []route.Contact) {
 
 // FindNodes mocks a FindNodes call by returning a NodeListResult with some
 // random contacts as closest.
-func (net *udpNetwork) FindNodes(target node.ID, address net.UDPAddr) (chan network.FindResult, error) {
+func (net *udpNetwork) FindNodes(target node.ID, address net.UDPAddr, timeout time.Duration, deadline time.Time) (chan network.FindResult, error) {
 	ch := make(chan network.FindResult)
 	go func() {
 		id, closest := randomFindNodesResult(address)
@@ -128,7 +158,7 @@ func (net *udpNetwork) FindNodes(target node.ID, address net.UDPAddr) (chan netw
 
 var findValueCalls uint32 = 0
 
-func (net *udpNetwork) FindValue(key store.Key, address net.UDPAddr) (chan network.FindResult, error) {
+func (net *udpNetwork) FindValue(key store.Key, address net.UDPAddr, timeout time.Duration, deadline time.Time) (chan network.FindResult, error) {
 	calls := atomic.AddUint32(&findValueCalls, 1)
 
 	ch := make(chan network.FindResult)
@@ -151,45 +181,403 @@ func (net *udpNetwork) FindValue(key store.Key, address net.UDPAddr) (chan netwo
 	return ch, nil
 }
 
-func (net *udpNetwork) Ping(addr net.UDPAddr) (chan *network.PingResult, []byte, error) {
-	return nil, nil, nil
+// dead is a contact that never responds to pings.
+var dead = route.NewContact(node.NewID(), net.UDPAddr{
+	IP:   net.IP{10, 10, 10, 253},
+	Port: 123,
+	Zone: "",
+})
+
+func (net *udpNetwork) Ping(addr net.UDPAddr, timeout time.Duration) (chan *network.PingResult, []byte, error) {
+	challenge := []byte{254}
+
+	ch := make(chan *network.PingResult, 1)
+	if addr.IP.Equal(dead.Address.IP) {
+		ch <- nil // Timed out.
+	} else {
+		ch <- &network.PingResult{Challenge: challenge}
+	}
+
+	return ch, challenge, nil
 }
 func (net *udpNetwork) Pong(challenge []byte, sessionID network.SessionID, addr net.UDPAddr) error {
 	return nil
 }
-func (net *udpNetwork) SendValue(key store.Key, value string, closets []route.Contact, sessionID network.SessionID, addr net.UDPAddr) error {
+func (net *udpNetwork) SendValue(key store.Key, value []byte, meta store.Meta, found bool, closets []route.Contact, sessionID network.SessionID, addr net.UDPAddr) error {
 	return nil
 }
 func (net *udpNetwork) SendNodes(closets []route.Contact, sessionID network.SessionID, addr net.UDPAddr) error {
 	return nil
 }
-func (net *udpNetwork) Store(key store.Key, value string, class network.StoreClass, addr net.UDPAddr) error {
+func (net *udpNetwork) Store(key store.Key, explicit bool, value []byte, meta store.Meta, written time.Time, class network.StoreClass, ttl time.Duration, addr net.UDPAddr, timeout time.Duration, deadline time.Time) error {
+	return nil
+}
+
+// HasValue mocks a HasValue call where every callee holds the value.
+func (net *udpNetwork) HasValue(key store.Key, address net.UDPAddr, timeout time.Duration, deadline time.Time) (chan network.FindResult, error) {
+	ch := make(chan network.FindResult, 1)
+	id, _ := randomFindNodesResult(address)
+	ch <- &findValueResult{from: route.Contact{NodeID: id, Address: address}, found: true}
+	return ch, nil
+}
+func (net *udpNetwork) Ack(sessionID network.SessionID, addr net.UDPAddr) error {
+	return nil
+}
+func (net *udpNetwork) Delete(key store.Key, addr net.UDPAddr) error {
 	return nil
 }
+
+// GetPeers mocks a GetPeers call which is never answered.
+func (net *udpNetwork) GetPeers(count int, addr net.UDPAddr, timeout time.Duration) (chan network.FindResult, error) {
+	ch := make(chan network.FindResult, 1)
+	ch <- nil // Timed out.
+	return ch, nil
+}
 func (net *udpNetwork) StoreRequestCh() chan *network.StoreRequest         { return nil }
+func (net *udpNetwork) DeleteRequestCh() chan *network.DeleteRequest       { return nil }
 func (net *udpNetwork) FindNodesRequestCh() chan *network.FindNodesRequest { return nil }
 func (net *udpNetwork) FindValueRequestCh() chan *network.FindValueRequest { return nil }
+func (net *udpNetwork) GetPeersRequestCh() chan *network.GetPeersRequest   { return nil }
 func (net *udpNetwork) PongRequestCh() chan *network.PongRequest           { return nil }
 func (net *udpNetwork) ReadyCh() chan struct{}                             { return nil }
+func (net *udpNetwork) ErrCh() chan error                                  { return nil }
+func (net *udpNetwork) DroppedRequests() uint64                            { return 0 }
+func (net *udpNetwork) ReadErrors() uint64                                 { return 0 }
+func (net *udpNetwork) InFlight() int                                      { return 0 }
+func (net *udpNetwork) Signed() bool                                       { return true }
 func (net *udpNetwork) Listen() error                                      { return nil }
+func (net *udpNetwork) Close() error                                       { return nil }
 
 func newDHT(t *testing.T) *DHT {
-	d, err := New(me, others[:1], new(udpNetwork))
+	d, err := New(me, others[:1], new(udpNetwork), Config{})
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
 	return d
 }
 
+func TestNew_config(t *testing.T) {
+	d, err := New(me, others[:1], new(udpNetwork), Config{K: 8, Alpha: 2})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if d.config.K != 8 || d.config.Alpha != 2 {
+		t.Errorf("unexpected config, got: %+v", d.config)
+	}
+
+	d = newDHT(t)
+	if d.config.K != k || d.config.Alpha != α {
+		t.Errorf("unexpected default config, got: %+v", d.config)
+	}
+
+	invalid := []Config{
+		Config{K: -1},
+		Config{K: 2, Alpha: 3},
+		Config{Alpha: -1},
+		Config{JoinRetries: -1},
+		Config{Timeout: -time.Second},
+		Config{Jitter: -0.1},
+		Config{Jitter: 1},
+		Config{ExpiryGrace: -time.Second},
+		Config{MaxPeers: -1},
+		Config{KeepaliveInterval: -time.Second},
+		Config{KeepaliveContacts: -1},
+		Config{AlphaMin: 1},
+		Config{LogLevel: LogError - 1},
+		Config{LogLevel: LogDebug + 1},
+		Config{AlphaMax: -1},
+		Config{AlphaMax: 2},
+		Config{AlphaMin: 4, AlphaMax: 6},
+		Config{AlphaMax: k + 1},
+		Config{Namespace: make([]byte, store.MaxNamespaceSize+1)},
+	}
+
+	for _, config := range invalid {
+		_, err = New(me, others[:1], new(udpNetwork), config)
+		if err == nil {
+			t.Errorf("expected error for config: %+v", config)
+		}
+	}
+}
+
 func TestJoin(t *testing.T) {
 	d := newDHT(t)
 
-	err := d.Join(me)
+	err := d.Join(me, others[:1])
 	if err != nil {
 		t.Errorf("unexpected error: %w", err)
 	}
 }
 
+// readyNetwork is a mock network that is ready to be used immediately.
+type readyNetwork struct {
+	udpNetwork
+}
+
+func (n *readyNetwork) ReadyCh() chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}
+
+func TestWaitReady(t *testing.T) {
+	d, err := New(me, others[:1], new(readyNetwork), Config{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer d.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := d.WaitReady(ctx); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	d, err = New(me, []route.Contact{dead}, new(readyNetwork), Config{JoinRetries: 1})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer d.Close()
+
+	if err := d.WaitReady(ctx); err == nil || err == ctx.Err() {
+		t.Errorf("expected join error, got: %v", err)
+	}
+
+	// The network of the mock is never ready.
+	d = newDHT(t)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := d.WaitReady(ctx); err != context.DeadlineExceeded {
+		t.Errorf("unexpected error, got: %v, exp: %v", err, context.DeadlineExceeded)
+	}
+
+	d.Close()
+	if err := d.WaitReady(context.Background()); err != ErrClosed {
+		t.Errorf("unexpected error, got: %v, exp: %v", err, ErrClosed)
+	}
+}
+
+// joinEvents is an event handler that reports the result of the initial join.
+type joinEvents struct {
+	logEvents
+	joined chan error
+}
+
+func (e *joinEvents) OnJoin(attempts int, err error) {
+	e.joined <- err
+}
+
+func TestNew_joinFailed(t *testing.T) {
+	e := &joinEvents{joined: make(chan error, 1)}
+	d, err := New(me, []route.Contact{dead}, new(readyNetwork), Config{JoinRetries: 1, Events: e})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer d.Close()
+
+	select {
+	case err := <-e.joined:
+		if err == nil {
+			t.Error("expected join error to be reported")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("expected join to be reported")
+	}
+}
+
+// failedNetwork never becomes ready, and reports the error on the ErrCh.
+type failedNetwork struct {
+	udpNetwork
+}
+
+func (n *failedNetwork) ErrCh() chan error {
+	ch := make(chan error, 1)
+	ch <- errors.New("address already in use")
+	return ch
+}
+
+func TestNew_networkFailed(t *testing.T) {
+	d, err := New(me, others, new(failedNetwork), Config{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer d.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	err = d.WaitReady(ctx)
+	if err == nil || err == context.DeadlineExceeded {
+		t.Errorf("expected the network error, got: %v", err)
+	}
+}
+
+func TestJoin_bootstrapFailover(t *testing.T) {
+	d := newDHT(t)
+
+	err := d.Join(me, []route.Contact{dead, others[0]})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	err = d.Join(me, []route.Contact{dead})
+	if err == nil {
+		t.Error("expected error when no bootstrap contact responds")
+	}
+}
+
+func TestFindNode(t *testing.T) {
+	d, err := New(me, others[:1], new(udpNetwork), Config{K: 2})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	target := node.NewID()
+	contacts, err := d.FindNode(target)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if len(contacts) == 0 || len(contacts) > 2 {
+		t.Errorf("unexpected number of contacts, got: %d", len(contacts))
+	}
+
+	sorted := route.NewCandidates(target, contacts...).SortedContacts()
+	for i := range contacts {
+		if !contacts[i].NodeID.Equal(sorted[i].NodeID) {
+			t.Errorf("contacts not sorted by distance to target")
+		}
+	}
+}
+
+func TestFindNodeVerbose(t *testing.T) {
+	d, err := New(me, others[:1], new(udpNetwork), Config{K: 2})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	contacts, hops, elapsed, err := d.FindNodeVerbose(node.NewID())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(contacts) == 0 || len(contacts) > 2 {
+		t.Errorf("unexpected number of contacts, got: %d", len(contacts))
+	}
+
+	// The walk needs at least one round to find the closest node and another
+	// to confirm that it didn't change.
+	if hops < 2 {
+		t.Errorf("unexpected number of hops, got: %d", hops)
+	}
+
+	if elapsed <= 0 {
+		t.Errorf("unexpected elapsed time, got: %v", elapsed)
+	}
+}
+
+func TestFindNode_exhausted(t *testing.T) {
+	// A lookup needs at least two rounds, one to find the closest node and one
+	// to confirm it.
+	d, err := New(me, others, new(udpNetwork), Config{MaxHops: 1})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	contacts, err := d.FindNode(node.NewID())
+	if !errors.Is(err, ErrLookupExhausted) {
+		t.Errorf("expected lookup to be exhausted, got: %v", err)
+	}
+	if len(contacts) == 0 {
+		t.Error("expected the best known contacts to be returned")
+	}
+	if len(contacts) > d.config.K {
+		t.Errorf("unexpected number of contacts, got: %d, exp: at most %d", len(contacts), d.config.K)
+	}
+}
+
+func TestFindNode_comparator(t *testing.T) {
+	var calls int32
+	cmp := func(target node.ID, a, b route.Contact) bool {
+		atomic.AddInt32(&calls, 1)
+		return route.XORComparator(target, a, b)
+	}
+
+	d, err := New(me, others, new(udpNetwork), Config{Comparator: cmp})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := d.FindNode(node.NewID()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if atomic.LoadInt32(&calls) == 0 {
+		t.Errorf("expected the comparator to be used by the lookup")
+	}
+}
+
+// freshNetwork answers every FindNodes call with a single, previously unseen
+// contact far from the zero ID, numbering the contacts in the order they were
+// created.
+type freshNetwork struct {
+	udpNetwork
+	mu  sync.Mutex
+	seq map[node.ID]int
+}
+
+func (net *freshNetwork) FindNodes(target node.ID, address net.UDPAddr, timeout time.Duration, deadline time.Time) (chan network.FindResult, error) {
+	net.mu.Lock()
+	id := node.NewID()
+	id[0] |= 0x80
+	net.seq[id] = len(net.seq) + 1
+	net.mu.Unlock()
+
+	ch := make(chan network.FindResult, 1)
+	ch <- &findNodesResult{
+		from:    route.Contact{NodeID: node.NewID(), Address: address},
+		closest: []route.Contact{{NodeID: id, Address: address}},
+	}
+	return ch, nil
+}
+
+func (net *freshNetwork) newer(a, b route.Contact) bool {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+	return net.seq[a.NodeID] > net.seq[b.NodeID]
+}
+
+func TestFindNode_comparatorConvergence(t *testing.T) {
+	fresh := &freshNetwork{seq: make(map[node.ID]int)}
+
+	// The comparator puts the newest contact first, so the first contact of
+	// the shortlist changes every round, while the XOR-closest one does not.
+	cmp := func(target node.ID, a, b route.Contact) bool {
+		if fresh.newer(a, b) || fresh.newer(b, a) {
+			return fresh.newer(a, b)
+		}
+		return route.XORComparator(target, a, b)
+	}
+
+	var id node.ID
+	id[len(id)-1] = 1
+	bootstrap := route.Contact{NodeID: id, Address: others[0].Address}
+
+	d, err := New(me, []route.Contact{bootstrap}, fresh, Config{Comparator: cmp, MaxHops: 5})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer d.Close()
+
+	if _, err := d.FindNode(node.ID{}); err != nil {
+		t.Errorf("expected the lookup to converge, got: %v", err)
+	}
+}
+
 func TestPut(t *testing.T) {
 	d := newDHT(t)
 
@@ -209,34 +597,2961 @@ func TestPut(t *testing.T) {
 	}
 }
 
-func TestGet(t *testing.T) {
+func TestPut_namespace(t *testing.T) {
+	d, err := New(me, others[:1], new(udpNetwork), Config{Namespace: []byte("camomile")})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer d.Close()
+
+	value := "ABC, du är mina tankar"
+	hash, err := d.Put(value)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	exp, _ := store.KeyFromBytesIn([]byte("camomile"), []byte(value))
+	if hash != exp {
+		t.Errorf("unexpected hash, got: %v, exp: %v", hash, exp)
+	}
+	if hash == store.KeyFromValue(value) {
+		t.Error("expected the hash to differ from the hash without namespace")
+	}
+}
+
+func TestPutWithReplicas(t *testing.T) {
 	d := newDHT(t)
 
-	hash := store.Key{
-		189, 224, 233, 246, 233, 211, 250, 189, 91, 246, 132, 158, 23, 159, 10,
-		238, 72, 86, 48, 246, 213, 193, 196, 57, 133, 23, 204, 21, 67, 251, 147,
-		134,
+	_, replicas, err := d.PutWithReplicas("ABC, du är mina tankar")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
 	}
 
-	value, _, err := d.Get(hash)
+	if len(replicas) == 0 || len(replicas) > d.config.K {
+		t.Errorf("unexpected number of replicas, got: %d", len(replicas))
+	}
+}
+
+// unackedNetwork is a mock network where only every other store is
+// acknowledged.
+type unackedNetwork struct {
+	udpNetwork
+	stores uint32
+}
+
+func (n *unackedNetwork) Store(key store.Key, explicit bool, value []byte, meta store.Meta, written time.Time, class network.StoreClass, ttl time.Duration, addr net.UDPAddr, timeout time.Duration, deadline time.Time) error {
+	if atomic.AddUint32(&n.stores, 1)%2 == 0 {
+		return fmt.Errorf("store acknowledgment from: %v: %w", addr.String(), network.ErrTimeout)
+	}
+	return nil
+}
+
+func TestPutWithReplicas_unacknowledged(t *testing.T) {
+	nw := new(unackedNetwork)
+	d, err := New(me, others[:1], nw, Config{K: 4, Alpha: 1})
 	if err != nil {
-		t.Errorf("unexpected error: %w", err)
+		t.Fatalf("unexpected error: %v", err)
 	}
+	defer d.Close()
 
-	expValue := "ABC, du är mina tankar"
-	if value != expValue {
-		t.Errorf("unexpected value, got: %s, exp: %s", value, expValue)
+	hash, replicas, err := d.PutWithReplicas("ABC, du är mina tankar")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// Every other store sent is acknowledged, 2 of the 4 stores, or of the 3
+	// stores if the local node is among the k closest and stores the value
+	// without a network round trip.
+	remote := 0
+	local := false
+	for _, c := range replicas {
+		if c.NodeID.Equal(me.NodeID) {
+			local = true
+		} else {
+			remote++
+		}
+	}
+	if remote != 2 {
+		t.Errorf("unexpected number of replicas, got: %d, exp: 2", remote)
+	}
+
+	_, err = d.db.GetItem(hash)
+	if stored := err == nil; local != stored {
+		t.Errorf("unexpected local replica, got: %v, exp: %v", local, stored)
 	}
 }
 
-func TestForget(t *testing.T) {
+func TestPutAndVerify(t *testing.T) {
 	d := newDHT(t)
 
-	hash := store.Key{
-		189, 224, 233, 246, 233, 211, 250, 189, 91, 246, 132, 158, 23, 159, 10,
-		238, 72, 86, 48, 246, 213, 193, 196, 57, 133, 23, 204, 21, 67, 251, 147,
-		134,
+	_, err := d.PutAndVerify("ABC, du är mina tankar")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
 	}
 
-	d.Forget(hash)
+	d, err = New(me, others[:1], new(missingNetwork), Config{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, err = d.PutAndVerify("ABC, du är mina tankar")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("unexpected error, got: %v, exp: %v", err, ErrNotFound)
+	}
+}
+
+func TestPutBytes(t *testing.T) {
+	d := newDHT(t)
+
+	value := []byte{0xff, 0xfe, 0x00, 0x80}
+
+	hash, err := d.PutBytes(value)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if hash != store.KeyFromBytes(value) {
+		t.Errorf("unexpected hash, got: %v, exp: %v", hash, store.KeyFromBytes(value))
+	}
+
+	got, err := d.GetBytes(hash)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !bytes.Equal(got, value) {
+		t.Errorf("unexpected value, got: %v, exp: %v", got, value)
+	}
+}
+
+func TestPutAtKey(t *testing.T) {
+	d := newDHT(t)
+
+	key := store.Key{1, 2, 3}
+	value := "ABC, du är mina tankar"
+
+	err := d.PutAtKey(key, value)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	item, err := d.db.GetLocalItem(key)
+	if err != nil || item.Value != value {
+		t.Errorf("expected value to be published at the key, got: %v (%v)", item, err)
+	}
+}
+
+func TestPutLocal(t *testing.T) {
+	nw := new(countingNetwork)
+	d, err := New(me, others[:1], nw, Config{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer d.Close()
+
+	value := "ABC, du är mina tankar"
+	hash := d.PutLocal(value)
+	if hash != d.keyOf([]byte(value)) {
+		t.Errorf("unexpected key, got: %v, exp: %v", hash, d.keyOf([]byte(value)))
+	}
+
+	got, sender, err := d.Get(hash)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got != value || !sender.Equal(me.NodeID) {
+		t.Errorf("expected value to be served by the local node, got: %q from: %v", got, sender)
+	}
+	if n := atomic.LoadInt64(&nw.findValues); n != 0 {
+		t.Errorf("unexpected find value network calls, got: %d, exp: 0", n)
+	}
+
+	// Published by the local node, so it's republished.
+	if items := d.db.LocalItems(); len(items) != 1 || items[0].Key != hash {
+		t.Errorf("expected value to be a local item, got: %v", items)
+	}
+}
+
+// publishNetwork is a mock network that is ready to be used immediately, and
+// reports the keys of the published values.
+type publishNetwork struct {
+	readyNetwork
+	published chan store.Key
+}
+
+func (n *publishNetwork) Store(key store.Key, explicit bool, value []byte, meta store.Meta, written time.Time, class network.StoreClass, ttl time.Duration, addr net.UDPAddr, timeout time.Duration, deadline time.Time) error {
+	if class == network.StoreClassPublish {
+		select {
+		case n.published <- key:
+		default:
+		}
+	}
+	return nil
+}
+
+func TestPutLocal_publishOnJoin(t *testing.T) {
+	nw := &publishNetwork{published: make(chan store.Key, 1)}
+	d, err := New(me, others[:1], nw, Config{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer d.Close()
+
+	// Published once joined, instead of at the next republish.
+	hash := d.PutLocal("Jag vill ha en egen måne")
+	select {
+	case key := <-nw.published:
+		if key != hash {
+			t.Errorf("unexpected published key, got: %v, exp: %v", key, hash)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("expected the value to be published after the join")
+	}
+}
+
+func TestPutIfAbsent(t *testing.T) {
+	d, err := New(me, others[:1], new(missingNetwork), Config{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer d.Close()
+
+	key := store.Key{1, 2, 3}
+	value := "ABC, du är mina tankar"
+
+	stored, existing, err := d.PutIfAbsent(key, value)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !stored || existing != "" {
+		t.Errorf("expected absent value to be stored, got: %v (existing: %q)", stored, existing)
+	}
+
+	stored, existing, err = d.PutIfAbsent(key, "Nu har jag bytt")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stored || existing != value {
+		t.Errorf("expected existing value, got: %v (existing: %q, exp: %q)", stored, existing, value)
+	}
+	if item, _ := d.db.GetLocalItem(key); item.Value != value {
+		t.Errorf("expected value to be kept, got: %q", item.Value)
+	}
+
+	// Every callee of the mock network holds a value.
+	d = newDHT(t)
+	defer d.Close()
+
+	stored, existing, err = d.PutIfAbsent(key, value)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stored || existing == "" {
+		t.Errorf("expected value in the network to be returned, got: %v (existing: %q)", stored, existing)
+	}
+	if _, err := d.db.GetLocalItem(key); err == nil {
+		t.Error("expected no value to be published")
+	}
+}
+
+// delayedNetwork is a mock network where every store takes a while to send.
+type delayedNetwork struct {
+	udpNetwork
+}
+
+func (n *delayedNetwork) Store(key store.Key, explicit bool, value []byte, meta store.Meta, written time.Time, class network.StoreClass, ttl time.Duration, addr net.UDPAddr, timeout time.Duration, deadline time.Time) error {
+	time.Sleep(100 * time.Millisecond)
+	return nil
+}
+
+func TestPut_parallel(t *testing.T) {
+	d, err := New(me, others[:1], new(delayedNetwork), Config{K: 3, Alpha: 3})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	start := time.Now()
+	_, replicas, err := d.PutWithReplicas("ABC, du är mina tankar")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(replicas) != 3 {
+		t.Errorf("unexpected number of replicas, got: %d, exp: %d", len(replicas), 3)
+	}
+
+	if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+		t.Errorf("expected stores to be sent concurrently, took: %v", elapsed)
+	}
+}
+
+func TestBan(t *testing.T) {
+	d := newDHT(t)
+
+	banned := others[5]
+	d.Ban(banned.NodeID)
+
+	for i := 0; i < 10; i++ {
+		contacts, err := d.FindNode(node.NewID())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		for _, contact := range contacts {
+			if contact.NodeID.Equal(banned.NodeID) {
+				t.Fatal("unexpected banned contact in lookup result")
+			}
+		}
+	}
+
+	if _, _, ok := d.rt.ContactInfo(banned.NodeID); ok {
+		t.Error("unexpected banned contact in routing table")
+	}
+}
+
+func TestPutWithTTL(t *testing.T) {
+	d := newDHT(t)
+
+	hash, err := d.PutWithTTL("ABC, du är mina tankar", time.Minute)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if hash != store.KeyFromValue("ABC, du är mina tankar") {
+		t.Errorf("unexpected hash: %v", hash)
+	}
+}
+
+func TestGet(t *testing.T) {
+	d := newDHT(t)
+
+	hash := store.Key{
+		189, 224, 233, 246, 233, 211, 250, 189, 91, 246, 132, 158, 23, 159, 10,
+		238, 72, 86, 48, 246, 213, 193, 196, 57, 133, 23, 204, 21, 67, 251, 147,
+		134,
+	}
+
+	value, _, err := d.Get(hash)
+	if err != nil {
+		t.Errorf("unexpected error: %w", err)
+	}
+
+	expValue := "ABC, du är mina tankar"
+	if value != expValue {
+		t.Errorf("unexpected value, got: %s, exp: %s", value, expValue)
+	}
+}
+
+func TestFindValueCall_closestMiss(t *testing.T) {
+	var hash store.Key
+	call := NewFindValueCall(hash)
+
+	_, ok := call.closestMiss()
+	if ok {
+		t.Error("expected no miss before any result")
+	}
+
+	candidates := route.NewCandidates(node.ID(hash), others[:3]...).SortedContacts()
+	for i := len(candidates) - 1; i >= 0; i-- {
+		call.Result(&findValueResult{}, candidates[i])
+	}
+
+	miss, ok := call.closestMiss()
+	if !ok {
+		t.Fatal("expected a miss")
+	}
+
+	if !miss.NodeID.Equal(candidates[0].NodeID) {
+		t.Errorf("unexpected closest miss, got: %v, exp: %v", miss.NodeID, candidates[0].NodeID)
+	}
+
+	stop := call.Result(&findValueResult{value: "ABC, du är mina tankar"}, others[3])
+	if !stop {
+		t.Error("expected walk to stop on value")
+	}
+
+	miss, _ = call.closestMiss()
+	if miss.NodeID.Equal(others[3].NodeID) {
+		t.Error("unexpected node that returned the value as miss")
+	}
+}
+
+// countingNetwork is a mock network that counts the find value calls.
+type countingNetwork struct {
+	udpNetwork
+	findValues int64
+}
+
+func (n *countingNetwork) FindValue(key store.Key, address net.UDPAddr, timeout time.Duration, deadline time.Time) (chan network.FindResult, error) {
+	atomic.AddInt64(&n.findValues, 1)
+	return n.udpNetwork.FindValue(key, address, timeout, deadline)
+}
+
+func TestGet_local(t *testing.T) {
+	nw := new(countingNetwork)
+	d, err := New(me, others[:1], nw, Config{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	value := "Jag vill ha en egen måne"
+	hash, err := d.Put(value)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got, sender, err := d.Get(hash)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if got != value || !sender.Equal(me.NodeID) {
+		t.Errorf("unexpected value, got: %s from: %v, exp: %s from: %v", got, sender, value, me.NodeID)
+	}
+
+	if n := atomic.LoadInt64(&nw.findValues); n != 0 {
+		t.Errorf("unexpected find value network calls, got: %d, exp: 0", n)
+	}
+}
+
+// timeoutNetwork never answers a lookup.
+type timeoutNetwork struct {
+	udpNetwork
+}
+
+func (n *timeoutNetwork) FindNodes(target node.ID, address net.UDPAddr, timeout time.Duration, deadline time.Time) (chan network.FindResult, error) {
+	ch := make(chan network.FindResult, 1)
+	ch <- nil // Timed out.
+	return ch, nil
+}
+
+// selfNetwork is a mock network where every lookup response includes the local
+// node.
+type selfNetwork struct {
+	udpNetwork
+}
+
+func (n *selfNetwork) FindNodes(target node.ID, address net.UDPAddr, timeout time.Duration, deadline time.Time) (chan network.FindResult, error) {
+	ch := make(chan network.FindResult, 1)
+	_, closest := randomFindNodesResult(address)
+	ch <- &findNodesResult{closest: append(closest, me)}
+	return ch, nil
+}
+
+func TestFindNode_self(t *testing.T) {
+	d, err := New(me, others[:1], new(selfNetwork), Config{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer d.Close()
+
+	contacts, err := d.FindNode(me.NodeID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(contacts) == 0 {
+		t.Fatal("expected contacts")
+	}
+
+	for _, c := range contacts {
+		if c.NodeID.Equal(me.NodeID) {
+			t.Errorf("unexpected local node in results: %v", c.NodeID)
+		}
+	}
+}
+
+// selfStoreNetwork is a mock network where every lookup response includes the
+// local node, and which records the addresses stores are sent to.
+type selfStoreNetwork struct {
+	selfNetwork
+	mu    sync.Mutex
+	addrs []net.UDPAddr
+}
+
+func (n *selfStoreNetwork) Store(key store.Key, explicit bool, value []byte, meta store.Meta, written time.Time, class network.StoreClass, ttl time.Duration, addr net.UDPAddr, timeout time.Duration, deadline time.Time) error {
+	n.mu.Lock()
+	n.addrs = append(n.addrs, addr)
+	n.mu.Unlock()
+	return nil
+}
+
+func TestIterativeStore_self(t *testing.T) {
+	nw := new(selfStoreNetwork)
+	d, err := New(me, others[:1], nw, Config{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer d.Close()
+
+	// The local node is the closest possible node to its own ID.
+	key := store.Key(me.NodeID)
+	stored, err := d.iterativeStore(context.Background(), key, []byte("Du är min man"), nil, time.Time{}, network.StoreClassPublish, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(stored) == 0 || !stored[0].NodeID.Equal(me.NodeID) {
+		t.Errorf("expected the local node first in the stored contacts, got: %v", stored)
+	}
+	selves := 0
+	for _, c := range stored {
+		if c.NodeID.Equal(me.NodeID) {
+			selves++
+		}
+	}
+	if selves != 1 {
+		t.Errorf("unexpected number of local stores, got: %d, exp: 1", selves)
+	}
+
+	if s := d.Stats(); s.Items != 1 {
+		t.Errorf("unexpected number of stored values, got: %d, exp: 1", s.Items)
+	}
+	if item, err := d.db.GetItem(key); err != nil || item.Value != "Du är min man" {
+		t.Errorf("expected the value to be stored locally, got: %v (%v)", item, err)
+	}
+
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	if len(nw.addrs) != len(stored)-1 {
+		t.Errorf("unexpected number of stores sent, got: %d, exp: %d", len(nw.addrs), len(stored)-1)
+	}
+	for _, addr := range nw.addrs {
+		if addr.String() == me.Address.String() {
+			t.Errorf("unexpected store sent to the local node: %v", addr.String())
+		}
+	}
+}
+
+// closestNetwork is a mock network where every callee responds with the k
+// closest of all the other contacts to the target, and which counts the find
+// nodes calls.
+type closestNetwork struct {
+	udpNetwork
+	findNodes int64
+}
+
+func (n *closestNetwork) FindNodes(target node.ID, address net.UDPAddr, timeout time.Duration, deadline time.Time) (chan network.FindResult, error) {
+	atomic.AddInt64(&n.findNodes, 1)
+
+	closest := append([]route.Contact{}, others...)
+	sort.Slice(closest, func(i, j int) bool {
+		return route.DistanceBetween(closest[i].NodeID, target).Less(route.DistanceBetween(closest[j].NodeID, target))
+	})
+
+	ch := make(chan network.FindResult, 1)
+	ch <- &findNodesResult{closest: closest[:k]}
+	return ch, nil
+}
+
+// refreshTargets returns the refresh IDs of the first n buckets, which are
+// close to each other like the targets of Join.
+func refreshTargets(n int) (targets []node.ID) {
+	for i := 0; i < n; i++ {
+		targets = append(targets, refreshID(me.NodeID, i))
+	}
+	return
+}
+
+func TestIterativeFindNodesBatch(t *testing.T) {
+	targets := refreshTargets(8)
+
+	serial := new(closestNetwork)
+	d, err := New(me, others[:1], serial, Config{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer d.Close()
+
+	for _, target := range targets {
+		if _, err := d.iterativeFindNodes(context.Background(), target); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	batched := new(closestNetwork)
+	d, err = New(me, others[:1], batched, Config{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer d.Close()
+
+	results, err := d.iterativeFindNodesBatch(context.Background(), targets)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(results) != len(targets) {
+		t.Fatalf("unexpected number of results, got: %d, exp: %d", len(results), len(targets))
+	}
+	for i, contacts := range results {
+		if len(contacts) == 0 {
+			t.Errorf("expected contacts for target %d", i)
+		}
+	}
+
+	if b, s := atomic.LoadInt64(&batched.findNodes), atomic.LoadInt64(&serial.findNodes); b >= s {
+		t.Errorf("expected fewer requests in batch, got: %d, serial: %d", b, s)
+	}
+}
+
+func benchmarkFindNodes(b *testing.B, lookup func(d *DHT, targets []node.ID)) {
+	nw := new(closestNetwork)
+	d, err := New(me, others[:1], nw, Config{})
+	if err != nil {
+		b.Fatalf("unexpected error: %v", err)
+	}
+	defer d.Close()
+
+	targets := refreshTargets(16)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		lookup(d, targets)
+	}
+	b.StopTimer()
+
+	b.ReportMetric(float64(atomic.LoadInt64(&nw.findNodes))/float64(b.N), "rpcs/op")
+}
+
+func BenchmarkFindNodes_serial(b *testing.B) {
+	benchmarkFindNodes(b, func(d *DHT, targets []node.ID) {
+		for _, target := range targets {
+			d.iterativeFindNodes(context.Background(), target)
+		}
+	})
+}
+
+func BenchmarkFindNodes_batch(b *testing.B) {
+	benchmarkFindNodes(b, func(d *DHT, targets []node.ID) {
+		d.iterativeFindNodesBatch(context.Background(), targets)
+	})
+}
+
+func TestFindNode_timeout(t *testing.T) {
+	d, err := New(me, others, new(timeoutNetwork), Config{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, err = d.FindNode(node.NewID())
+	if !errors.Is(err, network.ErrTimeout) {
+		t.Errorf("expected timeout error, got: %v", err)
+	}
+}
+
+func TestFindNode_trace(t *testing.T) {
+	var events []TraceEvent
+	trace := func(e TraceEvent) { events = append(events, e) }
+
+	d, err := New(me, others, new(timeoutNetwork), Config{Trace: trace})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	target := node.NewID()
+	d.FindNode(target)
+
+	// Every queried contact times out, within the same round.
+	queried := make(map[node.ID]int)
+	for _, e := range events {
+		if !e.Target.Equal(target) {
+			t.Errorf("unexpected target, got: %v, exp: %v", e.Target, target)
+		}
+
+		switch e.Kind {
+		case TraceQuery:
+			queried[e.Contact.NodeID] = e.Hop
+		case TraceTimeout:
+			hop, ok := queried[e.Contact.NodeID]
+			if !ok || hop != e.Hop {
+				t.Errorf("unexpected timeout of: %v in hop %d", e.Contact.NodeID, e.Hop)
+			}
+			delete(queried, e.Contact.NodeID)
+		default:
+			t.Errorf("unexpected event: %v", e.Kind)
+		}
+	}
+
+	if len(events) == 0 || len(queried) != 0 {
+		t.Errorf("expected every query to time out, got: %v", events)
+	}
+}
+
+// slowNetwork is a mock network where only the first contact responds quickly,
+// with the value.
+type slowNetwork struct {
+	udpNetwork
+}
+
+func (n *slowNetwork) FindValue(key store.Key, address net.UDPAddr, timeout time.Duration, deadline time.Time) (chan network.FindResult, error) {
+	ch := make(chan network.FindResult)
+	go func() {
+		id, closest := randomFindNodesResult(address)
+		result := &findValueResult{
+			from:    route.Contact{NodeID: id, Address: address},
+			closest: closest,
+		}
+
+		if address.IP.Equal(others[0].Address.IP) {
+			result.value = "ABC, du är mina tankar"
+		} else {
+			time.Sleep(time.Second)
+		}
+		ch <- result
+	}()
+	return ch, nil
+}
+
+// cachingNetwork is a mock network where only the first contact holds the
+// value, after the others have missed, and cache stores take long to be
+// acknowledged.
+type cachingNetwork struct {
+	udpNetwork
+	cached chan store.Key
+}
+
+func (n *cachingNetwork) FindValue(key store.Key, address net.UDPAddr, timeout time.Duration, deadline time.Time) (chan network.FindResult, error) {
+	ch := make(chan network.FindResult)
+	go func() {
+		id, closest := randomFindNodesResult(address)
+		result := &findValueResult{
+			from:    route.Contact{NodeID: id, Address: address},
+			closest: closest,
+		}
+
+		if address.IP.Equal(others[0].Address.IP) {
+			time.Sleep(50 * time.Millisecond)
+			result.value = "ABC, du är mina tankar"
+		}
+		ch <- result
+	}()
+	return ch, nil
+}
+
+func (n *cachingNetwork) Store(key store.Key, explicit bool, value []byte, meta store.Meta, written time.Time, class network.StoreClass, ttl time.Duration, addr net.UDPAddr, timeout time.Duration, deadline time.Time) error {
+	if class == network.StoreClassCache {
+		time.Sleep(time.Second)
+		n.cached <- key
+	}
+	return nil
+}
+
+func TestGet_cacheAsync(t *testing.T) {
+	nw := &cachingNetwork{cached: make(chan store.Key, 1)}
+	d, err := New(me, others[:3], nw, Config{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer d.Close()
+
+	// The value is returned without waiting for the cache store.
+	start := time.Now()
+	key := store.KeyFromValue("ABC, du är mina tankar")
+	if _, _, err := d.Get(key); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("expected the read to not wait for the cache store, took: %v", elapsed)
+	}
+
+	select {
+	case cached := <-nw.cached:
+		if cached != key {
+			t.Errorf("unexpected cached key, got: %v, exp: %v", cached, key)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("expected the value to be cached at the closest miss")
+	}
+}
+
+// holdersNetwork is a mock network where every callee holds its own value, the
+// address of the callee, and responds with the k closest of all the other
+// contacts to the key. Every callee except the first contact responds after
+// the delay.
+type holdersNetwork struct {
+	udpNetwork
+	delay time.Duration
+}
+
+func (n *holdersNetwork) FindValue(key store.Key, address net.UDPAddr, timeout time.Duration, deadline time.Time) (chan network.FindResult, error) {
+	closest := append([]route.Contact{}, others...)
+	sort.Slice(closest, func(i, j int) bool {
+		return closer(node.ID(key), closest[i], closest[j])
+	})
+
+	ch := make(chan network.FindResult)
+	go func() {
+		if !address.IP.Equal(others[0].Address.IP) {
+			time.Sleep(n.delay)
+		}
+		ch <- &findValueResult{closest: closest[:k], value: address.String()}
+	}()
+	return ch, nil
+}
+
+// holderNetwork is a mock network where only the holder holds the value, and
+// every callee responds with the k closest of all the contacts to the key.
+type holderNetwork struct {
+	udpNetwork
+	holder route.Contact
+}
+
+func (n *holderNetwork) FindValue(key store.Key, address net.UDPAddr, timeout time.Duration, deadline time.Time) (chan network.FindResult, error) {
+	closest := append([]route.Contact{}, others...)
+	sort.Slice(closest, func(i, j int) bool {
+		return closer(node.ID(key), closest[i], closest[j])
+	})
+
+	result := &findValueResult{closest: closest[:k]}
+	if sameAddress(address, n.holder.Address) {
+		result.value = "ABC, du är mina tankar"
+	}
+
+	ch := make(chan network.FindResult, 1)
+	ch <- result
+	return ch, nil
+}
+
+func TestGetVerbose(t *testing.T) {
+	key := store.KeyFromValue("ABC, du är mina tankar")
+	exp := append([]route.Contact{}, others...)
+	sort.Slice(exp, func(i, j int) bool {
+		return closer(node.ID(key), exp[i], exp[j])
+	})
+
+	// The three closest contacts are queried before the holder, after the
+	// bootstrap contact which is the furthest.
+	holder := exp[3]
+	d, err := New(me, exp[len(exp)-1:], &holderNetwork{holder: holder}, Config{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer d.Close()
+
+	value, holders, misses, err := d.GetVerbose(key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if value != "ABC, du är mina tankar" {
+		t.Errorf("unexpected value, got: %s", value)
+	}
+	if len(holders) != 1 || !holders[0].NodeID.Equal(holder.NodeID) {
+		t.Errorf("unexpected holders, got: %v, exp: %v", holders, holder.NodeID)
+	}
+
+	if len(misses) < 3 {
+		t.Fatalf("unexpected number of near misses, got: %d, exp at least: 3", len(misses))
+	}
+	for i, c := range misses {
+		if c.NodeID.Equal(holder.NodeID) {
+			t.Error("unexpected holder among the near misses")
+		}
+		if i < 3 && !c.NodeID.Equal(exp[i].NodeID) {
+			t.Errorf("unexpected near miss %d, got: %v, exp: %v", i, c.NodeID, exp[i].NodeID)
+		}
+		if i > 0 && closer(node.ID(key), c, misses[i-1]) {
+			t.Errorf("expected near misses sorted by distance, got: %v before: %v", misses[i-1].NodeID, c.NodeID)
+		}
+	}
+
+	// Held by the local node.
+	hash, err := d.Put("Jag vill ha en egen måne")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, holders, misses, err = d.GetVerbose(hash)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(holders) != 1 || !holders[0].NodeID.Equal(me.NodeID) || len(misses) != 0 {
+		t.Errorf("expected the local node as the only holder, got: %v (near misses: %v)", holders, misses)
+	}
+}
+
+func TestGetWithOptions(t *testing.T) {
+	d, err := New(me, others[:1], new(holdersNetwork), Config{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer d.Close()
+
+	key := store.KeyFromValue("ABC, du är mina tankar")
+	exp := d.withoutSelf(append([]route.Contact{}, others...))
+	sort.Slice(exp, func(i, j int) bool {
+		return closer(node.ID(key), exp[i], exp[j])
+	})
+
+	// The bootstrap contact is the only known contact, and the first holder.
+	value, from, err := d.GetWithOptions(context.Background(), key, GetOptions{FirstHitWins: true, Explicit: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !from.NodeID.Equal(others[0].NodeID) || value != others[0].Address.String() {
+		t.Errorf("unexpected first holder, got: %v (%s), exp: %v", from.NodeID, value, others[0].NodeID)
+	}
+
+	value, from, err = d.GetWithOptions(context.Background(), key, GetOptions{Explicit: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !from.NodeID.Equal(exp[0].NodeID) || value != exp[0].Address.String() {
+		t.Errorf("unexpected closest holder, got: %v (%s), exp: %v", from.NodeID, value, exp[0].NodeID)
+	}
+}
+
+func TestGetWithOptions_convergeDeadline(t *testing.T) {
+	d, err := New(me, others[:3], &holdersNetwork{delay: time.Second}, Config{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer d.Close()
+
+	// Only the first holder responds before the deadline.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	value, from, err := d.GetWithOptions(ctx, store.Key{}, GetOptions{Explicit: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !from.NodeID.Equal(others[0].NodeID) || value != others[0].Address.String() {
+		t.Errorf("unexpected holder, got: %v (%s), exp: %v", from.NodeID, value, others[0].NodeID)
+	}
+}
+
+func TestGetWithOptions_firstHitCleanup(t *testing.T) {
+	d, err := New(me, others[:3], &holdersNetwork{delay: 200 * time.Millisecond}, Config{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer d.Close()
+
+	before := runtime.NumGoroutine()
+
+	start := time.Now()
+	_, from, err := d.GetWithOptions(context.Background(), store.Key{}, GetOptions{FirstHitWins: true, Explicit: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !from.NodeID.Equal(others[0].NodeID) {
+		t.Errorf("unexpected holder, got: %v, exp: %v", from.NodeID, others[0].NodeID)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("expected to return on the first value, took: %v", elapsed)
+	}
+
+	// The pending responses are received and dropped.
+	for start := time.Now(); time.Since(start) < time.Second; {
+		if runtime.NumGoroutine() <= before {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("leaked goroutines, got: %d, exp: %d", after, before)
+	}
+}
+
+func TestIterativeFindValue_stop(t *testing.T) {
+	d, err := New(me, others[:3], new(slowNetwork), Config{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	start := time.Now()
+	value, from, err := d.iterativeFindValue(context.Background(), store.KeyFromValue("ABC, du är mina tankar"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("expected walk to stop on the first value, took: %v", elapsed)
+	}
+
+	if string(value) != "ABC, du är mina tankar" || !from.NodeID.Equal(others[0].NodeID) {
+		t.Errorf("unexpected value, got: %s from: %v", value, from.NodeID)
+	}
+}
+
+// refreshNetwork records the refresh requests sent, on top of slowNetwork.
+type refreshNetwork struct {
+	slowNetwork
+	refreshed chan net.UDPAddr
+}
+
+func (n *refreshNetwork) Store(key store.Key, explicit bool, value []byte, meta store.Meta, written time.Time, class network.StoreClass, ttl time.Duration, addr net.UDPAddr, timeout time.Duration, deadline time.Time) error {
+	if class == network.StoreClassRefresh {
+		n.refreshed <- addr
+	}
+	return nil
+}
+
+func TestGetAndRefresh(t *testing.T) {
+	nw := &refreshNetwork{refreshed: make(chan net.UDPAddr, 1)}
+	d, err := New(me, others[:3], nw, Config{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	value, err := d.GetAndRefresh(store.KeyFromValue("ABC, du är mina tankar"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if value != "ABC, du är mina tankar" {
+		t.Errorf("unexpected value, got: %s", value)
+	}
+
+	select {
+	case addr := <-nw.refreshed:
+		if !addr.IP.Equal(others[0].Address.IP) {
+			t.Errorf("unexpected refreshed node, got: %v, exp: %v", addr.String(), others[0].Address.String())
+		}
+	default:
+		t.Error("expected the node that served the value to be refreshed")
+	}
+}
+
+// missingNetwork is a mock network where no node holds any value.
+type missingNetwork struct {
+	udpNetwork
+}
+
+func (n *missingNetwork) FindValue(key store.Key, address net.UDPAddr, timeout time.Duration, deadline time.Time) (chan network.FindResult, error) {
+	return n.FindNodes(node.ID(key), address, timeout, deadline)
+}
+
+func (n *missingNetwork) HasValue(key store.Key, address net.UDPAddr, timeout time.Duration, deadline time.Time) (chan network.FindResult, error) {
+	return n.FindNodes(node.ID(key), address, timeout, deadline)
+}
+
+func TestExists(t *testing.T) {
+	d := newDHT(t)
+	defer d.Close()
+
+	exists, err := d.Exists(store.KeyFromValue("Vill du ha sällskap?"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !exists {
+		t.Error("expected the value to exist")
+	}
+
+	d, err = New(me, others[:1], new(missingNetwork), Config{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer d.Close()
+
+	exists, err = d.Exists(store.KeyFromValue("Vill du ha sällskap?"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if exists {
+		t.Error("expected the value to not exist")
+	}
+
+	d.db.AddLocalItem(store.KeyFromValue("Du är min man"), "Du är min man")
+	if exists, _ = d.Exists(store.KeyFromValue("Du är min man")); !exists {
+		t.Error("expected the local value to exist")
+	}
+}
+
+func TestGet_notFound(t *testing.T) {
+	d, err := New(me, others[:1], new(missingNetwork), Config{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, _, err = d.Get(store.KeyFromValue("Vill du ha sällskap?"))
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("unexpected error, got: %v, exp: %v", err, ErrNotFound)
+	}
+}
+
+func TestGetMany(t *testing.T) {
+	d, err := New(me, others[:1], new(missingNetwork), Config{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer d.Close()
+
+	values := []string{"ABC, du är mina tankar", "Du är min man"}
+	var keys []store.Key
+	for _, value := range values {
+		key := store.KeyFromValue(value)
+		d.db.AddLocalItem(key, value)
+		keys = append(keys, key)
+	}
+	missing := store.KeyFromValue("Vill du ha sällskap?")
+
+	got, err := d.GetMany(context.Background(), append(keys, missing, keys[0]))
+	for i, key := range keys {
+		if got[key] != values[i] {
+			t.Errorf("unexpected value, got: %s, exp: %s", got[key], values[i])
+		}
+	}
+
+	errs, ok := err.(KeyErrors)
+	if !ok || len(errs) != 1 {
+		t.Fatalf("unexpected error, got: %v", err)
+	}
+	if !errors.Is(errs[missing], ErrNotFound) {
+		t.Errorf("unexpected error, got: %v, exp: %v", errs[missing], ErrNotFound)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	got, err = d.GetMany(ctx, keys)
+	if len(got) != 0 {
+		t.Errorf("unexpected values after cancel, got: %v", got)
+	}
+	if errs, _ := err.(KeyErrors); !errors.Is(errs[keys[0]], context.Canceled) {
+		t.Errorf("unexpected error, got: %v, exp: %v", err, context.Canceled)
+	}
+}
+
+func TestIterativeFindValue_concurrent(t *testing.T) {
+	d := newDHT(t)
+	hash := store.KeyFromValue("ABC, du är mina tankar")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			value, _, err := d.iterativeFindValue(context.Background(), hash)
+			if err == nil && string(value) != "ABC, du är mina tankar" {
+				t.Errorf("unexpected value: %s", value)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestForget(t *testing.T) {
+	d := newDHT(t)
+
+	hash := store.Key{
+		189, 224, 233, 246, 233, 211, 250, 189, 91, 246, 132, 158, 23, 159, 10,
+		238, 72, 86, 48, 246, 213, 193, 196, 57, 133, 23, 204, 21, 67, 251, 147,
+		134,
+	}
+
+	d.Forget(hash)
+}
+
+// sendValueNetwork delivers find value requests from the channel to the DHT,
+// and records the found flag of the responses.
+type sendValueNetwork struct {
+	udpNetwork
+	ch    chan *network.FindValueRequest
+	found chan bool
+}
+
+func (n *sendValueNetwork) FindValueRequestCh() chan *network.FindValueRequest { return n.ch }
+
+func (n *sendValueNetwork) SendValue(key store.Key, value []byte, meta store.Meta, found bool, closest []route.Contact, sessionID network.SessionID, addr net.UDPAddr) error {
+	n.found <- found
+	return nil
+}
+
+func TestFindValueRequest_found(t *testing.T) {
+	nw := &sendValueNetwork{ch: make(chan *network.FindValueRequest), found: make(chan bool, 1)}
+	d, err := New(me, others[:1], nw, Config{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer d.Close()
+
+	// Without any contacts to respond with.
+	d.rt.Remove(others[0].NodeID)
+
+	key := store.KeyFromValue("Du är min man")
+	nw.ch <- &network.FindValueRequest{Key: key, From: others[1]}
+	if <-nw.found {
+		t.Error("expected a miss for a value that isn't held")
+	}
+
+	d.db.AddItem(key, "Du är min man", 1, d.config.K, true)
+	nw.ch <- &network.FindValueRequest{Key: key, From: others[1]}
+	if !<-nw.found {
+		t.Error("expected a hit for a value that is held")
+	}
+}
+
+// xorSorted returns a copy of the contacts sorted by XOR distance to the
+// target, by brute force.
+func xorSorted(target node.ID, contacts []route.Contact) []route.Contact {
+	sorted := append([]route.Contact(nil), contacts...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return route.DistanceBetween(target, sorted[i].NodeID).Less(route.DistanceBetween(target, sorted[j].NodeID))
+	})
+	return sorted
+}
+
+// fillBuckets adds n contacts spread over the first buckets of the routing
+// table, few enough per bucket that every contact is kept. Returns the added
+// contacts together with the bootstrap contact, others[0], which the routing
+// table starts with.
+func fillBuckets(d *DHT, n int) (added []route.Contact) {
+	added = append(added, others[0])
+	for i := 0; i < n; i++ {
+		c := route.NewContactInBucket(me.NodeID, i%8, others[0].Address)
+		d.rt.Add(c)
+		added = append(added, c)
+	}
+	return
+}
+
+func TestLocalClosest(t *testing.T) {
+	d := newDHT(t)
+	defer d.Close()
+
+	added := fillBuckets(d, 3*d.config.K)
+
+	key := store.KeyFromValue("Du är min man")
+	closest := d.LocalClosest(key, 3)
+	if len(closest) != 3 {
+		t.Fatalf("unexpected number of contacts, got: %d, exp: 3", len(closest))
+	}
+
+	exp := xorSorted(node.ID(key), added)
+	for i, c := range closest {
+		if !c.NodeID.Equal(exp[i].NodeID) {
+			t.Errorf("unexpected contact %d, got: %v, exp: %v", i, c.NodeID, exp[i].NodeID)
+		}
+	}
+}
+
+func TestDelete(t *testing.T) {
+	d := newDHT(t)
+
+	hash, err := d.Put("ABC, du är mina tankar")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	err = d.Delete(hash)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// unsignedNetwork is a mock network that doesn't sign the sent packets.
+type unsignedNetwork struct {
+	udpNetwork
+}
+
+func (n *unsignedNetwork) Signed() bool { return false }
+
+// failingDeleteNetwork is a mock network where deletes can't be sent.
+type failingDeleteNetwork struct {
+	udpNetwork
+}
+
+func (n *failingDeleteNetwork) Delete(key store.Key, addr net.UDPAddr) error {
+	return errors.New("network is unreachable")
+}
+
+func TestDelete_unsigned(t *testing.T) {
+	d, err := New(me, others[:1], new(unsignedNetwork), Config{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer d.Close()
+
+	hash := d.PutLocal("ABC, du är mina tankar")
+	if err := d.Delete(hash); !errors.Is(err, ErrUnsigned) {
+		t.Errorf("unexpected error, got: %v, exp: %v", err, ErrUnsigned)
+	}
+	if _, err := d.db.GetLocalItem(hash); err != nil {
+		t.Error("expected the value to be kept when the delete can't be honoured")
+	}
+}
+
+func TestDelete_failed(t *testing.T) {
+	d, err := New(me, others[:1], new(failingDeleteNetwork), Config{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer d.Close()
+
+	hash := d.PutLocal("ABC, du är mina tankar")
+	if err := d.Delete(hash); err == nil {
+		t.Error("expected error when the delete couldn't be sent")
+	}
+	if _, err := d.db.GetLocalItem(hash); err == nil {
+		t.Error("expected the value to be removed locally")
+	}
+}
+
+func TestGetWithSource(t *testing.T) {
+	d := newDHT(t)
+
+	hash := store.Key{
+		189, 224, 233, 246, 233, 211, 250, 189, 91, 246, 132, 158, 23, 159, 10,
+		238, 72, 86, 48, 246, 213, 193, 196, 57, 133, 23, 204, 21, 67, 251, 147,
+		134,
+	}
+
+	value, from, err := d.GetWithSource(hash)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	expValue := "ABC, du är mina tankar"
+	if value != expValue {
+		t.Errorf("unexpected value, got: %s, exp: %s", value, expValue)
+	}
+
+	if from.NodeID.Equal(me.NodeID) {
+		t.Errorf("unexpected local contact as source for network value")
+	}
+
+	// Values held in the local database are served by the local node.
+	d.db.AddItem(hash, expValue, 1, d.config.K, true)
+
+	_, from, err = d.GetWithSource(hash)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if !from.NodeID.Equal(me.NodeID) {
+		t.Errorf("unexpected source, got: %v, exp: %v", from.NodeID, me.NodeID)
+	}
+}
+
+func TestClose_concurrent(t *testing.T) {
+	d := newDHT(t)
+
+	const n = 8
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() { errs <- d.Close() }()
+	}
+
+	closed := 0
+	for i := 0; i < n; i++ {
+		switch err := <-errs; err {
+		case nil:
+			closed++
+		case ErrClosed:
+		default:
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	if closed != 1 {
+		t.Errorf("unexpected number of successful closes, got: %d, exp: %d", closed, 1)
+	}
+}
+
+func TestClose(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	d := newDHT(t)
+
+	err := d.Close()
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// Wait for the background goroutines to return.
+	for start := time.Now(); time.Since(start) < time.Second; {
+		if runtime.NumGoroutine() <= before {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("leaked goroutines, got: %d, exp: %d", after, before)
+	}
+
+	_, err = d.Put("ABC, du är mina tankar")
+	if err != ErrClosed {
+		t.Errorf("unexpected error, got: %v, exp: %v", err, ErrClosed)
+	}
+
+	_, _, err = d.Get(store.Key{})
+	if err != ErrClosed {
+		t.Errorf("unexpected error, got: %v, exp: %v", err, ErrClosed)
+	}
+
+	err = d.Close()
+	if err != ErrClosed {
+		t.Errorf("unexpected error, got: %v, exp: %v", err, ErrClosed)
+	}
+}
+
+func TestTablePath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dht")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "table")
+
+	d, err := New(me, others[:10], new(udpNetwork), Config{TablePath: path})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	err = d.Close()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("expected routing table to be saved: %v", err)
+	}
+	defer f.Close()
+
+	contacts, err := route.ReadContacts(f)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(contacts) != 10 {
+		t.Errorf("unexpected number of saved contacts, got: %d, exp: 10", len(contacts))
+	}
+
+	// Reload the table with another bootstrap contact.
+	d, err = New(me, others[10:11], new(udpNetwork), Config{TablePath: path})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, contact := range others[:11] {
+		closest := d.rt.NClosest(contact.NodeID, 1).SortedContacts()
+		if !closest[0].NodeID.Equal(contact.NodeID) {
+			t.Errorf("expected contact %v in the loaded routing table", contact.NodeID)
+		}
+	}
+}
+
+func TestStorePath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dht")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "store")
+
+	d, err := New(me, others[:1], new(udpNetwork), Config{StorePath: path})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	hash, err := d.Put("ABC, du är mina tankar")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	d.db.AddItem(hash, "ABC, du är mina tankar", 1, 1, true)
+
+	err = d.Close()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	d, err = New(me, others[:1], new(udpNetwork), Config{StorePath: path})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer d.Close()
+
+	value, from, err := d.GetWithSource(hash)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if value != "ABC, du är mina tankar" || !from.NodeID.Equal(me.NodeID) {
+		t.Errorf("expected value to be restored locally, got: %s from: %v", value, from.NodeID)
+	}
+}
+
+func TestSweep(t *testing.T) {
+	d, err := New(me, []route.Contact{dead, others[0]}, new(udpNetwork), Config{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	d.sweep([]route.Contact{dead, others[0]})
+
+	for _, c := range d.rt.NClosest(dead.NodeID, 2).SortedContacts() {
+		if c.NodeID.Equal(dead.NodeID) {
+			t.Error("expected dead contact to be evicted")
+		}
+	}
+}
+
+func TestRefreshID(t *testing.T) {
+	for index := 0; index < node.IDLength; index++ {
+		id := refreshID(me.NodeID, index)
+
+		// Count the number of leading bits shared with the local node, i.e.
+		// the bucket index.
+		shared := 0
+		for i := range id {
+			l := bits.LeadingZeros8(id[i] ^ me.NodeID[i])
+			shared += l
+			if l != 8 {
+				break
+			}
+		}
+
+		if shared != index {
+			t.Errorf("unexpected bucket for refresh ID, got: %d, exp: %d", shared, index)
+		}
+	}
+}
+
+func TestAccept(t *testing.T) {
+	d := newDHT(t)
+	if !d.accept(others[0], false) {
+		t.Error("expected unverified request to be accepted by default")
+	}
+
+	d, err := New(me, others[:1], new(udpNetwork), Config{RequireSignatures: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if d.accept(others[0], false) {
+		t.Error("expected unverified request to be dropped")
+	}
+	if !d.accept(others[0], true) {
+		t.Error("expected verified request to be accepted")
+	}
+}
+
+func TestRTT(t *testing.T) {
+	d := newDHT(t)
+
+	if _, ok := d.RTT(others[0].NodeID); ok {
+		t.Error("unexpected RTT for node that has not been pinged")
+	}
+
+	_, err := d.Ping(others[0].NodeID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, ok := d.RTT(others[0].NodeID); !ok {
+		t.Error("expected RTT for pinged node")
+	}
+}
+
+func TestPingContact(t *testing.T) {
+	d, err := New(me, []route.Contact{dead, others[0]}, new(udpNetwork), Config{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := d.PingContact(others[0], true); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if _, err := d.PingContact(dead, false); !errors.Is(err, network.ErrTimeout) {
+		t.Errorf("expected timeout error for dead contact, got: %v", err)
+	}
+	if _, _, ok := d.rt.ContactInfo(dead.NodeID); !ok {
+		t.Error("expected dead contact to be kept without evict")
+	}
+
+	if _, err := d.PingContact(dead, true); err == nil {
+		t.Error("expected error for dead contact")
+	}
+	if _, _, ok := d.rt.ContactInfo(dead.NodeID); ok {
+		t.Error("expected dead contact to be evicted")
+	}
+}
+
+func TestRTTs_observe(t *testing.T) {
+	r := rtts{m: make(map[node.ID]time.Duration)}
+	id := node.NewID()
+
+	r.observe(id, 800*time.Millisecond)
+	if srtt, _ := r.get(id); srtt != 800*time.Millisecond {
+		t.Errorf("unexpected RTT after first sample, got: %v", srtt)
+	}
+
+	r.observe(id, 0)
+	if srtt, _ := r.get(id); srtt != 700*time.Millisecond {
+		t.Errorf("unexpected smoothed RTT, got: %v, exp: %v", srtt, 700*time.Millisecond)
+	}
+}
+
+func TestAdaptiveAlpha(t *testing.T) {
+	var static *adaptiveAlpha
+	static.observe(0, true)
+	if n := static.get(α); n != α {
+		t.Errorf("unexpected static alpha, got: %d, exp: %d", n, α)
+	}
+
+	a := newAdaptiveAlpha(3, 1, 5)
+	window := func(rtt time.Duration, timeouts int) int {
+		for i := 0; i < alphaWindow; i++ {
+			a.observe(rtt, i < timeouts)
+		}
+		return a.get(α)
+	}
+
+	// Raised while the responses are fast, up to the max.
+	for _, exp := range []int{4, 5, 5} {
+		if n := window(10*time.Millisecond, 0); n != exp {
+			t.Errorf("unexpected alpha after fast responses, got: %d, exp: %d", n, exp)
+		}
+	}
+
+	// Kept when the responses slow down.
+	if n := window(100*time.Millisecond, 0); n != 5 {
+		t.Errorf("unexpected alpha after slow responses, got: %d, exp: %d", n, 5)
+	}
+
+	// Kept with a few timeouts, halved down to the min when they spike.
+	if n := window(10*time.Millisecond, 1); n != 5 {
+		t.Errorf("unexpected alpha after a timeout, got: %d, exp: %d", n, 5)
+	}
+	for _, exp := range []int{2, 1, 1} {
+		if n := window(10*time.Millisecond, alphaWindow/4); n != exp {
+			t.Errorf("unexpected alpha after timeouts, got: %d, exp: %d", n, exp)
+		}
+	}
+}
+
+func TestWalk_adaptiveAlpha(t *testing.T) {
+	d, err := New(me, others[:1], new(timeoutNetwork), Config{AlphaMax: 6})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer d.Close()
+
+	if n := d.alpha.get(α); n != α {
+		t.Fatalf("unexpected initial alpha, got: %d, exp: %d", n, α)
+	}
+
+	// Every request of the lookups times out, each lookup sends at most α.
+	for i := 0; i < alphaWindow; i++ {
+		d.FindNode(node.NewID())
+	}
+	if n := d.alpha.get(α); n >= α {
+		t.Errorf("expected alpha to be lowered after timeouts, got: %d", n)
+	}
+}
+
+func TestLogEvents_level(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.Logger
+	log.Logger = zerolog.New(&buf)
+	defer func() { log.Logger = logger }()
+
+	cases := []struct {
+		level LogLevel
+		exp   bool
+	}{
+		{LogError, false},
+		{LogInfo, true},
+		{LogDebug, true},
+	}
+	for _, c := range cases {
+		buf.Reset()
+		logEvents{level: c.level}.OnFindNodeRequest(others[0])
+		if logged := strings.Contains(buf.String(), "Find node request"); logged != c.exp {
+			t.Errorf("unexpected log of routine request at level %d, got: %v, exp: %v", c.level, logged, c.exp)
+		}
+	}
+
+	// Changes to the routing table are logged at every level.
+	buf.Reset()
+	logEvents{}.OnEvict(others[0], route.Contact{})
+	if !strings.Contains(buf.String(), "Evicted") {
+		t.Error("expected eviction to be logged")
+	}
+
+	if level, err := ParseLogLevel("info"); err != nil || level != LogInfo {
+		t.Errorf("unexpected log level, got: %d (%v), exp: %d", level, err, LogInfo)
+	}
+	if _, err := ParseLogLevel("chatty"); err == nil {
+		t.Error("expected error for an unknown log level")
+	}
+}
+
+func TestPut_tooLarge(t *testing.T) {
+	d, err := New(me, others[:1], new(udpNetwork), Config{MaxValueSize: 4})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, err = d.Put("abcde")
+	if !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("unexpected error, got: %v, exp: %v", err, ErrValueTooLarge)
+	}
+}
+
+// countingMetrics is a Metrics sink that counts the measurements.
+type countingMetrics struct {
+	lookups, hops, stored, failed, timeouts, size int64
+	checks, under                                 int64
+	rounds, alive, dead                           int64
+}
+
+func (m *countingMetrics) Lookup(hops int) {
+	atomic.AddInt64(&m.lookups, 1)
+	atomic.AddInt64(&m.hops, int64(hops))
+}
+
+func (m *countingMetrics) Store(ok bool) {
+	if ok {
+		atomic.AddInt64(&m.stored, 1)
+	} else {
+		atomic.AddInt64(&m.failed, 1)
+	}
+}
+
+func (m *countingMetrics) Timeout()        { atomic.AddInt64(&m.timeouts, 1) }
+func (m *countingMetrics) TableSize(n int) { atomic.StoreInt64(&m.size, int64(n)) }
+
+func (m *countingMetrics) UnderReplicated(n int) {
+	atomic.StoreInt64(&m.under, int64(n))
+	atomic.AddInt64(&m.checks, 1)
+}
+
+func (m *countingMetrics) Keepalive(alive, dead int) {
+	atomic.AddInt64(&m.alive, int64(alive))
+	atomic.AddInt64(&m.dead, int64(dead))
+	atomic.AddInt64(&m.rounds, 1)
+}
+
+func TestMetrics(t *testing.T) {
+	m := new(countingMetrics)
+	d, err := New(me, others[:1], new(udpNetwork), Config{Metrics: m})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, err = d.Put("ABC, du är mina tankar")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if lookups := atomic.LoadInt64(&m.lookups); lookups != 1 {
+		t.Errorf("unexpected number of lookups, got: %d, exp: %d", lookups, 1)
+	}
+	if hops := atomic.LoadInt64(&m.hops); hops < 1 {
+		t.Errorf("expected at least one hop, got: %d", hops)
+	}
+	if stored := atomic.LoadInt64(&m.stored); stored == 0 {
+		t.Error("expected successful stores to be counted")
+	}
+
+	d.Join(me, []route.Contact{dead})
+	if timeouts := atomic.LoadInt64(&m.timeouts); timeouts != 1 {
+		t.Errorf("unexpected number of timeouts, got: %d, exp: %d", timeouts, 1)
+	}
+	if size := atomic.LoadInt64(&m.size); int(size) != d.rt.Len() {
+		t.Errorf("unexpected table size, got: %d, exp: %d", size, d.rt.Len())
+	}
+}
+
+// recordingEvents is an event handler that records the stored keys and the
+// number of acquaintances.
+type recordingEvents struct {
+	logEvents
+	acquainted int64
+	stored     chan store.Key
+}
+
+func (e *recordingEvents) OnAcquainted(from route.Contact, contacts []route.Contact) {
+	atomic.AddInt64(&e.acquainted, 1)
+}
+
+func (e *recordingEvents) OnStored(key store.Key, contacts []route.Contact) {
+	e.stored <- key
+}
+
+func TestEvents(t *testing.T) {
+	e := &recordingEvents{stored: make(chan store.Key, 1)}
+	d, err := New(me, others[:1], new(udpNetwork), Config{Events: e})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	hash, err := d.Put("ABC, du är mina tankar")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	select {
+	case key := <-e.stored:
+		if key != hash {
+			t.Errorf("unexpected stored key, got: %v, exp: %v", key, hash)
+		}
+	default:
+		t.Error("expected stored event")
+	}
+
+	if atomic.LoadInt64(&e.acquainted) == 0 {
+		t.Error("expected acquainted events during lookup")
+	}
+}
+
+// evictEvents is an event handler that records the evicted contacts and their
+// replacements.
+type evictEvents struct {
+	logEvents
+	evicted chan [2]route.Contact
+}
+
+func (e *evictEvents) OnEvict(old, new route.Contact) {
+	e.evicted <- [2]route.Contact{old, new}
+}
+
+func TestEvents_evict(t *testing.T) {
+	e := &evictEvents{evicted: make(chan [2]route.Contact, 1)}
+	d, err := New(me, others[:1], new(udpNetwork), Config{Events: e})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer d.Close()
+
+	// Fill a bucket with unresponsive contacts, the least recently seen is
+	// evicted to make room for a new contact.
+	for i := 0; i < route.BucketSize; i++ {
+		d.rt.Add(route.NewContactInBucket(me.NodeID, 200, dead.Address))
+	}
+	old := d.rt.Head(route.NewContactInBucket(me.NodeID, 200, dead.Address).NodeID)
+	contact := route.NewContactInBucket(me.NodeID, 200, others[0].Address)
+
+	d.addNode(contact)
+	if evicted := <-e.evicted; !evicted[0].NodeID.Equal(old.NodeID) || !evicted[1].NodeID.Equal(contact.NodeID) {
+		t.Errorf("unexpected eviction, got: %v replaced by %v, exp: %v replaced by %v",
+			evicted[0].NodeID, evicted[1].NodeID, old.NodeID, contact.NodeID)
+	}
+
+	// A failing ping evicts the contact without a replacement.
+	old = d.rt.Head(contact.NodeID)
+	if _, err := d.PingContact(old, true); err == nil {
+		t.Fatal("expected the ping to fail")
+	}
+	if evicted := <-e.evicted; !evicted[0].NodeID.Equal(old.NodeID) || !evicted[1].NodeID.Equal(node.ID{}) {
+		t.Errorf("unexpected eviction, got: %v replaced by %v, exp: %v", evicted[0].NodeID, evicted[1].NodeID, old.NodeID)
+	}
+}
+
+// quorumNetwork is a mock network where every callee holds a value, the value
+// held by others[0] differs if conflict is set.
+type quorumNetwork struct {
+	udpNetwork
+	conflict bool
+}
+
+func (n *quorumNetwork) FindValue(key store.Key, address net.UDPAddr, timeout time.Duration, deadline time.Time) (chan network.FindResult, error) {
+	ch := make(chan network.FindResult, 1)
+	id, closest := randomFindNodesResult(address)
+	result := &findValueResult{
+		from:    route.Contact{NodeID: id, Address: address},
+		closest: closest,
+		value:   "ABC, du är mina tankar",
+	}
+	if n.conflict && address.IP.Equal(others[0].Address.IP) {
+		result.value = "ABC, du är min tanke"
+	}
+	ch <- result
+	return ch, nil
+}
+
+func TestGetQuorum(t *testing.T) {
+	hash := store.KeyFromValue("ABC, du är mina tankar")
+
+	d, err := New(me, others[:1], new(quorumNetwork), Config{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer d.Close()
+
+	value, agreement, err := d.GetQuorum(hash, 3)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if value != "ABC, du är mina tankar" || agreement != 3 {
+		t.Errorf("unexpected result, got: %q agreed by %d, exp: 3", value, agreement)
+	}
+
+	if _, _, err := d.GetQuorum(hash, 0); err == nil {
+		t.Error("expected error for a non-positive quorum")
+	}
+
+	d, err = New(me, others[:1], &quorumNetwork{conflict: true}, Config{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer d.Close()
+
+	// The value that doesn't match the hash is ignored.
+	value, agreement, err = d.GetQuorum(hash, 3)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if value != "ABC, du är mina tankar" || agreement != 3 {
+		t.Errorf("unexpected result, got: %q agreed by %d, exp: 3", value, agreement)
+	}
+
+	value, agreement, err = d.GetQuorumAtKey(hash, 3)
+	var conflict *ConflictError
+	if !errors.As(err, &conflict) {
+		t.Fatalf("unexpected error, got: %v, exp: conflict", err)
+	}
+	if len(conflict.Values) != 2 || len(conflict.Values["ABC, du är min tanke"]) != 1 {
+		t.Errorf("unexpected conflicting values, got: %v", conflict.Values)
+	}
+	if value != "ABC, du är mina tankar" || agreement != 2 {
+		t.Errorf("unexpected majority, got: %q agreed by %d, exp: 2", value, agreement)
+	}
+}
+
+// sendNodesNetwork delivers find nodes requests from the channel to the DHT,
+// and records the contacts sent in response.
+type sendNodesNetwork struct {
+	udpNetwork
+	ch   chan *network.FindNodesRequest
+	sent chan []route.Contact
+}
+
+func (n *sendNodesNetwork) FindNodesRequestCh() chan *network.FindNodesRequest { return n.ch }
+
+func (n *sendNodesNetwork) SendNodes(closest []route.Contact, sessionID network.SessionID, addr net.UDPAddr) error {
+	n.sent <- closest
+	return nil
+}
+
+func TestFindNodesRequest_closest(t *testing.T) {
+	nw := &sendNodesNetwork{ch: make(chan *network.FindNodesRequest), sent: make(chan []route.Contact, 1)}
+	d, err := New(me, others[:1], nw, Config{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer d.Close()
+
+	// More than k candidates. The request is sent by one of them, so that
+	// adding the sender doesn't change the candidates.
+	target := node.NewID()
+	added := fillBuckets(d, 3*d.config.K)
+
+	nw.ch <- &network.FindNodesRequest{Target: target, From: added[1]}
+	sent := <-nw.sent
+
+	if len(sent) != d.config.K {
+		t.Fatalf("unexpected number of contacts, got: %d, exp: %d", len(sent), d.config.K)
+	}
+	exp := xorSorted(target, added)
+	for i, c := range sent {
+		if !c.NodeID.Equal(exp[i].NodeID) {
+			t.Errorf("unexpected contact at %d, got: %v, exp: %v", i, c.NodeID, exp[i].NodeID)
+		}
+	}
+}
+
+// peersNetwork responds to get peers with the peers, delivers get peers
+// requests from the channel to the DHT, and records the contacts sent in
+// response.
+type peersNetwork struct {
+	udpNetwork
+	peers []route.Contact
+	ch    chan *network.GetPeersRequest
+	sent  chan []route.Contact
+
+	pinging, maxPinging int32 // Number of concurrent pings.
+}
+
+func (n *peersNetwork) Ping(addr net.UDPAddr, timeout time.Duration) (chan *network.PingResult, []byte, error) {
+	p := atomic.AddInt32(&n.pinging, 1)
+	defer atomic.AddInt32(&n.pinging, -1)
+	for m := atomic.LoadInt32(&n.maxPinging); p > m && !atomic.CompareAndSwapInt32(&n.maxPinging, m, p); m = atomic.LoadInt32(&n.maxPinging) {
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	return n.udpNetwork.Ping(addr, timeout)
+}
+
+func (n *peersNetwork) GetPeers(count int, addr net.UDPAddr, timeout time.Duration) (chan network.FindResult, error) {
+	ch := make(chan network.FindResult, 1)
+	ch <- &findNodesResult{closest: n.peers}
+	return ch, nil
+}
+
+func (n *peersNetwork) GetPeersRequestCh() chan *network.GetPeersRequest { return n.ch }
+
+func (n *peersNetwork) SendNodes(closest []route.Contact, sessionID network.SessionID, addr net.UDPAddr) error {
+	n.sent <- closest
+	return nil
+}
+
+func TestWarmFrom(t *testing.T) {
+	peers := []route.Contact{me}
+	for i := 0; i < 10; i++ {
+		peers = append(peers, route.NewContactInBucket(me.NodeID, i, others[0].Address))
+	}
+	peers[2].Address = dead.Address
+
+	nw := &peersNetwork{peers: peers}
+	d, err := New(me, others[:1], nw, Config{MaxPeers: 8, Alpha: 2})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer d.Close()
+
+	if err := d.WarmFrom(others[0]); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The bootstrap contact and the first peers within the bound that respond,
+	// except the local node.
+	if n := d.rt.Len(); n != 1+6 {
+		t.Errorf("unexpected number of contacts, got: %d, exp: %d", n, 1+6)
+	}
+	if _, _, ok := d.rt.ContactInfo(peers[1].NodeID); !ok {
+		t.Errorf("expected peer to be added: %v", peers[1].NodeID)
+	}
+	if _, _, ok := d.rt.ContactInfo(peers[2].NodeID); ok {
+		t.Errorf("expected unresponsive peer to be dropped: %v", peers[2].NodeID)
+	}
+	if p := atomic.LoadInt32(&nw.maxPinging); p > 2 {
+		t.Errorf("unexpected number of concurrent pings, got: %d, exp: at most %d", p, 2)
+	}
+	if _, _, ok := d.rt.ContactInfo(peers[9].NodeID); ok {
+		t.Errorf("expected peer over the bound to be dropped: %v", peers[9].NodeID)
+	}
+
+	d = newDHT(t)
+	defer d.Close()
+
+	if err := d.WarmFrom(others[0]); !errors.Is(err, network.ErrTimeout) {
+		t.Errorf("unexpected error, got: %v, exp: %v", err, network.ErrTimeout)
+	}
+}
+
+func TestGetPeersRequest_sample(t *testing.T) {
+	nw := &peersNetwork{ch: make(chan *network.GetPeersRequest), sent: make(chan []route.Contact, 1)}
+	d, err := New(me, others[:1], nw, Config{MaxPeers: 5})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer d.Close()
+
+	for i := 0; i < 20; i++ {
+		d.rt.Add(route.NewContactInBucket(me.NodeID, i, others[0].Address))
+	}
+
+	// More than the maximum is requested.
+	nw.ch <- &network.GetPeersRequest{Count: 100, From: others[0]}
+	sent := <-nw.sent
+
+	if len(sent) != 5 {
+		t.Fatalf("unexpected number of contacts, got: %d, exp: %d", len(sent), 5)
+	}
+	for _, c := range sent {
+		if c.NodeID.Equal(others[0].NodeID) {
+			t.Errorf("unexpected requester in the sample: %v", c.NodeID)
+		}
+	}
+
+	nw.ch <- &network.GetPeersRequest{Count: 2, From: others[0]}
+	if sent := <-nw.sent; len(sent) != 2 {
+		t.Errorf("unexpected number of contacts, got: %d, exp: %d", len(sent), 2)
+	}
+}
+
+// deadlineNetwork is a mock network where the lookups go unanswered until the
+// deadline of the caller.
+type deadlineNetwork struct {
+	udpNetwork
+}
+
+func (n *deadlineNetwork) FindValue(key store.Key, address net.UDPAddr, timeout time.Duration, deadline time.Time) (chan network.FindResult, error) {
+	ch := make(chan network.FindResult, 1)
+	go func() {
+		time.Sleep(time.Until(deadline))
+		ch <- nil // Timed out.
+	}()
+	return ch, nil
+}
+
+func TestGetContext(t *testing.T) {
+	d, err := New(me, others[:1], new(deadlineNetwork), Config{Timeout: 10 * time.Second})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer d.Close()
+
+	hash := store.KeyFromValue("ABC, du är mina tankar")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, _, err := d.GetContext(ctx, hash); err == nil {
+		t.Error("expected error when the deadline is exceeded")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("lookup outlived the deadline, took: %v", elapsed)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := d.GetContext(ctx, hash); !errors.Is(err, context.Canceled) {
+		t.Errorf("unexpected error, got: %v, exp: %v", err, context.Canceled)
+	}
+}
+
+func TestRPCTimeout(t *testing.T) {
+	d := &DHT{config: Config{Timeout: time.Second}}
+
+	if timeout, deadline := d.rpcTimeout(context.Background()); timeout != time.Second || !deadline.IsZero() {
+		t.Errorf("unexpected timeout without deadline, got: %v, %v", timeout, deadline)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	timeout, deadline := d.rpcTimeout(ctx)
+	if exp, _ := ctx.Deadline(); !deadline.Equal(exp) {
+		t.Errorf("unexpected deadline, got: %v, exp: %v", deadline, exp)
+	}
+	if timeout <= 0 || timeout > 50*time.Millisecond {
+		t.Errorf("expected the timeout to be capped by the deadline, got: %v", timeout)
+	}
+}
+
+// deleteNetwork delivers delete requests from the channel to the DHT.
+type deleteNetwork struct {
+	udpNetwork
+	ch chan *network.DeleteRequest
+}
+
+func (n *deleteNetwork) DeleteRequestCh() chan *network.DeleteRequest { return n.ch }
+
+func TestDeleteRequest_publisher(t *testing.T) {
+	nw := &deleteNetwork{ch: make(chan *network.DeleteRequest)}
+	d, err := New(me, others[:1], nw, Config{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer d.Close()
+
+	value := "ABC, du är mina tankar"
+	key := store.KeyFromValue(value)
+	d.db.AddItem(key, value, 1, 1, true)
+	d.db.AddPublisher(key, others[0].NodeID)
+
+	// Neither an unsigned request from the publisher nor a signed request from
+	// another node removes the value.
+	nw.ch <- &network.DeleteRequest{Key: key, From: others[0]}
+	nw.ch <- &network.DeleteRequest{Key: key, From: others[1], Verified: true}
+
+	// Unbuffered, the previous request has been handled once the next one is
+	// received.
+	nw.ch <- &network.DeleteRequest{Key: store.KeyFromValue("ABC"), From: others[0]}
+	if _, err := d.db.GetItem(key); err != nil {
+		t.Fatalf("expected the value to be kept: %v", err)
+	}
+
+	nw.ch <- &network.DeleteRequest{Key: key, From: others[0], Verified: true}
+	nw.ch <- &network.DeleteRequest{Key: store.KeyFromValue("ABC"), From: others[0]}
+	if _, err := d.db.GetItem(key); err == nil {
+		t.Error("expected the value to be removed by its verified publisher")
+	}
+}
+
+func TestStats(t *testing.T) {
+	nw := &deleteNetwork{ch: make(chan *network.DeleteRequest)}
+	d, err := New(me, others[:1], nw, Config{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer d.Close()
+
+	if _, err := d.Put("ABC, du är mina tankar"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Unbuffered, the request has been received by the handler once sent.
+	nw.ch <- &network.DeleteRequest{Key: store.KeyFromValue("ABC"), From: others[0]}
+
+	// The counter is incremented after the request is received, wait for the
+	// handler to get to it.
+	var stats Stats
+	for i := 0; i < 100; i++ {
+		if stats = d.Stats(); stats.RPCs.Delete == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if stats.RPCs.Delete != 1 {
+		t.Errorf("unexpected number of delete requests, got: %d, exp: 1", stats.RPCs.Delete)
+	}
+	if stats.LocalItems != 1 {
+		t.Errorf("unexpected number of local items, got: %d, exp: 1", stats.LocalItems)
+	}
+	if stats.Contacts == 0 {
+		t.Error("expected contacts in the routing table")
+	}
+	if stats.Uptime <= 0 {
+		t.Errorf("unexpected uptime, got: %v", stats.Uptime)
+	}
+}
+
+func TestStats_clock(t *testing.T) {
+	clk := clock.NewMock(time.Now())
+	d, err := New(me, others[:1], new(udpNetwork), Config{Clock: clk})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer d.Close()
+
+	clk.Advance(time.Hour)
+	if uptime := d.Stats().Uptime; uptime != time.Hour {
+		t.Errorf("unexpected uptime, got: %v, exp: %v", uptime, time.Hour)
+	}
+}
+
+func TestIPv6(t *testing.T) {
+	var contacts []route.Contact
+	for i := 0; i < 3; i++ {
+		contacts = append(contacts, route.NewContact(node.NewID(), net.UDPAddr{
+			IP:   net.IPv6loopback,
+			Port: 8130 + i,
+		}))
+	}
+
+	// Every node bootstraps using the first node, the first node uses the
+	// second.
+	var dhts []*DHT
+	for i, c := range contacts {
+		boot := contacts[0]
+		if i == 0 {
+			boot = contacts[1]
+		}
+
+		nw, err := network.NewUDPNetwork(c, network.Config{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		d, err := New(c, []route.Contact{boot}, nw, Config{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer d.Close()
+
+		go nw.Listen()
+		dhts = append(dhts, d)
+	}
+
+	// Wait for the second node to join through the first node.
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if _, seen, ok := dhts[0].rt.ContactInfo(contacts[1].NodeID); ok && !seen.IsZero() {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("second node never joined")
+		}
+	}
+
+	found, err := dhts[2].FindNode(contacts[1].NodeID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, c := range found {
+		if c.NodeID.Equal(contacts[1].NodeID) {
+			if !c.Address.IP.Equal(net.IPv6loopback) || c.Address.Port != contacts[1].Address.Port {
+				t.Errorf("unexpected address, got: %v, exp: %v", c.Address.String(), contacts[1].Address.String())
+			}
+			return
+		}
+	}
+	t.Errorf("lookup over IPv6 didn't find the second node, got: %v", found)
+}
+
+func TestMockNetwork(t *testing.T) {
+	mock := network.NewMock(0, 0)
+
+	var contacts []route.Contact
+	for i := 0; i < 10; i++ {
+		contacts = append(contacts, route.NewContact(node.NewID(), net.UDPAddr{
+			IP:   net.IPv4(10, 0, 1, byte(i+1)),
+			Port: 8118,
+		}))
+	}
+
+	// Attach every node before any of them joins, packets to unattached
+	// addresses are dropped.
+	var nws []network.Network
+	for _, c := range contacts {
+		nw, err := mock.Attach(c, network.Config{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		nws = append(nws, nw)
+	}
+
+	// Every node bootstraps using the first node, the first node uses the
+	// second.
+	var dhts []*DHT
+	for i, c := range contacts {
+		boot := contacts[0]
+		if i == 0 {
+			boot = contacts[1]
+		}
+
+		nw := nws[i]
+		d, err := New(c, []route.Contact{boot}, nw, Config{K: 3})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer d.Close()
+
+		go nw.Listen()
+		dhts = append(dhts, d)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	for i, d := range dhts {
+		if err := d.WaitReady(ctx); err != nil {
+			t.Fatalf("node %d never joined: %v", i, err)
+		}
+	}
+
+	value := "Jag vill ha en egen måne"
+	hash, err := dhts[5].Put(value)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got, _, err := dhts[8].Get(hash)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got != value {
+		t.Errorf("unexpected value, got: %s, exp: %s", got, value)
+	}
+}
+
+// handoffNetwork records the classes of the stores sent, and delivers store
+// requests from the channel to the DHT.
+type handoffNetwork struct {
+	udpNetwork
+	classes chan network.StoreClass
+	ch      chan *network.StoreRequest
+}
+
+func (n *handoffNetwork) Store(key store.Key, explicit bool, value []byte, meta store.Meta, written time.Time, class network.StoreClass, ttl time.Duration, addr net.UDPAddr, timeout time.Duration, deadline time.Time) error {
+	select {
+	case n.classes <- class:
+	default:
+	}
+	return nil
+}
+
+func (n *handoffNetwork) StoreRequestCh() chan *network.StoreRequest { return n.ch }
+
+func TestClose_handoff(t *testing.T) {
+	nw := &handoffNetwork{classes: make(chan network.StoreClass, 100)}
+	d, err := New(me, others[:1], nw, Config{Handoff: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	d.db.AddLocalItem(store.KeyFromValue("Du är min man"), "Du är min man")
+	d.Close()
+
+	handoffs := 0
+	for len(nw.classes) > 0 {
+		if <-nw.classes == network.StoreClassHandoff {
+			handoffs++
+		}
+	}
+	if handoffs == 0 {
+		t.Error("expected the published value to be handed off on close")
+	}
+}
+
+func TestStoreRequest_handoff(t *testing.T) {
+	nw := &handoffNetwork{ch: make(chan *network.StoreRequest)}
+	d, err := New(me, others[:1], nw, Config{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer d.Close()
+
+	value := "Du är min man"
+	key := store.KeyFromValue(value)
+
+	// Only handoffs signed by a publisher of the value are taken over.
+	nw.ch <- &network.StoreRequest{Class: network.StoreClassHandoff, Key: key, Value: []byte(value), From: others[0], Verified: true}
+	nw.ch <- &network.StoreRequest{Class: network.StoreClassPublish, Key: key, Value: []byte(value), From: others[0]}
+	nw.ch <- &network.StoreRequest{Class: network.StoreClassHandoff, Key: key, Value: []byte(value), From: others[1], Verified: true}
+	nw.ch <- &network.StoreRequest{Class: network.StoreClassHandoff, Key: key, Value: []byte(value), From: others[0]}
+	if _, err := d.db.GetLocalItem(key); err == nil {
+		t.Fatal("unexpected handoff taken over from an unverified node or a node that isn't a publisher")
+	}
+
+	nw.ch <- &network.StoreRequest{Class: network.StoreClassHandoff, Key: key, Value: []byte(value), From: others[0], Verified: true}
+
+	// Wait for the handler to take over the value.
+	var item store.Item
+	for i := 0; i < 100; i++ {
+		if item, err = d.db.GetLocalItem(key); err == nil {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if err != nil || item.Value != value {
+		t.Errorf("expected the value to be republished by the receiver, got: %v (%v)", item, err)
+	}
+	if _, err := d.db.GetItem(key); err != nil {
+		t.Errorf("expected the value to be stored, got: %v", err)
+	}
+}
+
+// metaNetwork records the metadata of the stores sent, responds to lookups of
+// values with the metadata and delivers store requests from the channel to the
+// DHT.
+type metaNetwork struct {
+	udpNetwork
+	meta  store.Meta
+	metas chan store.Meta
+	ch    chan *network.StoreRequest
+	acks  chan network.SessionID
+}
+
+func (n *metaNetwork) Ack(sessionID network.SessionID, addr net.UDPAddr) error {
+	select {
+	case n.acks <- sessionID:
+	default:
+	}
+	return nil
+}
+
+func (n *metaNetwork) Store(key store.Key, explicit bool, value []byte, meta store.Meta, written time.Time, class network.StoreClass, ttl time.Duration, addr net.UDPAddr, timeout time.Duration, deadline time.Time) error {
+	select {
+	case n.metas <- meta:
+	default:
+	}
+	return nil
+}
+
+func (n *metaNetwork) FindValue(key store.Key, address net.UDPAddr, timeout time.Duration, deadline time.Time) (chan network.FindResult, error) {
+	ch := make(chan network.FindResult, 1)
+	id, _ := randomFindNodesResult(address)
+	ch <- &findValueResult{from: route.Contact{NodeID: id, Address: address}, value: "Du är min man", meta: n.meta}
+	return ch, nil
+}
+
+func (n *metaNetwork) StoreRequestCh() chan *network.StoreRequest { return n.ch }
+
+func TestPutWithMeta(t *testing.T) {
+	meta := store.Meta{"content-type": "text/plain", "tag": "song"}
+	nw := &metaNetwork{meta: meta, metas: make(chan store.Meta, 1), ch: make(chan *network.StoreRequest)}
+	d, err := New(me, others[:1], nw, Config{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer d.Close()
+
+	hash, err := d.PutWithMeta("Du är min man", meta)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if sent := <-nw.metas; sent["tag"] != "song" {
+		t.Errorf("unexpected metadata sent, got: %v, exp: %v", sent, meta)
+	}
+
+	// Served from the local items.
+	if _, got, err := d.GetWithMeta(hash); err != nil || got["content-type"] != "text/plain" {
+		t.Errorf("unexpected local metadata, got: %v (%v), exp: %v", got, err, meta)
+	}
+
+	// Retrieved from the network.
+	d.Forget(hash)
+	value, got, err := d.GetWithMeta(hash)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if value != "Du är min man" || got["tag"] != "song" {
+		t.Errorf("unexpected value and metadata, got: %q %v, exp: %v", value, got, meta)
+	}
+
+	large := store.Meta{"tag": strings.Repeat("x", store.MaxMetaSize)}
+	if _, err := d.PutWithMeta("Du är min man", large); !errors.Is(err, ErrMetaTooLarge) {
+		t.Errorf("unexpected error, got: %v, exp: %v", err, ErrMetaTooLarge)
+	}
+}
+
+func TestStoreRequest_meta(t *testing.T) {
+	nw := &metaNetwork{ch: make(chan *network.StoreRequest)}
+	d, err := New(me, others[:1], nw, Config{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer d.Close()
+
+	value := "Du är min man"
+	key := store.KeyFromValue(value)
+	large := store.Meta{"tag": strings.Repeat("x", store.MaxMetaSize)}
+	nw.ch <- &network.StoreRequest{Class: network.StoreClassPublish, Key: key, Value: []byte(value), Meta: large, From: others[0]}
+	nw.ch <- &network.StoreRequest{Class: network.StoreClassPublish, Key: key, Value: []byte(value), Meta: store.Meta{"tag": "song"}, From: others[0]}
+
+	// Wait for the handler to store the value.
+	var item store.Item
+	for i := 0; i < 100; i++ {
+		if item, err = d.db.GetItem(key); err == nil {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if err != nil || item.Meta["tag"] != "song" {
+		t.Errorf("expected the value to be stored with its metadata, got: %v (%v)", item, err)
+	}
+}
+
+func TestStoreLocal_staleMeta(t *testing.T) {
+	d := newDHT(t)
+	defer d.Close()
+
+	key := store.Key{1}
+	now := time.Now()
+	d.storeLocal(key, []byte("new"), store.Meta{"v": "new"}, now, network.StoreClassPublish, 0)
+
+	// The older write loses under LastWriteWins, and keeps the metadata of the
+	// newer value.
+	d.storeLocal(key, []byte("old"), store.Meta{"v": "old"}, now.Add(-time.Second), network.StoreClassPublish, 0)
+
+	item, err := d.db.GetItem(key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if item.Value != "new" || item.Meta["v"] != "new" {
+		t.Errorf("expected the newer value and its metadata to be kept, got: %q with: %v", item.Value, item.Meta)
+	}
+}
+
+func TestStoreRequest_written(t *testing.T) {
+	nw := &metaNetwork{ch: make(chan *network.StoreRequest), acks: make(chan network.SessionID, 3)}
+	d, err := New(me, others[:1], nw, Config{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer d.Close()
+
+	key := store.Key{1}
+	now := time.Now()
+	nw.ch <- &network.StoreRequest{Class: network.StoreClassPublish, Explicit: true, Key: key, Value: []byte("new"), Written: now, From: others[0], SessionID: network.SessionID{1}}
+	nw.ch <- &network.StoreRequest{Class: network.StoreClassPublish, Explicit: true, Key: key, Value: []byte("old"), Written: now.Add(-time.Second), From: others[1], SessionID: network.SessionID{2}}
+
+	// The requests are handled in order, wait for a last request.
+	last := store.Key{2}
+	nw.ch <- &network.StoreRequest{Class: network.StoreClassPublish, Explicit: true, Key: last, Value: []byte("last"), From: others[0], SessionID: network.SessionID{3}}
+	for i := 0; i < 100; i++ {
+		if _, err = d.db.GetItem(last); err == nil {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if item, err := d.db.GetItem(key); err != nil || item.Value != "new" {
+		t.Errorf("expected the newest value to be kept, got: %v (%v)", item, err)
+	}
+
+	// The rejected value is neither acknowledged nor is its sender recorded as
+	// a publisher.
+	for _, exp := range []network.SessionID{{1}, {3}} {
+		select {
+		case got := <-nw.acks:
+			if got != exp {
+				t.Errorf("unexpected acknowledgment, got: %v, exp: %v", got, exp)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected acknowledgment of: %v", exp)
+		}
+	}
+	if d.db.HasPublisher(key, others[1].NodeID) {
+		t.Error("unexpected publisher of the rejected value")
+	}
+}
+
+func TestStoreRequest_refresh(t *testing.T) {
+	nw := &metaNetwork{ch: make(chan *network.StoreRequest), acks: make(chan network.SessionID, 2)}
+	d, err := New(me, others[:1], nw, Config{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer d.Close()
+
+	// The expiration set by the publisher isn't extended by the refresh, the
+	// refresh is still acknowledged so that the sender doesn't wait.
+	value := "ABC, du är mina tankar"
+	key := store.KeyFromValue(value)
+	d.db.AddItemWithTTL(key, value, time.Hour, true)
+
+	start := time.Now()
+	nw.ch <- &network.StoreRequest{Class: network.StoreClassRefresh, Key: key, From: others[0], SessionID: network.SessionID{1}}
+	select {
+	case <-nw.acks:
+		if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+			t.Errorf("expected the refresh to be acknowledged at once, took: %v", elapsed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the refresh of a held value to be acknowledged")
+	}
+
+	// Values that aren't held are not acknowledged.
+	nw.ch <- &network.StoreRequest{Class: network.StoreClassRefresh, Key: store.KeyFromValue("missing"), From: others[0], SessionID: network.SessionID{2}}
+	nw.ch <- &network.StoreRequest{Class: network.StoreClassRefresh, Key: key, From: others[0], SessionID: network.SessionID{3}}
+	select {
+	case got := <-nw.acks:
+		if got != (network.SessionID{3}) {
+			t.Errorf("unexpected acknowledgment, got: %v, exp: %v", got, network.SessionID{3})
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the refresh of a held value to be acknowledged")
+	}
+}
+
+func TestStoreRequest_mismatchedKey(t *testing.T) {
+	nw := &metaNetwork{ch: make(chan *network.StoreRequest)}
+	d, err := New(me, others[:1], nw, Config{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer d.Close()
+
+	forged := store.KeyFromValue("ABC, du är mina tankar")
+	explicit := store.Key{1}
+	nw.ch <- &network.StoreRequest{Class: network.StoreClassPublish, Key: forged, Value: []byte("ABC, du är min tanke"), From: others[0]}
+	nw.ch <- &network.StoreRequest{Class: network.StoreClassPublish, Key: explicit, Explicit: true, Value: []byte("ABC, du är min tanke"), From: others[0]}
+
+	// The requests are handled in order, wait for a last request.
+	last := store.KeyFromValue("last")
+	nw.ch <- &network.StoreRequest{Class: network.StoreClassPublish, Key: last, Value: []byte("last"), From: others[0]}
+	for i := 0; i < 100; i++ {
+		if _, err = d.db.GetItem(last); err == nil {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("expected the value matching its key to be stored: %v", err)
+	}
+
+	if _, err := d.db.GetItem(forged); err == nil {
+		t.Error("unexpected value that doesn't match its key stored")
+	}
+	if _, err := d.db.GetItem(explicit); err != nil {
+		t.Errorf("expected the explicitly keyed value to be stored: %v", err)
+	}
+}
+
+func TestGet_forged(t *testing.T) {
+	value := "ABC, du är mina tankar"
+	hash := store.KeyFromValue(value)
+
+	// The bootstrap contact is queried first, and serves a forged value.
+	d, err := New(me, others[:1], &quorumNetwork{conflict: true}, Config{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer d.Close()
+
+	got, sender, err := d.Get(hash)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got != value || sender.Equal(others[0].NodeID) {
+		t.Errorf("unexpected value, got: %q from %v, exp: %q", got, sender, value)
+	}
+
+	// Values at keys chosen by the publisher can't be checked.
+	got, sender, err = d.GetAtKey(hash)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got != "ABC, du är min tanke" || !sender.Equal(others[0].NodeID) {
+		t.Errorf("unexpected value, got: %q from %v, exp: the value of the bootstrap contact", got, sender)
+	}
+}
+
+func TestAddSender_verify(t *testing.T) {
+	d, err := New(me, others[:1], new(udpNetwork), Config{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer d.Close()
+
+	alive := route.NewContact(node.NewID(), net.UDPAddr{IP: net.IPv4(10, 10, 10, 252), Port: 123})
+
+	d.addSender(dead)
+	d.addSender(alive)
+
+	if _, _, ok := d.rt.ContactInfo(dead.NodeID); ok {
+		t.Error("unexpected unresponsive sender in the routing table")
+	}
+	if _, _, ok := d.rt.ContactInfo(alive.NodeID); !ok {
+		t.Error("expected responding sender in the routing table")
+	}
+
+	d, err = New(me, others[:1], new(udpNetwork), Config{DisableContactVerification: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer d.Close()
+
+	d.addSender(dead)
+	if _, _, ok := d.rt.ContactInfo(dead.NodeID); !ok {
+		t.Error("expected unverified sender in the routing table")
+	}
+
+	// The address of a known contact is still only replaced once the new
+	// address responds.
+	d.addSender(alive)
+	moved := alive
+	moved.Address = dead.Address
+	d.addSender(moved)
+	if c, _, _ := d.rt.ContactInfo(alive.NodeID); !sameAddress(c.Address, alive.Address) {
+		t.Errorf("unexpected unverified address, got: %v, exp: %v", c.Address.String(), alive.Address.String())
+	}
+}
+
+func TestAddRequester_advertised(t *testing.T) {
+	d := newDHT(t)
+	defer d.Close()
+
+	source := net.UDPAddr{IP: net.IPv4(10, 10, 10, 252), Port: 123}
+	alive := net.UDPAddr{IP: net.IPv4(10, 10, 10, 251), Port: 123}
+
+	// An unsigned request is only added at the advertised address if the
+	// sender answers a ping there.
+	spoofed := route.NewContact(node.NewID(), source)
+	d.addRequester(spoofed, dead.Address, false)
+	if _, _, ok := d.rt.ContactInfo(spoofed.NodeID); ok {
+		t.Error("unexpected sender at an unresponsive advertised address in the routing table")
+	}
+
+	natted := route.NewContact(node.NewID(), source)
+	d.addRequester(natted, alive, false)
+	if c, _, ok := d.rt.ContactInfo(natted.NodeID); !ok || !sameAddress(c.Address, alive) {
+		t.Errorf("expected sender at the advertised address in the routing table, got: %v", c.Address.String())
+	}
+
+	// A signed request is trusted without a ping.
+	signed := route.NewContact(node.NewID(), source)
+	d.addRequester(signed, dead.Address, true)
+	if c, _, ok := d.rt.ContactInfo(signed.NodeID); !ok || !sameAddress(c.Address, dead.Address) {
+		t.Errorf("expected signed sender at the advertised address in the routing table, got: %v", c.Address.String())
+	}
+}
+
+func TestRebuild(t *testing.T) {
+	d := newDHT(t)
+	defer d.Close()
+
+	for i := 0; i < 5; i++ {
+		d.rt.Add(route.NewContactInBucket(me.NodeID, 100+i, dead.Address))
+	}
+	before := d.rt.Len()
+
+	dropped, added, err := d.Rebuild()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if dropped != 5 {
+		t.Errorf("unexpected number of dropped contacts, got: %d, exp: %d", dropped, 5)
+	}
+	// Contacts of the last responses might still be added concurrently.
+	if n := d.rt.Len(); n < before-dropped+added {
+		t.Errorf("unexpected number of contacts, got: %d, exp at least: %d", n, before-dropped+added)
+	}
+	for _, c := range d.rt.AllContacts() {
+		if sameAddress(c.Address, dead.Address) {
+			t.Errorf("unexpected unresponsive contact in the routing table: %v", c.NodeID)
+		}
+	}
+
+	// Every contact is dead.
+	d, err = New(me, []route.Contact{dead}, new(udpNetwork), Config{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer d.Close()
+
+	if dropped, _, err := d.Rebuild(); err == nil || dropped != 1 {
+		t.Errorf("expected error after dropping every contact, got: %v (%d dropped)", err, dropped)
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	d := newDHT(t)
+	defer d.Close()
+
+	for _, c := range d.rt.AllContacts() {
+		d.rt.Remove(c.NodeID)
+	}
+
+	// The unresponsive contacts are the least recently seen.
+	for i := 0; i < 5; i++ {
+		d.rt.Add(route.NewContactInBucket(me.NodeID, 100+i, dead.Address))
+	}
+	for _, c := range others[1:4] {
+		d.rt.Add(c)
+	}
+
+	rounds := [][2]int{
+		{0, 3}, // Three of the unresponsive contacts.
+		{1, 2}, // The rest of them, and the least recently seen alive one.
+		{3, 0}, // Only responsive contacts are left.
+	}
+	for i, exp := range rounds {
+		alive, evicted := d.keepalive(3)
+		if alive != exp[0] || evicted != exp[1] {
+			t.Errorf("unexpected result of round %d, got: %d alive and %d evicted, exp: %d and %d",
+				i, alive, evicted, exp[0], exp[1])
+		}
+	}
+
+	if n := d.rt.Len(); n != 3 {
+		t.Errorf("unexpected number of contacts, got: %d, exp: %d", n, 3)
+	}
+
+	m := new(countingMetrics)
+	d, err := New(me, others[:1], new(readyNetwork), Config{Metrics: m, KeepaliveInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer d.Close()
+
+	for i := 0; i < 200 && atomic.LoadInt64(&m.rounds) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if n := atomic.LoadInt64(&m.rounds); n == 0 {
+		t.Fatal("expected a keepalive round")
+	}
+	if n := atomic.LoadInt64(&m.alive); n == 0 {
+		t.Error("expected responding contacts to be reported")
+	}
+}
+
+// addressEvents is an event handler that records the address changes.
+type addressEvents struct {
+	logEvents
+	changed chan [2]route.Contact
+}
+
+func (e *addressEvents) OnAddressChange(old, new route.Contact) {
+	e.changed <- [2]route.Contact{old, new}
+}
+
+func TestAddSender_addressChange(t *testing.T) {
+	e := &addressEvents{changed: make(chan [2]route.Contact, 1)}
+	d, err := New(me, others[:1], new(udpNetwork), Config{Events: e})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer d.Close()
+
+	old := route.NewContact(node.NewID(), net.UDPAddr{IP: net.IPv4(10, 10, 10, 252), Port: 123})
+	d.addSender(old)
+
+	// Rebound to an address that doesn't respond, e.g. spoofed.
+	moved := old
+	moved.Address = dead.Address
+	d.addSender(moved)
+
+	if c, _, _ := d.rt.ContactInfo(old.NodeID); !sameAddress(c.Address, old.Address) {
+		t.Errorf("unexpected unverified address, got: %v, exp: %v", c.Address.String(), old.Address.String())
+	}
+
+	moved.Address = net.UDPAddr{IP: net.IPv4(10, 10, 10, 251), Port: 123}
+	d.addSender(moved)
+
+	if c, _, _ := d.rt.ContactInfo(old.NodeID); !sameAddress(c.Address, moved.Address) {
+		t.Errorf("unexpected address, got: %v, exp: %v", c.Address.String(), moved.Address.String())
+	}
+
+	select {
+	case changed := <-e.changed:
+		if !sameAddress(changed[0].Address, old.Address) || !sameAddress(changed[1].Address, moved.Address) {
+			t.Errorf("unexpected address change, got: %v to %v", changed[0].Address.String(), changed[1].Address.String())
+		}
+	default:
+		t.Error("expected an address change event")
+	}
+
+	// Heard from at the same address again.
+	d.addSender(moved)
+	select {
+	case changed := <-e.changed:
+		t.Errorf("unexpected address change: %v to %v", changed[0].Address.String(), changed[1].Address.String())
+	default:
+	}
+}
+
+// unreplicatedNetwork is a ready mock network where no callee holds any value.
+type unreplicatedNetwork struct {
+	readyNetwork
+}
+
+func (n *unreplicatedNetwork) HasValue(key store.Key, address net.UDPAddr, timeout time.Duration, deadline time.Time) (chan network.FindResult, error) {
+	return n.FindNodes(node.ID(key), address, timeout, deadline)
+}
+
+func TestCheckReplication(t *testing.T) {
+	d := newDHT(t)
+	defer d.Close()
+
+	hash := store.KeyFromValue("ABC, du är mina tankar")
+	contacts, err := d.FindNode(node.ID(hash))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Every callee of the mock network holds the value.
+	replicas, err := d.CheckReplication(hash)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if replicas == 0 || replicas > d.config.K {
+		t.Errorf("unexpected number of replicas, got: %d, exp: %d", replicas, len(contacts))
+	}
+
+	m := new(countingMetrics)
+	d, err = New(me, others[:1], new(unreplicatedNetwork), Config{Metrics: m, ReplicationCheckInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer d.Close()
+
+	d.db.AddLocalItem(hash, "ABC, du är mina tankar")
+
+	for i := 0; i < 200 && atomic.LoadInt64(&m.checks) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if n := atomic.LoadInt64(&m.checks); n == 0 {
+		t.Fatal("expected the replication to be checked")
+	}
+	if n := atomic.LoadInt64(&m.under); n != 1 {
+		t.Errorf("unexpected number of under-replicated values, got: %d, exp: 1", n)
+	}
 }
@@ -0,0 +1,149 @@
+package dht
+
+import (
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/optmzr/d7024e-dht/node"
+	"github.com/optmzr/d7024e-dht/route"
+	"github.com/optmzr/d7024e-dht/store"
+)
+
+// EventHandler is notified of the requests handled by the DHT and of the
+// contacts it learns about. Implement it to route the events into another
+// logger or to observe the DHT in tests. The methods are called from multiple
+// goroutines and must not block.
+type EventHandler interface {
+	OnFindNodeRequest(from route.Contact)
+	OnFindValueRequest(from route.Contact, key store.Key)
+	OnStoreRequest(from route.Contact, key store.Key)
+	OnDeleteRequest(from route.Contact, key store.Key)
+	OnPingRequest(from route.Contact, challenge []byte)
+
+	// OnAcquainted is called with the closest contacts returned by a node
+	// during a lookup.
+	OnAcquainted(from route.Contact, contacts []route.Contact)
+
+	// OnStored is called with the contacts that accepted a value.
+	OnStored(key store.Key, contacts []route.Contact)
+
+	// OnEvict is called when a contact is removed from the routing table for
+	// failing to respond. New is the contact that took its place in the full
+	// bucket, or the zero contact if the old contact was just removed.
+	OnEvict(old, new route.Contact)
+
+	// OnCandidateRemoved is called when a lookup of the target drops a
+	// contact from its shortlist, because it couldn't be reached, timed out or
+	// was banned.
+	OnCandidateRemoved(target node.ID, contact route.Contact, err error)
+
+	// OnAddressChange is called when a contact in the routing table is heard
+	// from at a new address and the address is updated, e.g. after a NAT
+	// rebinding. Old and new have the same node ID.
+	OnAddressChange(old, new route.Contact)
+
+	// OnJoin is called when the initial join started by New is done, after
+	// the number of attempts. The error is nil if the join succeeded, attempts
+	// is zero if the network failed before the first attempt.
+	OnJoin(attempts int, err error)
+}
+
+// LogLevel is the verbosity of the logs of the routine events of a DHT, see
+// Config.LogLevel.
+type LogLevel int
+
+const (
+	LogError LogLevel = iota // Only errors and changes to the routing table.
+	LogInfo                  // Also every handled request and stored value.
+	LogDebug                 // Also the progress of lookups, failed callees and replicated values.
+)
+
+// ParseLogLevel returns the log level with the name, either error, info or
+// debug.
+func ParseLogLevel(name string) (LogLevel, error) {
+	switch name {
+	case "error":
+		return LogError, nil
+	case "info":
+		return LogInfo, nil
+	case "debug":
+		return LogDebug, nil
+	}
+	return LogError, fmt.Errorf("unknown log level: %s", name)
+}
+
+// logEvents is the default event handler, which writes the events to the
+// global logger. The routine events are only written if the level is verbose
+// enough.
+type logEvents struct {
+	level LogLevel
+}
+
+func (e logEvents) OnFindNodeRequest(from route.Contact) {
+	if e.level >= LogInfo {
+		log.Info().Msgf("Find node request from: %v", from.NodeID)
+	}
+}
+
+func (e logEvents) OnFindValueRequest(from route.Contact, key store.Key) {
+	if e.level >= LogInfo {
+		log.Info().Msgf("Find value request from: %v", from.NodeID)
+	}
+}
+
+func (e logEvents) OnStoreRequest(from route.Contact, key store.Key) {
+	if e.level >= LogInfo {
+		log.Info().Msgf("Store value request from: %v", from.NodeID)
+	}
+}
+
+func (e logEvents) OnDeleteRequest(from route.Contact, key store.Key) {
+	if e.level >= LogInfo {
+		log.Info().Msgf("Delete value request from: %v", from.NodeID)
+	}
+}
+
+func (e logEvents) OnPingRequest(from route.Contact, challenge []byte) {
+	if e.level >= LogInfo {
+		log.Info().Msgf("Pong request from: %v (%x)", from.NodeID, challenge)
+	}
+}
+
+func (e logEvents) OnAcquainted(from route.Contact, contacts []route.Contact) {
+	if e.level >= LogDebug {
+		log.Debug().Msgf("Acquainted with %d contacts from: %v", len(contacts), from.NodeID)
+	}
+}
+
+func (logEvents) OnEvict(old, new route.Contact) {
+	if new.NodeID.Equal(node.ID{}) {
+		log.Info().Msgf("Evicted unresponsive contact: %v", old.NodeID)
+	} else {
+		log.Info().Msgf("Evicted unresponsive contact: %v, replaced by: %v", old.NodeID, new.NodeID)
+	}
+}
+
+func (e logEvents) OnCandidateRemoved(target node.ID, contact route.Contact, err error) {
+	if e.level >= LogDebug {
+		log.Debug().Err(err).Msgf("Removed candidate %v from lookup of: %v", contact.NodeID, target)
+	}
+}
+
+func (logEvents) OnAddressChange(old, new route.Contact) {
+	log.Info().Msgf("Address of contact %v changed from: %v to: %v", old.NodeID, old.Address.String(), new.Address.String())
+}
+
+func (logEvents) OnJoin(attempts int, err error) {
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to join the DHT network after %d attempts, giving up", attempts)
+	} else {
+		log.Info().Msgf("Joined the DHT network after %d attempts", attempts)
+	}
+}
+
+func (e logEvents) OnStored(key store.Key, contacts []route.Contact) {
+	if e.level >= LogInfo {
+		log.Info().Msgf("Stored value with hash %v at %d nodes:\n%s", key.String(), len(contacts), tabbedContactList(contacts...))
+	}
+}
@@ -1,6 +1,10 @@
 package dht
 
 import (
+	"context"
+	"math/rand"
+	"sync/atomic"
+
 	"github.com/optmzr/d7024e-dht/network"
 	"github.com/optmzr/d7024e-dht/node"
 	"github.com/optmzr/d7024e-dht/route"
@@ -10,28 +14,64 @@ import (
 
 func (dht *DHT) refreshRequestHandler() {
 	for {
-		index := <-dht.rt.RefreshCh()
+		var index int
+		select {
+		case index = <-dht.rt.RefreshCh():
+		case <-dht.done:
+			return
+		}
 
-		log.Info().Msgf("Refresh request for bucket: %d", index)
+		if dht.config.LogLevel >= LogInfo {
+			log.Info().Msgf("Refresh request for bucket: %d", index)
+		}
 
-		id := node.NewIDWithPrefix(dht.me.NodeID, index)
+		id := refreshID(dht.me.NodeID, index)
 
-		_, err := dht.iterativeFindNodes(id)
+		_, err := dht.iterativeFindNodes(context.Background(), id)
 		if err != nil {
 			log.Error().Err(err).Msgf("Refresh failed for bucket: %d using random ID: %v", index, id)
 		}
 	}
 }
 
+// refreshID returns a random ID within the range of the bucket at the index.
+// An ID in bucket i shares the first i bits with the local node and differs at
+// the next bit. NewIDWithPrefix flips the last bit of the prefix, the prefix
+// must therefore be one bit longer than the bucket index.
+func refreshID(me node.ID, index int) node.ID {
+	return node.NewIDWithPrefix(me, index+1)
+}
+
+// accept returns false if signatures are required and the request was not
+// signed by the owner of the sender ID.
+func (dht *DHT) accept(from route.Contact, verified bool) bool {
+	if verified || !dht.config.RequireSignatures {
+		return true
+	}
+
+	log.Warn().Msgf("Dropping unverified request from: %v (%v)", from.NodeID, from.Address.String())
+	return false
+}
+
 func (dht *DHT) findValueRequestHandler() {
 	for {
-		request := <-dht.nw.FindValueRequestCh()
+		var request *network.FindValueRequest
+		select {
+		case request = <-dht.nw.FindValueRequestCh():
+		case <-dht.done:
+			return
+		}
 
-		log.Info().Msgf("Find value request from: %v", request.From.NodeID)
+		if !dht.accept(request.From, request.Verified) {
+			continue
+		}
+
+		atomic.AddUint64(&dht.rpcs.FindValue, 1)
+		dht.config.Events.OnFindValueRequest(request.From, request.Key)
 
 		// Add node so it is moved to the top of its bucket in the routing
 		// table.
-		go dht.addNode(request.From)
+		go dht.addRequester(request.From, request.Advertised, request.Verified)
 
 		var closest []route.Contact
 		target := node.ID(request.Key)
@@ -41,12 +81,18 @@ func (dht *DHT) findValueRequestHandler() {
 		if err != nil {
 			// No luck.
 			// Fetch this nodes contacts that are closest to the requested key.
-			closest = dht.rt.NClosest(target, k).SortedContacts()
-		} else {
-			log.Info().Msgf("Found value: %s", item.Value)
+			closest = dht.rt.NClosest(target, dht.config.K).SortedContacts()
+		} else if dht.config.LogLevel >= LogInfo {
+			log.Info().Msgf("Found value with %d bytes", len(item.Value))
 		}
 
-		err = dht.nw.SendValue(request.Key, item.Value, closest, request.SessionID, request.From.Address)
+		value, meta := []byte(item.Value), item.Meta
+		if request.Exists {
+			value, meta = nil, nil // Only signal that the value is found.
+		}
+
+		found := err == nil
+		err = dht.nw.SendValue(request.Key, value, meta, found, closest, request.SessionID, request.From.Address)
 		if err != nil {
 			log.Error().Err(err).Msgf("Send value network call failed for: %v", request.From.Address)
 		}
@@ -55,16 +101,28 @@ func (dht *DHT) findValueRequestHandler() {
 
 func (dht *DHT) findNodesRequestHandler() {
 	for {
-		request := <-dht.nw.FindNodesRequestCh()
+		var request *network.FindNodesRequest
+		select {
+		case request = <-dht.nw.FindNodesRequestCh():
+		case <-dht.done:
+			return
+		}
 
-		log.Info().Msgf("Find node request from: %v", request.From.NodeID)
+		if !dht.accept(request.From, request.Verified) {
+			continue
+		}
+
+		atomic.AddUint64(&dht.rpcs.FindNodes, 1)
+		dht.config.Events.OnFindNodeRequest(request.From)
 
 		// Add node so it is moved to the top of its bucket in the routing
 		// table.
-		go dht.addNode(request.From)
+		go dht.addRequester(request.From, request.Advertised, request.Verified)
 
-		// Fetch this nodes contacts that are closest to the requested target.
-		closest := dht.rt.NClosest(request.Target, k).SortedContacts()
+		// Fetch this nodes contacts that are closest to the requested target,
+		// at most k of them ordered by XOR distance so that the response
+		// stays within a single packet.
+		closest := dht.rt.NClosest(request.Target, dht.config.K).SortedContacts()
 
 		err := dht.nw.SendNodes(closest, request.SessionID, request.From.Address)
 		if err != nil {
@@ -73,40 +131,227 @@ func (dht *DHT) findNodesRequestHandler() {
 	}
 }
 
+func (dht *DHT) getPeersRequestHandler() {
+	for {
+		var request *network.GetPeersRequest
+		select {
+		case request = <-dht.nw.GetPeersRequestCh():
+		case <-dht.done:
+			return
+		}
+
+		if !dht.accept(request.From, request.Verified) {
+			continue
+		}
+
+		atomic.AddUint64(&dht.rpcs.GetPeers, 1)
+
+		// Add node so it is moved to the top of its bucket in the routing
+		// table.
+		go dht.addRequester(request.From, request.Advertised, request.Verified)
+
+		// Bound the sample so that the response stays reasonably small.
+		count := request.Count
+		if count <= 0 || count > dht.config.MaxPeers {
+			count = dht.config.MaxPeers
+		}
+
+		peers := dht.samplePeers(count, request.From.NodeID)
+
+		err := dht.nw.SendNodes(peers, request.SessionID, request.From.Address)
+		if err != nil {
+			log.Error().Err(err).Msgf("Get peers network call failed for: %v", request.From.Address)
+		}
+	}
+}
+
+// samplePeers returns a random sample of at most n contacts of the routing
+// table, except the contact with the excluded node ID.
+func (dht *DHT) samplePeers(n int, exclude node.ID) []route.Contact {
+	var peers []route.Contact
+	for _, c := range dht.rt.AllContacts() {
+		if !c.NodeID.Equal(exclude) {
+			peers = append(peers, c)
+		}
+	}
+
+	rand.Shuffle(len(peers), func(i, j int) {
+		peers[i], peers[j] = peers[j], peers[i]
+	})
+
+	if len(peers) > n {
+		peers = peers[:n]
+	}
+	return peers
+}
+
 func (dht *DHT) storeRequestHandler() {
 	for {
-		request := <-dht.nw.StoreRequestCh()
+		var request *network.StoreRequest
+		select {
+		case request = <-dht.nw.StoreRequestCh():
+		case <-dht.done:
+			return
+		}
+
+		if !dht.accept(request.From, request.Verified) {
+			continue
+		}
 
-		log.Info().Msgf("Store value request from: %v", request.From.NodeID)
+		key := request.Key
+
+		atomic.AddUint64(&dht.rpcs.Store, 1)
+		dht.config.Events.OnStoreRequest(request.From, key)
+
+		if len(request.Value) > dht.config.MaxValueSize {
+			log.Warn().Msgf("Dropping value of %d bytes from: %v, the maximum is %d bytes",
+				len(request.Value), request.From.NodeID, dht.config.MaxValueSize)
+			continue
+		}
+		if size := request.Meta.Size(); size > store.MaxMetaSize {
+			log.Warn().Msgf("Dropping value with %d bytes of metadata from: %v, the maximum is %d bytes",
+				size, request.From.NodeID, store.MaxMetaSize)
+			continue
+		}
+		if request.Class != network.StoreClassRefresh && !request.Explicit && dht.keyOf(request.Value) != key {
+			// Refreshes carry no value, and explicitly keyed values are not
+			// derived from their keys.
+			log.Warn().Msgf("Dropping value that doesn't match its key from: %v", request.From.NodeID)
+			continue
+		}
 
 		// Add node so it is moved to the top of its bucket in the routing
 		// table.
-		go dht.addNode(request.From)
+		go dht.addRequester(request.From, request.Advertised, request.Verified)
 
 		var touch bool
 		switch request.Class {
+		case network.StoreClassHandoff:
+			// The publisher is leaving, republish the value in its place. Only
+			// accepted from a signed publisher that has stored the value here,
+			// so that other nodes can't make this node republish their values.
+			if !request.Verified || !dht.db.HasPublisher(key, request.From.NodeID) {
+				log.Warn().Msgf("Dropping handoff from: %v, not a verified publisher of: %v", request.From.NodeID, key)
+				continue
+			}
+			if !dht.db.AddHandedOffItem(key, string(request.Value), request.Meta, request.Written) {
+				log.Warn().Msgf("Dropping handoff of: %v from: %v, over the handoff limits or published by this node", key, request.From.NodeID)
+				continue
+			}
+			touch = true
+		case network.StoreClassRefresh:
+			// Acknowledged whenever the value is held, even if its expiration
+			// isn't extended, e.g. when set by the publisher. Only a missing
+			// value makes the sender wait for the timeout.
+			dht.db.RefreshItem(key)
+			if expire, held := dht.db.Expiry(key); held && expire.After(dht.config.Clock.Now()) {
+				dht.ack(request)
+			}
+			continue
 		case network.StoreClassPublish:
 			touch = true
 		case network.StoreClassReplicate:
 			touch = false
+		case network.StoreClassCache:
+			ttl := request.TTL
+			if ttl <= 0 {
+				ttl = tCache
+			}
+			if dht.db.AddCachedItem(key, string(request.Value), ttl) {
+				dht.setMeta(request)
+				dht.ack(request)
+			}
+			continue
+		}
+
+		var stored bool
+		if request.TTL > 0 {
+			// Expiration explicitly set by the publisher.
+			stored = dht.db.AddItemWithTTLAt(key, string(request.Value), request.Written, request.TTL, touch)
+		} else {
+			centrality := dht.rt.Centrality(node.ID(key))
+			stored = dht.db.AddItemAt(key, string(request.Value), request.Written, centrality, dht.config.K, touch)
+		}
+
+		// The sender isn't told that the value is stored, nor recorded as its
+		// publisher, if the value was rejected, e.g. by the conflict policy.
+		if !stored {
+			log.Debug().Msgf("Not acknowledging rejected value of: %v from: %v", key, request.From.NodeID)
+			continue
+		}
+
+		dht.db.AddPublisher(key, request.From.NodeID)
+		dht.setMeta(request)
+		dht.ack(request)
+	}
+}
+
+// setMeta sets the metadata of the stored value of the store request. Requests
+// without metadata keep the metadata already stored, e.g. when replicated by a
+// node that didn't receive it.
+func (dht *DHT) setMeta(request *network.StoreRequest) {
+	if len(request.Meta) > 0 {
+		dht.db.SetMeta(request.Key, request.Meta)
+	}
+}
+
+// ack confirms to the sender that the value of the store request was stored.
+func (dht *DHT) ack(request *network.StoreRequest) {
+	if err := dht.nw.Ack(request.SessionID, request.From.Address); err != nil {
+		log.Error().Err(err).Msgf("Failed to acknowledge store from: %v", request.From.NodeID)
+	}
+}
+
+func (dht *DHT) deleteRequestHandler() {
+	for {
+		var request *network.DeleteRequest
+		select {
+		case request = <-dht.nw.DeleteRequestCh():
+		case <-dht.done:
+			return
 		}
 
-		key := store.KeyFromValue(request.Value)
-		centrality := dht.rt.Centrality(node.ID(key))
+		if !dht.accept(request.From, request.Verified) {
+			continue
+		}
 
-		dht.db.AddItem(key, request.Value, centrality, k, touch)
+		atomic.AddUint64(&dht.rpcs.Delete, 1)
+		dht.config.Events.OnDeleteRequest(request.From, request.Key)
+
+		// Add node so it is moved to the top of its bucket in the routing
+		// table.
+		go dht.addRequester(request.From, request.Advertised, request.Verified)
+
+		// Only a signed publisher that has stored the value here may delete
+		// it, so that other nodes can't remove the values of others.
+		if !request.Verified || !dht.db.HasPublisher(request.Key, request.From.NodeID) {
+			log.Warn().Msgf("Dropping delete from: %v, not a verified publisher of: %v", request.From.NodeID, request.Key)
+			continue
+		}
+
+		dht.db.RemoveItem(request.Key)
 	}
 }
 
 func (dht *DHT) pongRequestHandler() {
 	for {
-		request := <-dht.nw.PongRequestCh()
+		var request *network.PongRequest
+		select {
+		case request = <-dht.nw.PongRequestCh():
+		case <-dht.done:
+			return
+		}
 
-		log.Info().Msgf("Pong request from: %v (%x)", request.From.NodeID, request.Challenge)
+		if !dht.accept(request.From, request.Verified) {
+			continue
+		}
+
+		atomic.AddUint64(&dht.rpcs.Ping, 1)
+		dht.config.Events.OnPingRequest(request.From, request.Challenge)
 
 		// Add node so it is moved to the top of its bucket in the routing
 		// table.
-		go dht.addNode(request.From)
+		go dht.addRequester(request.From, request.Advertised, request.Verified)
 
 		err := dht.nw.Pong(
 			request.Challenge,
@@ -120,11 +365,18 @@ func (dht *DHT) pongRequestHandler() {
 
 func (dht *DHT) replicateRequestHandler() {
 	for {
-		item := <-dht.db.ReplicateCh()
+		var item store.Item
+		select {
+		case item = <-dht.db.ReplicateCh():
+		case <-dht.done:
+			return
+		}
 
-		log.Debug().Msgf("Replicate request on value: %v", item)
+		if dht.config.LogLevel >= LogDebug {
+			log.Debug().Msgf("Replicate request on value: %v", item)
+		}
 
-		_, err := dht.iterativeStore(item.Value, network.StoreClassReplicate)
+		_, err := dht.iterativeStore(context.Background(), item.Key, []byte(item.Value), item.Meta, item.Written, network.StoreClassReplicate, item.TTL)
 		if err != nil {
 			log.Error().Err(err).Msgf("Replicate event failed for value: %v", item)
 		}
@@ -133,13 +385,24 @@ func (dht *DHT) replicateRequestHandler() {
 
 func (dht *DHT) republishRequestHandler() {
 	for {
-		item := <-dht.db.RepublishCh()
+		var item store.Item
+		select {
+		case item = <-dht.db.RepublishCh():
+		case <-dht.done:
+			return
+		}
 
-		log.Debug().Msgf("Republish request on value: %v", item)
+		if dht.config.LogLevel >= LogDebug {
+			log.Debug().Msgf("Republish request on value: %v", item)
+		}
 
-		_, err := dht.iterativeStore(item.Value, network.StoreClassPublish)
-		if err != nil {
+		stored, err := dht.iterativeStore(context.Background(), item.Key, []byte(item.Value), item.Meta, item.Written, network.StoreClassPublish, item.TTL)
+		if err != nil || len(stored) == 0 {
 			log.Error().Err(err).Msgf("Republish event failed for value: %v", item)
+
+			// Try again sooner rather than waiting for the next republish
+			// interval, the value might expire on the remote nodes before that.
+			dht.db.RetryRepublish(item.Key, tReplicate)
 		}
 	}
 }
@@ -0,0 +1,88 @@
+package dht
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/optmzr/d7024e-dht/route"
+)
+
+// keepalive pings the n least recently seen contacts of the routing table.
+// The responding contacts are moved to the top of their buckets, which marks
+// them as seen so that the next round pings other contacts, and the
+// unresponsive contacts are evicted. Returns the number of contacts that
+// responded and that were evicted.
+func (dht *DHT) keepalive(n int) (alive, dead int) {
+	type entry struct {
+		contact route.Contact
+		seen    time.Time
+	}
+
+	var entries []entry
+	for _, c := range dht.rt.AllContacts() {
+		if _, seen, ok := dht.rt.ContactInfo(c.NodeID); ok {
+			entries = append(entries, entry{c, seen})
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].seen.Before(entries[j].seen)
+	})
+	if len(entries) > n {
+		entries = entries[:n]
+	}
+
+	contacts := make([]route.Contact, len(entries))
+	for i, e := range entries {
+		contacts[i] = e.contact
+	}
+
+	var responded, evicted int64
+	fanOut(contacts, dht.config.Alpha, func(_ int, contact route.Contact) {
+		if _, err := dht.ping(contact); err != nil {
+			log.Debug().Err(err).Msgf("Evicting unresponsive contact: %v", contact.NodeID)
+			dht.evict(contact)
+			atomic.AddInt64(&evicted, 1)
+			return
+		}
+
+		dht.addNode(contact)
+		atomic.AddInt64(&responded, 1)
+	})
+
+	return int(responded), int(evicted)
+}
+
+// keepaliveMonitor pings KeepaliveContacts contacts of the routing table at
+// the interval, starting with the first interval after the join. Unlike the
+// bucket refresh, which looks up random IDs in buckets that haven't been
+// touched, it verifies that the contacts already in the table are still alive.
+func (dht *DHT) keepaliveMonitor(interval time.Duration) {
+	select {
+	case <-dht.joined:
+	case <-dht.done:
+		return
+	}
+
+	ticker := dht.config.Clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.Chan():
+		case <-dht.done:
+			return
+		}
+
+		alive, dead := dht.keepalive(dht.config.KeepaliveContacts)
+		if dead > 0 {
+			log.Info().Msgf("Keepalive evicted %d of %d contacts", dead, alive+dead)
+		}
+
+		dht.config.Metrics.Keepalive(alive, dead)
+		dht.config.Metrics.TableSize(dht.rt.Len())
+	}
+}
@@ -0,0 +1,41 @@
+package dht
+
+// Metrics receives measurements of the DHT, implement it to export them to a
+// monitoring system. The methods are called from multiple goroutines and must
+// not block.
+type Metrics interface {
+	// Lookup is called when an iterative lookup is done, with the number of
+	// rounds of requests it took.
+	Lookup(hops int)
+
+	// Store is called for every node a value is stored at, ok is false if the
+	// store request failed.
+	Store(ok bool)
+
+	// Timeout is called when a request sent to another node timed out.
+	Timeout()
+
+	// TableSize is called with the number of contacts in the routing table
+	// whenever it might have changed.
+	TableSize(n int)
+
+	// UnderReplicated is called after every replication check, see
+	// Config.ReplicationCheckInterval, with the number of values published by
+	// this node that are held by fewer than k nodes.
+	UnderReplicated(n int)
+
+	// Keepalive is called after every round of keepalive pings, see
+	// Config.KeepaliveInterval, with the number of contacts that responded
+	// and the number that were evicted.
+	Keepalive(alive, dead int)
+}
+
+// nopMetrics is the default metrics sink, which discards every measurement.
+type nopMetrics struct{}
+
+func (nopMetrics) Lookup(hops int)           {}
+func (nopMetrics) Store(ok bool)             {}
+func (nopMetrics) Timeout()                  {}
+func (nopMetrics) TableSize(n int)           {}
+func (nopMetrics) UnderReplicated(n int)     {}
+func (nopMetrics) Keepalive(alive, dead int) {}
@@ -0,0 +1,79 @@
+package dht
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/optmzr/d7024e-dht/node"
+	"github.com/optmzr/d7024e-dht/route"
+	"github.com/optmzr/d7024e-dht/store"
+)
+
+// CheckReplication looks up the k closest nodes to the key and asks each of
+// them if it holds the value, without transferring it. Returns the number of
+// nodes that holds the value, the local node is not counted.
+func (dht *DHT) CheckReplication(hash store.Key) (int, error) {
+	contacts, err := dht.FindNode(node.ID(hash))
+	if err != nil {
+		return 0, err
+	}
+
+	var replicas int32
+	fanOut(contacts, dht.config.Alpha, func(_ int, contact route.Contact) {
+		ch, err := dht.nw.HasValue(hash, contact.Address, dht.config.Timeout, time.Time{})
+		if err != nil {
+			log.Warn().Err(err).Msgf("Unable to probe: %v for value with hash: %v", contact.NodeID, hash)
+			return
+		}
+
+		if result := <-ch; result != nil && (result.Found() || len(result.Value()) > 0) {
+			atomic.AddInt32(&replicas, 1)
+		}
+	})
+
+	return int(replicas), nil
+}
+
+// replicationMonitor counts the holders of every value published by this node
+// at the interval, there are no holders to count before the join. The values
+// held by fewer than k nodes are logged and reported to the metrics.
+func (dht *DHT) replicationMonitor(interval time.Duration) {
+	select {
+	case <-dht.joined:
+	case <-dht.done:
+		return
+	}
+
+	ticker := dht.config.Clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.Chan():
+		case <-dht.done:
+			return
+		}
+
+		under := 0
+		for _, item := range dht.db.LocalItems() {
+			if dht.closed() {
+				return
+			}
+
+			replicas, err := dht.CheckReplication(item.Key)
+			if err != nil {
+				log.Error().Err(err).Msgf("Replication check failed for value with hash: %v", item.Key)
+				continue
+			}
+
+			if replicas < dht.config.K {
+				log.Warn().Msgf("Value with hash %v is under-replicated, held by %d of %d nodes", item.Key, replicas, dht.config.K)
+				under++
+			}
+		}
+
+		dht.config.Metrics.UnderReplicated(under)
+	}
+}
@@ -0,0 +1,49 @@
+package dht
+
+import (
+	"sync"
+	"time"
+
+	"github.com/optmzr/d7024e-dht/node"
+)
+
+// rttGain is the weight of a new round-trip time sample in the smoothed
+// round-trip time, the same as the one used by TCP (RFC 6298).
+const rttGain = 0.125
+
+// rtts holds the smoothed round-trip time of each contact, and a Mutex lock
+// for the datastructure.
+type rtts struct {
+	sync.RWMutex
+	m map[node.ID]time.Duration
+}
+
+// observe adds a round-trip time sample for the node ID.
+func (r *rtts) observe(id node.ID, sample time.Duration) {
+	r.Lock()
+	defer r.Unlock()
+
+	srtt, ok := r.m[id]
+	if !ok {
+		r.m[id] = sample
+		return
+	}
+
+	r.m[id] = srtt + time.Duration(rttGain*float64(sample-srtt))
+}
+
+// get returns the smoothed round-trip time of the node ID, or false if it has
+// never responded.
+func (r *rtts) get(id node.ID) (time.Duration, bool) {
+	r.RLock()
+	defer r.RUnlock()
+
+	srtt, ok := r.m[id]
+	return srtt, ok
+}
+
+// RTT returns the smoothed round-trip time of the node, measured from the pings
+// and lookups sent to it. Returns false if the node has never responded.
+func (dht *DHT) RTT(id node.ID) (time.Duration, bool) {
+	return dht.rtts.get(id)
+}
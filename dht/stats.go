@@ -0,0 +1,56 @@
+package dht
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a snapshot of the state of a DHT instance.
+type Stats struct {
+	Contacts   int           // Number of contacts in the routing table.
+	Items      int           // Number of values stored by other nodes.
+	Bytes      int           // Total size of the values stored by other nodes.
+	LocalItems int           // Number of values published by this node.
+	Uptime     time.Duration // Time since the DHT instance was created.
+	RPCs       RPCStats      // Requests handled since the instance was created.
+	InFlight   int           // Number of requests waiting for a response.
+}
+
+// RPCStats holds the number of handled requests of every type.
+type RPCStats struct {
+	FindNodes uint64
+	FindValue uint64
+	Store     uint64
+	Delete    uint64
+	Ping      uint64
+	GetPeers  uint64
+}
+
+// rpcCounters counts the handled requests, the fields are updated atomically.
+type rpcCounters RPCStats
+
+func (c *rpcCounters) snapshot() RPCStats {
+	return RPCStats{
+		FindNodes: atomic.LoadUint64(&c.FindNodes),
+		FindValue: atomic.LoadUint64(&c.FindValue),
+		Store:     atomic.LoadUint64(&c.Store),
+		Delete:    atomic.LoadUint64(&c.Delete),
+		Ping:      atomic.LoadUint64(&c.Ping),
+		GetPeers:  atomic.LoadUint64(&c.GetPeers),
+	}
+}
+
+// Stats returns a snapshot of the routing table, the stored values and the
+// handled requests. It only reads counters and is cheap enough to be polled.
+func (dht *DHT) Stats() Stats {
+	items, bytes := dht.db.Size()
+	return Stats{
+		Contacts:   dht.rt.Len(),
+		Items:      items,
+		Bytes:      bytes,
+		LocalItems: dht.db.LocalLen(),
+		Uptime:     dht.config.Clock.Now().Sub(dht.started),
+		RPCs:       dht.rpcs.snapshot(),
+		InFlight:   dht.nw.InFlight(),
+	}
+}
@@ -0,0 +1,50 @@
+package dht
+
+import (
+	"github.com/optmzr/d7024e-dht/node"
+	"github.com/optmzr/d7024e-dht/route"
+)
+
+// TraceKind is the kind of step in a lookup.
+type TraceKind int
+
+const (
+	TraceQuery    TraceKind = iota // A request was sent to the contact.
+	TraceFailed                    // The request couldn't be sent to the contact.
+	TraceResponse                  // The contact responded.
+	TraceTimeout                   // The response from the contact timed out.
+)
+
+func (k TraceKind) String() string {
+	switch k {
+	case TraceQuery:
+		return "query"
+	case TraceFailed:
+		return "failed"
+	case TraceResponse:
+		return "response"
+	case TraceTimeout:
+		return "timeout"
+	}
+	return "unknown"
+}
+
+// TraceEvent is a step in a lookup.
+type TraceEvent struct {
+	Kind    TraceKind
+	Target  node.ID       // Target of the lookup.
+	Contact route.Contact // Contact queried, or that responded.
+	Hop     int           // Round of requests the step belongs to, starting at 1.
+}
+
+// Trace is called, from the goroutine running the lookup, for every step of
+// every lookup.
+type Trace func(e TraceEvent)
+
+// trace calls the trace of the config, if any.
+func (dht *DHT) trace(kind TraceKind, target node.ID, contact route.Contact, hop int) {
+	if dht.config.Trace == nil {
+		return
+	}
+	dht.config.Trace(TraceEvent{Kind: kind, Target: target, Contact: contact, Hop: hop})
+}
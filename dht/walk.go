@@ -1,7 +1,10 @@
 package dht
 
 import (
+	"context"
 	"fmt"
+	"sort"
+	"time"
 
 	"github.com/optmzr/d7024e-dht/network"
 	"github.com/optmzr/d7024e-dht/node"
@@ -12,25 +15,103 @@ import (
 type awaitChannel struct {
 	ch     chan network.FindResult
 	callee route.Contact
+	sent   time.Time
 }
 
 type awaitResult struct {
 	result network.FindResult
 	callee route.Contact
+	rtt    time.Duration
 }
 
-func (dht *DHT) walk(call Call) ([]route.Contact, error) {
+// batch is shared by the lookups of a batch, see iterativeFindNodesBatch. The
+// lookups must be run one at a time.
+type batch struct {
+	sent map[node.ID]bool          // Contacted by any of the lookups.
+	seen map[node.ID]route.Contact // Learned by any of the lookups, and not failed.
+}
+
+func newBatch() *batch {
+	return &batch{
+		sent: make(map[node.ID]bool),
+		seen: make(map[node.ID]route.Contact),
+	}
+}
+
+// closest returns at most n of the learned contacts closest to the target.
+func (b *batch) closest(target node.ID, n int) []route.Contact {
+	if b == nil {
+		return nil
+	}
+
+	contacts := make([]route.Contact, 0, len(b.seen))
+	for _, c := range b.seen {
+		contacts = append(contacts, c)
+	}
+	sort.Slice(contacts, func(i, j int) bool {
+		return route.DistanceBetween(contacts[i].NodeID, target).Less(route.DistanceBetween(contacts[j].NodeID, target))
+	})
+
+	if len(contacts) > n {
+		contacts = contacts[:n]
+	}
+	return contacts
+}
+
+func (b *batch) learn(contacts ...route.Contact) {
+	if b == nil {
+		return
+	}
+	for _, c := range contacts {
+		b.seen[c.NodeID] = c
+	}
+}
+
+func (b *batch) forget(contact route.Contact) {
+	if b == nil {
+		return
+	}
+	delete(b.seen, contact.NodeID)
+}
+
+// walk performs an iterative lookup with the call, and returns the contacts in
+// the shortlist sorted by distance to the target together with the number of
+// rounds of requests (hops) the lookup took. The lookup is abandoned with the
+// error of the context once it's done, and no request outlives the deadline of
+// the context.
+func (dht *DHT) walk(ctx context.Context, call Call) (contacts []route.Contact, hops int, err error) {
+	return dht.walkBatch(ctx, call, nil)
+}
+
+// walkBatch performs the lookup like walk, as part of the batch if it's not
+// nil. The shortlist is then seeded with the closest contacts learned by the
+// earlier lookups of the batch, and contacts queried by the earlier lookups are
+// not queried again.
+func (dht *DHT) walkBatch(ctx context.Context, call Call, b *batch) (contacts []route.Contact, hops int, err error) {
+	if dht.closed() {
+		return nil, 0, ErrClosed
+	}
+
 	nw := dht.nw
 	me := dht.me
 	target := call.Target()
 
 	// The first α contacts selected are used to create a *shortlist* for the
 	// search.
-	sl := dht.rt.NClosest(target, α)
+	sl := dht.rt.NClosest(target, dht.alpha.get(dht.config.Alpha))
+	sl.SetComparator(dht.config.Comparator)
+	for _, c := range b.closest(target, dht.config.K) {
+		if !dht.rt.Banned(c.NodeID) {
+			sl.Add(c)
+		}
+	}
 
 	// Keep a map of contacts that has been sent to, to make sure we do not
 	// contact the same node multiple times.
 	sent := make(map[node.ID]bool)
+	if b != nil {
+		sent = b.sent
+	}
 
 	// If a cycle results in an unchanged `closest` node, then a FindNode
 	// network call should be made to each of the closest nodes that has not
@@ -38,78 +119,155 @@ func (dht *DHT) walk(call Call) ([]route.Contact, error) {
 	rest := false
 
 	// Contacts holds a sorted (slice) copy of the shortlist.
-	contacts := sl.SortedContacts()
+	contacts = sl.SortedContacts()
 
 	if len(contacts) == 0 {
 		// No candidates found in the routing table.
-		return contacts, fmt.Errorf("empty routing table")
+		return contacts, 0, fmt.Errorf("empty routing table")
 	}
 
-	// Closest is the node that closest in distance to the target node ID.
-	closest := contacts[0]
+	// Closest is the node that closest in distance to the target node ID. It
+	// is tracked by XOR distance, since the comparator may order the shortlist
+	// by something else.
+	closest := nearest(target, contacts)
+
+	// Cause is the error of the last failed request, returned if every
+	// candidate fails.
+	var cause error
+
+	for hops = 1; ; hops++ {
+		if dht.closed() {
+			return nil, hops, ErrClosed
+		}
+		if e := ctx.Err(); e != nil {
+			return contacts, hops, e
+		}
+
+		if hops > dht.config.MaxHops {
+			// The closest node kept changing, give up and return the best
+			// contacts known so far.
+			hops = dht.config.MaxHops
+			dht.config.Metrics.Lookup(hops)
+			return contacts, hops, fmt.Errorf("%w: after %d hops", ErrLookupExhausted, hops)
+		}
 
-	for {
 		// Holds a slice of channels that are awaiting a response from the
 		// network.
 		await := []awaitChannel{}
 
+		// The degree of parallelism might adapt between the rounds.
+		alpha := dht.alpha.get(dht.config.Alpha)
+
 		for i, contact := range contacts {
-			if i >= α && !rest {
+			if i >= alpha && !rest {
 				break // Limit to α contacts per shortlist.
 			}
 			if sent[contact.NodeID] || contact.NodeID.Equal(me.NodeID) {
 				continue // Ignore already contacted contacts or local node.
 			}
 
-			ch, err := call.Do(nw, contact.Address)
+			start := time.Now()
+			timeout, deadline := dht.rpcTimeout(ctx)
+			ch, err := call.Do(nw, contact.Address, timeout, deadline)
 			if err != nil {
-				log.Error().Err(err).Msgf("Unable to dial: %v, removing from candidates...", contact.NodeID)
+				if dht.config.LogLevel >= LogDebug {
+					log.Error().Err(err).Msgf("Unable to dial: %v, removing from candidates...", contact.NodeID)
+				}
+				cause = err
+				dht.trace(TraceFailed, target, contact, hops)
 
 				sl.Remove(contact)
+				b.forget(contact)
+				dht.config.Events.OnCandidateRemoved(target, contact, err)
 			} else {
 				// Mark as contacted.
 				sent[contact.NodeID] = true
+				dht.trace(TraceQuery, target, contact, hops)
 
 				// Add to await channel queue.
-				await = append(await, awaitChannel{ch: ch, callee: contact})
+				await = append(await, awaitChannel{ch: ch, callee: contact, sent: start})
 			}
 		}
 
-		results := make(chan awaitResult)
+		// Buffered, so that the goroutines can deliver their result and exit
+		// even if the walk is stopped before every result has been read.
+		results := make(chan awaitResult, len(await))
 		for _, ac := range await {
 			go func(ac awaitChannel) {
 				// Redirect all responses to the results channel.
 				r := <-ac.ch
-				results <- awaitResult{result: r, callee: ac.callee}
+				rtt := time.Since(ac.sent)
+				if r != nil {
+					dht.rtts.observe(ac.callee.NodeID, rtt)
+				}
+				results <- awaitResult{result: r, callee: ac.callee, rtt: rtt}
 			}(ac)
 		}
 
 		// Iterate through every result from the responding nodes and add their
 		// closest contacts to the shortlist.
 		for i := 0; i < len(await); i++ {
-			ac := <-results
+			var ac awaitResult
+			select {
+			case ac = <-results:
+			case <-ctx.Done():
+				return sl.SortedContacts(), hops, ctx.Err()
+			}
 			result := ac.result
 			callee := ac.callee
 
 			if result != nil {
+				dht.trace(TraceResponse, target, callee, hops)
+			} else {
+				dht.trace(TraceTimeout, target, callee, hops)
+			}
+			dht.alpha.observe(ac.rtt, result == nil)
+
+			if result != nil && dht.rt.Banned(callee.NodeID) {
+				// Ignore the response, the callee was banned during the walk.
+				sl.Remove(callee)
+				b.forget(callee)
+				cause = fmt.Errorf("%v is banned", callee.NodeID)
+				dht.config.Events.OnCandidateRemoved(target, callee, cause)
+			} else if result != nil {
 				// Add node so it is moved to the top of its bucket in the
 				// routing table.
 				go dht.addNode(callee)
 
-				// Add the responding node's closest contacts.
-				sl.Add(result.Closest()...)
+				// Add the responding node's closest contacts, except the
+				// local node which is never a result of its own lookups.
+				for _, contact := range result.Closest() {
+					if contact.NodeID.Equal(me.NodeID) {
+						continue
+					}
+					if !dht.rt.Banned(contact.NodeID) {
+						sl.Add(contact)
+						b.learn(contact)
+					}
+				}
+				b.learn(callee)
+				dht.config.Events.OnAcquainted(callee, result.Closest())
 
 				// Update callee with intermediate results.
 				stop := call.Result(result, callee)
 				if stop {
-					break // Callee requested that the walk must be stopped.
+					// Callee requested that the walk must be stopped, abandon
+					// the pending responses.
+					dht.config.Metrics.Lookup(hops)
+					return sl.SortedContacts(), hops, nil
 				}
 			} else {
 				// Network response timed out.
-				log.Warn().Msgf("Network response from: %v timed out, removing from candidates...", callee.NodeID)
+				if dht.config.LogLevel >= LogDebug {
+					log.Warn().Msgf("Network response from: %v timed out, removing from candidates...", callee.NodeID)
+				}
+				dht.config.Metrics.Timeout()
+				cause = network.ErrTimeout
 
 				// Remove the callee from the candidates.
 				sl.Remove(callee)
+				b.forget(callee)
+				dht.config.Events.OnCandidateRemoved(target, callee, cause)
 			}
 		}
 
@@ -118,10 +276,11 @@ func (dht *DHT) walk(call Call) ([]route.Contact, error) {
 		if len(contacts) == 0 {
 			// No candidates responded and all of them was therefore removed
 			// from the shortlist.
-			return contacts, fmt.Errorf("no candidates responded")
+			dht.config.Metrics.Lookup(hops)
+			return contacts, hops, fmt.Errorf("no candidates responded: %w", cause)
 		}
 
-		first := contacts[0]
+		first := nearest(target, contacts)
 		if closest.NodeID.Equal(first.NodeID) {
 			// Unchanged closest node from last run, re-run but check all the
 			// nodes in the shortlist (and not only the α closest).
@@ -131,7 +290,8 @@ func (dht *DHT) walk(call Call) ([]route.Contact, error) {
 			}
 
 			// Done. Return the contacts in the shortlist sorted by distance.
-			return contacts, nil
+			dht.config.Metrics.Lookup(hops)
+			return contacts, hops, nil
 
 		} else {
 			// New closest node found, continue iteration.
@@ -139,3 +299,33 @@ func (dht *DHT) walk(call Call) ([]route.Contact, error) {
 		}
 	}
 }
+
+// nearest returns the contact of the non-empty contacts that is closest to the
+// target by XOR distance.
+func nearest(target node.ID, contacts []route.Contact) route.Contact {
+	n := contacts[0]
+	for _, c := range contacts[1:] {
+		if closer(target, c, n) {
+			n = c
+		}
+	}
+	return n
+}
+
+// rpcTimeout returns the timeout of the requests sent on behalf of the context,
+// capped by the time remaining until the deadline of the context, together with
+// the deadline. The deadline is zero if the context has none. The default
+// timeout of the network is left to the network to cap by the deadline.
+func (dht *DHT) rpcTimeout(ctx context.Context) (timeout time.Duration, deadline time.Time) {
+	timeout = dht.config.Timeout
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return
+	}
+
+	if remaining := time.Until(deadline); timeout > 0 && remaining < timeout {
+		timeout = remaining
+	}
+	return
+}
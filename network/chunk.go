@@ -0,0 +1,208 @@
+package network
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/optmzr/d7024e-dht/packet"
+)
+
+const maxPacketSize = 8192 // Encoded packets larger than this are chunked (bytes).
+const chunkSize = 4096     // Maximum size of the data in a chunk (bytes).
+const maxChunks = 1024     // Maximum number of chunks of a single packet.
+
+// The packets being reassembled are bounded per source address and in total,
+// the oldest packets are discarded to stay within the limits.
+const maxSourcePartials = 8                         // Maximum number of packets reassembled at once from a single source.
+const maxSourcePartialBytes = maxChunks * chunkSize // Maximum size of the chunks received from a single source (bytes).
+const maxPartials = 1024                            // Maximum number of packets reassembled at once.
+const maxPartialBytes = 16 * maxChunks * chunkSize  // Maximum size of the chunks received (bytes).
+
+type partialKey struct {
+	addr      string
+	sessionID SessionID
+}
+
+// partial is a packet that is being reassembled from its chunks.
+type partial struct {
+	parts    [][]byte
+	received int
+	bytes    int    // Size of the received chunks.
+	seq      uint64 // Order in which the packets were first seen.
+	expire   time.Time
+}
+
+// usage is the number of packets being reassembled, and the size of their
+// received chunks.
+type usage struct {
+	partials int
+	bytes    int
+}
+
+func (u usage) over(partials, bytes int) bool {
+	return u.partials > partials || u.bytes > bytes
+}
+
+// reassembler reassembles packets from their chunks, incomplete packets are
+// discarded after a timeout, or when the limits are exceeded.
+type reassembler struct {
+	partials map[partialKey]*partial
+	sources  map[string]usage // Usage of each source address.
+	total    usage
+	seq      uint64
+	timeout  time.Duration
+
+	maxSourcePartials, maxSourceBytes int
+	maxPartials, maxBytes             int
+	sync.Mutex
+}
+
+func newReassembler(timeout time.Duration) *reassembler {
+	return &reassembler{
+		partials:          make(map[partialKey]*partial),
+		sources:           make(map[string]usage),
+		timeout:           timeout,
+		maxSourcePartials: maxSourcePartials,
+		maxSourceBytes:    maxSourcePartialBytes,
+		maxPartials:       maxPartials,
+		maxBytes:          maxPartialBytes,
+	}
+}
+
+// split splits the encoded packet into chunks of at most chunkSize bytes.
+func split(b []byte) ([]*packet.Chunk, error) {
+	total := (len(b) + chunkSize - 1) / chunkSize
+	if total > maxChunks {
+		return nil, fmt.Errorf("packet of %d bytes exceeds the maximum of %d chunks", len(b), maxChunks)
+	}
+
+	chunks := make([]*packet.Chunk, 0, total)
+	for i := 0; i < total; i++ {
+		end := (i + 1) * chunkSize
+		if end > len(b) {
+			end = len(b)
+		}
+
+		chunks = append(chunks, &packet.Chunk{
+			Index: uint32(i),
+			Total: uint32(total),
+			Data:  b[i*chunkSize : end],
+		})
+	}
+	return chunks, nil
+}
+
+// add adds a received chunk. The reassembled packet is returned once every
+// chunk has been received.
+func (r *reassembler) add(addr string, sessionID SessionID, c *packet.Chunk) ([]byte, bool, error) {
+	if c.Total == 0 || c.Total > maxChunks || c.Index >= c.Total {
+		return nil, false, fmt.Errorf("invalid chunk %d of %d", c.Index, c.Total)
+	}
+	if len(c.Data) > chunkSize {
+		return nil, false, fmt.Errorf("chunk of %d bytes exceeds the maximum of %d bytes", len(c.Data), chunkSize)
+	}
+
+	now := time.Now()
+	key := partialKey{addr: addr, sessionID: sessionID}
+
+	r.Lock()
+	defer r.Unlock()
+
+	// Discard packets that never were completed.
+	for k, p := range r.partials {
+		if now.After(p.expire) {
+			r.remove(k)
+		}
+	}
+
+	p, ok := r.partials[key]
+	if !ok {
+		p = &partial{
+			parts:  make([][]byte, c.Total),
+			seq:    r.seq,
+			expire: now.Add(r.timeout),
+		}
+		r.seq++
+		r.partials[key] = p
+		r.account(addr, 1, 0)
+	}
+
+	if int(c.Total) != len(p.parts) {
+		r.remove(key)
+		return nil, false, fmt.Errorf("chunk total changed from %d to %d", len(p.parts), c.Total)
+	}
+
+	if p.parts[c.Index] == nil {
+		p.parts[c.Index] = c.Data
+		p.received++
+		p.bytes += len(c.Data)
+		r.account(addr, 0, len(c.Data))
+	}
+
+	// Discard the oldest packets of the source, and then of any source, until
+	// within the limits.
+	for r.sources[addr].over(r.maxSourcePartials, r.maxSourceBytes) {
+		r.remove(r.oldest(addr))
+	}
+	for r.total.over(r.maxPartials, r.maxBytes) {
+		r.remove(r.oldest(""))
+	}
+	if _, ok := r.partials[key]; !ok {
+		return nil, false, fmt.Errorf("chunk %d of %d discarded, too many incomplete packets", c.Index, c.Total)
+	}
+
+	if p.received < len(p.parts) {
+		return nil, false, nil
+	}
+
+	r.remove(key)
+
+	var b []byte
+	for _, part := range p.parts {
+		b = append(b, part...)
+	}
+	return b, true, nil
+}
+
+// account adds the number of packets and the size of the chunks to the usage of
+// the source address and the total usage. The lock must be held.
+func (r *reassembler) account(addr string, partials, bytes int) {
+	u := r.sources[addr]
+	u.partials += partials
+	u.bytes += bytes
+	if u.partials == 0 {
+		delete(r.sources, addr)
+	} else {
+		r.sources[addr] = u
+	}
+
+	r.total.partials += partials
+	r.total.bytes += bytes
+}
+
+// remove discards the packet being reassembled. The lock must be held.
+func (r *reassembler) remove(key partialKey) {
+	p, ok := r.partials[key]
+	if !ok {
+		return
+	}
+
+	delete(r.partials, key)
+	r.account(key.addr, -1, -p.bytes)
+}
+
+// oldest returns the key of the packet that has been reassembled the longest,
+// from the source address or from any source if empty. The lock must be held.
+func (r *reassembler) oldest(addr string) (key partialKey) {
+	var oldest *partial
+	for k, p := range r.partials {
+		if addr != "" && k.addr != addr {
+			continue
+		}
+		if oldest == nil || p.seq < oldest.seq {
+			key, oldest = k, p
+		}
+	}
+	return
+}
@@ -0,0 +1,114 @@
+package network
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestSplit(t *testing.T) {
+	b := bytes.Repeat([]byte{1}, 2*chunkSize+1)
+
+	chunks, err := split(b)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(chunks) != 3 {
+		t.Fatalf("unexpected number of chunks, got: %d, exp: 3", len(chunks))
+	}
+	if len(chunks[2].Data) != 1 || chunks[2].Index != 2 || chunks[2].Total != 3 {
+		t.Errorf("unexpected last chunk: %d of %d (%d bytes)", chunks[2].Index, chunks[2].Total, len(chunks[2].Data))
+	}
+
+	_, err = split(make([]byte, (maxChunks+1)*chunkSize))
+	if err == nil {
+		t.Error("expected error for too large packet")
+	}
+}
+
+func TestReassembler_add(t *testing.T) {
+	r := newReassembler(time.Minute)
+
+	b := append(bytes.Repeat([]byte{1}, chunkSize), 2, 3)
+	chunks, _ := split(b)
+
+	// Chunks can arrive in any order, and sometimes twice.
+	for _, i := range []int{1, 1} {
+		_, complete, err := r.add("addr", SessionID{1}, chunks[i])
+		if err != nil || complete {
+			t.Fatalf("unexpected result for chunk %d, complete: %v, err: %v", i, complete, err)
+		}
+	}
+
+	rb, complete, err := r.add("addr", SessionID{1}, chunks[0])
+	if err != nil || !complete {
+		t.Fatalf("expected reassembled packet, complete: %v, err: %v", complete, err)
+	}
+	if !bytes.Equal(rb, b) {
+		t.Error("reassembled packet differs from the original")
+	}
+	if len(r.partials) != 0 {
+		t.Errorf("expected completed packet to be removed, got: %d", len(r.partials))
+	}
+}
+
+func TestReassembler_invalid(t *testing.T) {
+	r := newReassembler(time.Minute)
+
+	chunks, _ := split(make([]byte, 2*chunkSize))
+	chunks[0].Index = 2
+
+	if _, _, err := r.add("addr", SessionID{1}, chunks[0]); err == nil {
+		t.Error("expected error for chunk index out of range")
+	}
+}
+
+func TestReassembler_limits(t *testing.T) {
+	r := newReassembler(time.Minute)
+	r.maxSourcePartials = 2
+	r.maxPartials = 3
+
+	chunks, _ := split(make([]byte, 2*chunkSize))
+
+	// Incomplete packets beyond the limit of a source discard its oldest.
+	for i := byte(1); i <= 3; i++ {
+		if _, _, err := r.add("a", SessionID{i}, chunks[0]); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if _, ok := r.partials[partialKey{"a", SessionID{1}}]; ok {
+		t.Error("expected the oldest packet of the source to be discarded")
+	}
+	if r.sources["a"].partials != 2 {
+		t.Errorf("unexpected number of packets of the source, got: %d, exp: 2", r.sources["a"].partials)
+	}
+
+	// Incomplete packets beyond the total limit discard the oldest of any source.
+	for _, addr := range []string{"b", "c"} {
+		if _, _, err := r.add(addr, SessionID{1}, chunks[0]); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if _, ok := r.partials[partialKey{"a", SessionID{2}}]; ok {
+		t.Error("expected the oldest packet to be discarded")
+	}
+	if len(r.partials) != 3 || r.total.partials != 3 || r.total.bytes != 3*chunkSize {
+		t.Errorf("unexpected usage, got: %d packets, %+v", len(r.partials), r.total)
+	}
+
+	// The bytes of a source are limited too.
+	r.maxSourceBytes = chunkSize
+	if _, _, err := r.add("b", SessionID{1}, chunks[1]); err == nil {
+		t.Error("expected error for packet exceeding the size limit")
+	}
+	if _, ok := r.sources["b"]; ok {
+		t.Error("expected the usage of the source to be removed")
+	}
+
+	oversized := *chunks[0]
+	oversized.Data = make([]byte, chunkSize+1)
+	if _, _, err := r.add("d", SessionID{1}, &oversized); err == nil {
+		t.Error("expected error for oversized chunk")
+	}
+}
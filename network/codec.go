@@ -0,0 +1,58 @@
+package network
+
+import (
+	"bytes"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+
+	"github.com/optmzr/d7024e-dht/packet"
+)
+
+// Codec serializes packets to and from the wire format used by the UDP
+// transport.
+type Codec interface {
+	Marshal(p *packet.Packet) ([]byte, error)
+	Unmarshal(b []byte) (*packet.Packet, error)
+}
+
+// ProtoCodec serializes packets using the protobuf binary format, this is the
+// default wire format.
+type ProtoCodec struct{}
+
+// JSONCodec serializes packets using the protobuf JSON mapping. It's only
+// meant for debugging, as it makes the traffic readable when sniffed.
+type JSONCodec struct{}
+
+func (ProtoCodec) Marshal(p *packet.Packet) ([]byte, error) {
+	b, err := proto.Marshal(p)
+	if err != nil {
+		return nil, withCause(ErrEncode, "", err)
+	}
+	return b, nil
+}
+
+func (ProtoCodec) Unmarshal(b []byte) (*packet.Packet, error) {
+	p := &packet.Packet{}
+	if err := proto.Unmarshal(b, p); err != nil {
+		return p, withCause(ErrDecode, "", err)
+	}
+	return p, nil
+}
+
+func (JSONCodec) Marshal(p *packet.Packet) ([]byte, error) {
+	var buf bytes.Buffer
+	m := jsonpb.Marshaler{}
+	if err := m.Marshal(&buf, p); err != nil {
+		return nil, withCause(ErrEncode, "", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (JSONCodec) Unmarshal(b []byte) (*packet.Packet, error) {
+	p := &packet.Packet{}
+	if err := jsonpb.Unmarshal(bytes.NewReader(b), p); err != nil {
+		return p, withCause(ErrDecode, "", err)
+	}
+	return p, nil
+}
@@ -0,0 +1,78 @@
+package network
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/optmzr/d7024e-dht/packet"
+)
+
+func TestCodec(t *testing.T) {
+	codecs := map[string]Codec{
+		"proto": ProtoCodec{},
+		"json":  JSONCodec{},
+	}
+
+	for name, codec := range codecs {
+		p := &packet.Packet{
+			SessionId: []byte{123},
+			SenderId:  []byte{100},
+			Payload: &packet.Packet_Store{Store: &packet.Store{
+				Class: StoreClassPublish,
+				Value: []byte(value),
+			}},
+		}
+
+		b, err := codec.Marshal(p)
+		if err != nil {
+			t.Fatalf("%s: unexpected marshal error: %v", name, err)
+		}
+
+		pp, err := codec.Unmarshal(b)
+		if err != nil {
+			t.Fatalf("%s: unexpected unmarshal error: %v", name, err)
+		}
+
+		if !bytes.Equal(pp.GetSessionId(), p.GetSessionId()) {
+			t.Errorf("%s: unexpected session ID, got: %v, exp: %v", name, pp.GetSessionId(), p.GetSessionId())
+		}
+		if string(pp.GetStore().GetValue()) != value {
+			t.Errorf("%s: unexpected value, got: %s, exp: %s", name, pp.GetStore().GetValue(), value)
+		}
+		if pp.GetStore().GetClass() != StoreClassPublish {
+			t.Errorf("%s: unexpected class, got: %v", name, pp.GetStore().GetClass())
+		}
+	}
+}
+
+func TestWithCause(t *testing.T) {
+	u := &udpNetwork{timeout: time.Second}
+
+	// Nothing listens on the port, the dial is refused.
+	err := u.sendTCP(net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}, []byte{1})
+	if !errors.Is(err, ErrUnreachable) {
+		t.Errorf("expected unreachable error, got: %v", err)
+	}
+
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) {
+		t.Errorf("expected the cause to be wrapped, got: %v", err)
+	}
+}
+
+func TestCodec_decodeError(t *testing.T) {
+	codecs := map[string]Codec{
+		"proto": ProtoCodec{},
+		"json":  JSONCodec{},
+	}
+
+	for name, codec := range codecs {
+		_, err := codec.Unmarshal([]byte{0xff, 0xff, 0xff})
+		if !errors.Is(err, ErrDecode) {
+			t.Errorf("%s: expected decode error, got: %v", name, err)
+		}
+	}
+}
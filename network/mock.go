@@ -0,0 +1,124 @@
+package network
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/optmzr/d7024e-dht/route"
+)
+
+// mockPacket is an encoded packet delivered by a mock.
+type mockPacket struct {
+	b    []byte
+	from net.UDPAddr
+}
+
+// Mock is an in-memory transport that routes the packets between networks in
+// the same process, e.g. to run many DHT instances in a test without sockets.
+// The attached networks encode, sign and handle the packets like networks
+// bound to a UDP socket. Networks are identified by the address of their
+// contact, give them distinct IPs or disable rate limiting, as the requests
+// are rate limited per IP.
+type Mock struct {
+	latency  time.Duration
+	dropRate float64
+	rng      *rand.Rand
+	nodes    map[string]*udpNetwork
+	sync.Mutex
+}
+
+// NewMock creates a mock where every packet is delayed by the latency, and
+// dropped with the probability of the drop rate.
+func NewMock(latency time.Duration, dropRate float64) *Mock {
+	return &Mock{
+		latency:  latency,
+		dropRate: dropRate,
+		rng:      rand.New(rand.NewSource(time.Now().UnixNano())),
+		nodes:    make(map[string]*udpNetwork),
+	}
+}
+
+// Attach creates a network for the contact that sends and receives packets
+// through the mock. Returns an error if a network with the same address is
+// already attached.
+func (m *Mock) Attach(me route.Contact, config Config) (Network, error) {
+	config = config.withDefaults()
+
+	if err := checkKey(me, config.PrivateKey); err != nil {
+		return nil, err
+	}
+	if err := checkChallengeSize(config.ChallengeSize); err != nil {
+		return nil, err
+	}
+	if err := checkTag(config.Tag); err != nil {
+		return nil, err
+	}
+
+	n := newNetwork(me, config)
+	n.mock = m
+	n.inbox = make(chan mockPacket, 1024)
+	n.port = me.Address.Port
+
+	m.Lock()
+	defer m.Unlock()
+
+	if _, ok := m.nodes[me.Address.String()]; ok {
+		return nil, fmt.Errorf("address %s is already attached", me.Address.String())
+	}
+	m.nodes[me.Address.String()] = n
+
+	return n, nil
+}
+
+// detach removes the network from the mock, packets sent to it are dropped.
+func (m *Mock) detach(n *udpNetwork) {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.nodes[n.me.Address.String()] == n {
+		delete(m.nodes, n.me.Address.String())
+	}
+}
+
+// deliver delivers the packet to the network attached at the address after the
+// latency, unless it's dropped. Packets to unknown addresses are dropped, like
+// datagrams to a closed port.
+func (m *Mock) deliver(from net.UDPAddr, b []byte, to net.UDPAddr) {
+	m.Lock()
+	n, ok := m.nodes[to.String()]
+	drop := m.rng.Float64() < m.dropRate
+	m.Unlock()
+
+	if !ok || drop {
+		return
+	}
+
+	time.AfterFunc(m.latency, func() {
+		select {
+		case n.inbox <- mockPacket{b: b, from: from}:
+		case <-n.done:
+		}
+	})
+}
+
+// listenInbox handles the packets delivered by the mock, or the mux, until the
+// network is closed.
+func (u *udpNetwork) listenInbox() error {
+	select {
+	case u.ready <- struct{}{}:
+	case <-u.done:
+		return nil
+	}
+
+	for {
+		select {
+		case p := <-u.inbox:
+			go u.handleDatagram(p.b, p.from, false)
+		case <-u.done:
+			return nil
+		}
+	}
+}
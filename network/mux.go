@@ -0,0 +1,203 @@
+package network
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/optmzr/d7024e-dht/route"
+)
+
+// MaxTagSize is the maximum size of the tag of a network in bytes.
+const MaxTagSize = 255
+
+// frameMarker starts the frame of a tagged packet. It's never
+// the first byte of an encoded packet, as it's an invalid protobuf tag and not
+// the start of a JSON object.
+const frameMarker = 0xff
+
+// frame prepends the tag to the encoded packet, which is returned as is if the
+// tag is empty. The frame is the marker, the size of the tag and the tag.
+func frame(tag, b []byte) []byte {
+	if len(tag) == 0 {
+		return b
+	}
+
+	f := make([]byte, 0, 2+len(tag)+len(b))
+	f = append(f, frameMarker, byte(len(tag)))
+	f = append(f, tag...)
+	return append(f, b...)
+}
+
+// parseFrame returns the tag and the encoded packet of a received datagram, the
+// tag is empty if the packet is untagged. Returns false if the frame is
+// truncated.
+func parseFrame(b []byte) (tag, packet []byte, ok bool) {
+	if len(b) == 0 || b[0] != frameMarker {
+		return nil, b, true
+	}
+	if len(b) < 2 || len(b) < 2+int(b[1]) {
+		return nil, nil, false
+	}
+
+	n := int(b[1])
+	return b[2 : 2+n], b[2+n:], true
+}
+
+// unframe returns the encoded packet of a received datagram, or false if it
+// isn't tagged with the tag.
+func unframe(tag, b []byte) ([]byte, bool) {
+	t, p, ok := parseFrame(b)
+	if !ok || !bytes.Equal(t, tag) {
+		return nil, false
+	}
+	return p, true
+}
+
+// checkTag returns an error if the tag doesn't fit in a frame.
+func checkTag(tag []byte) error {
+	if len(tag) > MaxTagSize {
+		return fmt.Errorf("tag must be at most %d bytes, got: %d", MaxTagSize, len(tag))
+	}
+	return nil
+}
+
+// Mux shares a UDP socket between the networks of independent DHTs, e.g. a
+// content index and a metadata index on the same host. Every attached network
+// has a distinct tag, see Config.Tag, and the received packets are delivered to
+// the network of their tag. Packets of tags that no network is attached with
+// are dropped.
+type Mux struct {
+	conn    *net.UDPConn
+	nodes   map[string]*udpNetwork
+	done    chan struct{}
+	dropped uint64 // Number of packets of unknown tags, accessed atomically.
+	sync.Mutex
+}
+
+// NewMux binds the shared socket to the address.
+func NewMux(addr net.UDPAddr) (*Mux, error) {
+	if err := checkAddress(addr); err != nil {
+		return nil, fmt.Errorf("invalid listen address %s: %w", addr.String(), err)
+	}
+
+	conn, err := net.ListenUDP("udp", &addr)
+	if err != nil {
+		return nil, fmt.Errorf("cannot bind to %s: %w", addr.String(), err)
+	}
+
+	return &Mux{
+		conn:  conn,
+		nodes: make(map[string]*udpNetwork),
+		done:  make(chan struct{}),
+	}, nil
+}
+
+// Attach creates a network for the contact that sends and receives packets
+// through the shared socket, tagged with the tag of the config. Returns an
+// error if a network with the same tag is already attached. Large packets are
+// always sent as UDP chunks, as the TCP listener can't be shared, and the
+// address of the contact is not advertised.
+func (m *Mux) Attach(me route.Contact, config Config) (Network, error) {
+	config = config.withDefaults()
+
+	if err := checkKey(me, config.PrivateKey); err != nil {
+		return nil, err
+	}
+	if err := checkChallengeSize(config.ChallengeSize); err != nil {
+		return nil, err
+	}
+	if err := checkTag(config.Tag); err != nil {
+		return nil, err
+	}
+
+	n := newNetwork(me, config)
+	n.conn = m.conn
+	n.mux = m
+	n.inbox = make(chan mockPacket, 1024)
+	n.port = m.conn.LocalAddr().(*net.UDPAddr).Port
+
+	m.Lock()
+	defer m.Unlock()
+
+	if _, ok := m.nodes[string(config.Tag)]; ok {
+		return nil, fmt.Errorf("tag %q is already attached", config.Tag)
+	}
+	m.nodes[string(config.Tag)] = n
+
+	return n, nil
+}
+
+// detach removes the network from the mux, packets of its tag are
+// dropped.
+func (m *Mux) detach(n *udpNetwork) {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.nodes[string(n.tag)] == n {
+		delete(m.nodes, string(n.tag))
+	}
+}
+
+// Listen reads packets from the shared socket until the mux is closed, and
+// delivers them to the attached networks. Listen must also be called on every
+// attached network, which handles the delivered packets.
+func (m *Mux) Listen() error {
+	log.Info().Msgf("Listening for UDP packets on: %s", m.conn.LocalAddr().String())
+
+	buffer := make([]byte, 65535)
+
+	for {
+		size, addr, err := m.conn.ReadFromUDP(buffer)
+		if err != nil {
+			select {
+			case <-m.done:
+				return nil // Socket closed by Close.
+			default:
+			}
+
+			log.Error().Err(err).Msgf("Error when reading from UDP from address %v: %s", addr, err)
+			continue
+		}
+
+		b := make([]byte, size)
+		copy(b, buffer)
+
+		tag, _, ok := parseFrame(b)
+		m.Lock()
+		n, found := m.nodes[string(tag)]
+		m.Unlock()
+
+		if !ok || !found {
+			atomic.AddUint64(&m.dropped, 1)
+			log.Debug().Msgf("Dropping packet of unknown tag %q from: %v", tag, addr.String())
+			continue
+		}
+
+		// Drop the packet rather than blocking the other tags, like a
+		// full socket buffer.
+		select {
+		case n.inbox <- mockPacket{b: b, from: *addr}:
+		default:
+			atomic.AddUint64(&m.dropped, 1)
+			log.Warn().Msgf("Dropping packet from: %v, the inbox of tag %q is full", addr.String(), tag)
+		}
+	}
+}
+
+// Dropped returns the number of received packets that were dropped, as no
+// network is attached with their tag or as its inbox was full.
+func (m *Mux) Dropped() uint64 {
+	return atomic.LoadUint64(&m.dropped)
+}
+
+// Close stops listening and closes the shared socket. The attached networks
+// must be closed separately. It must only be called once.
+func (m *Mux) Close() error {
+	close(m.done)
+	return m.conn.Close()
+}
@@ -0,0 +1,159 @@
+package network
+
+import (
+	"bytes"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/optmzr/d7024e-dht/node"
+	"github.com/optmzr/d7024e-dht/route"
+)
+
+func TestFrame(t *testing.T) {
+	b := []byte{0x0a, 1, 2, 3}
+
+	if f := frame(nil, b); !bytes.Equal(f, b) {
+		t.Errorf("expected untagged packet to be unchanged, got: %x", f)
+	}
+
+	f := frame([]byte("meta"), b)
+	if p, ok := unframe([]byte("meta"), f); !ok || !bytes.Equal(p, b) {
+		t.Errorf("unexpected packet, got: %x (%v), exp: %x", p, ok, b)
+	}
+
+	for _, c := range []struct {
+		tag []byte
+		b   []byte
+	}{
+		{[]byte("content"), f},  // Another tag.
+		{nil, f},                // Tagged, but expected untagged.
+		{[]byte("meta"), b},     // Untagged, but expected tagged.
+		{[]byte("meta"), f[:4]}, // Truncated frame.
+	} {
+		if p, ok := unframe(c.tag, c.b); ok {
+			t.Errorf("expected packet to be dropped in tag %q, got: %x", c.tag, p)
+		}
+	}
+
+	if err := checkTag(make([]byte, MaxTagSize+1)); err == nil {
+		t.Error("expected error for a too large tag")
+	}
+}
+
+func TestMock_tag(t *testing.T) {
+	useRNG(t, rand.Read)
+	mock := NewMock(0, 0)
+
+	a := route.NewContact(node.NewID(), net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 8118})
+	b := route.NewContact(node.NewID(), net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 8118})
+	c := route.NewContact(node.NewID(), net.UDPAddr{IP: net.IPv4(10, 0, 0, 3), Port: 8118})
+
+	na, err := mock.Attach(a, Config{Tag: []byte("a"), Timeout: 50 * time.Millisecond, Retransmits: -1})
+	panicOnErr(err)
+	defer na.Close()
+
+	nb, err := mock.Attach(b, Config{Tag: []byte("b")})
+	panicOnErr(err)
+	defer nb.Close()
+
+	nc, err := mock.Attach(c, Config{Tag: []byte("a")})
+	panicOnErr(err)
+	defer nc.Close()
+
+	for _, n := range []Network{na, nb, nc} {
+		go n.Listen()
+		<-n.ReadyCh()
+	}
+
+	// Another tag.
+	ch, err := na.FindNodes(node.NewID(), b.Address, 0, time.Time{})
+	panicOnErr(err)
+	if r := <-ch; r != nil {
+		t.Errorf("expected packet of another tag to be dropped, got: %v", r)
+	}
+
+	// The same tag.
+	ch, err = na.FindNodes(node.NewID(), c.Address, 0, time.Time{})
+	panicOnErr(err)
+
+	r := <-nc.FindNodesRequestCh()
+	err = nc.SendNodes([]route.Contact{b}, r.SessionID, r.From.Address)
+	panicOnErr(err)
+
+	if r := <-ch; r == nil || len(r.Closest()) != 1 {
+		t.Errorf("unexpected result in the same tag, got: %v", r)
+	}
+}
+
+func TestMux(t *testing.T) {
+	useRNG(t, rand.Read)
+
+	addr := net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8124}
+	mux, err := NewMux(addr)
+	panicOnErr(err)
+	defer mux.Close()
+
+	content, err := mux.Attach(route.NewContact(node.NewID(), addr), Config{Tag: []byte("content")})
+	panicOnErr(err)
+	defer content.Close()
+
+	meta, err := mux.Attach(route.NewContact(node.NewID(), addr), Config{Tag: []byte("meta")})
+	panicOnErr(err)
+	defer meta.Close()
+
+	if _, err := mux.Attach(route.NewContact(node.NewID(), addr), Config{Tag: []byte("meta")}); err == nil {
+		t.Error("expected error for an attached tag")
+	}
+
+	go mux.Listen()
+	for _, n := range []Network{content, meta} {
+		go n.Listen()
+		<-n.ReadyCh()
+	}
+
+	// A node of the metadata index on another socket.
+	other := route.NewContact(node.NewID(), net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8125})
+	x, err := NewUDPNetwork(other, Config{Tag: []byte("meta"), Timeout: 100 * time.Millisecond, Retransmits: -1})
+	panicOnErr(err)
+	defer x.Close()
+
+	go x.Listen()
+	<-x.ReadyCh()
+
+	ch, err := x.FindNodes(node.NewID(), addr, 0, time.Time{})
+	panicOnErr(err)
+
+	select {
+	case r := <-meta.FindNodesRequestCh():
+		err = meta.SendNodes([]route.Contact{other}, r.SessionID, r.From.Address)
+		panicOnErr(err)
+	case r := <-content.FindNodesRequestCh():
+		t.Fatalf("expected request to be delivered to the metadata index, got: %v", r)
+	case <-time.After(time.Second):
+		t.Fatal("expected request to be delivered")
+	}
+
+	if r := <-ch; r == nil || len(r.Closest()) != 1 {
+		t.Errorf("unexpected result from the metadata index, got: %v", r)
+	}
+
+	// Untagged packets, and packets of unknown tags, are dropped.
+	before := mux.Dropped()
+
+	_, err = n.FindNodes(node.NewID(), addr, 0, time.Time{})
+	panicOnErr(err)
+
+	select {
+	case r := <-meta.FindNodesRequestCh():
+		t.Errorf("unexpected untagged request, got: %v", r)
+	case r := <-content.FindNodesRequestCh():
+		t.Errorf("unexpected untagged request, got: %v", r)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if n := mux.Dropped(); n == before {
+		t.Error("expected untagged packet to be dropped")
+	}
+}
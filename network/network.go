@@ -1,13 +1,20 @@
 package network
 
 import (
+	"bytes"
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ed25519"
 
 	"github.com/optmzr/d7024e-dht/node"
 	"github.com/optmzr/d7024e-dht/packet"
@@ -21,12 +28,75 @@ const (
 	StoreClassUnknown   = packet.StoreClass_UNKNOWN
 	StoreClassPublish   = packet.StoreClass_PUBLISH
 	StoreClassReplicate = packet.StoreClass_REPLICATE
+	StoreClassCache     = packet.StoreClass_CACHE
+	StoreClassRefresh   = packet.StoreClass_REFRESH
+	StoreClassHandoff   = packet.StoreClass_HANDOFF
 )
 
 const Size256 = 256 / 8
 
 const networkTimeout = 1 * time.Second
 
+const retransmits = 2 // Default number of retransmissions of an unanswered request.
+
+const rateLimit = 100 // Default number of requests per second from a single source.
+const rateBurst = 200 // Default number of requests allowed in a burst from a single source.
+
+const challengeSize = Size256 // Default size of the ping challenge (bytes).
+const minChallengeSize = 16   // Minimum size of the ping challenge (bytes).
+
+const sessionAttempts = 8 // Maximum number of session IDs generated for a request before giving up.
+
+const drainPoll = 10 * time.Millisecond // Interval between checks for pending requests while closing.
+
+const replayWindow = 5 * time.Minute // Time during which replayed requests are dropped.
+const replayCacheSize = 10000        // Maximum number of remembered requests.
+
+// ErrTimeout is wrapped by errors caused by a request that wasn't answered in
+// time.
+var ErrTimeout = errors.New("request timed out")
+
+// ErrClosed is returned by requests sent once the network is closing.
+var ErrClosed = errors.New("network is closed")
+
+// ErrEncode is returned when a packet can't be encoded to the wire format.
+var ErrEncode = errors.New("cannot encode packet")
+
+// ErrDecode is returned when received bytes can't be decoded to a packet.
+var ErrDecode = errors.New("cannot decode packet")
+
+// ErrUnreachable is returned when a packet can't be sent to the address.
+var ErrUnreachable = errors.New("address unreachable")
+
+// causeError is an error classified by one of the sentinel errors that wraps
+// the error that caused it, errors.Is matches both.
+type causeError struct {
+	sentinel error
+	context  string // Describes the failed operation, empty if none.
+	cause    error
+}
+
+// withCause returns an error classified by the sentinel error, with the context
+// and the cause in the message.
+func withCause(sentinel error, context string, cause error) error {
+	return &causeError{sentinel: sentinel, context: context, cause: cause}
+}
+
+func (e *causeError) Error() string {
+	if e.context == "" {
+		return fmt.Sprintf("%v: %v", e.sentinel, e.cause)
+	}
+	return fmt.Sprintf("%v: %s: %v", e.sentinel, e.context, e.cause)
+}
+
+func (e *causeError) Unwrap() error {
+	return e.cause
+}
+
+func (e *causeError) Is(target error) bool {
+	return target == e.sentinel
+}
+
 type SessionID [Size256]byte
 
 type randRead func([]byte) (int, error)
@@ -37,38 +107,215 @@ func init() {
 	rng = rand.Read
 }
 
+// Config contains the tunable parameters of the UDP network. The zero value
+// uses the defaults.
+type Config struct {
+	Codec Codec // Wire format of the packets, defaults to ProtoCodec.
+
+	// PrivateKey signs every sent packet if set. The node ID of the local
+	// contact must then be derived from its public key, see
+	// node.IDFromPublicKey.
+	PrivateKey ed25519.PrivateKey
+
+	// ReplayWindow is the time during which a request with the same sender ID
+	// and session ID as an earlier request is dropped as a replay. At most
+	// ReplayCacheSize requests are remembered.
+	ReplayWindow    time.Duration
+	ReplayCacheSize int
+
+	// ChallengeSize is the size in bytes of the random challenge sent in
+	// pings, which must be echoed by the pong. Pongs that doesn't echo the
+	// challenge are dropped, a larger challenge is harder to guess by an
+	// off-path attacker. Defaults to 32 bytes, and must be at least 16 bytes.
+	ChallengeSize int
+
+	// Timeout is the default time to wait for a response, used by calls that
+	// doesn't provide their own timeout.
+	Timeout time.Duration
+
+	// DrainTimeout is the maximum time Close waits for the pending requests to
+	// be answered, or to time out, before the socket is closed. New requests
+	// are refused meanwhile. Defaults to the timeout, negative closes the
+	// socket at once.
+	DrainTimeout time.Duration
+
+	// Retransmits is the number of times an unanswered ping or lookup is
+	// resent, with the same session ID, before it's considered timed out. The
+	// wait before each retransmission starts at the timeout and is doubled
+	// every attempt. Negative disables retransmission.
+	Retransmits int
+
+	// RateLimit is the number of requests per second accepted from a single
+	// source IP, with bursts of up to RateBurst requests. Requests over the
+	// limit are dropped. Negative disables rate limiting.
+	RateLimit float64
+	RateBurst int
+
+	// ReadBuffer and WriteBuffer are the sizes in bytes of the receive and
+	// send buffers of the socket, raise them if packets are dropped under
+	// bursts of traffic. The defaults of the OS are used if zero.
+	ReadBuffer  int
+	WriteBuffer int
+
+	// TCPThreshold is the size in bytes of encoded packets, e.g. stores of
+	// large values, above which the packet is sent over TCP instead of as UDP
+	// chunks. The TCP listener is bound to the same port as the UDP socket,
+	// unless DisableTCP is set. Packets are sent over UDP if the TCP transfer
+	// fails.
+	TCPThreshold int
+	DisableTCP   bool
+
+	// MaxTCPPacketSize is the maximum size in bytes of a packet received over
+	// TCP, larger packets are dropped before they are read. Defaults to a value
+	// of the default dht.Config.MaxValueSize with its metadata and the rest of
+	// the packet, raise it together with the maximum value size.
+	// MaxTCPConns is the maximum number of TCP connections handled at once,
+	// further connections are closed at once. Defaults to 64.
+	MaxTCPPacketSize int
+	MaxTCPConns      int
+
+	// ListenAddress is the address the sockets are bound to, if it differs
+	// from the address of the local contact, e.g. behind NAT with port
+	// forwarding. The address of the local contact is then advertised in every
+	// sent packet, and is used by the receivers to contact this node.
+	ListenAddress *net.UDPAddr
+
+	// Tag is prepended to every sent packet on the wire, so that the networks
+	// of independent DHTs can share a socket, see Mux. Received packets with
+	// another tag are dropped, and so are untagged packets. Packets are
+	// untagged if the tag is empty, as sent by networks without a tag. At
+	// most MaxTagSize bytes. Unrelated to the namespace of the keys of a DHT,
+	// see dht.Config.Namespace.
+	Tag []byte
+}
+
+// withDefaults returns a copy of the configuration where unset fields are
+// replaced with the default values.
+func (c Config) withDefaults() Config {
+	if c.Codec == nil {
+		c.Codec = ProtoCodec{}
+	}
+	if c.ReplayWindow <= 0 {
+		c.ReplayWindow = replayWindow
+	}
+	if c.ReplayCacheSize <= 0 {
+		c.ReplayCacheSize = replayCacheSize
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = networkTimeout
+	}
+	if c.DrainTimeout == 0 {
+		c.DrainTimeout = c.Timeout
+	}
+	if c.ChallengeSize == 0 {
+		c.ChallengeSize = challengeSize
+	}
+	if c.RateLimit == 0 {
+		c.RateLimit = rateLimit
+	}
+	if c.RateBurst <= 0 {
+		c.RateBurst = rateBurst
+	}
+	if c.TCPThreshold <= 0 {
+		c.TCPThreshold = tcpThreshold
+	}
+	if c.MaxTCPPacketSize <= 0 {
+		c.MaxTCPPacketSize = maxTCPPacketSize
+	}
+	if c.MaxTCPConns <= 0 {
+		c.MaxTCPConns = maxTCPConns
+	}
+	if c.Retransmits == 0 {
+		c.Retransmits = retransmits
+	} else if c.Retransmits < 0 {
+		c.Retransmits = 0
+	}
+	return c
+}
+
 type udpNetwork struct {
-	conn  *net.UDPConn
+	conn  *net.UDPConn     // Nil if attached to a mock.
+	mock  *Mock            // Routes the packets instead of the socket if set.
+	mux   *Mux             // Owns the socket and delivers the packets if set.
+	inbox chan mockPacket  // Packets delivered by the mock.
+	tcp   *net.TCPListener // Nil if TCP is disabled.
+	port  int              // UDP port of the socket.
 	me    route.Contact
+	codec Codec
+	key   ed25519.PrivateKey
+	rc    *replayCache
+	ra    *reassembler
+	rl    *rateLimiter // Nil if rate limiting is disabled.
 	fnt   *table
 	fvt   *table
 	pt    *table
+	st    *table
 	fnr   chan *FindNodesRequest
+	gpr   chan *GetPeersRequest
 	fvr   chan *FindValueRequest
 	pr    chan *PongRequest
 	sr    chan *StoreRequest
+	dr    chan *DeleteRequest
 	ready chan struct{}
+	errs  chan error
+	done  chan struct{}
+
+	closing   chan struct{} // Closed when Close starts, new requests are then refused.
+	closeOnce sync.Once
+	drain     time.Duration // Maximum time Close waits for the pending requests.
+
+	timeout     time.Duration // Default time to wait for a response.
+	challenge   int           // Size of the ping challenge.
+	retransmits int
+	tcpSize     int           // Size of packets above which TCP is used.
+	tcpMax      int           // Maximum size of packets received over TCP.
+	tcpConns    chan struct{} // Semaphore of the handled TCP connections.
+	advertise   bool          // Advertise the address of the local contact in sent packets.
+	tag         []byte        // Tags the sent packets, received packets of other tags are dropped.
+	dropped     uint64        // Number of requests dropped by the rate limiter, accessed atomically.
+	readErrors  uint64        // Number of failed reads from the socket, accessed atomically.
 }
 
+// Network sends and receives the Kademlia RPCs. The calls that wait for a
+// response accept a timeout, a zero timeout uses the default of the network.
+// The lookups and stores also accept a deadline of the caller, the call times
+// out at the deadline even if retransmissions remain, a zero deadline is
+// ignored. Timed out calls results in a nil response on the channel. The ReadyCh
+// receives when the network is listening, and the ErrCh if it stops listening
+// on an error.
 type Network interface {
-	Ping(addr net.UDPAddr) (chan *PingResult, []byte, error)
+	Ping(addr net.UDPAddr, timeout time.Duration) (chan *PingResult, []byte, error)
 	Pong(challenge []byte, sessionID SessionID, addr net.UDPAddr) error
-	FindNodes(target node.ID, addr net.UDPAddr) (chan FindResult, error)
-	Store(key store.Key, value string, class StoreClass, addr net.UDPAddr) error
-	FindValue(key store.Key, addr net.UDPAddr) (chan FindResult, error)
-	SendValue(key store.Key, value string, closest []route.Contact, sessionID SessionID, addr net.UDPAddr) error
+	FindNodes(target node.ID, addr net.UDPAddr, timeout time.Duration, deadline time.Time) (chan FindResult, error)
+	Store(key store.Key, explicit bool, value []byte, meta store.Meta, written time.Time, class StoreClass, ttl time.Duration, addr net.UDPAddr, timeout time.Duration, deadline time.Time) error
+	Ack(sessionID SessionID, addr net.UDPAddr) error
+	FindValue(key store.Key, addr net.UDPAddr, timeout time.Duration, deadline time.Time) (chan FindResult, error)
+	HasValue(key store.Key, addr net.UDPAddr, timeout time.Duration, deadline time.Time) (chan FindResult, error)
+	Delete(key store.Key, addr net.UDPAddr) error
+	SendValue(key store.Key, value []byte, meta store.Meta, found bool, closest []route.Contact, sessionID SessionID, addr net.UDPAddr) error
 	SendNodes(closest []route.Contact, sessionID SessionID, addr net.UDPAddr) error
+	GetPeers(count int, addr net.UDPAddr, timeout time.Duration) (chan FindResult, error)
 	FindNodesRequestCh() chan *FindNodesRequest
+	GetPeersRequestCh() chan *GetPeersRequest
 	FindValueRequestCh() chan *FindValueRequest
 	StoreRequestCh() chan *StoreRequest
+	DeleteRequestCh() chan *DeleteRequest
 	PongRequestCh() chan *PongRequest
 	ReadyCh() chan struct{}
+	ErrCh() chan error
+	DroppedRequests() uint64
+	ReadErrors() uint64
+	InFlight() int
+	Signed() bool
 	Listen() error
+	Close() error
 }
 
 type FindResult interface {
 	Closest() []route.Contact
-	Value() string
+	Value() []byte
+	Meta() store.Meta // Metadata of the value, only set for find value results.
+	Found() bool      // The callee held the value, only set for find value results.
 }
 
 type PingResult struct {
@@ -76,15 +323,34 @@ type PingResult struct {
 }
 
 type PongRequest struct {
-	From      route.Contact
-	SessionID SessionID
-	Challenge []byte
+	From       route.Contact
+	SessionID  SessionID
+	Challenge  []byte
+	Advertised net.UDPAddr // Address advertised by the sender, zero if none.
+	Verified   bool        // Signed by the owner of the sender ID.
 }
 
 type StoreRequest struct {
-	Class StoreClass
-	Value string
-	From  route.Contact
+	SessionID  SessionID
+	Class      StoreClass
+	Key        store.Key
+	Value      []byte
+	Meta       store.Meta
+	Written    time.Time // Time the publisher wrote the value, zero if unknown.
+	TTL        time.Duration
+	Explicit   bool // The key was chosen by the publisher, not derived from the value.
+	From       route.Contact
+	Advertised net.UDPAddr // Address advertised by the sender, zero if none.
+	Verified   bool        // Signed by the owner of the sender ID.
+}
+
+type AckResult struct{}
+
+type DeleteRequest struct {
+	Key        store.Key
+	From       route.Contact
+	Advertised net.UDPAddr // Address advertised by the sender, zero if none.
+	Verified   bool        // Signed by the owner of the sender ID.
 }
 
 type FindNodesResult struct {
@@ -95,67 +361,298 @@ type FindValueResult struct {
 	SessionID SessionID
 	closest   []route.Contact
 	Key       store.Key
-	value     string
+	value     []byte
+	meta      store.Meta
+	found     bool
 }
 
 func (r *FindNodesResult) Closest() []route.Contact {
 	return r.closest
 }
 
-func (r *FindNodesResult) Value() string {
-	return ""
+func (r *FindNodesResult) Value() []byte {
+	return nil
+}
+
+func (r *FindNodesResult) Meta() store.Meta {
+	return nil
+}
+
+func (r *FindNodesResult) Found() bool {
+	return false
 }
 
 func (r *FindValueResult) Closest() []route.Contact {
 	return r.closest
 }
 
-func (r *FindValueResult) Value() string {
+func (r *FindValueResult) Value() []byte {
 	return r.value
 }
 
+func (r *FindValueResult) Meta() store.Meta {
+	return r.meta
+}
+
+func (r *FindValueResult) Found() bool {
+	return r.found
+}
+
 type FindNodesRequest struct {
-	SessionID SessionID
-	Target    node.ID
-	From      route.Contact
+	SessionID  SessionID
+	Target     node.ID
+	From       route.Contact
+	Advertised net.UDPAddr // Address advertised by the sender, zero if none.
+	Verified   bool        // Signed by the owner of the sender ID.
+}
+
+// GetPeersRequest asks for a random sample of at most Count contacts of the
+// routing table, answered with SendNodes.
+type GetPeersRequest struct {
+	SessionID  SessionID
+	Count      int
+	From       route.Contact
+	Advertised net.UDPAddr // Address advertised by the sender, zero if none.
+	Verified   bool        // Signed by the owner of the sender ID.
 }
 
 type FindValueRequest struct {
-	Key       store.Key
-	SessionID SessionID
-	From      route.Contact
+	Key        store.Key
+	Exists     bool // Respond without the value if it's held.
+	SessionID  SessionID
+	From       route.Contact
+	Advertised net.UDPAddr // Address advertised by the sender, zero if none.
+	Verified   bool        // Signed by the owner of the sender ID.
+}
+
+func NewUDPNetwork(me route.Contact, config Config) (Network, error) {
+	config = config.withDefaults()
+
+	if err := checkKey(me, config.PrivateKey); err != nil {
+		return nil, err
+	}
+	if err := checkChallengeSize(config.ChallengeSize); err != nil {
+		return nil, err
+	}
+	if err := checkTag(config.Tag); err != nil {
+		return nil, err
+	}
+
+	bind := me.Address
+	if config.ListenAddress != nil {
+		bind = *config.ListenAddress
+	}
+
+	if err := checkAddresses(me.Address, bind, config.ListenAddress != nil); err != nil {
+		return nil, err
+	}
+
+	// Bind the socket up front, so that the caller gets the error instead of
+	// a network that never becomes ready.
+	conn, err := net.ListenUDP("udp", &bind)
+	if err != nil {
+		return nil, fmt.Errorf("cannot bind to %s: %w", bind.String(), err)
+	}
+
+	err = setBuffers(conn, config.ReadBuffer, config.WriteBuffer)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	var tcp *net.TCPListener
+	if !config.DisableTCP {
+		tcp, err = listenTCP(conn)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	n := newNetwork(me, config)
+	n.conn = conn
+	n.tcp = tcp
+	n.port = conn.LocalAddr().(*net.UDPAddr).Port
+	n.advertise = config.ListenAddress != nil
+
+	return n, nil
+}
+
+// checkAddresses returns an error if the bind address, or the advertised
+// address of the local contact, isn't a valid UDP address. Only an advertised
+// address that differs from the bind address must be reachable, i.e. have an
+// IP and a port.
+func checkAddresses(advertised, bind net.UDPAddr, separate bool) error {
+	if err := checkAddress(bind); err != nil {
+		return fmt.Errorf("invalid listen address %s: %w", bind.String(), err)
+	}
+	if !separate {
+		return nil
+	}
+
+	if err := checkAddress(advertised); err != nil {
+		return fmt.Errorf("invalid advertised address %s: %w", advertised.String(), err)
+	}
+	if advertised.IP == nil || advertised.IP.IsUnspecified() {
+		return fmt.Errorf("advertised address %s has no IP", advertised.String())
+	}
+	if advertised.Port == 0 {
+		return fmt.Errorf("advertised address %s has no port", advertised.String())
+	}
+	return nil
+}
+
+// checkAddress returns an error if the IP or the port of the address is
+// malformed.
+func checkAddress(addr net.UDPAddr) error {
+	if addr.IP != nil && len(addr.IP) != net.IPv4len && len(addr.IP) != net.IPv6len {
+		return errors.New("malformed IP")
+	}
+	if addr.Port < 0 || addr.Port > 65535 {
+		return fmt.Errorf("port out of range: %d", addr.Port)
+	}
+	return nil
+}
+
+// checkKey returns an error if the private key is set but invalid, or if the
+// node ID isn't derived from its public key.
+func checkKey(me route.Contact, key ed25519.PrivateKey) error {
+	if key == nil {
+		return nil
+	}
+
+	if len(key) != ed25519.PrivateKeySize {
+		return fmt.Errorf("private key must be %d bytes", ed25519.PrivateKeySize)
+	}
+
+	pub := key.Public().(ed25519.PublicKey)
+	if !me.NodeID.Equal(node.IDFromPublicKey(pub)) {
+		return fmt.Errorf("node ID %v is not derived from the public key", me.NodeID)
+	}
+	return nil
 }
 
-func NewUDPNetwork(me route.Contact) (Network, error) {
+// checkChallengeSize returns an error if the ping challenge is too short to
+// protect against spoofed pongs.
+func checkChallengeSize(size int) error {
+	if size < minChallengeSize {
+		return fmt.Errorf("challenge must be at least %d bytes, got: %d", minChallengeSize, size)
+	}
+	return nil
+}
+
+// newNetwork creates a network without a transport, which is set by the
+// caller.
+func newNetwork(me route.Contact, config Config) *udpNetwork {
 	fvtTicker := time.NewTicker(time.Second)
 	fntTicker := time.NewTicker(time.Second)
 	ptTicker := time.NewTicker(time.Second)
+	stTicker := time.NewTicker(time.Second)
 
 	n := &udpNetwork{
-		me:  me,
-		fvt: newTable(networkTimeout, fvtTicker),
-		fnt: newTable(networkTimeout, fntTicker),
-		pt:  newTable(networkTimeout, ptTicker),
+		me:    me,
+		codec: config.Codec,
+		key:   config.PrivateKey,
+		rc:    newReplayCache(config.ReplayWindow, config.ReplayCacheSize),
+		ra:    newReassembler(config.Timeout),
+		fvt:   newTable(config.Timeout, fvtTicker),
+		fnt:   newTable(config.Timeout, fntTicker),
+		pt:    newTable(config.Timeout, ptTicker),
+		st:    newTable(config.Timeout, stTicker),
+
+		timeout:     config.Timeout,
+		challenge:   config.ChallengeSize,
+		retransmits: config.Retransmits,
+		tcpSize:     config.TCPThreshold,
+		tcpMax:      config.MaxTCPPacketSize,
+		tcpConns:    make(chan struct{}, config.MaxTCPConns),
+		tag:         config.Tag,
+		drain:       config.DrainTimeout,
 	}
 
 	n.fnr = make(chan *FindNodesRequest)
+	n.gpr = make(chan *GetPeersRequest)
 	n.fvr = make(chan *FindValueRequest)
 	n.sr = make(chan *StoreRequest)
+	n.dr = make(chan *DeleteRequest)
 	n.pr = make(chan *PongRequest)
 	n.ready = make(chan struct{})
+	n.errs = make(chan error, 1)
+	n.done = make(chan struct{})
+	n.closing = make(chan struct{})
 
-	return n, nil
+	if config.RateLimit > 0 {
+		n.rl = newRateLimiter(config.RateLimit, config.RateBurst)
+	}
+
+	return n
 }
 
 func (u *udpNetwork) StoreRequestCh() chan *StoreRequest         { return u.sr }
+func (u *udpNetwork) DeleteRequestCh() chan *DeleteRequest       { return u.dr }
 func (u *udpNetwork) FindNodesRequestCh() chan *FindNodesRequest { return u.fnr }
+func (u *udpNetwork) GetPeersRequestCh() chan *GetPeersRequest   { return u.gpr }
 func (u *udpNetwork) FindValueRequestCh() chan *FindValueRequest { return u.fvr }
 func (u *udpNetwork) PongRequestCh() chan *PongRequest           { return u.pr }
 func (u *udpNetwork) ReadyCh() chan struct{}                     { return u.ready }
 
-func (u *udpNetwork) Ping(addr net.UDPAddr) (chan *PingResult, []byte, error) {
+// ErrCh receives the error that stops the network from listening, e.g. if the
+// socket is closed by someone else than Close. Binding errors are returned by
+// NewUDPNetwork instead.
+func (u *udpNetwork) ErrCh() chan error { return u.errs }
+
+// fail reports the error on the ErrCh, the first error is kept if nobody has
+// received it yet.
+func (u *udpNetwork) fail(err error) {
+	select {
+	case u.errs <- err:
+	default:
+	}
+}
+
+// DroppedRequests returns the number of requests that has been dropped for
+// exceeding the rate limit.
+func (u *udpNetwork) DroppedRequests() uint64 {
+	return atomic.LoadUint64(&u.dropped)
+}
+
+// ReadErrors returns the number of reads from the socket that has failed, which
+// are packets lost.
+func (u *udpNetwork) ReadErrors() uint64 {
+	return atomic.LoadUint64(&u.readErrors)
+}
+
+// InFlight returns the number of requests that are waiting for a response.
+// Sessions are removed once answered, or by the sweep of timed out sessions
+// every second.
+func (u *udpNetwork) InFlight() int {
+	return u.fvt.Len() + u.fnt.Len() + u.pt.Len() + u.st.Len()
+}
+
+// Signed returns true if the sent packets are signed, see Config.PrivateKey.
+func (u *udpNetwork) Signed() bool {
+	return u.key != nil
+}
+
+// setBuffers sets the sizes of the socket buffers, sizes of zero are left as
+// the defaults of the OS.
+func setBuffers(conn *net.UDPConn, read, write int) error {
+	if read > 0 {
+		if err := conn.SetReadBuffer(read); err != nil {
+			return fmt.Errorf("cannot set read buffer to %d bytes: %w", read, err)
+		}
+	}
+	if write > 0 {
+		if err := conn.SetWriteBuffer(write); err != nil {
+			return fmt.Errorf("cannot set write buffer to %d bytes: %w", write, err)
+		}
+	}
+	return nil
+}
+
+func (u *udpNetwork) Ping(addr net.UDPAddr, timeout time.Duration) (chan *PingResult, []byte, error) {
 	id := generateID()
-	c := generateChallenge()
+	c := generateChallenge(u.challenge)
 
 	payload := &packet.Ping{
 		Challenge: c,
@@ -166,16 +663,12 @@ func (u *udpNetwork) Ping(addr net.UDPAddr) (chan *PingResult, []byte, error) {
 		Payload:   &packet.Packet_Ping{Ping: payload},
 	}
 
-	err := u.send(addr, *p)
+	result, err := u.request(u.pt, id, addr, p, timeout, time.Time{})
 	if err != nil {
 		return nil, nil, err
 	}
 
-	result := makeResultChan()
-	pingResult := toPingResult(result)
-	u.pt.Put(id, result)
-
-	return pingResult, c, nil
+	return toPingResult(result), c, nil
 }
 
 func (u *udpNetwork) Pong(challenge []byte, sessionID SessionID, addr net.UDPAddr) error {
@@ -188,10 +681,10 @@ func (u *udpNetwork) Pong(challenge []byte, sessionID SessionID, addr net.UDPAdd
 		Payload:   &packet.Packet_Pong{Pong: payload},
 	}
 
-	return u.send(addr, *p)
+	return u.send(addr, p)
 }
 
-func (u *udpNetwork) FindNodes(target node.ID, addr net.UDPAddr) (chan FindResult, error) {
+func (u *udpNetwork) FindNodes(target node.ID, addr net.UDPAddr, timeout time.Duration, deadline time.Time) (chan FindResult, error) {
 	id := generateID()
 
 	payload := &packet.FindNode{
@@ -203,24 +696,53 @@ func (u *udpNetwork) FindNodes(target node.ID, addr net.UDPAddr) (chan FindResul
 		Payload:   &packet.Packet_FindNode{FindNode: payload},
 	}
 
-	result := makeResultChan()
-	findResult := toFindResult(result)
-	u.fnt.Put(id, result)
+	result, err := u.request(u.fnt, id, addr, p, timeout, deadline)
+	if err != nil {
+		return nil, err
+	}
+
+	return toFindResult(result), nil
+}
+
+// GetPeers asks the callee for a random sample of at most count contacts of its
+// routing table. The response is received like the response to FindNodes, the
+// callee might respond with fewer contacts than requested.
+func (u *udpNetwork) GetPeers(count int, addr net.UDPAddr, timeout time.Duration) (chan FindResult, error) {
+	id := generateID()
 
-	err := u.send(addr, *p)
+	payload := &packet.GetPeers{
+		Count: uint32(count),
+	}
+	p := &packet.Packet{
+		SessionId: id[:],
+		SenderId:  u.me.NodeID.Bytes(),
+		Payload:   &packet.Packet_GetPeers{GetPeers: payload},
+	}
+
+	result, err := u.request(u.fnt, id, addr, p, timeout, time.Time{})
 	if err != nil {
 		return nil, err
 	}
 
-	return findResult, nil
+	return toFindResult(result), nil
 }
 
-func (u *udpNetwork) Store(key store.Key, value string, class StoreClass, addr net.UDPAddr) error {
+// Store sends a store request and waits until the callee acknowledges it, an
+// error wrapping ErrTimeout is returned if it never does. The write time of the
+// publisher is sent with the value, a zero time if unknown. Explicit marks a key
+// chosen by the publisher, otherwise the callee expects the key to be derived
+// from the value.
+func (u *udpNetwork) Store(key store.Key, explicit bool, value []byte, meta store.Meta, written time.Time, class StoreClass, ttl time.Duration, addr net.UDPAddr, timeout time.Duration, deadline time.Time) error {
 	id := generateID()
 
 	payload := &packet.Store{
-		Class: class,
-		Value: value,
+		Class:    class,
+		Key:      key[:],
+		Value:    value,
+		Ttl:      int64(ttl),
+		Meta:     toMetaEntries(meta),
+		Written:  toUnixNano(written),
+		Explicit: explicit,
 	}
 	p := &packet.Packet{
 		SessionId: id[:],
@@ -228,14 +750,44 @@ func (u *udpNetwork) Store(key store.Key, value string, class StoreClass, addr n
 		Payload:   &packet.Packet_Store{Store: payload},
 	}
 
-	return u.send(addr, *p)
+	result, err := u.request(u.st, id, addr, p, timeout, deadline)
+	if err != nil {
+		return err
+	}
+
+	if r := <-result; r == nil {
+		return fmt.Errorf("store acknowledgment from: %v: %w", addr.String(), ErrTimeout)
+	}
+	return nil
+}
+
+// Ack acknowledges the store request with the session ID.
+func (u *udpNetwork) Ack(sessionID SessionID, addr net.UDPAddr) error {
+	p := &packet.Packet{
+		SessionId: sessionID[:],
+		SenderId:  u.me.NodeID.Bytes(),
+		Payload:   &packet.Packet_Ack{Ack: &packet.Ack{}},
+	}
+
+	return u.send(addr, p)
+}
+
+func (u *udpNetwork) FindValue(key store.Key, addr net.UDPAddr, timeout time.Duration, deadline time.Time) (chan FindResult, error) {
+	return u.findValue(key, false, addr, timeout, deadline)
+}
+
+// HasValue sends a find value request like FindValue, where a callee that holds
+// the value only responds that it's found, without the value.
+func (u *udpNetwork) HasValue(key store.Key, addr net.UDPAddr, timeout time.Duration, deadline time.Time) (chan FindResult, error) {
+	return u.findValue(key, true, addr, timeout, deadline)
 }
 
-func (u *udpNetwork) FindValue(key store.Key, addr net.UDPAddr) (chan FindResult, error) {
+func (u *udpNetwork) findValue(key store.Key, exists bool, addr net.UDPAddr, timeout time.Duration, deadline time.Time) (chan FindResult, error) {
 	id := generateID()
 
 	payload := &packet.FindValue{
-		Key: key[:],
+		Key:    key[:],
+		Exists: exists,
 	}
 	p := &packet.Packet{
 		SessionId: id[:],
@@ -243,31 +795,124 @@ func (u *udpNetwork) FindValue(key store.Key, addr net.UDPAddr) (chan FindResult
 		Payload:   &packet.Packet_FindValue{FindValue: payload},
 	}
 
+	result, err := u.request(u.fvt, id, addr, p, timeout, deadline)
+	if err != nil {
+		return nil, err
+	}
+
+	return toFindResult(result), nil
+}
+
+// request sends a packet that expects a response with the same session ID.
+// The packet is retransmitted with exponential backoff while unanswered, the
+// session times out once every attempt has been waited for, or at the deadline
+// if it's earlier.
+func (u *udpNetwork) request(t *table, id SessionID, addr net.UDPAddr, p *packet.Packet, timeout time.Duration, deadline time.Time) (chan interface{}, error) {
+	if u.stopping() {
+		return nil, fmt.Errorf("request to: %v: %w", addr.String(), ErrClosed)
+	}
+
+	if timeout <= 0 {
+		timeout = u.timeout
+	}
+
+	// Wait for the original request and every retransmission, e.g. 1+2+4
+	// times the timeout for two retransmissions.
+	total := timeout * time.Duration(1<<uint(u.retransmits+1)-1)
+
+	if !deadline.IsZero() {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, fmt.Errorf("deadline passed before request to: %v: %w", addr.String(), ErrTimeout)
+		}
+		if remaining < total {
+			total = remaining
+		}
+	}
+
+	// The challenge of a ping is kept with the session, so that pongs that
+	// doesn't echo it can be dropped. If the session ID is already in use by a
+	// pending session a new ID is generated for the request, as the responses
+	// would otherwise be delivered to the wrong waiter. The pending session is
+	// left untouched.
 	result := makeResultChan()
-	findResult := toFindResult(result)
-	u.fvt.Put(id, result)
+	for attempt := 1; !t.PutChallenge(id, result, total, p.GetPing().GetChallenge()); attempt++ {
+		if attempt == sessionAttempts {
+			return nil, fmt.Errorf("no unused session ID for request to: %v", addr.String())
+		}
+
+		log.Warn().Msgf("Session ID already in use, generating a new one (ID: %v)", id)
+		id = generateID()
+		p.SessionId = id[:]
+	}
 
-	err := u.send(addr, *p)
+	err := u.send(addr, p)
 	if err != nil {
+		t.Remove(id)
 		return nil, err
 	}
 
-	return findResult, nil
+	if u.retransmits > 0 {
+		go u.retransmit(t, id, addr, *p, timeout)
+	}
+
+	return result, nil
 }
 
-func (u *udpNetwork) SendValue(key store.Key, value string, closest []route.Contact, sessionID SessionID, addr net.UDPAddr) error {
-	var nodes []*packet.NodeInfo
-	var contacts []route.Contact
+// retransmit resends the packet until the session is answered, or timed out,
+// or every retransmission has been sent.
+func (u *udpNetwork) retransmit(t *table, id SessionID, addr net.UDPAddr, p packet.Packet, wait time.Duration) {
+	for attempt := 1; attempt <= u.retransmits; attempt++ {
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-u.done:
+			timer.Stop()
+			return
+		}
+
+		if _, ok := t.Get(id); !ok {
+			return // Answered or timed out.
+		}
 
-	contacts = append(contacts, closest...)
+		log.Debug().Msgf("Retransmitting request (ID: %v, attempt: %d)", id, attempt)
 
-	for _, c := range contacts {
-		p := &packet.NodeInfo{
-			NodeId: c.NodeID.Bytes(),
-			Ip:     c.Address.IP,
-			Port:   uint32(c.Address.Port),
+		p.Attempt = uint32(attempt)
+		if err := u.send(addr, &p); err != nil {
+			log.Error().Err(err).Msgf("Retransmission failed for: %v", addr.String())
+			return
 		}
-		nodes = append(nodes, p)
+
+		wait *= 2
+	}
+}
+
+func (u *udpNetwork) Delete(key store.Key, addr net.UDPAddr) error {
+	if u.stopping() {
+		return fmt.Errorf("delete request to: %v: %w", addr.String(), ErrClosed)
+	}
+
+	id := generateID()
+
+	payload := &packet.Delete{
+		Key: key[:],
+	}
+	p := &packet.Packet{
+		SessionId: id[:],
+		SenderId:  u.me.NodeID.Bytes(),
+		Payload:   &packet.Packet_Delete{Delete: payload},
+	}
+
+	return u.send(addr, p)
+}
+
+// SendValue responds to a find value request, with the value if found and
+// otherwise the closest contacts. A node without any contacts still responds
+// with found set to false.
+func (u *udpNetwork) SendValue(key store.Key, value []byte, meta store.Meta, found bool, closest []route.Contact, sessionID SessionID, addr net.UDPAddr) error {
+	var nodes []*packet.NodeInfo
+	for _, c := range closest {
+		nodes = append(nodes, toNodeInfo(c))
 	}
 
 	internalPayload := &packet.NodeList{
@@ -278,6 +923,8 @@ func (u *udpNetwork) SendValue(key store.Key, value string, closest []route.Cont
 		Key:      key[:],
 		Value:    value,
 		NodeList: internalPayload,
+		Found:    found,
+		Meta:     toMetaEntries(meta),
 	}
 	p := &packet.Packet{
 		SessionId: sessionID[:],
@@ -285,7 +932,7 @@ func (u *udpNetwork) SendValue(key store.Key, value string, closest []route.Cont
 		Payload:   &packet.Packet_Value{Value: payload},
 	}
 
-	err := u.send(addr, *p)
+	err := u.send(addr, p)
 	if err != nil {
 		return err
 	}
@@ -297,12 +944,7 @@ func (u *udpNetwork) SendNodes(closest []route.Contact, sessionID SessionID, add
 	var nodes []*packet.NodeInfo
 
 	for _, c := range closest {
-		p := &packet.NodeInfo{
-			NodeId: c.NodeID.Bytes(),
-			Ip:     c.Address.IP,
-			Port:   uint32(c.Address.Port),
-		}
-		nodes = append(nodes, p)
+		nodes = append(nodes, toNodeInfo(c))
 	}
 
 	payload := &packet.NodeList{
@@ -315,7 +957,7 @@ func (u *udpNetwork) SendNodes(closest []route.Contact, sessionID SessionID, add
 		Payload:   &packet.Packet_NodeList{NodeList: payload},
 	}
 
-	err := u.send(addr, *p)
+	err := u.send(addr, p)
 	if err != nil {
 		return err
 	}
@@ -323,17 +965,27 @@ func (u *udpNetwork) SendNodes(closest []route.Contact, sessionID SessionID, add
 	return nil
 }
 
+// Listen reads packets from the socket bound by NewUDPNetwork until the network
+// is closed.
 func (u *udpNetwork) Listen() (err error) {
+	if u.mock != nil || u.mux != nil {
+		return u.listenInbox()
+	}
+
 	log.Info().Msgf("Listening for UDP packets on: %s", u.me.Address.String())
 
-	u.conn, err = net.ListenUDP("udp", &u.me.Address)
-	if err != nil {
-		return err
-	}
 	defer u.conn.Close()
 
+	if u.tcp != nil {
+		go u.acceptTCP()
+	}
+
 	// Notify everyone that we're ready.
-	u.ready <- struct{}{}
+	select {
+	case u.ready <- struct{}{}:
+	case <-u.done:
+		return nil
+	}
 
 	// Reusable buffer, can be used between every read loop as it will be copied
 	// before sending the data to the packet handler.
@@ -343,6 +995,16 @@ func (u *udpNetwork) Listen() (err error) {
 		n, addr, err := u.conn.ReadFromUDP(buffer)
 
 		if err != nil {
+			if u.closed() {
+				return nil // Socket closed by Close.
+			}
+			if errors.Is(err, net.ErrClosed) {
+				err = fmt.Errorf("socket closed while listening: %w", err)
+				u.fail(err)
+				return err
+			}
+			atomic.AddUint64(&u.readErrors, 1)
+
 			log.Error().Err(err).Msgf("Error when reading from UDP from address %v: %s", addr, err)
 			continue
 		}
@@ -351,7 +1013,75 @@ func (u *udpNetwork) Listen() (err error) {
 		rawPacket := make([]byte, n)
 		copy(rawPacket, buffer)
 
-		go u.handlePacket(rawPacket, *addr)
+		go u.handleDatagram(rawPacket, *addr, false)
+	}
+}
+
+// Close refuses new requests and waits, at most the drain timeout, for the
+// pending requests to be answered or time out while the replies are still
+// received. It then stops listening for packets, closes the sockets and signals
+// every request that is still pending as timed out. Closing the network again
+// returns ErrClosed.
+func (u *udpNetwork) Close() (err error) {
+	err = ErrClosed
+	u.closeOnce.Do(func() {
+		err = u.close()
+	})
+	return
+}
+
+func (u *udpNetwork) close() error {
+	close(u.closing)
+	u.waitDrained()
+
+	close(u.done)
+
+	u.fnt.close()
+	u.fvt.close()
+	u.pt.close()
+	u.st.close()
+
+	if u.tcp != nil {
+		u.tcp.Close()
+	}
+	if u.mock != nil {
+		u.mock.detach(u)
+		return nil
+	}
+	if u.mux != nil {
+		u.mux.detach(u) // The socket is closed by the mux.
+		return nil
+	}
+	return u.conn.Close()
+}
+
+// waitDrained waits until no request is pending, or until the drain timeout
+// has passed.
+func (u *udpNetwork) waitDrained() {
+	deadline := time.Now().Add(u.drain)
+	for u.InFlight() > 0 && time.Now().Before(deadline) {
+		time.Sleep(drainPoll)
+	}
+}
+
+// stopping returns true once Close has been called, while the pending requests
+// are drained and after the network is closed.
+func (u *udpNetwork) stopping() bool {
+	select {
+	case <-u.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+// closed returns true if the network has been closed.
+func (u *udpNetwork) closed() bool {
+	select {
+	case <-u.done:
+		return true
+	default:
+		return false
 	}
 }
 
@@ -359,15 +1089,79 @@ func logChannelNotFound(id SessionID) {
 	log.Warn().Msgf("Channel with ID: %x not found in table", id)
 }
 
-func (u *udpNetwork) handlePacket(b []byte, addr net.UDPAddr) {
-	p := &packet.Packet{}
-	err := proto.Unmarshal(b, p)
+// handleDatagram handles a received datagram, or TCP transfer, if it's tagged
+// with the tag of the network. Limited is set if the packet has already been
+// counted by the rate limiter, e.g. before a TCP transfer was read.
+func (u *udpNetwork) handleDatagram(b []byte, addr net.UDPAddr, limited bool) {
+	p, ok := unframe(u.tag, b)
+	if !ok {
+		log.Debug().Msgf("Dropping packet of another tag from: %v", addr.String())
+		return
+	}
+	u.handlePacket(p, addr, limited)
+}
+
+func (u *udpNetwork) handlePacket(b []byte, addr net.UDPAddr, limited bool) {
+	p, err := u.codec.Unmarshal(b)
 	if err != nil {
 		log.Error().Err(err).Msg("Error unserializing packet")
 
 		return
 	}
 
+	if chunk := p.GetChunk(); chunk != nil {
+		var sessionID SessionID
+		copy(sessionID[:], p.GetSessionId())
+
+		b, complete, err := u.ra.add(addr.String(), sessionID, chunk)
+		if err != nil {
+			log.Error().Err(err).Msgf("Dropping chunk from: %v", addr.String())
+			return
+		}
+		if complete {
+			u.handlePacket(b, addr, limited)
+		}
+		return
+	}
+
+	switch p.Payload.(type) {
+	case *packet.Packet_FindValue, *packet.Packet_Ping, *packet.Packet_FindNode,
+		*packet.Packet_Store, *packet.Packet_Delete, *packet.Packet_GetPeers:
+		// Limit the requests before any expensive processing.
+		if !limited && u.rl != nil && !u.rl.allow(addr.IP.String()) {
+			atomic.AddUint64(&u.dropped, 1)
+			return
+		}
+
+		var sessionID SessionID
+		copy(sessionID[:], p.GetSessionId())
+
+		senderID, err := node.IDFromBytes(p.GetSenderId())
+		if err != nil {
+			log.Warn().Err(err).Msgf("Dropping request with invalid sender ID from: %v", addr.String())
+			return
+		}
+
+		if u.rc.seen(senderID, sessionID, p.GetAttempt()) {
+			log.Warn().Msgf("Dropping replayed request from: %v (ID: %v)", addr.String(), sessionID)
+			return
+		}
+	}
+
+	verified := verify(p)
+
+	// The address advertised by the sender, e.g. behind NAT, is passed on
+	// next to the source address. Replies are always sent to the source
+	// address, so that a spoofed advertised address can't redirect them.
+	var advertised net.UDPAddr
+	if ip := net.IP(p.GetAdvertisedIp()); p.GetAdvertisedPort() != 0 {
+		if len(ip) != net.IPv4len && len(ip) != net.IPv6len || p.GetAdvertisedPort() > 65535 {
+			log.Warn().Msgf("Dropping packet with invalid advertised address from: %v", addr.String())
+			return
+		}
+		advertised = net.UDPAddr{IP: ip, Port: int(p.GetAdvertisedPort()), Zone: addr.Zone}
+	}
+
 	switch p.Payload.(type) {
 	case *packet.Packet_Value:
 		var sessionID SessionID
@@ -378,18 +1172,9 @@ func (u *udpNetwork) handlePacket(b []byte, addr net.UDPAddr) {
 		copy(senderID[:], p.SenderId)
 		copy(key[:], p.GetValue().Key)
 
-		for _, contact := range p.GetValue().GetNodeList().GetNodes() {
-			closest = append(closest, route.Contact{
-				NodeID: node.IDFromBytes(contact.NodeId),
-				Address: net.UDPAddr{
-					IP:   contact.Ip,
-					Port: int(contact.Port),
-					Zone: "",
-				},
-			})
-		}
+		closest = fromNodeInfos(p.GetValue().GetNodeList().GetNodes())
 
-		ch, ok := u.fvt.Get(sessionID)
+		ch, ok := u.fvt.Take(sessionID)
 		if !ok {
 			logChannelNotFound(sessionID)
 			return
@@ -400,10 +1185,10 @@ func (u *udpNetwork) handlePacket(b []byte, addr net.UDPAddr) {
 			closest:   closest,
 			Key:       key,
 			value:     p.GetValue().Value,
+			meta:      fromMetaEntries(p.GetValue().GetMeta()),
+			found:     p.GetValue().Found,
 		}
 
-		u.fvt.Remove(sessionID)
-
 	case *packet.Packet_NodeList:
 		var sessionID SessionID
 		var senderID node.ID
@@ -411,18 +1196,9 @@ func (u *udpNetwork) handlePacket(b []byte, addr net.UDPAddr) {
 		copy(sessionID[:], p.SessionId)
 		copy(senderID[:], p.SenderId)
 
-		for _, contact := range p.GetNodeList().GetNodes() {
-			closest = append(closest, route.Contact{
-				NodeID: node.IDFromBytes(contact.NodeId),
-				Address: net.UDPAddr{
-					IP:   contact.Ip,
-					Port: int(contact.Port),
-					Zone: "",
-				},
-			})
-		}
+		closest = fromNodeInfos(p.GetNodeList().GetNodes())
 
-		ch, ok := u.fnt.Get(sessionID)
+		ch, ok := u.fnt.Take(sessionID)
 		if !ok {
 			logChannelNotFound(sessionID)
 			return
@@ -432,8 +1208,6 @@ func (u *udpNetwork) handlePacket(b []byte, addr net.UDPAddr) {
 			closest: closest,
 		}
 
-		u.fnt.Remove(sessionID)
-
 	case *packet.Packet_FindValue:
 		var key store.Key
 		var senderID node.ID
@@ -442,16 +1216,25 @@ func (u *udpNetwork) handlePacket(b []byte, addr net.UDPAddr) {
 		copy(senderID[:], p.GetSenderId())
 		copy(sessionID[:], p.GetSessionId())
 
-		u.fvr <- &FindValueRequest{
+		request := &FindValueRequest{
 			Key:       key,
+			Exists:    p.GetFindValue().GetExists(),
 			SessionID: sessionID,
 			From: route.Contact{
 				NodeID: senderID,
 				Address: net.UDPAddr{
 					IP:   addr.IP,
 					Port: addr.Port,
+					Zone: addr.Zone, // Required to reply to link-local IPv6 addresses.
 				},
 			},
+			Advertised: advertised,
+			Verified:   verified,
+		}
+
+		select {
+		case u.fvr <- request:
+		case <-u.done:
 		}
 
 	case *packet.Packet_Ping:
@@ -460,33 +1243,68 @@ func (u *udpNetwork) handlePacket(b []byte, addr net.UDPAddr) {
 		copy(senderID[:], p.GetSenderId())
 		copy(sessionID[:], p.GetSessionId())
 
-		u.pr <- &PongRequest{
+		request := &PongRequest{
 			From: route.Contact{
 				NodeID: senderID,
 				Address: net.UDPAddr{
 					IP:   addr.IP,
 					Port: addr.Port,
+					Zone: addr.Zone, // Required to reply to link-local IPv6 addresses.
 				},
 			},
-			SessionID: sessionID,
-			Challenge: p.GetPing().GetChallenge(),
+			SessionID:  sessionID,
+			Challenge:  p.GetPing().GetChallenge(),
+			Advertised: advertised,
+			Verified:   verified,
+		}
+
+		select {
+		case u.pr <- request:
+		case <-u.done:
 		}
 
 	case *packet.Packet_Pong:
 		var sessionID SessionID
 		copy(sessionID[:], p.GetSessionId())
 
-		ch, ok := u.pt.Get(sessionID)
+		_, challenge, ok := u.pt.GetChallenge(sessionID)
 		if !ok {
 			logChannelNotFound(sessionID)
 			return
 		}
 
+		// Drop pongs with a mismatched or missing challenge, e.g. spoofed by
+		// an off-path attacker, and keep waiting for the real pong.
+		if len(p.GetPong().GetChallenge()) != len(challenge) {
+			log.Warn().Msgf("Dropping pong with a %d byte challenge from: %v (ID: %v), expected %d bytes",
+				len(p.GetPong().GetChallenge()), addr.String(), sessionID, len(challenge))
+			return
+		}
+		if !bytes.Equal(challenge, p.GetPong().GetChallenge()) {
+			log.Warn().Msgf("Dropping pong with mismatched challenge from: %v (ID: %v)", addr.String(), sessionID)
+			return
+		}
+
+		ch, ok := u.pt.Take(sessionID)
+		if !ok {
+			return // Answered by a duplicate pong, or timed out.
+		}
+
 		ch <- &PingResult{
 			Challenge: p.GetPong().GetChallenge(),
 		}
 
-		u.pt.Remove(sessionID)
+	case *packet.Packet_Ack:
+		var sessionID SessionID
+		copy(sessionID[:], p.GetSessionId())
+
+		ch, ok := u.st.Take(sessionID)
+		if !ok {
+			logChannelNotFound(sessionID)
+			return
+		}
+
+		ch <- &AckResult{}
 
 	case *packet.Packet_FindNode:
 		var sessionID SessionID
@@ -496,7 +1314,7 @@ func (u *udpNetwork) handlePacket(b []byte, addr net.UDPAddr) {
 		copy(senderID[:], p.GetSenderId())
 		copy(targetID[:], p.GetFindNode().NodeId)
 
-		u.fnr <- &FindNodesRequest{
+		request := &FindNodesRequest{
 			SessionID: sessionID,
 			Target:    targetID,
 			From: route.Contact{
@@ -504,26 +1322,111 @@ func (u *udpNetwork) handlePacket(b []byte, addr net.UDPAddr) {
 				Address: net.UDPAddr{
 					IP:   addr.IP,
 					Port: addr.Port,
+					Zone: addr.Zone, // Required to reply to link-local IPv6 addresses.
 				},
 			},
+			Advertised: advertised,
+			Verified:   verified,
+		}
+
+		select {
+		case u.fnr <- request:
+		case <-u.done:
+		}
+
+	case *packet.Packet_GetPeers:
+		var sessionID SessionID
+		var senderID node.ID
+		copy(sessionID[:], p.GetSessionId())
+		copy(senderID[:], p.GetSenderId())
+
+		request := &GetPeersRequest{
+			SessionID: sessionID,
+			Count:     int(p.GetGetPeers().GetCount()),
+			From: route.Contact{
+				NodeID: senderID,
+				Address: net.UDPAddr{
+					IP:   addr.IP,
+					Port: addr.Port,
+					Zone: addr.Zone, // Required to reply to link-local IPv6 addresses.
+				},
+			},
+			Advertised: advertised,
+			Verified:   verified,
+		}
+
+		select {
+		case u.gpr <- request:
+		case <-u.done:
 		}
 
 	case *packet.Packet_Store:
+		var sessionID SessionID
 		var senderID node.ID
+		copy(sessionID[:], p.GetSessionId())
 		copy(senderID[:], p.GetSenderId())
 		value := p.GetStore().Value
 		class := p.GetStore().Class
+		ttl := time.Duration(p.GetStore().Ttl)
+
+		// The key is decoupled from the value to allow explicitly keyed
+		// values, stores without a key are keyed by the hash of the value.
+		var key store.Key
+		if k := p.GetStore().Key; len(k) > 0 {
+			copy(key[:], k)
+		} else {
+			key = store.KeyFromBytes(value)
+		}
 
-		u.sr <- &StoreRequest{
-			Class: class,
-			Value: value,
+		request := &StoreRequest{
+			SessionID: sessionID,
+			Class:     class,
+			Key:       key,
+			Value:     value,
+			Meta:      fromMetaEntries(p.GetStore().GetMeta()),
+			Written:   fromUnixNano(p.GetStore().GetWritten()),
+			TTL:       ttl,
+			Explicit:  p.GetStore().GetExplicit(),
 			From: route.Contact{
 				NodeID: senderID,
 				Address: net.UDPAddr{
 					IP:   addr.IP,
 					Port: addr.Port,
+					Zone: addr.Zone, // Required to reply to link-local IPv6 addresses.
 				},
 			},
+			Advertised: advertised,
+			Verified:   verified,
+		}
+
+		select {
+		case u.sr <- request:
+		case <-u.done:
+		}
+
+	case *packet.Packet_Delete:
+		var senderID node.ID
+		var key store.Key
+		copy(senderID[:], p.GetSenderId())
+		copy(key[:], p.GetDelete().Key)
+
+		request := &DeleteRequest{
+			Key: key,
+			From: route.Contact{
+				NodeID: senderID,
+				Address: net.UDPAddr{
+					IP:   addr.IP,
+					Port: addr.Port,
+					Zone: addr.Zone, // Required to reply to link-local IPv6 addresses.
+				},
+			},
+			Advertised: advertised,
+			Verified:   verified,
+		}
+
+		select {
+		case u.dr <- request:
+		case <-u.done:
 		}
 
 	default:
@@ -531,6 +1434,94 @@ func (u *udpNetwork) handlePacket(b []byte, addr net.UDPAddr) {
 	}
 }
 
+// toMetaEntries encodes the metadata, ordered by key so that the encoding is
+// deterministic.
+func toMetaEntries(meta store.Meta) (entries []*packet.MetaEntry) {
+	keys := make([]string, 0, len(meta))
+	for k := range meta {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		entries = append(entries, &packet.MetaEntry{Key: k, Value: meta[k]})
+	}
+	return
+}
+
+// fromMetaEntries decodes the metadata, nil if there are no entries.
+func fromMetaEntries(entries []*packet.MetaEntry) store.Meta {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	meta := make(store.Meta, len(entries))
+	for _, e := range entries {
+		meta[e.GetKey()] = e.GetValue()
+	}
+	return meta
+}
+
+// toUnixNano encodes the time in Unix nanoseconds, zero if the time is zero.
+func toUnixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// fromUnixNano decodes the time from Unix nanoseconds, the zero time if zero.
+func fromUnixNano(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+// toNodeInfo encodes the contact, IPv4 addresses are encoded as 4 bytes and
+// IPv6 addresses as 16 bytes.
+func toNodeInfo(c route.Contact) *packet.NodeInfo {
+	ip := c.Address.IP
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	return &packet.NodeInfo{
+		NodeId: c.NodeID.Bytes(),
+		Ip:     ip,
+		Port:   uint32(c.Address.Port),
+	}
+}
+
+// fromNodeInfos decodes the contacts, contacts with a malformed node ID or
+// address, i.e. neither an IPv4 nor an IPv6 address, are dropped. The zone of link-local
+// addresses is only meaningful to the sender and is therefore never included.
+func fromNodeInfos(nodes []*packet.NodeInfo) (contacts []route.Contact) {
+	for _, n := range nodes {
+		if l := len(n.Ip); l != 0 && l != net.IPv4len && l != net.IPv6len {
+			log.Warn().Msgf("Dropping contact with invalid IP address: %v", n.Ip)
+			continue
+		}
+
+		id, err := node.IDFromBytes(n.NodeId)
+		if err != nil {
+			log.Warn().Err(err).Msg("Dropping contact with invalid node ID")
+			continue
+		}
+
+		contacts = append(contacts, route.Contact{
+			NodeID: id,
+			Address: net.UDPAddr{
+				IP:   net.IP(n.Ip),
+				Port: int(n.Port),
+			},
+		})
+	}
+	return
+}
+
+// generateID returns a random session ID, read from crypto/rand unless the
+// source is replaced.
 func generateID() (id SessionID) {
 	_, err := rng(id[:])
 	if err != nil {
@@ -539,24 +1530,140 @@ func generateID() (id SessionID) {
 	return id
 }
 
-func generateChallenge() []byte {
-	c := make([]byte, Size256)
-	_, err := rng(c)
+// generateChallenge returns a challenge of the size read from crypto/rand, and
+// not from the replaceable source of the session IDs, as the challenge must be
+// unpredictable.
+func generateChallenge(size int) []byte {
+	c := make([]byte, size)
+	_, err := rand.Read(c)
 	if err != nil {
 		panic(err)
 	}
 	return c
 }
 
-func (u *udpNetwork) send(addr net.UDPAddr, packet packet.Packet) error {
-	b, err := proto.Marshal(&packet)
+// sign adds the public key and a signature over the packet, if the network has
+// a private key.
+func (u *udpNetwork) sign(p *packet.Packet) error {
+	if u.key == nil {
+		return nil
+	}
+
+	p.PublicKey = u.key.Public().(ed25519.PublicKey)
+	p.Signature = nil
+
+	b, err := proto.Marshal(p)
 	if err != nil {
+		return withCause(ErrEncode, "cannot marshal packet for signing", err)
+	}
+
+	p.Signature = ed25519.Sign(u.key, b)
+	return nil
+}
+
+// verify returns true if the packet is signed by the private key of the public
+// key that the sender ID is derived from.
+func verify(p *packet.Packet) bool {
+	pub := p.GetPublicKey()
+	sig := p.GetSignature()
+	if len(pub) != ed25519.PublicKeySize || len(sig) != ed25519.SignatureSize {
+		return false
+	}
+
+	id, err := node.IDFromBytes(p.GetSenderId())
+	if err != nil || !id.Equal(node.IDFromPublicKey(pub)) {
+		return false
+	}
+
+	// The signature is made over the packet without the signature.
+	p.Signature = nil
+	b, err := proto.Marshal(p)
+	p.Signature = sig
+	if err != nil {
+		return false
+	}
+
+	return ed25519.Verify(pub, b, sig)
+}
+
+// send signs and encodes the packet, and writes it to the address with the
+// socket bound by NewUDPNetwork, which is shared by every call.
+func (u *udpNetwork) send(addr net.UDPAddr, p *packet.Packet) error {
+	if u.advertise {
+		ip := u.me.Address.IP
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		p.AdvertisedIp = ip
+		p.AdvertisedPort = uint32(u.me.Address.Port)
+	}
+
+	if err := u.sign(p); err != nil {
 		return err
 	}
-	_, err = u.conn.WriteTo(b, &addr)
+
+	b, err := u.codec.Marshal(p)
 	if err != nil {
 		return err
 	}
+
+	if u.tcp != nil && len(b) > u.tcpSize {
+		err = u.sendTCP(addr, b)
+		if err == nil {
+			return nil
+		}
+		log.Warn().Err(err).Msgf("TCP transfer to: %v failed, falling back to UDP", addr.String())
+	}
+
+	if len(b) > maxPacketSize {
+		return u.sendChunks(addr, b)
+	}
+
+	return u.write(b, addr)
+}
+
+// write writes an encoded packet, of at most maxPacketSize bytes, to the socket
+// or the mock, tagged with the tag of the network.
+func (u *udpNetwork) write(b []byte, addr net.UDPAddr) error {
+	b = frame(u.tag, b)
+
+	if u.mock != nil {
+		u.mock.deliver(u.me.Address, b, addr)
+		return nil
+	}
+
+	_, err := u.conn.WriteToUDP(b, &addr)
+	if err != nil {
+		return withCause(ErrUnreachable, addr.String(), err)
+	}
+	return nil
+}
+
+// sendChunks splits an encoded packet that is too large for one datagram into
+// chunks, the receiver reassembles the packet before handling it.
+func (u *udpNetwork) sendChunks(addr net.UDPAddr, b []byte) error {
+	chunks, err := split(b)
+	if err != nil {
+		return withCause(ErrEncode, "", err)
+	}
+
+	id := generateID()
+	for _, chunk := range chunks {
+		p := &packet.Packet{
+			SessionId: id[:],
+			SenderId:  u.me.NodeID.Bytes(),
+			Payload:   &packet.Packet_Chunk{Chunk: chunk},
+		}
+
+		c, err := u.codec.Marshal(p)
+		if err != nil {
+			return err
+		}
+
+		if err := u.write(c, addr); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -2,16 +2,25 @@ package network
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 	stdlog "log"
 	"net"
 	"os"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ed25519"
 
 	"github.com/optmzr/d7024e-dht/node"
+	"github.com/optmzr/d7024e-dht/packet"
 	"github.com/optmzr/d7024e-dht/route"
 	"github.com/optmzr/d7024e-dht/store"
 )
@@ -64,10 +73,10 @@ func init() {
 		Address: *mAddr,
 	}
 
-	n, err = NewUDPNetwork(nNode)
+	n, err = NewUDPNetwork(nNode, Config{})
 	panicOnErr(err)
 
-	m, err = NewUDPNetwork(mNode)
+	m, err = NewUDPNetwork(mNode, Config{})
 	panicOnErr(err)
 
 	go func(n Network) {
@@ -84,6 +93,14 @@ func init() {
 	<-m.ReadyCh()
 }
 
+// useRNG generates the session IDs with r until the test is finished, the
+// previous generator is then restored.
+func useRNG(t *testing.T, r randRead) {
+	old := rng
+	rng = r
+	t.Cleanup(func() { rng = old })
+}
+
 func nextFakeID(a []byte) randRead {
 	return func(b []byte) (int, error) {
 		copy(b, a)
@@ -95,7 +112,7 @@ func TestFindValue_value(t *testing.T) {
 	rng = nextFakeID([]byte{1})
 
 	// Send a FindValue request to a node at mNode
-	ch, err := n.FindValue(store.Key{}, *mAddr)
+	ch, err := n.FindValue(store.Key{}, *mAddr, 0, time.Time{})
 	if err != nil {
 		t.Error(err)
 	}
@@ -109,7 +126,8 @@ func TestFindValue_value(t *testing.T) {
 	}
 
 	// Respond to a FindValue request with a value.
-	err = m.SendValue(store.Key{}, value, contacts, SessionID{1}, *nAddr)
+	meta := store.Meta{"content-type": "text/plain", "tag": "poem"}
+	err = m.SendValue(store.Key{}, []byte(value), meta, false, contacts, SessionID{1}, *nAddr)
 	if err != nil {
 		t.Error(err)
 	}
@@ -123,23 +141,85 @@ func TestFindValue_value(t *testing.T) {
 		t.Errorf("unexpected number of contacts in closest, got: %v, exp: 5", r.Closest())
 	}
 
-	res := r.Value()
+	if r.Found() {
+		t.Error("unexpected found flag in response with closest contacts")
+	}
+
+	if len(r.Meta()) != 2 || r.Meta()["content-type"] != "text/plain" {
+		t.Errorf("unexpected metadata, got: %v, exp: %v", r.Meta(), meta)
+	}
+
+	res := string(r.Value())
 	if res != value {
 		t.Errorf("Expected: %s Got: %s", value, res)
 	}
 }
 
+func TestFindValue_large(t *testing.T) {
+	rng = nextFakeID([]byte{17})
+
+	ch, err := n.FindValue(store.Key{}, *mAddr, 0, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Larger than a datagram, the response must be chunked or sent over TCP
+	// instead of being dropped.
+	value := strings.Repeat("ABC, du är mina tankar. ", 1000)
+
+	err = m.SendValue(store.Key{}, []byte(value), nil, true, nil, SessionID{17}, *nAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := <-ch
+	if r == nil {
+		t.Fatal("expected a response, got timeout")
+	}
+	if string(r.Value()) != value {
+		t.Errorf("unexpected value, got %d bytes, exp: %d bytes", len(r.Value()), len(value))
+	}
+}
+
+func TestHasValue(t *testing.T) {
+	rng = nextFakeID([]byte{14})
+
+	ch, err := n.HasValue(store.Key{7}, *mAddr, 0, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var r *FindValueRequest
+	for r == nil || r.SessionID != (SessionID{14}) {
+		r = <-m.FindValueRequestCh() // Skip requests left by other tests.
+	}
+
+	if !r.Exists {
+		t.Error("expected the request to only ask if the value exists")
+	}
+
+	err = m.SendValue(r.Key, nil, nil, true, nil, r.SessionID, r.From.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := <-ch
+	if res == nil || !res.Found() {
+		t.Errorf("expected found response, got: %v", res)
+	}
+}
+
 func TestFindValue_contacts(t *testing.T) {
 	rng = nextFakeID([]byte{2})
 
 	// Send a FindValue request to a node at mNode
-	ch, err := n.FindValue(store.Key{}, *mAddr)
+	ch, err := n.FindValue(store.Key{}, *mAddr, 0, time.Time{})
 	if err != nil {
 		t.Error(err)
 	}
 
-	// Respond to a FindValue request with a list of contacts
-	err = n.SendValue(store.Key{}, value, []route.Contact{}, SessionID{2}, *nAddr)
+	// Respond to a FindValue request with the value and no contacts.
+	err = n.SendValue(store.Key{}, []byte(value), nil, true, []route.Contact{}, SessionID{2}, *nAddr)
 	if err != nil {
 		t.Error(err)
 	}
@@ -148,19 +228,44 @@ func TestFindValue_contacts(t *testing.T) {
 	if r == nil {
 		t.Errorf("unexpected nil channel")
 	}
-	res := r.Value()
+	res := string(r.Value())
 
 	if res != value {
 		t.Errorf("Expected: %s Got: %s", value, res)
 	}
+
+	if !r.Found() {
+		t.Error("expected found flag in response with the value")
+	}
+}
+
+func TestFindValue_missWithoutContacts(t *testing.T) {
+	rng = nextFakeID([]byte{19})
+
+	ch, err := n.FindValue(store.Key{}, *mAddr, 0, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A node with an empty routing table has no contacts to respond with.
+	err = m.SendValue(store.Key{}, nil, nil, false, nil, SessionID{19}, *nAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := <-ch
+	if r == nil {
+		t.Fatal("expected a response, got timeout")
+	}
+	if r.Found() {
+		t.Error("unexpected found flag in response without the value")
+	}
 }
 
 func TestPingPongShow_correctChallengeReply(t *testing.T) {
 	rng = nextFakeID([]byte{3})
 
-	correctChallenge := []byte{254}
-
-	res, _, err := n.Ping(*mAddr)
+	res, correctChallenge, err := n.Ping(*mAddr, 0)
 	if err != nil {
 		t.Error(err)
 	}
@@ -183,25 +288,31 @@ func TestPingPongShow_correctChallengeReply(t *testing.T) {
 func TestPingPongShow_wrongChallengeReply(t *testing.T) {
 	rng = nextFakeID([]byte{4})
 
-	correctChallenge := []byte{254}
 	wrongChallenge := []byte{0}
 
-	res, _, err := n.Ping(*mAddr)
+	res, correctChallenge, err := n.Ping(*mAddr, 0)
 	if err != nil {
 		t.Error(err)
 	}
 
-	err = m.Pong(wrongChallenge, SessionID{4}, *nAddr)
-	if err != nil {
-		t.Error(err)
+	// A pong with the wrong challenge must be dropped, and not consume the
+	// session.
+	for _, c := range [][]byte{wrongChallenge, nil, correctChallenge} {
+		err = m.Pong(c, SessionID{4}, *nAddr)
+		if err != nil {
+			t.Error(err)
+		}
 	}
 
 	r := <-res
+	if r == nil {
+		t.Fatal("expected pong with the correct challenge")
+	}
 	rc := r.Challenge
 
 	comp := bytes.Compare(rc, correctChallenge)
 
-	if comp == 0 {
+	if comp != 0 {
 		t.Errorf("Got: %v Expected: %v", rc, correctChallenge)
 	}
 }
@@ -209,7 +320,7 @@ func TestPingPongShow_wrongChallengeReply(t *testing.T) {
 func TestFindNodes_closest(t *testing.T) {
 	rng = nextFakeID([]byte{5})
 
-	ch, err := n.FindNodes(node.ID{}, *mAddr)
+	ch, err := n.FindNodes(node.ID{}, *mAddr, 0, time.Time{})
 	if err != nil {
 		t.Error(err)
 	}
@@ -228,7 +339,7 @@ func TestFindNodes_closest(t *testing.T) {
 
 	r := <-ch
 
-	if r.Value() != "" {
+	if len(r.Value()) != 0 {
 		t.Errorf("unexpected value in result, got: %v, exp: \"\" (none)", r.Value())
 	}
 
@@ -241,23 +352,1003 @@ func TestFindNodes_closest(t *testing.T) {
 	}
 }
 
+func TestGetPeers(t *testing.T) {
+	rng = nextFakeID([]byte{16})
+
+	ch, err := n.GetPeers(5, *mAddr, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := <-m.GetPeersRequestCh()
+	if r.Count != 5 {
+		t.Errorf("unexpected count, got: %d, exp: %d", r.Count, 5)
+	}
+	if r.SessionID != (SessionID{16}) {
+		t.Errorf("unexpected session ID, got: %v, exp: %v", r.SessionID, SessionID{16})
+	}
+
+	contacts := []route.Contact{
+		{NodeID: node.NewID(), Address: net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: 1}},
+		{NodeID: node.NewID(), Address: net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: 2}},
+	}
+
+	err = m.SendNodes(contacts, r.SessionID, r.From.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := <-ch
+	if result == nil {
+		t.Fatal("expected a response, got timeout")
+	}
+	if len(result.Closest()) != len(contacts) {
+		t.Errorf("unexpected contacts, got: %v, exp: %v", result.Closest(), contacts)
+	}
+}
+
+// storeAsync sends the store request from n in the background, since Store
+// waits for the request to be acknowledged.
+func storeAsync(key store.Key, value []byte, ttl time.Duration) chan error {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- n.Store(key, false, value, nil, time.Time{}, StoreClassPublish, ttl, *mAddr, 0, time.Time{})
+	}()
+	return errs
+}
+
+func TestStore_meta(t *testing.T) {
+	rng = nextFakeID([]byte{15})
+	meta := store.Meta{"content-type": "text/plain"}
+	written := time.Unix(0, 1234567890)
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- n.Store(store.Key{9}, true, []byte(value), meta, written, StoreClassPublish, 0, *mAddr, 0, time.Time{})
+	}()
+
+	// Skip requests left over from other tests.
+	var r *StoreRequest
+	for r = <-m.StoreRequestCh(); r.SessionID != (SessionID{15}); r = <-m.StoreRequestCh() {
+	}
+
+	if err := m.Ack(r.SessionID, r.From.Address); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Error(err)
+	}
+
+	if len(r.Meta) != 1 || r.Meta["content-type"] != "text/plain" {
+		t.Errorf("unexpected metadata in request, got: %v, exp: %v", r.Meta, meta)
+	}
+	if !r.Written.Equal(written) {
+		t.Errorf("unexpected write time in request, got: %v, exp: %v", r.Written, written)
+	}
+	if !r.Explicit {
+		t.Error("expected the store to be marked as explicitly keyed")
+	}
+}
+
 func TestStore(t *testing.T) {
 	rng = nextFakeID([]byte{6})
 	value := "ABC, du är mina tankar"
 	key := store.Key{1}
 
-	err := n.Store(key, value, StoreClassPublish, *mAddr)
+	errs := storeAsync(key, []byte(value), time.Minute)
+
+	r := <-m.StoreRequestCh()
+
+	if err := m.Ack(r.SessionID, r.From.Address); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Error(err)
+	}
+
+	if string(r.Value) != value {
+		t.Errorf("unexpected value in request, got: %s, exp: %s", r.Value, value)
+	}
+
+	if r.TTL != time.Minute {
+		t.Errorf("unexpected TTL in request, got: %v, exp: %v", r.TTL, time.Minute)
+	}
+
+	if r.Key != key {
+		t.Errorf("unexpected key in request, got: %v, exp: %v", r.Key, key)
+	}
+
+	if r.SessionID != (SessionID{6}) {
+		t.Errorf("unexpected session ID in request, got: %v, exp: %v", r.SessionID, SessionID{6})
+	}
+
+	if !r.From.NodeID.Equal(nNode.NodeID) {
+		t.Errorf("unexpected from node ID in request, got: %v, exp: %v", r.From.NodeID, nNode.NodeID)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	rng = nextFakeID([]byte{7})
+	key := store.Key{2}
+
+	err := n.Delete(key, *mAddr)
 	if err != nil {
 		t.Error(err)
 	}
 
-	r := <-m.StoreRequestCh()
+	r := <-m.DeleteRequestCh()
 
-	if r.Value != value {
-		t.Errorf("unexpected value in request, got: %s, exp: %s", r.Value, value)
+	if !bytes.Equal(r.Key[:], key[:]) {
+		t.Errorf("unexpected key in request, got: %v, exp: %v", r.Key, key)
 	}
 
 	if !r.From.NodeID.Equal(nNode.NodeID) {
 		t.Errorf("unexpected from node ID in request, got: %v, exp: %v", r.From.NodeID, nNode.NodeID)
 	}
 }
+
+func TestClose(t *testing.T) {
+	addr, err := net.ResolveUDPAddr("udp", "127.0.0.1:8120")
+	panicOnErr(err)
+
+	o, err := NewUDPNetwork(route.Contact{NodeID: node.NewID(), Address: *addr}, Config{})
+	panicOnErr(err)
+
+	listening := make(chan error)
+	go func() {
+		listening <- o.Listen()
+	}()
+
+	<-o.ReadyCh()
+
+	// Pending requests must be signaled as timed out on close.
+	ch, err := o.FindNodes(node.ID{}, *mAddr, 0, time.Time{})
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = o.Close()
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if r := <-ch; r != nil {
+		t.Errorf("expected nil result for pending request, got: %v", r)
+	}
+
+	select {
+	case err = <-listening:
+		if err != nil {
+			t.Errorf("unexpected error from listen: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("listen didn't return within 1 second after close")
+	}
+}
+
+func TestNewUDPNetwork_bindError(t *testing.T) {
+	// The address is already bound by n.
+	_, err := NewUDPNetwork(route.Contact{NodeID: node.NewID(), Address: *nAddr}, Config{})
+	if err == nil {
+		t.Error("expected error when binding to an address in use")
+	}
+}
+
+func TestNewUDPNetwork_buffers(t *testing.T) {
+	addr := net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	o, err := NewUDPNetwork(route.Contact{NodeID: node.NewID(), Address: addr}, Config{
+		ReadBuffer:  1 << 20,
+		WriteBuffer: 1 << 20,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer o.Close()
+
+	if n := o.ReadErrors(); n != 0 {
+		t.Errorf("unexpected number of read errors, got: %d, exp: 0", n)
+	}
+}
+
+func TestSign(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	panicOnErr(err)
+
+	id := node.IDFromPublicKey(pub)
+
+	o, err := NewUDPNetwork(route.Contact{NodeID: id, Address: net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}}, Config{PrivateKey: priv})
+	panicOnErr(err)
+	defer o.Close()
+
+	p := &packet.Packet{
+		SessionId: []byte{123},
+		SenderId:  id.Bytes(),
+		Payload:   &packet.Packet_Delete{Delete: &packet.Delete{Key: []byte{111}}},
+	}
+
+	err = o.(*udpNetwork).sign(p)
+	panicOnErr(err)
+
+	if !verify(p) {
+		t.Error("expected signed packet to be verified")
+	}
+
+	p.SessionId = []byte{124}
+	if verify(p) {
+		t.Error("expected tampered packet to not be verified")
+	}
+
+	p.SessionId = []byte{123}
+	p.SenderId = node.NewID().Bytes()
+	if verify(p) {
+		t.Error("expected packet with spoofed sender ID to not be verified")
+	}
+
+	// The node ID must be derived from the public key.
+	_, err = NewUDPNetwork(route.Contact{NodeID: node.NewID(), Address: *nAddr}, Config{PrivateKey: priv})
+	if err == nil {
+		t.Error("expected error for node ID not derived from the public key")
+	}
+}
+
+func TestStore_binary(t *testing.T) {
+	rng = nextFakeID([]byte{10})
+
+	// Not valid UTF-8, which can't be sent as a protobuf string.
+	value := []byte{0xff, 0xfe, 0x00, 0x80}
+
+	errs := storeAsync(store.Key{4}, value, 0)
+
+	select {
+	case r := <-m.StoreRequestCh():
+		if !bytes.Equal(r.Value, value) {
+			t.Errorf("unexpected value in request, got: %v, exp: %v", r.Value, value)
+		}
+		m.Ack(r.SessionID, r.From.Address)
+	case err := <-errs:
+		t.Fatal(err)
+	case <-time.After(time.Second):
+		t.Fatal("binary store request was never received")
+	}
+
+	if err := <-errs; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStore_chunked(t *testing.T) {
+	rng = nextFakeID([]byte{8})
+
+	// Large enough to be split into multiple chunks.
+	value := strings.Repeat("ABC, du är mina tankar. ", 1000)
+
+	errs := storeAsync(store.Key{3}, []byte(value), 0)
+
+	select {
+	case r := <-m.StoreRequestCh():
+		if string(r.Value) != value {
+			t.Errorf("unexpected value in request, got %d bytes, exp: %d bytes", len(r.Value), len(value))
+		}
+		m.Ack(r.SessionID, r.From.Address)
+	case err := <-errs:
+		t.Fatal(err)
+	case <-time.After(time.Second):
+		t.Fatal("chunked store request was never received")
+	}
+
+	if err := <-errs; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStore_tcp(t *testing.T) {
+	rng = nextFakeID([]byte{12})
+
+	// Too large to be sent as UDP chunks, or to be received over TCP with the
+	// default maximum size.
+	value := bytes.Repeat([]byte{42}, maxChunks*chunkSize+1)
+
+	rAddr := net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8127}
+	r, err := NewUDPNetwork(route.Contact{NodeID: node.NewID(), Address: rAddr}, Config{MaxTCPPacketSize: 2 * len(value)})
+	panicOnErr(err)
+	defer r.Close()
+	go r.Listen()
+	<-r.ReadyCh()
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- n.Store(store.Key{5}, false, value, nil, time.Time{}, StoreClassPublish, 0, rAddr, 0, time.Time{})
+	}()
+
+	select {
+	case req := <-r.StoreRequestCh():
+		if !bytes.Equal(req.Value, value) {
+			t.Errorf("unexpected value of %d bytes, exp: %d bytes", len(req.Value), len(value))
+		}
+		if req.From.Address.Port != nAddr.Port {
+			t.Errorf("unexpected sender port, got: %d, exp: %d", req.From.Address.Port, nAddr.Port)
+		}
+		r.Ack(req.SessionID, req.From.Address)
+	case err := <-errs:
+		t.Fatal(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("store request sent over TCP was never received")
+	}
+
+	if err := <-errs; err != nil {
+		t.Error(err)
+	}
+
+	err = n.Store(store.Key{5}, false, value, nil, time.Time{}, StoreClassPublish, 0, *mAddr, 200*time.Millisecond, time.Time{})
+	if err == nil {
+		t.Error("expected error when the packet exceeds the maximum size of the receiver")
+	}
+
+	o, err := NewUDPNetwork(route.Contact{NodeID: node.NewID(), Address: net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}}, Config{DisableTCP: true})
+	panicOnErr(err)
+	defer o.Close()
+
+	err = o.Store(store.Key{5}, false, value, nil, time.Time{}, StoreClassPublish, 0, *mAddr, 0, time.Time{})
+	if err == nil {
+		t.Error("expected error when TCP is disabled")
+	}
+}
+
+// closedTCP returns true if the connection is closed by the peer within a
+// short time.
+func closedTCP(conn net.Conn) bool {
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, err := conn.Read(make([]byte, 1))
+	return errors.Is(err, io.EOF)
+}
+
+func TestAcceptTCP_limits(t *testing.T) {
+	rAddr := net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8128}
+	r, err := NewUDPNetwork(route.Contact{NodeID: node.NewID(), Address: rAddr}, Config{MaxTCPConns: 1, RateLimit: 1, RateBurst: 1})
+	panicOnErr(err)
+	defer r.Close()
+	go r.Listen()
+	<-r.ReadyCh()
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", rAddr.String())
+		panicOnErr(err)
+		return conn
+	}
+
+	// Waits for the body of the packet, taking the only connection.
+	var header [tcpHeaderSize]byte
+	binary.BigEndian.PutUint32(header[2:], 1000)
+
+	first := dial()
+	defer first.Close()
+	first.Write(header[:])
+
+	second := dial()
+	defer second.Close()
+	if !closedTCP(second) {
+		t.Error("expected the connection over the maximum to be closed")
+	}
+
+	if closedTCP(first) {
+		t.Fatal("unexpected close of the connection waiting for the body")
+	}
+	first.Close()
+	time.Sleep(50 * time.Millisecond) // The connection is released by the handler.
+
+	// Over the rate limit, closed before the body is read.
+	third := dial()
+	defer third.Close()
+	third.Write(header[:])
+	if !closedTCP(third) {
+		t.Error("expected the connection over the rate limit to be closed")
+	}
+	if n := r.DroppedRequests(); n != 1 {
+		t.Errorf("unexpected number of dropped requests, got: %d, exp: %d", n, 1)
+	}
+}
+
+func TestStore_unacknowledged(t *testing.T) {
+	o, err := NewUDPNetwork(route.Contact{NodeID: node.NewID(), Address: net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}}, Config{Retransmits: -1})
+	panicOnErr(err)
+	defer o.Close()
+
+	// Nothing listens at the address.
+	addr := net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8199}
+
+	err = o.Store(store.Key{6}, false, []byte("Jag vill ha en egen måne"), nil, time.Time{}, StoreClassPublish, 0, addr, 50*time.Millisecond, time.Time{})
+	if !errors.Is(err, ErrTimeout) {
+		t.Errorf("unexpected error, got: %v, exp: %v", err, ErrTimeout)
+	}
+}
+
+func TestStore_deadline(t *testing.T) {
+	o, err := NewUDPNetwork(route.Contact{NodeID: node.NewID(), Address: net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}}, Config{})
+	panicOnErr(err)
+	defer o.Close()
+
+	// Nothing listens at the address.
+	addr := net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8199}
+
+	// The deadline is reached long before the timeout and retransmissions,
+	// that would take 7 seconds. Sessions are swept once a second.
+	start := time.Now()
+	err = o.Store(store.Key{8}, false, []byte("Jag vill ha en egen måne"), nil, time.Time{}, StoreClassPublish, 0, addr, time.Second, start.Add(50*time.Millisecond))
+	if !errors.Is(err, ErrTimeout) {
+		t.Errorf("unexpected error, got: %v, exp: %v", err, ErrTimeout)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("store outlived the deadline, took: %v", elapsed)
+	}
+
+	err = o.Store(store.Key{8}, false, []byte("Jag vill ha en egen måne"), nil, time.Time{}, StoreClassPublish, 0, addr, time.Second, start)
+	if !errors.Is(err, ErrTimeout) {
+		t.Errorf("unexpected error for a passed deadline, got: %v, exp: %v", err, ErrTimeout)
+	}
+}
+
+func TestInFlight_timeout(t *testing.T) {
+	// Every request needs a session of its own, undo the fake IDs of the other
+	// tests.
+	useRNG(t, rand.Read)
+	o, err := NewUDPNetwork(route.Contact{NodeID: node.NewID(), Address: net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}}, Config{Retransmits: -1})
+	panicOnErr(err)
+	defer o.Close()
+
+	// Nothing listens at the address.
+	addr := net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8199}
+
+	const n = 2000
+	var chs []chan FindResult
+	for i := 0; i < n; i++ {
+		ch, err := o.FindNodes(node.NewID(), addr, time.Millisecond, time.Time{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		chs = append(chs, ch)
+	}
+
+	if inFlight := o.InFlight(); inFlight == 0 || inFlight > n {
+		t.Errorf("unexpected number of requests in flight, got: %d, exp: %d", inFlight, n)
+	}
+
+	for _, ch := range chs {
+		select {
+		case r := <-ch:
+			if r != nil {
+				t.Fatalf("unexpected response: %v", r)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("request didn't time out")
+		}
+	}
+
+	if inFlight := o.InFlight(); inFlight != 0 {
+		t.Errorf("expected every timed out request to be removed, got: %d in flight", inFlight)
+	}
+}
+
+func TestFindNodes_retransmit(t *testing.T) {
+	rng = nextFakeID([]byte{9})
+
+	addr, err := net.ResolveUDPAddr("udp", "127.0.0.1:8121")
+	panicOnErr(err)
+
+	oNode := route.Contact{NodeID: node.NewID(), Address: *addr}
+	o, err := NewUDPNetwork(oNode, Config{Timeout: 50 * time.Millisecond, Retransmits: 2})
+	panicOnErr(err)
+	defer o.Close()
+
+	go o.Listen()
+	<-o.ReadyCh()
+
+	ch, err := o.FindNodes(node.ID{}, *mAddr, 0, time.Time{})
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Ignore the original request, as if the response was lost, and respond
+	// to the retransmission.
+	var requests []*FindNodesRequest
+	for len(requests) < 2 {
+		r := <-m.FindNodesRequestCh()
+		if r.From.NodeID.Equal(oNode.NodeID) {
+			requests = append(requests, r) // Skip requests left by other tests.
+		}
+	}
+	r1, r2 := requests[0], requests[1]
+
+	if r1.SessionID != r2.SessionID {
+		t.Errorf("expected retransmission to reuse the session ID, got: %v, exp: %v", r2.SessionID, r1.SessionID)
+	}
+
+	contacts := []route.Contact{route.NewContact(node.NewID(), net.UDPAddr{})}
+	err = m.SendNodes(contacts, r2.SessionID, r2.From.Address)
+	if err != nil {
+		t.Error(err)
+	}
+
+	r := <-ch
+	if r == nil {
+		t.Fatal("expected response to the retransmission, got timeout")
+	}
+	if len(r.Closest()) != len(contacts) {
+		t.Errorf("unexpected number of contacts, got: %d, exp: %d", len(r.Closest()), len(contacts))
+	}
+}
+
+func TestFindNodes_request(t *testing.T) {
+	rng = nextFakeID([]byte{11})
+
+	addr, err := net.ResolveUDPAddr("udp", "127.0.0.1:8122")
+	panicOnErr(err)
+
+	oNode := route.Contact{NodeID: node.NewID(), Address: *addr}
+	o, err := NewUDPNetwork(oNode, Config{})
+	panicOnErr(err)
+	defer o.Close()
+
+	go o.Listen()
+	<-o.ReadyCh()
+
+	target := node.NewID()
+	_, err = o.FindNodes(target, *mAddr, 0, time.Time{})
+	if err != nil {
+		t.Error(err)
+	}
+
+	var r *FindNodesRequest
+	for r == nil || !r.From.NodeID.Equal(oNode.NodeID) {
+		r = <-m.FindNodesRequestCh() // Skip requests left by other tests.
+	}
+
+	if !r.Target.Equal(target) {
+		t.Errorf("unexpected target, got: %v, exp: %v", r.Target, target)
+	}
+	if r.From.Address.Port != addr.Port {
+		t.Errorf("unexpected sender port, got: %d, exp: %d", r.From.Address.Port, addr.Port)
+	}
+	if r.SessionID != (SessionID{11}) {
+		t.Errorf("unexpected session ID, got: %v, exp: %v", r.SessionID, SessionID{11})
+	}
+}
+
+func TestFindNodes_advertised(t *testing.T) {
+	rng = nextFakeID([]byte{13})
+
+	listen, err := net.ResolveUDPAddr("udp", "127.0.0.1:8123")
+	panicOnErr(err)
+	advertised, err := net.ResolveUDPAddr("udp", "192.0.2.1:18123")
+	panicOnErr(err)
+
+	oNode := route.Contact{NodeID: node.NewID(), Address: *advertised}
+	o, err := NewUDPNetwork(oNode, Config{ListenAddress: listen})
+	panicOnErr(err)
+	defer o.Close()
+
+	_, err = o.FindNodes(node.NewID(), *mAddr, 0, time.Time{})
+	if err != nil {
+		t.Error(err)
+	}
+
+	var r *FindNodesRequest
+	for r == nil || !r.From.NodeID.Equal(oNode.NodeID) {
+		r = <-m.FindNodesRequestCh() // Skip requests left by other tests.
+	}
+
+	// Replies go to the source address, the advertised address is only passed
+	// on.
+	if !r.From.Address.IP.Equal(listen.IP) || r.From.Address.Port != listen.Port {
+		t.Errorf("unexpected sender address, got: %v, exp: %v", r.From.Address.String(), listen.String())
+	}
+	if !r.Advertised.IP.Equal(advertised.IP) || r.Advertised.Port != advertised.Port {
+		t.Errorf("unexpected advertised address, got: %v, exp: %v", r.Advertised.String(), advertised.String())
+	}
+
+	invalid := []net.UDPAddr{
+		net.UDPAddr{Port: 18123},
+		net.UDPAddr{IP: net.IPv4zero, Port: 18123},
+		net.UDPAddr{IP: advertised.IP},
+		net.UDPAddr{IP: advertised.IP, Port: 1 << 16},
+	}
+
+	for _, addr := range invalid {
+		p, err := NewUDPNetwork(route.Contact{NodeID: node.NewID(), Address: addr}, Config{
+			ListenAddress: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)},
+		})
+		if err == nil {
+			p.Close()
+			t.Errorf("expected error for advertised address: %v", addr.String())
+		}
+	}
+}
+
+func TestNodeInfo(t *testing.T) {
+	contacts := []route.Contact{
+		route.NewContact(node.NewID(), net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 8118}),
+		route.NewContact(node.NewID(), net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 8118}),
+	}
+
+	var nodes []*packet.NodeInfo
+	for _, c := range contacts {
+		nodes = append(nodes, toNodeInfo(c))
+	}
+
+	if len(nodes[0].Ip) != net.IPv4len {
+		t.Errorf("expected IPv4 address to be encoded as %d bytes, got: %d", net.IPv4len, len(nodes[0].Ip))
+	}
+	if len(nodes[1].Ip) != net.IPv6len {
+		t.Errorf("expected IPv6 address to be encoded as %d bytes, got: %d", net.IPv6len, len(nodes[1].Ip))
+	}
+
+	// Contacts with invalid addresses must be dropped.
+	nodes = append(nodes, &packet.NodeInfo{NodeId: node.NewID().Bytes(), Ip: []byte{1, 2, 3}})
+
+	decoded := fromNodeInfos(nodes)
+	if len(decoded) != len(contacts) {
+		t.Fatalf("unexpected number of contacts, got: %d, exp: %d", len(decoded), len(contacts))
+	}
+
+	for i := range contacts {
+		if !decoded[i].Address.IP.Equal(contacts[i].Address.IP) || decoded[i].Address.Port != contacts[i].Address.Port {
+			t.Errorf("unexpected address, got: %v, exp: %v", decoded[i].Address.String(), contacts[i].Address.String())
+		}
+	}
+}
+
+func BenchmarkSend(b *testing.B) {
+	p := &packet.Packet{
+		SessionId: []byte{1},
+		SenderId:  nNode.NodeID.Bytes(),
+		Payload:   &packet.Packet_Delete{Delete: &packet.Delete{Key: []byte{111}}},
+	}
+
+	// Nothing is listening at the address, so that the packets aren't handled
+	// by a test network.
+	addr := net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8199}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := n.(*udpNetwork).send(addr, p)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestMock(t *testing.T) {
+	mock := NewMock(time.Millisecond, 0)
+
+	a := route.NewContact(node.NewID(), net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 8118})
+	b := route.NewContact(node.NewID(), net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 8118})
+
+	na, err := mock.Attach(a, Config{})
+	panicOnErr(err)
+	defer na.Close()
+
+	nb, err := mock.Attach(b, Config{})
+	panicOnErr(err)
+	defer nb.Close()
+
+	if _, err := mock.Attach(a, Config{}); err == nil {
+		t.Error("expected error when attaching the same address twice")
+	}
+
+	go na.Listen()
+	go nb.Listen()
+	<-na.ReadyCh()
+	<-nb.ReadyCh()
+
+	ch, challenge, err := na.Ping(b.Address, 0)
+	panicOnErr(err)
+
+	r := <-nb.PongRequestCh()
+	if !r.From.NodeID.Equal(a.NodeID) || !r.From.Address.IP.Equal(a.Address.IP) {
+		t.Errorf("unexpected sender, got: %v (%v)", r.From.NodeID, r.From.Address.String())
+	}
+
+	err = nb.Pong(r.Challenge, r.SessionID, r.From.Address)
+	panicOnErr(err)
+
+	if p := <-ch; p == nil || !bytes.Equal(p.Challenge, challenge) {
+		t.Errorf("unexpected pong, got: %v", p)
+	}
+}
+
+func TestPing_challengeSize(t *testing.T) {
+	mock := NewMock(0, 0)
+
+	a := route.NewContact(node.NewID(), net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 8118})
+	b := route.NewContact(node.NewID(), net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 8118})
+
+	if _, err := mock.Attach(a, Config{ChallengeSize: 8}); err == nil {
+		t.Error("expected error for a too short challenge")
+	}
+
+	na, err := mock.Attach(a, Config{ChallengeSize: 16})
+	panicOnErr(err)
+	defer na.Close()
+
+	nb, err := mock.Attach(b, Config{})
+	panicOnErr(err)
+	defer nb.Close()
+
+	go na.Listen()
+	go nb.Listen()
+	<-na.ReadyCh()
+	<-nb.ReadyCh()
+
+	ch, challenge, err := na.Ping(b.Address, 0)
+	panicOnErr(err)
+
+	r := <-nb.PongRequestCh()
+	if len(r.Challenge) != 16 || !bytes.Equal(r.Challenge, challenge) {
+		t.Errorf("unexpected challenge, got: %x, exp 16 bytes: %x", r.Challenge, challenge)
+	}
+
+	// A pong echoing a prefix of the challenge must be dropped.
+	for _, c := range [][]byte{r.Challenge[:8], r.Challenge} {
+		err = nb.Pong(c, r.SessionID, r.From.Address)
+		panicOnErr(err)
+	}
+
+	if p := <-ch; p == nil || !bytes.Equal(p.Challenge, challenge) {
+		t.Errorf("unexpected pong, got: %v", p)
+	}
+
+	// Unpredictable even if the session IDs are not.
+	useRNG(t, collidingID())
+
+	_, c1, err := na.Ping(b.Address, 0)
+	panicOnErr(err)
+	_, c2, err := na.Ping(b.Address, 0)
+	panicOnErr(err)
+
+	if bytes.Equal(c1, c2) {
+		t.Errorf("expected the challenges to differ, got: %x", c1)
+	}
+}
+
+func TestMock_drop(t *testing.T) {
+	mock := NewMock(0, 1)
+
+	a := route.NewContact(node.NewID(), net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 8118})
+	b := route.NewContact(node.NewID(), net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 8118})
+
+	na, err := mock.Attach(a, Config{Timeout: 10 * time.Millisecond, Retransmits: -1})
+	panicOnErr(err)
+	defer na.Close()
+
+	nb, err := mock.Attach(b, Config{})
+	panicOnErr(err)
+	defer nb.Close()
+
+	go na.Listen()
+	go nb.Listen()
+	<-na.ReadyCh()
+	<-nb.ReadyCh()
+
+	ch, err := na.FindNodes(node.NewID(), b.Address, 0, time.Time{})
+	panicOnErr(err)
+
+	if r := <-ch; r != nil {
+		t.Errorf("expected every packet to be dropped, got: %v", r)
+	}
+}
+
+// collidingID returns a source of session IDs that returns every ID twice in a
+// row, so that concurrent requests collide.
+func collidingID() randRead {
+	var mu sync.Mutex
+	var calls int
+	return func(b []byte) (int, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		id := SessionID{18, byte(calls / 2)}
+		calls++
+		return copy(b, id[:]), nil
+	}
+}
+
+func TestPing_concurrentSessions(t *testing.T) {
+	useRNG(t, collidingID())
+
+	const requests = 32
+
+	var wg sync.WaitGroup
+	errs := make(chan error, requests)
+
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			res, challenge, err := n.Ping(*mAddr, 0)
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			// A waiter whose session was replaced by a colliding request is
+			// never signaled.
+			select {
+			case r := <-res:
+				if r == nil {
+					errs <- errors.New("expected pong, got timeout")
+				} else if !bytes.Equal(r.Challenge, challenge) {
+					errs <- fmt.Errorf("pong delivered to the wrong waiter, got: %v, exp: %v", r.Challenge, challenge)
+				}
+			case <-time.After(10 * time.Second):
+				errs <- errors.New("expected pong, got no result")
+			}
+		}()
+	}
+
+	// Answer every ping, each pong carries the session ID of its ping. Pings
+	// that reuse a session ID are dropped as replays by the receiver, and pings
+	// left unanswered by other tests are skipped.
+	for i := 0; i < requests; {
+		var r *PongRequest
+		select {
+		case r = <-m.PongRequestCh():
+		case <-time.After(10 * time.Second):
+			t.Fatalf("expected %d pings, got: %d", requests, i)
+		}
+		if r.SessionID[0] != 18 {
+			continue
+		}
+		i++
+
+		if err := m.Pong(r.Challenge, r.SessionID, r.From.Address); err != nil {
+			t.Error(err)
+		}
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestListen_errCh(t *testing.T) {
+	o, err := NewUDPNetwork(route.Contact{NodeID: node.NewID(), Address: net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8126}}, Config{})
+	panicOnErr(err)
+	defer o.Close()
+
+	listened := make(chan error, 1)
+	go func() { listened <- o.Listen() }()
+	<-o.ReadyCh()
+
+	// Close the socket behind the back of the network.
+	o.(*udpNetwork).conn.Close()
+
+	select {
+	case err := <-o.ErrCh():
+		if !errors.Is(err, net.ErrClosed) {
+			t.Errorf("unexpected error, got: %v, exp: %v", err, net.ErrClosed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the error on the error channel")
+	}
+	if err := <-listened; err == nil {
+		t.Error("expected listen to return the error")
+	}
+}
+
+func TestClose_twice(t *testing.T) {
+	mock := NewMock(0, 0)
+
+	a := route.NewContact(node.NewID(), net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 8118})
+	na, err := mock.Attach(a, Config{DrainTimeout: -1})
+	panicOnErr(err)
+
+	if err := na.Close(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := na.Close(); !errors.Is(err, ErrClosed) {
+		t.Errorf("unexpected error, got: %v, exp: %v", err, ErrClosed)
+	}
+}
+
+func TestClose_drain(t *testing.T) {
+	useRNG(t, rand.Read)
+	mock := NewMock(0, 0)
+
+	a := route.NewContact(node.NewID(), net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 8118})
+	b := route.NewContact(node.NewID(), net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 8118})
+
+	na, err := mock.Attach(a, Config{Timeout: time.Second, Retransmits: -1, DrainTimeout: time.Second})
+	panicOnErr(err)
+
+	nb, err := mock.Attach(b, Config{})
+	panicOnErr(err)
+	defer nb.Close()
+
+	go na.Listen()
+	go nb.Listen()
+	<-na.ReadyCh()
+	<-nb.ReadyCh()
+
+	ch, err := na.FindNodes(node.NewID(), b.Address, 0, time.Time{})
+	panicOnErr(err)
+	r := <-nb.FindNodesRequestCh()
+
+	closed := make(chan error, 1)
+	go func() { closed <- na.Close() }()
+
+	// New requests are refused once the network is closing.
+	for !na.(*udpNetwork).stopping() {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err = na.FindNodes(node.NewID(), b.Address, 0, time.Time{}); !errors.Is(err, ErrClosed) {
+		t.Errorf("unexpected error, got: %v, exp: %v", err, ErrClosed)
+	}
+
+	select {
+	case err := <-closed:
+		t.Fatalf("expected close to wait for the pending request, got: %v", err)
+	default:
+	}
+
+	// The reply to the pending request is still delivered.
+	err = nb.SendNodes([]route.Contact{b}, r.SessionID, r.From.Address)
+	panicOnErr(err)
+
+	if res := <-ch; res == nil || len(res.Closest()) != 1 {
+		t.Errorf("expected the pending request to be answered, got: %v", res)
+	}
+
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected close to return once drained")
+	}
+}
+
+func TestClose_drainTimeout(t *testing.T) {
+	useRNG(t, rand.Read)
+	mock := NewMock(0, 0)
+
+	a := route.NewContact(node.NewID(), net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 8118})
+	b := route.NewContact(node.NewID(), net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 8118})
+
+	na, err := mock.Attach(a, Config{Timeout: time.Minute, DrainTimeout: 50 * time.Millisecond})
+	panicOnErr(err)
+
+	nb, err := mock.Attach(b, Config{})
+	panicOnErr(err)
+	defer nb.Close()
+
+	go na.Listen()
+	go nb.Listen()
+	<-na.ReadyCh()
+	<-nb.ReadyCh()
+
+	// Never answered, and closed long before it times out.
+	ch, err := na.FindNodes(node.NewID(), b.Address, 0, time.Time{})
+	panicOnErr(err)
+	<-nb.FindNodesRequestCh()
+
+	start := time.Now()
+	if err := na.Close(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected close to be bounded by the drain timeout, took: %v", elapsed)
+	}
+
+	if res := <-ch; res != nil {
+		t.Errorf("expected the pending request to be signaled as timed out, got: %v", res)
+	}
+
+	if err := na.Store(store.Key{}, false, nil, nil, time.Time{}, StoreClassPublish, 0, b.Address, 0, time.Time{}); !errors.Is(err, ErrClosed) {
+		t.Errorf("unexpected error, got: %v, exp: %v", err, ErrClosed)
+	}
+}
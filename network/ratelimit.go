@@ -0,0 +1,92 @@
+package network
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// maxRateBuckets is the maximum number of sources with a token bucket, the
+// least recently seen source is forgotten when exceeded.
+const maxRateBuckets = 10000
+
+type tokenBucket struct {
+	source string
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter limits the number of requests per source with a token bucket per
+// source. A bucket holds at most burst tokens and is refilled at rate tokens
+// per second, every request takes one token.
+type rateLimiter struct {
+	buckets map[string]*list.Element
+	order   *list.List // Least recently seen source at the front.
+	rate    float64
+	burst   float64
+	size    int
+	sync.Mutex
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		buckets: make(map[string]*list.Element),
+		order:   list.New(),
+		rate:    rate,
+		burst:   float64(burst),
+		size:    maxRateBuckets,
+	}
+}
+
+// allow takes a token from the bucket of the source, it returns false if the
+// bucket is empty, i.e. the source is over the limit.
+func (r *rateLimiter) allow(source string) bool {
+	now := time.Now()
+
+	r.Lock()
+	defer r.Unlock()
+
+	r.prune(now)
+
+	e, ok := r.buckets[source]
+	if !ok {
+		if r.order.Len() >= r.size {
+			r.forget(r.order.Front())
+		}
+
+		e = r.order.PushBack(&tokenBucket{source: source, tokens: r.burst, last: now})
+		r.buckets[source] = e
+	}
+	r.order.MoveToBack(e)
+
+	b := e.Value.(*tokenBucket)
+	b.tokens += now.Sub(b.last).Seconds() * r.rate
+	if b.tokens > r.burst {
+		b.tokens = r.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+// prune forgets the buckets that have been idle long enough to be refilled, as
+// they are equal to a new bucket.
+func (r *rateLimiter) prune(now time.Time) {
+	refill := time.Duration(r.burst / r.rate * float64(time.Second))
+	for e := r.order.Front(); e != nil; e = r.order.Front() {
+		if now.Sub(e.Value.(*tokenBucket).last) < refill {
+			break
+		}
+		r.forget(e)
+	}
+}
+
+func (r *rateLimiter) forget(e *list.Element) {
+	delete(r.buckets, e.Value.(*tokenBucket).source)
+	r.order.Remove(e)
+}
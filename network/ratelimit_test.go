@@ -0,0 +1,78 @@
+package network
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter_burst(t *testing.T) {
+	r := newRateLimiter(1, 3)
+
+	for i := 0; i < 3; i++ {
+		if !r.allow("10.0.0.1") {
+			t.Errorf("expected request %d within the burst to be allowed", i)
+		}
+	}
+
+	if r.allow("10.0.0.1") {
+		t.Error("expected request over the burst to be dropped")
+	}
+
+	if !r.allow("10.0.0.2") {
+		t.Error("expected request from another source to be allowed")
+	}
+}
+
+func TestRateLimiter_refill(t *testing.T) {
+	r := newRateLimiter(100, 1)
+
+	r.allow("10.0.0.1")
+	if r.allow("10.0.0.1") {
+		t.Error("expected request over the burst to be dropped")
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	if !r.allow("10.0.0.1") {
+		t.Error("expected request to be allowed after the bucket was refilled")
+	}
+}
+
+func TestRateLimiter_prune(t *testing.T) {
+	r := newRateLimiter(1, 1)
+
+	r.allow("idle")
+	r.allow("recent")
+	r.buckets["idle"].Value.(*tokenBucket).last = time.Now().Add(-time.Second)
+
+	r.prune(time.Now())
+
+	if _, ok := r.buckets["idle"]; ok {
+		t.Error("expected idle bucket to be pruned")
+	}
+	if _, ok := r.buckets["recent"]; !ok {
+		t.Error("expected recently used bucket to be kept")
+	}
+}
+
+func TestRateLimiter_size(t *testing.T) {
+	r := newRateLimiter(1, 1)
+	r.size = 2
+
+	r.allow("10.0.0.1")
+	r.allow("10.0.0.2")
+	r.allow("10.0.0.1")
+	r.allow("10.0.0.3")
+
+	if len(r.buckets) != 2 || r.order.Len() != 2 {
+		t.Fatalf("unexpected number of buckets, got: %d, exp: 2", len(r.buckets))
+	}
+	if _, ok := r.buckets["10.0.0.2"]; ok {
+		t.Error("expected the least recently seen source to be forgotten")
+	}
+
+	// The remembered source is still limited.
+	if r.allow("10.0.0.1") {
+		t.Error("expected request over the burst to be dropped")
+	}
+}
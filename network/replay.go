@@ -0,0 +1,75 @@
+package network
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/optmzr/d7024e-dht/node"
+)
+
+type nonce struct {
+	from      node.ID
+	sessionID SessionID
+	attempt   uint32
+}
+
+type seenNonce struct {
+	nonce nonce
+	seen  time.Time
+}
+
+// replayCache remembers the nonces, i.e. the sender ID, session ID and
+// retransmission attempt, of recently received requests so that replayed
+// requests can be dropped. Retransmissions are not replays as they are sent
+// with the next attempt number.
+type replayCache struct {
+	nonces map[nonce]*list.Element
+	order  *list.List // Oldest nonce at the front.
+	window time.Duration
+	size   int
+	sync.Mutex
+}
+
+func newReplayCache(window time.Duration, size int) *replayCache {
+	return &replayCache{
+		nonces: make(map[nonce]*list.Element),
+		order:  list.New(),
+		window: window,
+		size:   size,
+	}
+}
+
+// seen records the nonce and returns true if it was already received within
+// the time window. The oldest nonces are forgotten when the cache is full.
+func (c *replayCache) seen(from node.ID, sessionID SessionID, attempt uint32) bool {
+	now := time.Now()
+	n := nonce{from: from, sessionID: sessionID, attempt: attempt}
+
+	c.Lock()
+	defer c.Unlock()
+
+	// Forget nonces outside of the time window.
+	for e := c.order.Front(); e != nil; e = c.order.Front() {
+		if now.Sub(e.Value.(seenNonce).seen) <= c.window {
+			break
+		}
+		c.forget(e)
+	}
+
+	if _, ok := c.nonces[n]; ok {
+		return true
+	}
+
+	if c.order.Len() >= c.size {
+		c.forget(c.order.Front())
+	}
+
+	c.nonces[n] = c.order.PushBack(seenNonce{nonce: n, seen: now})
+	return false
+}
+
+func (c *replayCache) forget(e *list.Element) {
+	delete(c.nonces, e.Value.(seenNonce).nonce)
+	c.order.Remove(e)
+}
@@ -0,0 +1,60 @@
+package network
+
+import (
+	"testing"
+	"time"
+
+	"github.com/optmzr/d7024e-dht/node"
+)
+
+func TestReplayCache_seen(t *testing.T) {
+	c := newReplayCache(time.Hour, 10)
+
+	from := node.NewID()
+	id := SessionID{1}
+
+	if c.seen(from, id, 0) {
+		t.Error("unexpected replay for first request")
+	}
+	if !c.seen(from, id, 0) {
+		t.Error("expected replay for duplicate request")
+	}
+	if c.seen(node.NewID(), id, 0) {
+		t.Error("unexpected replay for same session ID from another node")
+	}
+	if c.seen(from, id, 1) {
+		t.Error("unexpected replay for retransmission")
+	}
+}
+
+func TestReplayCache_window(t *testing.T) {
+	c := newReplayCache(10*time.Millisecond, 10)
+
+	from := node.NewID()
+	id := SessionID{1}
+
+	c.seen(from, id, 0)
+	time.Sleep(20 * time.Millisecond)
+
+	if c.seen(from, id, 0) {
+		t.Error("unexpected replay outside of the time window")
+	}
+}
+
+func TestReplayCache_size(t *testing.T) {
+	c := newReplayCache(time.Hour, 2)
+
+	from := node.NewID()
+	first := SessionID{1}
+
+	c.seen(from, first, 0)
+	c.seen(from, SessionID{2}, 0)
+	c.seen(from, SessionID{3}, 0)
+
+	if len(c.nonces) != 2 || c.order.Len() != 2 {
+		t.Errorf("unexpected cache size, got: %d", len(c.nonces))
+	}
+	if c.seen(from, first, 0) {
+		t.Error("expected oldest nonce to be forgotten when the cache is full")
+	}
+}
@@ -8,13 +8,15 @@ import (
 )
 
 type item struct {
-	result chan interface{}
-	ttl    time.Time
+	result    chan interface{}
+	ttl       time.Time
+	challenge []byte // Expected challenge of a pong, nil for other sessions.
 }
 
 type table struct {
 	items map[SessionID]item
 	ttl   time.Duration
+	done  chan struct{}
 	sync.Mutex
 }
 
@@ -26,38 +28,120 @@ func newTable(ttl time.Duration, ticker *time.Ticker) *table {
 	t := &table{
 		ttl:   ttl,
 		items: make(map[SessionID]item),
+		done:  make(chan struct{}),
 	}
 
 	go func() {
-		for now := range ticker.C {
-			t.Lock()
-			for k, v := range t.items {
-				if now.After(v.ttl) {
-					log.Debug().Msgf("Session timed out (ID: %v)", k)
-					v.result <- nil // Signal removal of channel.
-					delete(t.items, k)
-				}
+		defer ticker.Stop()
+
+		for {
+			var now time.Time
+			select {
+			case now = <-ticker.C:
+			case <-t.done:
+				return
 			}
-			t.Unlock()
+
+			t.expire(now)
 		}
 	}()
 
 	return t
 }
 
-func (t *table) Put(id SessionID, ch chan interface{}) {
+// expire removes the sessions that has timed out at the time, and signals
+// their removal. The sessions are removed before they're signaled, so that a
+// slow receiver doesn't hold the lock of the table.
+func (t *table) expire(now time.Time) (n int) {
+	var expired []chan interface{}
+
+	t.Lock()
+	for k, v := range t.items {
+		if now.After(v.ttl) {
+			log.Debug().Msgf("Session timed out (ID: %v)", k)
+			expired = append(expired, v.result)
+			delete(t.items, k)
+		}
+	}
+	t.Unlock()
+
+	for _, ch := range expired {
+		ch <- nil // Signal removal of channel.
+	}
+	return len(expired)
+}
+
+// Len returns the number of pending sessions.
+func (t *table) Len() int {
+	t.Lock()
+	defer t.Unlock()
+	return len(t.items)
+}
+
+// close stops the session timeout handler and signals removal of every pending
+// channel. It must only be called once.
+func (t *table) close() {
+	close(t.done)
+
 	t.Lock()
 	defer t.Unlock()
+	for k, v := range t.items {
+		v.result <- nil // Signal removal of channel.
+		delete(t.items, k)
+	}
+}
+
+// Put adds the channel of a pending session, it's signaled with nil if no
+// response is received before the timeout. A zero timeout uses the default of
+// the table. Returns false, and keeps the pending session, if the session ID is
+// already in use.
+func (t *table) Put(id SessionID, ch chan interface{}, timeout time.Duration) bool {
+	return t.PutChallenge(id, ch, timeout, nil)
+}
+
+// PutChallenge adds the channel of a pending session like Put, together with
+// the challenge that the response must echo.
+func (t *table) PutChallenge(id SessionID, ch chan interface{}, timeout time.Duration, challenge []byte) bool {
+	if timeout <= 0 {
+		timeout = t.ttl
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	if _, ok := t.items[id]; ok {
+		return false
+	}
 	t.items[id] = item{
-		result: ch,
-		ttl:    time.Now().Add(t.ttl),
+		result:    ch,
+		ttl:       time.Now().Add(timeout),
+		challenge: challenge,
 	}
+	return true
 }
 
 func (t *table) Get(id SessionID) (chan interface{}, bool) {
+	ch, _, ok := t.GetChallenge(id)
+	return ch, ok
+}
+
+// GetChallenge returns the channel of a pending session together with the
+// challenge that the response must echo.
+func (t *table) GetChallenge(id SessionID) (chan interface{}, []byte, bool) {
+	t.Lock()
+	defer t.Unlock()
+	i, ok := t.items[id]
+	return i.result, i.challenge, ok
+}
+
+// Take removes the pending session and returns its channel. Only one caller
+// gets the channel of a session, which must then deliver exactly one result to
+// it. Duplicate responses, e.g. to retransmitted requests, therefore can't block
+// on a channel that no one reads anymore.
+func (t *table) Take(id SessionID) (chan interface{}, bool) {
 	t.Lock()
 	defer t.Unlock()
 	i, ok := t.items[id]
+	delete(t.items, id)
 	return i.result, ok
 }
 
@@ -14,7 +14,7 @@ func TestTable_putGet(t *testing.T) {
 	id := generateID()
 	ch := makeResultChan()
 
-	table.Put(id, ch)
+	table.Put(id, ch, 0)
 
 	c, ok := table.Get(id)
 	if !ok {
@@ -31,6 +31,25 @@ func TestTable_putGet(t *testing.T) {
 	}
 }
 
+func TestTable_putInUse(t *testing.T) {
+	ticker := time.NewTicker(time.Hour)
+	table := newTable(time.Hour, ticker)
+
+	id := generateID()
+	ch := makeResultChan()
+
+	if !table.Put(id, ch, 0) {
+		t.Fatal("expected unused session ID to be added")
+	}
+	if table.Put(id, makeResultChan(), 0) {
+		t.Error("expected session ID in use to be rejected")
+	}
+
+	if c, ok := table.Get(id); !ok || c != ch {
+		t.Error("expected the pending session to be kept")
+	}
+}
+
 func TestTable_remove(t *testing.T) {
 	// Create ticker that doesn't remove any element during the lifetime of this
 	// test.
@@ -40,7 +59,7 @@ func TestTable_remove(t *testing.T) {
 	id := generateID()
 	ch := makeResultChan()
 
-	table.Put(id, ch)
+	table.Put(id, ch, 0)
 
 	_, ok := table.Get(id)
 	if !ok {
@@ -55,6 +74,23 @@ func TestTable_remove(t *testing.T) {
 	}
 }
 
+func TestTable_take(t *testing.T) {
+	ticker := time.NewTicker(time.Hour)
+	table := newTable(time.Hour, ticker)
+
+	id := generateID()
+	table.Put(id, makeResultChan(), 0)
+
+	if _, ok := table.Take(id); !ok {
+		t.Error("expected channel, got nil")
+	}
+
+	// The second response to the same session must not get the channel.
+	if _, ok := table.Take(id); ok {
+		t.Error("expected no channel after take")
+	}
+}
+
 func TestTable_ttl(t *testing.T) {
 	tch := make(chan time.Time)
 	ticker := &time.Ticker{
@@ -71,7 +107,7 @@ func TestTable_ttl(t *testing.T) {
 	ch := makeResultChan()
 
 	table := newTable(time.Nanosecond, ticker)
-	table.Put(id, ch)
+	table.Put(id, ch, 0)
 
 	select {
 	case v := <-ch: // Wait for removal.
@@ -88,3 +124,34 @@ func TestTable_ttl(t *testing.T) {
 		t.Error("expected channel to be removed")
 	}
 }
+
+func TestTable_timeout(t *testing.T) {
+	tch := make(chan time.Time)
+	ticker := &time.Ticker{
+		C: tch,
+	}
+
+	id := generateID()
+	ch := makeResultChan()
+
+	// The per-call timeout must override the default of the table.
+	table := newTable(time.Hour, ticker)
+	table.Put(id, ch, time.Minute)
+
+	go func(tch chan time.Time) {
+		tch <- time.Now().Add(30 * time.Second)
+		tch <- time.Now().Add(2 * time.Minute)
+	}(tch)
+
+	select {
+	case v := <-ch:
+		if v != nil {
+			t.Errorf("expected to receive nil value from channel, got: %v", v)
+		}
+		if _, ok := table.Get(id); ok {
+			t.Error("expected channel to be removed")
+		}
+	case <-time.After(1 * time.Second):
+		t.Error("channel didn't receive null within 1 second")
+	}
+}
@@ -0,0 +1,135 @@
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/optmzr/d7024e-dht/store"
+	"github.com/rs/zerolog/log"
+)
+
+const tcpThreshold = 64 * 1024      // Default size of encoded packets above which TCP is used (bytes).
+const tcpTimeout = 10 * time.Second // Maximum time to transfer a packet over TCP.
+const maxTCPConns = 64              // Default maximum number of TCP connections handled at once.
+
+// maxTCPPacketSize is the default maximum size of a packet received over TCP,
+// a value of the default maximum size of the DHT with its metadata, and room
+// for the rest of the packet, e.g. the contacts of a find value response.
+const maxTCPPacketSize = 64*1024 + store.MaxMetaSize + 16*1024
+
+// tcpHeaderSize is the size of the header of a packet sent over TCP, which is
+// the UDP port of the sender followed by the size of the packet.
+const tcpHeaderSize = 2 + 4
+
+// listenTCP binds the TCP listener used for large transfers to the same port
+// as the UDP socket.
+func listenTCP(conn *net.UDPConn) (*net.TCPListener, error) {
+	local := conn.LocalAddr().(*net.UDPAddr)
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: local.IP, Port: local.Port, Zone: local.Zone})
+	if err != nil {
+		return nil, fmt.Errorf("cannot bind tcp to %s: %w", local.String(), err)
+	}
+	return l, nil
+}
+
+// sendTCP sends an encoded packet over a new TCP connection to the address, the
+// connection is closed once the packet is written. The TCP port is the same as
+// the UDP port of the receiver.
+func (u *udpNetwork) sendTCP(addr net.UDPAddr, b []byte) error {
+	b = frame(u.tag, b)
+
+	tcpAddr := &net.TCPAddr{IP: addr.IP, Port: addr.Port, Zone: addr.Zone}
+	conn, err := net.DialTimeout("tcp", tcpAddr.String(), u.timeout)
+	if err != nil {
+		return withCause(ErrUnreachable, tcpAddr.String(), err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(tcpTimeout))
+
+	// The source port of the connection is ephemeral, the UDP port is sent so
+	// that the receiver knows where to reply.
+	var header [tcpHeaderSize]byte
+	binary.BigEndian.PutUint16(header[:2], uint16(u.port))
+	binary.BigEndian.PutUint32(header[2:], uint32(len(b)))
+
+	if _, err := conn.Write(header[:]); err != nil {
+		return withCause(ErrUnreachable, tcpAddr.String(), err)
+	}
+	if _, err := conn.Write(b); err != nil {
+		return withCause(ErrUnreachable, tcpAddr.String(), err)
+	}
+	return nil
+}
+
+// acceptTCP accepts connections until the listener is closed, and handles the
+// packet of every connection.
+func (u *udpNetwork) acceptTCP() {
+	for {
+		conn, err := u.tcp.Accept()
+		if err != nil {
+			if u.closed() {
+				return // Listener closed by Close.
+			}
+
+			log.Error().Err(err).Msg("Error when accepting TCP connection")
+			continue
+		}
+
+		select {
+		case u.tcpConns <- struct{}{}:
+		default:
+			log.Warn().Msgf("Dropping TCP connection from: %v, too many connections", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+
+		go func() {
+			defer func() { <-u.tcpConns }()
+			u.handleTCP(conn)
+		}()
+	}
+}
+
+// handleTCP reads a packet from the connection and handles it like a packet
+// received over UDP from the UDP port of the sender.
+func (u *udpNetwork) handleTCP(conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(tcpTimeout))
+
+	var header [tcpHeaderSize]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		log.Error().Err(err).Msgf("Error when reading TCP header from: %v", conn.RemoteAddr())
+		return
+	}
+
+	remote := conn.RemoteAddr().(*net.TCPAddr)
+
+	// Limit the transfers before the packet is read, the packet isn't counted
+	// again when it's handled.
+	if u.rl != nil && !u.rl.allow(remote.IP.String()) {
+		atomic.AddUint64(&u.dropped, 1)
+		return
+	}
+
+	port := binary.BigEndian.Uint16(header[:2])
+	size := binary.BigEndian.Uint32(header[2:])
+	if size > uint32(u.tcpMax) {
+		log.Warn().Msgf("Dropping TCP packet of %d bytes from: %v, the maximum is %d bytes",
+			size, conn.RemoteAddr(), u.tcpMax)
+		return
+	}
+
+	b := make([]byte, size)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		log.Error().Err(err).Msgf("Error when reading TCP packet from: %v", conn.RemoteAddr())
+		return
+	}
+
+	u.handleDatagram(b, net.UDPAddr{IP: remote.IP, Port: int(port), Zone: remote.Zone}, true)
+}
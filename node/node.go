@@ -5,6 +5,8 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
+
+	"golang.org/x/crypto/blake2b"
 )
 
 const IDLength = 256 // bits.
@@ -30,6 +32,12 @@ func NewID() (id ID) {
 	return id
 }
 
+// IDFromPublicKey derives the ID bound to a public key, i.e. the blake2b256
+// hash of the key. A node can only claim the ID if it holds the private key.
+func IDFromPublicKey(pub []byte) ID {
+	return blake2b.Sum256(pub)
+}
+
 // IDFromString parses a hexadecimal representation of an ID into an ID.
 func IDFromString(str string) (id ID, err error) {
 	i, err := hex.DecodeString(str)
@@ -121,8 +129,27 @@ func NewIDWithPrefix(prefix ID, i int) ID {
 	return id
 }
 
-// IDFromBytes reads the bytes in a slice into an ID.
-func IDFromBytes(b []byte) (id ID) {
+// IDWithPrefix creates a new ID that starts with the prefix bytes, the rest of
+// the ID is random. It's useful to place IDs close to each other, e.g. in
+// tests. Panics if the prefix is longer than an ID.
+func IDWithPrefix(prefix []byte) ID {
+	if len(prefix) > IDBytesLength {
+		panic(fmt.Sprintf("prefix must be at most %d bytes, got: %d", IDBytesLength, len(prefix)))
+	}
+
+	id := NewID()
+	copy(id[:], prefix)
+	return id
+}
+
+// IDFromBytes reads the bytes in a slice into an ID. The slice must be exactly
+// IDBytesLength bytes.
+func IDFromBytes(b []byte) (id ID, err error) {
+	if len(b) != IDBytesLength {
+		err = fmt.Errorf("id must be %d bytes, got: %d", IDBytesLength, len(b))
+		return
+	}
+
 	copy(id[:], b)
 	return
 }
@@ -139,7 +166,8 @@ func (a ID) Equal(b ID) bool {
 	return bytes.Equal(a.Bytes(), b.Bytes())
 }
 
-// String returns the hexadecimal representation of an ID as a string.
+// String returns the hexadecimal representation of an ID as a string, in lower
+// case and zero padded to the full length. It's parsed by IDFromString.
 func (a ID) String() string {
 	return hex.EncodeToString(a[:])
 }
@@ -71,12 +71,38 @@ func TestIDFromString(t *testing.T) {
 }
 
 func TestIDFromBytes(t *testing.T) {
-	b := []byte{123, 123, 123}
-	exp := [32]byte{123, 123, 123}
+	exp := NewID()
 
-	id := IDFromBytes(b)
-	if !bytes.Equal(id[:], exp[:]) {
-		t.Errorf("unexpected id, got:\n\t%v,\nexp:\n\t %v", id[:], exp)
+	id, err := IDFromBytes(exp.Bytes())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !id.Equal(exp) {
+		t.Errorf("unexpected id, got:\n\t%v,\nexp:\n\t %v", id, exp)
+	}
+
+	_, err = IDFromBytes([]byte{123, 123, 123})
+	if err == nil {
+		t.Error("expected error for short slice")
+	}
+}
+
+func TestNewID(t *testing.T) {
+	a, b := NewID(), NewID()
+	if a.Equal(b) {
+		t.Error("expected random IDs to differ")
+	}
+
+	// The hexadecimal representation must round-trip.
+	id, err := IDFromString(a.String())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !id.Equal(a) {
+		t.Errorf("unexpected id, got: %v, exp: %v", id, a)
+	}
+	if len(a.String()) != 2*IDBytesLength {
+		t.Errorf("unexpected length of string, got: %d, exp: %d", len(a.String()), 2*IDBytesLength)
 	}
 }
 
@@ -105,3 +131,35 @@ func TestIDWithPrefixGenerator_uniqueDistances(t *testing.T) {
 		i++
 	}
 }
+
+func TestIDWithPrefix(t *testing.T) {
+	prefix := []byte{0xde, 0xad}
+
+	a, b := IDWithPrefix(prefix), IDWithPrefix(prefix)
+	if !bytes.HasPrefix(a[:], prefix) || !bytes.HasPrefix(b[:], prefix) {
+		t.Errorf("unexpected prefix, got: %v and %v, exp: %x", a, b, prefix)
+	}
+	if a.Equal(b) {
+		t.Errorf("expected random suffixes, both got: %v", a)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic for prefix longer than an ID")
+		}
+	}()
+	IDWithPrefix(make([]byte, IDBytesLength+1))
+}
+
+func TestIDFromPublicKey(t *testing.T) {
+	a := IDFromPublicKey([]byte{1, 2, 3})
+	b := IDFromPublicKey([]byte{1, 2, 3})
+	c := IDFromPublicKey([]byte{1, 2, 4})
+
+	if !a.Equal(b) {
+		t.Errorf("expected same ID for same key, got: %v and %v", a, b)
+	}
+	if a.Equal(c) {
+		t.Errorf("expected different IDs for different keys, got: %v", a)
+	}
+}
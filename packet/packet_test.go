@@ -103,7 +103,7 @@ func ExamplePong() {
 func ExampleStore() {
 	payload := &packet.Store{
 		Key:   []byte{111},
-		Value: "ABC, du är mina tankar",
+		Value: []byte("ABC, du är mina tankar"),
 	}
 
 	r := &packet.Packet{
@@ -125,7 +125,7 @@ func ExampleStore() {
 
 	switch p := rr.GetPayload().(type) {
 	case *packet.Packet_Store:
-		fmt.Printf("got store: %v=%v", rr.GetStore().GetKey(), p.Store.GetValue())
+		fmt.Printf("got store: %v=%s", rr.GetStore().GetKey(), p.Store.GetValue())
 	case nil:
 		fmt.Printf("expected type '*Packet_Store' as payload, got '%v'", p)
 	}
@@ -136,7 +136,7 @@ func ExampleStore() {
 func ExampleValue() {
 	payload := &packet.Value{
 		Key:   []byte{111},
-		Value: "ABC, du är mina tankar",
+		Value: []byte("ABC, du är mina tankar"),
 	}
 
 	r := &packet.Packet{
@@ -158,7 +158,7 @@ func ExampleValue() {
 
 	switch p := rr.GetPayload().(type) {
 	case *packet.Packet_Value:
-		fmt.Printf("got value: %v=%v", rr.GetValue().GetKey(), rr.GetValue().GetValue())
+		fmt.Printf("got value: %v=%s", rr.GetValue().GetKey(), rr.GetValue().GetValue())
 	case nil:
 		fmt.Printf("expected type '*Packet_Value' as payload, got '%v'", p)
 	}
@@ -166,6 +166,73 @@ func ExampleValue() {
 	// Output: got value: [111]=ABC, du är mina tankar
 }
 
+func ExampleDelete() {
+	payload := &packet.Delete{
+		Key: []byte{111},
+	}
+
+	r := &packet.Packet{
+		SessionId: []byte{123},
+		SenderId:  []byte{100},
+		Payload:   &packet.Packet_Delete{payload},
+	}
+
+	d, err := proto.Marshal(r)
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	rr := &packet.Packet{}
+	err = proto.Unmarshal(d, rr)
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	switch p := rr.GetPayload().(type) {
+	case *packet.Packet_Delete:
+		fmt.Printf("got delete: %v", rr.GetDelete().GetKey())
+	case nil:
+		fmt.Printf("expected type '*Packet_Delete' as payload, got '%v'", p)
+	}
+
+	// Output: got delete: [111]
+}
+
+func ExampleChunk() {
+	payload := &packet.Chunk{
+		Index: 1,
+		Total: 2,
+		Data:  []byte{111},
+	}
+
+	r := &packet.Packet{
+		SessionId: []byte{123},
+		SenderId:  []byte{100},
+		Payload:   &packet.Packet_Chunk{payload},
+	}
+
+	d, err := proto.Marshal(r)
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	rr := &packet.Packet{}
+	err = proto.Unmarshal(d, rr)
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	switch p := rr.GetPayload().(type) {
+	case *packet.Packet_Chunk:
+		c := rr.GetChunk()
+		fmt.Printf("got chunk: %d/%d %v", c.GetIndex(), c.GetTotal(), c.GetData())
+	case nil:
+		fmt.Printf("expected type '*Packet_Chunk' as payload, got '%v'", p)
+	}
+
+	// Output: got chunk: 1/2 [111]
+}
+
 func ExampleFindValue() {
 	payload := &packet.FindValue{
 		Key: []byte{111},
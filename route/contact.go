@@ -3,6 +3,7 @@ package route
 import (
 	"net"
 	"sort"
+	"sync"
 
 	"github.com/optmzr/d7024e-dht/node"
 )
@@ -14,15 +15,37 @@ type Contact struct {
 	distance Distance
 }
 
+// NewContactInBucket creates a contact with a random node ID that belongs to the
+// bucket at the index in the routing table of the node with the ID, i.e. the
+// XOR distance between the IDs has exactly index leading zero bits. It's useful
+// to exercise the bucket boundaries in tests. The index must be less than
+// node.IDLength.
+func NewContactInBucket(id node.ID, index int, address net.UDPAddr) Contact {
+	// NewIDWithPrefix keeps the first index bits and flips the next bit.
+	return NewContact(node.NewIDWithPrefix(id, index+1), address)
+}
+
 // Contacts implements a sortable list of contacts.
 type Contacts []Contact
 
 type contactMap map[node.ID]Contact
 
-// Candidates implements a set of contacts.
+// Comparator reports whether contact a should be ordered before contact b in a
+// lookup for the target.
+type Comparator func(target node.ID, a, b Contact) bool
+
+// XORComparator orders contacts by their XOR distance to the target, which is
+// the default ordering of a shortlist.
+func XORComparator(target node.ID, a, b Contact) bool {
+	return distance(target, a.NodeID).Less(distance(target, b.NodeID))
+}
+
+// Candidates implements a set of contacts. It's safe for concurrent use.
 type Candidates struct {
+	rw       sync.RWMutex
 	target   node.ID
 	contacts contactMap
+	cmp      Comparator // Orders the contacts, XOR distance if nil.
 }
 
 func NewContact(id node.ID, address net.UDPAddr) Contact {
@@ -54,29 +77,58 @@ func (cs Contacts) sort() {
 }
 
 func (sl *Candidates) Add(contacts ...Contact) {
+	sl.rw.Lock()
+	defer sl.rw.Unlock()
+
 	for _, contact := range contacts {
 		sl.contacts[contact.NodeID] = contact
 	}
 }
 
 func (sl *Candidates) Remove(contact Contact) {
+	sl.rw.Lock()
+	defer sl.rw.Unlock()
+
 	delete(sl.contacts, contact.NodeID)
 }
 
 func (sl *Candidates) Len() int {
+	sl.rw.RLock()
+	defer sl.rw.RUnlock()
+
 	return len(sl.contacts)
 }
 
+// SetComparator replaces the ordering of the contacts returned by
+// SortedContacts. A nil comparator restores the ordering by XOR distance.
+func (sl *Candidates) SetComparator(cmp Comparator) {
+	sl.rw.Lock()
+	defer sl.rw.Unlock()
+
+	sl.cmp = cmp
+}
+
 // SortedContacts returns all the contacts in the shortlist set sorted by their
-// distance.
+// distance, or by the comparator if one is set.
 func (sl *Candidates) SortedContacts() Contacts {
+	sl.rw.RLock()
+	defer sl.rw.RUnlock()
+
 	var contacts Contacts
 
 	for _, contact := range sl.contacts {
 		contact.distance = distance(sl.target, contact.NodeID)
 		contacts = append(contacts, contact)
 	}
+
 	contacts.sort()
+	if sl.cmp != nil {
+		// Stable, so that contacts the comparator considers equal are kept in
+		// the order of their distance.
+		sort.SliceStable(contacts, func(i, j int) bool {
+			return sl.cmp(sl.target, contacts[i], contacts[j])
+		})
+	}
 
 	return contacts
 }
@@ -93,3 +145,11 @@ func NewCandidates(target node.ID, contacts ...Contact) *Candidates {
 
 	return sl
 }
+
+// NewShortlist creates a new shortlist set with the provided contacts, where
+// the contacts are ordered by the comparator.
+func NewShortlist(target node.ID, cmp Comparator, contacts ...Contact) *Candidates {
+	sl := NewCandidates(target, contacts...)
+	sl.cmp = cmp
+	return sl
+}
@@ -2,7 +2,10 @@ package route
 
 import (
 	"net"
+	"sync"
 	"testing"
+
+	"github.com/optmzr/d7024e-dht/node"
 )
 
 func randomContacts(n int) (contacts []Contact) {
@@ -55,6 +58,33 @@ func TestCandidatesSortedContacts(t *testing.T) {
 	}
 }
 
+func TestShortlistComparator(t *testing.T) {
+	numContacts := 10
+	target := zeroID()
+	contacts := randomContacts(numContacts)
+
+	// Reverse the ordering of the default comparator.
+	cmp := func(target node.ID, a, b Contact) bool {
+		return XORComparator(target, b, a)
+	}
+
+	sl := NewShortlist(target, cmp, contacts...)
+	sorted := sl.SortedContacts()
+	for i := 1; i < len(sorted); i++ {
+		if !sorted[i].distance.Less(sorted[i-1].distance) {
+			t.Errorf("contacts not sorted by comparator: %v < %v", sorted[i-1], sorted[i])
+		}
+	}
+
+	sl.SetComparator(nil)
+	sorted = sl.SortedContacts()
+	for i := 1; i < len(sorted); i++ {
+		if !sorted[i-1].distance.Less(sorted[i].distance) {
+			t.Errorf("contacts not sorted by distance: %v > %v", sorted[i-1], sorted[i])
+		}
+	}
+}
+
 func TestCandidatesRemove(t *testing.T) {
 	numContacts := 10
 	contacts := randomContacts(numContacts)
@@ -90,3 +120,36 @@ func TestCandidatesRemoveNonExisting(t *testing.T) {
 	// Shouldn't panic.
 	sl.Remove(NewContact(nonExisting, net.UDPAddr{}))
 }
+
+func TestCandidates_concurrent(t *testing.T) {
+	contacts := randomContacts(100)
+	sl := NewCandidates(randomID(), contacts[:10]...)
+
+	// Run with -race to detect unsynchronized access.
+	var wg sync.WaitGroup
+	for i, c := range contacts {
+		wg.Add(1)
+		go func(i int, c Contact) {
+			defer wg.Done()
+
+			sl.Add(c)
+			sl.SortedContacts()
+			if i%2 == 0 {
+				sl.Remove(c)
+			}
+			sl.Len()
+		}(i, c)
+	}
+	wg.Wait()
+
+	if n := sl.Len(); n != 50 {
+		t.Errorf("unexpected number of contacts, got: %d, exp: 50", n)
+	}
+
+	sorted := sl.SortedContacts()
+	for i := 1; i < len(sorted); i++ {
+		if sorted[i].distance.Less(sorted[i-1].distance) {
+			t.Fatalf("contacts not sorted by distance at: %d", i)
+		}
+	}
+}
@@ -3,7 +3,12 @@ package route
 import (
 	"bytes"
 	"container/list"
+	"encoding/gob"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"io"
+	"math/bits"
 	"sync"
 	"time"
 
@@ -18,17 +23,42 @@ type bucket struct {
 	rw         sync.RWMutex
 }
 
+// lastSeen holds the time each contact was last heard from, and a Mutex lock
+// for the datastructure.
+type lastSeen struct {
+	sync.RWMutex
+	m map[node.ID]time.Time
+}
+
+// banned holds the node IDs that must not be added to the routing table, and
+// a Mutex lock for the datastructure.
+type banned struct {
+	sync.RWMutex
+	m map[node.ID]struct{}
+}
+
 // Table implements a routing table according to the Kademlia specification.
 type Table struct {
 	buckets   [node.IDLength]*bucket
 	me        Contact
+	lastSeen  lastSeen
+	banned    banned
 	tRefresh  time.Duration
 	refreshCh chan int
+	done      chan struct{}
 }
 
 // Distance represents the distance between two node IDs.
 type Distance [node.IDBytesLength]byte
 
+// DistanceBetween returns the XOR distance between two node IDs.
+func DistanceBetween(a, b node.ID) Distance {
+	return distance(a, b)
+}
+
+// BucketIndex returns the index of the bucket that a contact at the distance
+// belongs to, i.e. the number of leading zero bits of the distance. Equal IDs
+// belong to the last bucket.
 func (d Distance) BucketIndex() int {
 	// Count number of leading zeros.
 	for i, b := range d {
@@ -45,10 +75,27 @@ func (d Distance) BucketIndex() int {
 	return cap(d)*8 - 1
 }
 
+// LeadingZeros returns the number of leading zero bits of the distance, i.e.
+// the length of the common prefix of the two IDs. Unlike BucketIndex it's equal
+// to node.IDLength for equal IDs.
+func (d Distance) LeadingZeros() int {
+	for i, b := range d {
+		if b != 0 {
+			return i*8 + bits.LeadingZeros8(b)
+		}
+	}
+	return node.IDLength
+}
+
 func (a Distance) Less(b Distance) bool {
 	return bytes.Compare(a[:], b[:]) < 0
 }
 
+// String returns the hexadecimal representation of the distance.
+func (d Distance) String() string {
+	return hex.EncodeToString(d[:])
+}
+
 // distance calculates the XOR metric for Kademlia.
 func distance(a, b node.ID) (d Distance) {
 	for i := range a {
@@ -77,7 +124,8 @@ func (b *bucket) add(c Contact) (ok bool) {
 		if c.NodeID.Equal(e.Value.(Contact).NodeID) {
 			b.MoveToFront(e)
 			// Successfully "added", in reality, the position in the list was
-			// just updated.
+			// just updated. The known address is kept, it's only replaced by
+			// readdress.
 			return true
 		}
 	}
@@ -91,6 +139,21 @@ func (b *bucket) add(c Contact) (ok bool) {
 	return false // Full bucket, contact was not added.
 }
 
+// readdress replaces the address of the contact with the node ID of c, and
+// returns false if it's not in the bucket. The bucket is not touched.
+func (b *bucket) readdress(c Contact) (ok bool) {
+	b.rw.Lock()
+	defer b.rw.Unlock()
+
+	for e := b.Front(); e != nil; e = e.Next() {
+		if c.NodeID.Equal(e.Value.(Contact).NodeID) {
+			e.Value = c
+			return true
+		}
+	}
+	return false
+}
+
 // head retrieves the oldest contact in a bucket. The bucket must have at least
 // one contact, or else it'll panic.
 func (b *bucket) head() Contact {
@@ -106,6 +169,20 @@ func (b *bucket) head() Contact {
 	return e.Value.(Contact)
 }
 
+// find returns the contact with the node ID, or false if it's not in the
+// bucket. The bucket is not touched.
+func (b *bucket) find(id node.ID) (Contact, bool) {
+	b.rw.RLock()
+	defer b.rw.RUnlock()
+
+	for e := b.Front(); e != nil; e = e.Next() {
+		if c := e.Value.(Contact); id.Equal(c.NodeID) {
+			return c, true
+		}
+	}
+	return Contact{}, false
+}
+
 // remove a contact from a bucket. If the contact doesn't exist the bucket is
 // left unchanged.
 func (b *bucket) remove(id node.ID) {
@@ -125,10 +202,9 @@ func (b *bucket) remove(id node.ID) {
 }
 
 // contacts returns all the contacts in a bucket including the distance to a
-// provided node ID.
+// provided node ID. The bucket is not touched, as reading neighbouring buckets
+// during a lookup doesn't count as activity in their range.
 func (b *bucket) contacts(id node.ID) (c Contacts) {
-	b.touch()
-
 	b.rw.RLock()
 	defer b.rw.RUnlock()
 
@@ -141,6 +217,18 @@ func (b *bucket) contacts(id node.ID) (c Contacts) {
 	return
 }
 
+// oldest returns all the contacts in a bucket ordered from the least recently
+// seen, without touching the bucket.
+func (b *bucket) oldest() (c Contacts) {
+	b.rw.RLock()
+	defer b.rw.RUnlock()
+
+	for e := b.Back(); e != nil; e = e.Prev() {
+		c = append(c, e.Value.(Contact))
+	}
+	return
+}
+
 // len returns the number of contacts in the bucket.
 func (b *bucket) len() int {
 	b.rw.RLock()
@@ -149,7 +237,8 @@ func (b *bucket) len() int {
 }
 
 // Add finds the correct bucket to add the contact to and inserts the contact.
-// It will return false if the bucket is full.
+// It will return false if the bucket is full or if the contact is banned. A
+// contact already in the table keeps its address, see Readdress.
 func (rt *Table) Add(c Contact) (ok bool) {
 	me := rt.me
 
@@ -158,9 +247,106 @@ func (rt *Table) Add(c Contact) (ok bool) {
 		return true // OK, the node already know of itself.
 	}
 
+	if rt.Banned(c.NodeID) {
+		return false
+	}
+
 	d := distance(me.NodeID, c.NodeID)
 	b := rt.buckets[d.BucketIndex()]
-	return b.add(c)
+	if !b.add(c) {
+		return false
+	}
+
+	rt.lastSeen.Lock()
+	rt.lastSeen.m[c.NodeID] = time.Now()
+	rt.lastSeen.Unlock()
+
+	return true
+}
+
+// Readdress replaces the address of the contact already in the table with the
+// address of c, e.g. after a NAT rebinding. It will return false if the contact
+// is not in the table. The address should have been confirmed, e.g. by a ping,
+// since it's used for every later request to the contact.
+func (rt *Table) Readdress(c Contact) (ok bool) {
+	d := distance(rt.me.NodeID, c.NodeID)
+	return rt.buckets[d.BucketIndex()].readdress(c)
+}
+
+// ContactInfo returns the contact with the node ID along with the time it was
+// last heard from. The time is zero for contacts that have not been heard from
+// since they were added as bootstrapping contacts. Returns false if the contact
+// is not in the routing table.
+func (rt *Table) ContactInfo(id node.ID) (c Contact, seen time.Time, ok bool) {
+	d := distance(rt.me.NodeID, id)
+	b := rt.buckets[d.BucketIndex()]
+
+	c, ok = b.find(id)
+	if !ok {
+		return
+	}
+
+	rt.lastSeen.RLock()
+	seen = rt.lastSeen.m[id]
+	rt.lastSeen.RUnlock()
+
+	return
+}
+
+// PingFunc pings a contact and reports if it responded.
+type PingFunc func(c Contact) bool
+
+// AddWithPing adds a contact to its bucket. If the bucket is full the least
+// recently seen contact is pinged and only evicted, to make room for the new
+// contact, if it fails to respond. A responding contact is moved to the front
+// of the bucket and the new contact is dropped, as long-lived nodes are
+// preferred. Returns true if the contact was added.
+func (rt *Table) AddWithPing(c Contact, ping PingFunc) (ok bool) {
+	if rt.Add(c) {
+		return true
+	}
+
+	if rt.Banned(c.NodeID) {
+		return false // Not rejected for a full bucket.
+	}
+
+	d := distance(rt.me.NodeID, c.NodeID)
+	b := rt.buckets[d.BucketIndex()]
+
+	old := b.head()
+	if ping(old) {
+		rt.Add(old)
+		return false
+	}
+
+	rt.Remove(old.NodeID)
+	return rt.Add(c)
+}
+
+// Ban removes the contact with the node ID from the routing table and rejects
+// it from being added again, until unbanned.
+func (rt *Table) Ban(id node.ID) {
+	rt.banned.Lock()
+	rt.banned.m[id] = struct{}{}
+	rt.banned.Unlock()
+
+	rt.Remove(id)
+}
+
+// Unban allows the contact with the node ID to be added to the routing table
+// again.
+func (rt *Table) Unban(id node.ID) {
+	rt.banned.Lock()
+	delete(rt.banned.m, id)
+	rt.banned.Unlock()
+}
+
+// Banned returns true if the node ID is banned from the routing table.
+func (rt *Table) Banned(id node.ID) bool {
+	rt.banned.RLock()
+	defer rt.banned.RUnlock()
+	_, ok := rt.banned.m[id]
+	return ok
 }
 
 // Head retrieves the oldest contact in a bucket for a specified id.
@@ -177,6 +363,38 @@ func (rt *Table) Remove(id node.ID) {
 	d := distance(rt.me.NodeID, id)
 	b := rt.buckets[d.BucketIndex()]
 	b.remove(id)
+
+	rt.lastSeen.Lock()
+	delete(rt.lastSeen.m, id)
+	rt.lastSeen.Unlock()
+}
+
+// Buckets returns a copy of the contacts in every bucket, indexed by the bucket
+// index. The contacts of each bucket are ordered from the least recently seen.
+// The buckets are not touched.
+func (rt *Table) Buckets() []Contacts {
+	buckets := make([]Contacts, len(rt.buckets))
+	for i, b := range rt.buckets {
+		buckets[i] = b.oldest()
+	}
+	return buckets
+}
+
+// AllContacts returns a copy of all the contacts in the routing table, ordered
+// by bucket index.
+func (rt *Table) AllContacts() (contacts Contacts) {
+	for _, b := range rt.buckets {
+		contacts = append(contacts, b.oldest()...)
+	}
+	return
+}
+
+// Len returns the number of contacts in the routing table.
+func (rt *Table) Len() (n int) {
+	for _, b := range rt.buckets {
+		n += b.len()
+	}
+	return
 }
 
 // Centrality returns the centrality metric according to the formula:
@@ -201,25 +419,31 @@ func (rt *Table) Centrality(target node.ID) int {
 	return ca + cb
 }
 
-// NClosest finds the N closest nodes for a provided node ID.
+// NClosest finds the N closest nodes for a provided node ID. The contacts are
+// exactly the N closest by XOR distance to the node ID, and at most N contacts
+// are returned even if contacts are added concurrently.
 func (rt *Table) NClosest(target node.ID, n int) (sl *Candidates) {
 	me := rt.me
 	d := distance(me.NodeID, target)
 	index := d.BucketIndex()
 
+	// Only the bucket that the target belongs to is touched by the lookup.
 	b := rt.buckets[index]
+	b.touch()
 	sl = NewCandidates(target, b.contacts(me.NodeID)...)
 
-	for i := 1; sl.Len() < n && (index-i >= 0 || index+i < cap(rt.buckets)); i++ {
-		if index-i >= 0 {
-			b = rt.buckets[index-i]
-			sl.Add(b.contacts(me.NodeID)...)
-		}
-		if index+i < cap(rt.buckets) {
-			b = rt.buckets[index+i]
-			sl.Add(b.contacts(me.NodeID)...)
+	// The contacts in the buckets above the index are closer to the target
+	// than those in the buckets below it, which are further away the lower
+	// the index. The buckets above are therefore added together, before the
+	// buckets below are added one at a time.
+	if sl.Len() < n {
+		for i := index + 1; i < len(rt.buckets); i++ {
+			sl.Add(rt.buckets[i].contacts(me.NodeID)...)
 		}
 	}
+	for i := index - 1; sl.Len() < n && i >= 0; i-- {
+		sl.Add(rt.buckets[i].contacts(me.NodeID)...)
+	}
 
 	if sl.Len() >= n {
 		// Create new truncated shortlist with only the N closest nodes.
@@ -239,20 +463,73 @@ func (rt *Table) RefreshCh() chan int {
 // and sends a refresh request with the bucket index to the refresh channel.
 func (rt *Table) refreshHandler(ticker *time.Ticker) {
 	go func() {
-		for now := range ticker.C {
+		defer ticker.Stop()
+
+		for {
+			var now time.Time
+			select {
+			case now = <-ticker.C:
+			case <-rt.done:
+				return
+			}
+
 			for i, b := range rt.buckets {
 				b.rw.RLock()
 				refresh := now.After(b.lastAccess.Add(rt.tRefresh))
 				b.rw.RUnlock()
 
 				if refresh {
-					rt.refreshCh <- i
+					select {
+					case rt.refreshCh <- i:
+					case <-rt.done:
+						return
+					}
 				}
 			}
 		}
 	}()
 }
 
+// Close stops the refresh handler of the routing table. It must only be called
+// once.
+func (rt *Table) Close() {
+	close(rt.done)
+}
+
+// Save serializes all the contacts in the routing table to the writer. The
+// contacts are written from the least recently seen in every bucket, so that
+// the order is preserved when loaded with LoadTable.
+func (rt *Table) Save(w io.Writer) error {
+	err := gob.NewEncoder(w).Encode(rt.AllContacts())
+	if err != nil {
+		return fmt.Errorf("cannot encode contacts: %w", err)
+	}
+	return nil
+}
+
+// ReadContacts reads the contacts of a routing table serialized by Save.
+func ReadContacts(r io.Reader) (contacts Contacts, err error) {
+	err = gob.NewDecoder(r).Decode(&contacts)
+	if err != nil {
+		err = fmt.Errorf("cannot decode contacts: %w", err)
+	}
+	return
+}
+
+// LoadTable creates a new routing table seeded with the contacts read from
+// the reader, as written by Save. The loaded contacts are used as the
+// bootstrapping nodes and at least one contact must therefore be present.
+func LoadTable(me Contact, r io.Reader,
+	tRefresh time.Duration, refreshTicker *time.Ticker) (rt *Table, err error) {
+
+	contacts, err := ReadContacts(r)
+	if err != nil {
+		return
+	}
+
+	return NewTable(me, contacts, tRefresh, refreshTicker)
+}
+
 // NewTable creates a new routing table with all the buckets initialized and the
 // local node added to the last bucket. At least one bootstrapping node must be
 // provided.
@@ -267,16 +544,23 @@ func NewTable(me Contact, others []Contact,
 	rt = new(Table)
 	rt.me = me
 	rt.refreshCh = make(chan int)
+	rt.done = make(chan struct{})
 	rt.tRefresh = tRefresh
+	rt.lastSeen = lastSeen{m: make(map[node.ID]time.Time)}
+	rt.banned = banned{m: make(map[node.ID]struct{})}
 
 	// Create all the buckets.
 	for i := range rt.buckets {
 		rt.buckets[i] = &bucket{List: list.New()}
 	}
 
-	// Add bootstrapping contacts.
+	// Add bootstrapping contacts, these have not been heard from yet.
 	for _, other := range others {
-		rt.Add(other)
+		if me.NodeID.Equal(other.NodeID) {
+			continue
+		}
+		d := distance(me.NodeID, other.NodeID)
+		rt.buckets[d.BucketIndex()].add(other)
 	}
 
 	go rt.refreshHandler(refreshTicker)
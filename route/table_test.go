@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"fmt"
 	"math/rand" // Not cryptographically secure on purpose.
+	"net"
+	"sort"
 	"sync"
 	"testing"
 	"time"
@@ -44,29 +46,33 @@ func TestDistance(t *testing.T) {
 		b     node.ID
 		dist  Distance
 		index int
+		zeros int
 	}{
 		{
 			a:     makeID([]byte{1}),
 			b:     makeID([]byte{1}),
 			dist:  Distance{0},
 			index: 255,
+			zeros: 256,
 		},
 		{
 			a:     makeID([]byte{1}),
 			b:     makeID([]byte{2}),
 			dist:  Distance{3},
 			index: 6,
+			zeros: 6,
 		},
 		{
 			a:     makeID([]byte{1}),
 			b:     makeID([]byte{5}),
 			dist:  Distance{4},
 			index: 5,
+			zeros: 5,
 		},
 	}
 
 	for _, test := range testTable {
-		d := distance(test.a, test.b)
+		d := DistanceBetween(test.a, test.b)
 
 		if !bytes.Equal(d[:], test.dist[:]) {
 			t.Errorf("unexpected distance for:\n\ta=%x,\n\tb=%x,\ngot: %d, exp: %d", test.a, test.b, d, test.dist)
@@ -76,6 +82,11 @@ func TestDistance(t *testing.T) {
 		if i != test.index {
 			t.Errorf("unexpected index for:\n\ta=%x,\n\tb=%x,\ngot: %d, exp: %d", test.a, test.b, i, test.index)
 		}
+
+		z := d.LeadingZeros()
+		if z != test.zeros {
+			t.Errorf("unexpected leading zeros for:\n\ta=%x,\n\tb=%x,\ngot: %d, exp: %d", test.a, test.b, z, test.zeros)
+		}
 	}
 }
 
@@ -141,6 +152,93 @@ func TestAdd(t *testing.T) {
 	}
 }
 
+func TestAdd_addressChange(t *testing.T) {
+	me := Contact{NodeID: zeroID()}
+	boot := Contact{NodeID: makeID([]byte{0x80})}
+
+	rt, _ := NewTable(me, []Contact{boot},
+		time.Second, time.NewTicker(time.Second))
+
+	old := Contact{NodeID: makeID([]byte{0x01}), Address: net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 8118}}
+	rt.Add(old)
+
+	// Adding a known contact at another address keeps the known address.
+	c := old
+	c.Address = net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 8119}
+	if !rt.Add(c) {
+		t.Fatal("expected the contact to be added")
+	}
+
+	got, _, ok := rt.ContactInfo(c.NodeID)
+	if !ok || got.Address.String() != old.Address.String() {
+		t.Errorf("unexpected address, got: %v, exp: %v", got.Address.String(), old.Address.String())
+	}
+
+	if !rt.Readdress(c) {
+		t.Fatal("expected the contact to be readdressed")
+	}
+
+	got, _, ok = rt.ContactInfo(c.NodeID)
+	if !ok || got.Address.String() != c.Address.String() {
+		t.Errorf("unexpected address, got: %v, exp: %v", got.Address.String(), c.Address.String())
+	}
+	if n := rt.Len(); n != 2 {
+		t.Errorf("unexpected number of contacts, got: %d, exp: %d", n, 2)
+	}
+
+	if rt.Readdress(Contact{NodeID: makeID([]byte{0x02})}) {
+		t.Error("unexpected readdress of an unknown contact")
+	}
+}
+
+func TestAddWithPing(t *testing.T) {
+	me := Contact{NodeID: zeroID()}
+	boot := Contact{NodeID: makeID([]byte{0x80})}
+
+	rt, _ := NewTable(me, []Contact{boot},
+		time.Second, time.NewTicker(time.Second))
+
+	// Fill the bucket of the bootstrap node.
+	for i := 1; i < BucketSize; i++ {
+		rt.Add(Contact{NodeID: makeID([]byte{0x80, byte(i)})})
+	}
+
+	c := Contact{NodeID: makeID([]byte{0x80, 0xff})}
+
+	var pinged Contact
+	alive := func(old Contact) bool {
+		pinged = old
+		return true
+	}
+
+	if rt.AddWithPing(c, alive) {
+		t.Error("expected new contact to be dropped when the oldest is alive")
+	}
+	if !pinged.NodeID.Equal(boot.NodeID) {
+		t.Errorf("expected oldest contact to be pinged, got: %v, exp: %v", pinged.NodeID, boot.NodeID)
+	}
+	if front := rt.buckets[0].Front().Value.(Contact); !front.NodeID.Equal(boot.NodeID) {
+		t.Errorf("expected alive contact to be moved to the front, got: %v", front.NodeID)
+	}
+
+	dead := func(old Contact) bool {
+		pinged = old
+		return false
+	}
+
+	if !rt.AddWithPing(c, dead) {
+		t.Error("expected new contact to be added when the oldest is dead")
+	}
+	if rt.buckets[0].Len() != BucketSize {
+		t.Errorf("unexpected bucket size: %d", rt.buckets[0].Len())
+	}
+	for e := rt.buckets[0].Front(); e != nil; e = e.Next() {
+		if e.Value.(Contact).NodeID.Equal(pinged.NodeID) {
+			t.Errorf("expected dead contact to be evicted: %v", pinged.NodeID)
+		}
+	}
+}
+
 func TestHead_incremental(t *testing.T) {
 	me := Contact{NodeID: zeroID()}
 	boot := Contact{NodeID: randomID()}
@@ -300,6 +398,43 @@ func TestNClosest(t *testing.T) {
 	}
 }
 
+func TestNClosest_exact(t *testing.T) {
+	me := Contact{NodeID: randomID()}
+	boot := Contact{NodeID: randomID()}
+	rt, err := NewTable(me, []Contact{boot}, time.Second, time.NewTicker(time.Second))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer rt.Close()
+
+	// Spread more than n contacts over the buckets around the target.
+	target := NewContactInBucket(me.NodeID, 4, net.UDPAddr{}).NodeID
+	for i := 0; i < 8; i++ {
+		for index := 0; index < 10; index++ {
+			rt.Add(NewContactInBucket(me.NodeID, index, net.UDPAddr{}))
+		}
+	}
+
+	var all Contacts
+	for _, bucket := range rt.Buckets() {
+		all = append(all, bucket...)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return distance(target, all[i].NodeID).Less(distance(target, all[j].NodeID))
+	})
+
+	const n = 20
+	closest := rt.NClosest(target, n).SortedContacts()
+	if len(closest) != n {
+		t.Fatalf("unexpected number of contacts, got: %d, exp: %d", len(closest), n)
+	}
+	for i, c := range closest {
+		if !c.NodeID.Equal(all[i].NodeID) {
+			t.Errorf("unexpected contact at %d, got: %v, exp: %v", i, c.NodeID, all[i].NodeID)
+		}
+	}
+}
+
 func BenchmarkAdd(b *testing.B) {
 	rt, _ := NewTable(
 		Contact{NodeID: randomID()},
@@ -424,6 +559,30 @@ func TestRefreshCh(t *testing.T) {
 	}
 }
 
+func TestNClosest_touch(t *testing.T) {
+	me := Contact{NodeID: zeroID()}
+	boot := Contact{NodeID: makeID([]byte{0x01})}
+
+	rt, _ := NewTable(me, []Contact{boot},
+		time.Second, time.NewTicker(time.Second))
+
+	for _, b := range rt.buckets {
+		b.lastAccess = time.Time{}
+	}
+
+	// Target is in bucket 0, the only contact lives in bucket 7.
+	rt.NClosest(makeID([]byte{0x80}), 1)
+
+	for i, b := range rt.buckets {
+		touched := !b.lastAccess.IsZero()
+		if i == 0 && !touched {
+			t.Error("expected bucket of the target to be touched")
+		} else if i != 0 && touched {
+			t.Errorf("unexpected touch of bucket %d", i)
+		}
+	}
+}
+
 func TestCentrality(t *testing.T) {
 	me := Contact{NodeID: zeroID()}
 
@@ -447,3 +606,245 @@ func TestCentrality(t *testing.T) {
 		t.Errorf("unexpected centrality, got: %d, exp: %d", c, exp)
 	}
 }
+
+func TestLen(t *testing.T) {
+	me := Contact{NodeID: zeroID()}
+
+	rt, _ := NewTable(me, randomContacts(10),
+		time.Second, time.NewTicker(time.Second))
+
+	if n := rt.Len(); n != 10 {
+		t.Errorf("unexpected length, got: %d, exp: %d", n, 10)
+	}
+}
+
+func TestBan(t *testing.T) {
+	me := Contact{NodeID: zeroID()}
+	boot := Contact{NodeID: makeID([]byte{1})}
+
+	rt, _ := NewTable(me, []Contact{boot},
+		time.Second, time.NewTicker(time.Second))
+
+	rt.Ban(boot.NodeID)
+	if _, _, ok := rt.ContactInfo(boot.NodeID); ok {
+		t.Error("expected banned contact to be removed")
+	}
+
+	if rt.Add(boot) {
+		t.Error("expected banned contact to be rejected")
+	}
+
+	pinged := false
+	rt.AddWithPing(boot, func(c Contact) bool {
+		pinged = true
+		return true
+	})
+	if pinged {
+		t.Error("unexpected ping when adding banned contact")
+	}
+
+	rt.Unban(boot.NodeID)
+	if !rt.Add(boot) {
+		t.Error("expected unbanned contact to be added")
+	}
+}
+
+func TestBuckets(t *testing.T) {
+	me := Contact{NodeID: zeroID()}
+	boot := Contact{NodeID: makeID([]byte{1})}
+
+	rt, _ := NewTable(me, []Contact{boot},
+		time.Second, time.NewTicker(time.Second))
+
+	others := []Contact{
+		Contact{NodeID: makeID([]byte{2})},
+		Contact{NodeID: makeID([]byte{3})},
+		Contact{NodeID: makeID([]byte{128})},
+	}
+
+	var wg sync.WaitGroup
+	for _, c := range others {
+		wg.Add(1)
+		go func(c Contact) {
+			defer wg.Done()
+			rt.Add(c)
+			rt.Buckets()
+		}(c)
+	}
+	wg.Wait()
+
+	buckets := rt.Buckets()
+	if len(buckets) != node.IDLength {
+		t.Fatalf("unexpected number of buckets, got: %d, exp: %d", len(buckets), node.IDLength)
+	}
+
+	exp := map[int]int{0: 1, 6: 2, 7: 1}
+	for i, contacts := range buckets {
+		if len(contacts) != exp[i] {
+			t.Errorf("unexpected number of contacts in bucket %d, got: %d, exp: %d", i, len(contacts), exp[i])
+		}
+		for _, c := range contacts {
+			if index := DistanceBetween(me.NodeID, c.NodeID).BucketIndex(); index != i {
+				t.Errorf("contact %v in bucket %d, exp: %d", c.NodeID, i, index)
+			}
+		}
+	}
+
+	if all := rt.AllContacts(); len(all) != rt.Len() || len(all) != 4 {
+		t.Errorf("unexpected number of contacts, got: %d, exp: %d", len(all), 4)
+	}
+}
+
+func TestNewContactInBucket(t *testing.T) {
+	me := Contact{NodeID: node.NewID()}
+	boot := NewContactInBucket(me.NodeID, 0, net.UDPAddr{})
+	rt, err := NewTable(me, []Contact{boot}, time.Second, time.NewTicker(time.Second))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for i := 0; i < node.IDLength; i++ {
+		c := NewContactInBucket(me.NodeID, i, net.UDPAddr{})
+		if index := DistanceBetween(me.NodeID, c.NodeID).BucketIndex(); index != i {
+			t.Fatalf("unexpected bucket index, got: %d, exp: %d", index, i)
+		}
+		if i > 0 {
+			rt.Add(c) // The bootstrap contact is in the first bucket.
+		}
+	}
+
+	for i, contacts := range rt.Buckets() {
+		if len(contacts) != 1 {
+			t.Errorf("unexpected number of contacts in bucket %d, got: %d, exp: 1", i, len(contacts))
+		}
+	}
+
+	// Fill the bucket, the contact after is rejected.
+	for i := 1; i < BucketSize; i++ {
+		if !rt.Add(NewContactInBucket(me.NodeID, 128, net.UDPAddr{})) {
+			t.Fatalf("unexpected full bucket after %d contacts", i)
+		}
+	}
+	if rt.Add(NewContactInBucket(me.NodeID, 128, net.UDPAddr{})) {
+		t.Error("expected full bucket to reject the contact")
+	}
+}
+
+func TestSaveLoadTable(t *testing.T) {
+	me := Contact{NodeID: zeroID()}
+	boot := Contact{NodeID: randomID()}
+
+	rt, _ := NewTable(me, []Contact{boot},
+		time.Second, time.NewTicker(time.Second))
+
+	contacts := randomContacts(100)
+	for _, c := range contacts {
+		rt.Add(c)
+	}
+
+	var buf bytes.Buffer
+	err := rt.Save(&buf)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	loaded, err := LoadTable(me, &buf,
+		time.Second, time.NewTicker(time.Second))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for i := range rt.buckets {
+		exp := rt.buckets[i].oldest()
+		got := loaded.buckets[i].oldest()
+
+		if len(exp) != len(got) {
+			t.Fatalf("unexpected number of contacts in bucket %d, got: %d, exp: %d", i, len(got), len(exp))
+		}
+
+		for j := range exp {
+			if !exp[j].NodeID.Equal(got[j].NodeID) {
+				t.Errorf("unexpected contact in bucket %d at %d, got: %v, exp: %v", i, j, got[j].NodeID, exp[j].NodeID)
+			}
+		}
+	}
+
+	_, err = LoadTable(me, &bytes.Buffer{},
+		time.Second, time.NewTicker(time.Second))
+	if err == nil {
+		t.Error("expected error when loading empty table")
+	}
+}
+
+func TestSaveLoadTable_addresses(t *testing.T) {
+	me := Contact{NodeID: zeroID()}
+
+	addresses := []net.UDPAddr{
+		{IP: net.IPv4(10, 0, 0, 1), Port: 8118},
+		{IP: net.ParseIP("2001:db8::1"), Port: 8118},
+		{IP: net.ParseIP("fe80::1"), Port: 8118, Zone: "eth0"},
+	}
+
+	var contacts []Contact
+	for i, addr := range addresses {
+		contacts = append(contacts, Contact{NodeID: makeID([]byte{0x80 >> uint(i)}), Address: addr})
+	}
+
+	rt, _ := NewTable(me, contacts,
+		time.Second, time.NewTicker(time.Second))
+
+	var buf bytes.Buffer
+	if err := rt.Save(&buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	loaded, err := ReadContacts(&buf)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, exp := range contacts {
+		found := false
+		for _, got := range loaded {
+			if got.NodeID.Equal(exp.NodeID) {
+				found = true
+				if got.Address.String() != exp.Address.String() {
+					t.Errorf("unexpected address, got: %v, exp: %v", got.Address.String(), exp.Address.String())
+				}
+			}
+		}
+		if !found {
+			t.Errorf("contact %v was not persisted", exp.NodeID)
+		}
+	}
+}
+
+func TestContactInfo(t *testing.T) {
+	me := Contact{NodeID: zeroID()}
+	boot := Contact{NodeID: makeID([]byte{0x80})}
+
+	rt, _ := NewTable(me, []Contact{boot},
+		time.Second, time.NewTicker(time.Second))
+
+	c, seen, ok := rt.ContactInfo(boot.NodeID)
+	if !ok || !c.NodeID.Equal(boot.NodeID) {
+		t.Fatalf("expected bootstrap contact in table, got: %v", c.NodeID)
+	}
+	if !seen.IsZero() {
+		t.Errorf("unexpected last seen for bootstrap contact: %v", seen)
+	}
+
+	before := time.Now()
+	rt.Add(boot)
+
+	_, seen, _ = rt.ContactInfo(boot.NodeID)
+	if seen.Before(before) {
+		t.Errorf("last seen was not updated, got: %v", seen)
+	}
+
+	rt.Remove(boot.NodeID)
+
+	if _, _, ok = rt.ContactInfo(boot.NodeID); ok {
+		t.Error("unexpected contact info for removed contact")
+	}
+}
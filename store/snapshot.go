@@ -0,0 +1,134 @@
+package store
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/optmzr/d7024e-dht/node"
+)
+
+// snapshot is the serialized form of a database. Expiration and republish
+// times are stored as the remaining durations, since the clock of the node
+// might change between the snapshot and the restore.
+type snapshot struct {
+	Remote []snapshotRemoteItem
+	Local  []snapshotLocalItem
+}
+
+type snapshotRemoteItem struct {
+	Key    Key
+	Value  string
+	Meta   Meta
+	TTL    time.Duration // Remaining lifetime.
+	Fixed  bool
+	Cached bool
+
+	Written    time.Time
+	Publishers []node.ID
+}
+
+type snapshotLocalItem struct {
+	Key       Key
+	Value     string
+	Meta      Meta
+	Republish time.Duration // Remaining time until republish.
+	HandedOff bool
+	Written   time.Time
+}
+
+// SnapshotTo serializes the remote and local items of the database to the
+// writer, together with their remaining lifetimes.
+func (db *Database) SnapshotTo(w io.Writer) error {
+	now := db.clock.Now()
+
+	var s snapshot
+
+	db.remoteItems.RLock()
+	for key, remoteItem := range db.remoteItems.m {
+		item := snapshotRemoteItem{
+			Key:     key,
+			Value:   remoteItem.value,
+			Meta:    remoteItem.meta,
+			TTL:     remoteItem.expire.Sub(now),
+			Fixed:   remoteItem.fixed,
+			Cached:  remoteItem.cached,
+			Written: remoteItem.written,
+		}
+		for id := range remoteItem.publishers {
+			item.Publishers = append(item.Publishers, id)
+		}
+		s.Remote = append(s.Remote, item)
+	}
+	db.remoteItems.RUnlock()
+
+	db.localItems.RLock()
+	for key, localItem := range db.localItems.m {
+		s.Local = append(s.Local, snapshotLocalItem{
+			Key:       key,
+			Value:     localItem.value,
+			Meta:      localItem.meta,
+			Republish: localItem.republish.Sub(now),
+			HandedOff: localItem.handedOff,
+			Written:   localItem.written,
+		})
+	}
+	db.localItems.RUnlock()
+
+	err := gob.NewEncoder(w).Encode(s)
+	if err != nil {
+		return fmt.Errorf("cannot encode snapshot: %w", err)
+	}
+	return nil
+}
+
+// RestoreFrom reads a snapshot written by SnapshotTo and adds the items to the
+// database. Remote items that expired since the snapshot was taken are
+// skipped, local items are kept until they are forgotten.
+func (db *Database) RestoreFrom(r io.Reader) error {
+	var s snapshot
+	err := gob.NewDecoder(r).Decode(&s)
+	if err != nil {
+		return fmt.Errorf("cannot decode snapshot: %w", err)
+	}
+
+	now := db.clock.Now()
+
+	for _, item := range s.Remote {
+		if item.TTL <= 0 {
+			continue // Expired.
+		}
+
+		// The stored time is left as zero, so that the item is replicated
+		// during the next replication event.
+		db.putRemoteItem(item.Key, remoteItem{
+			value:   item.Value,
+			meta:    item.Meta,
+			expire:  now.Add(item.TTL),
+			fixed:   item.Fixed,
+			cached:  item.Cached,
+			written: item.Written,
+		})
+
+		// The publishers are kept, so that they can still update and delete
+		// the item after the restore.
+		for _, id := range item.Publishers {
+			db.AddPublisher(item.Key, id)
+		}
+	}
+
+	db.localItems.Lock()
+	for _, item := range s.Local {
+		db.putLocalItem(item.Key, localItem{
+			value:     item.Value,
+			meta:      item.Meta,
+			republish: now.Add(item.Republish),
+			handedOff: item.HandedOff,
+			written:   item.Written,
+		})
+	}
+	db.localItems.Unlock()
+
+	return nil
+}
@@ -1,49 +1,177 @@
 package store
 
 import (
+	"container/list"
 	"encoding/hex"
 	"fmt"
 	"math"
+	"math/rand"
 	"sync"
 	"time"
 
 	"github.com/rs/zerolog/log"
 	"golang.org/x/crypto/blake2b"
 
+	"github.com/optmzr/d7024e-dht/clock"
 	"github.com/optmzr/d7024e-dht/node"
 )
 
+// maxRefreshedAge is the maximum total lifetime of an item whose expiration is
+// reset by RefreshItem.
+const maxRefreshedAge = 7 * 24 * time.Hour
+
 // Key should be a checksum made with blake2b256 hash algorithm, in binary and at a length of 32 bytes.
 type Key node.ID
 
+// Item is a key/value pair held by the database. Values are arbitrary bytes,
+// kept in an immutable string.
 type Item struct {
-	Key   Key
-	Value string
+	Key     Key
+	Value   string
+	Meta    Meta          // Metadata supplied by the publisher, nil if none.
+	TTL     time.Duration // Remaining lifetime, zero if using the default expiration.
+	Expire  time.Time     // Expiration time, zero if the item doesn't expire.
+	Written time.Time     // Time the publisher wrote the value, zero if unknown.
+}
+
+// ConflictPolicy decides whether an incoming value replaces a different value
+// already stored at the same key, see SetConflictPolicy.
+type ConflictPolicy func(stored, incoming Item) (replace bool)
+
+// LastWriteWins replaces the stored value if the incoming value was written
+// after it. Values without a write time are older than all values that has one,
+// and the stored value is kept on a tie, e.g. two values without a write time.
+//
+// The write times are told by the clocks of the publishers, a publisher whose
+// clock is ahead wins over later writes by the others for as long as the clocks
+// are skewed. Write times further ahead than MaxClockSkew are clamped when the
+// value is stored, so that a value can't be made to win indefinitely.
+func LastWriteWins(stored, incoming Item) bool {
+	return incoming.Written.After(stored.Written)
+}
+
+// RejectConflicts keeps the value stored first, until it expires or is
+// removed.
+func RejectConflicts(stored, incoming Item) bool {
+	return false
+}
+
+// MaxClockSkew is how far ahead of the clock of this node the write time of a
+// stored value can be, later write times are clamped.
+const MaxClockSkew = time.Minute
+
+// MaxMetaSize is the maximum total size of the keys and values of the metadata
+// of an item.
+const MaxMetaSize = 1024
+
+// Meta is small structured metadata attached to an item by its publisher, e.g.
+// the content type or tags of the value. Metadata held by the database must not
+// be modified.
+type Meta map[string]string
+
+// Size returns the total size of the keys and values of the metadata.
+func (m Meta) Size() (n int) {
+	for k, v := range m {
+		n += len(k) + len(v)
+	}
+	return
 }
 
 // item is an item stored by the kademlia network on this node.
 // This contains timers that decide the retention of the object along with the stored value and identifier of the node that made the store request to the network initially.
 type remoteItem struct {
-	value  string
-	expire time.Time
+	value   string
+	meta    Meta
+	expire  time.Time
+	fixed   bool // Expiration set by the publisher, not extended on reads.
+	cached  bool
+	written time.Time // Time the publisher wrote the value, zero if unknown.
+	stored  time.Time // Last time another node stored the item at this node.
+	created time.Time // First time the item was stored at this node.
+
+	publishers map[node.ID]struct{} // Nodes that has stored the item at this node.
 }
 
 // localItem contains a timer and the value that this node has stored on the kademlia network.
 type localItem struct {
 	value     string
+	meta      Meta
+	written   time.Time // Time the value was published, republished unchanged.
 	republish time.Time
+	handedOff bool // Handed off by a leaving publisher, bounded by the handoff limits.
 }
 
 // remoteItems holds multiple items, and a Mutex lock for the datastructure.
 type remoteItems struct {
 	sync.RWMutex
-	m map[Key]remoteItem
+	m         map[Key]remoteItem
+	bytes     int    // Total size of the values.
+	evictions uint64 // Number of items evicted to stay within the limits.
+
+	// The keys of the cached and the stored items, in the order they were
+	// accessed, least recently accessed at the front.
+	lru       map[Key]*list.Element
+	cachedLRU *list.List
+	storedLRU *list.List
+}
+
+type lruEntry struct {
+	key    Key
+	cached bool
+}
+
+func newRemoteItems() remoteItems {
+	return remoteItems{
+		m:         make(map[Key]remoteItem),
+		lru:       make(map[Key]*list.Element),
+		cachedLRU: list.New(),
+		storedLRU: list.New(),
+	}
+}
+
+// accessed moves the key of the item to the back of the list of the cached or
+// the stored items.
+func (r *remoteItems) accessed(key Key, cached bool) {
+	if e, ok := r.lru[key]; ok {
+		if e.Value.(lruEntry).cached == cached {
+			r.order(cached).MoveToBack(e)
+			return
+		}
+		r.unlink(key)
+	}
+
+	r.lru[key] = r.order(cached).PushBack(lruEntry{key: key, cached: cached})
+}
+
+// remove deletes the item.
+func (r *remoteItems) remove(key Key) {
+	if remoteItem, found := r.m[key]; found {
+		r.bytes -= len(remoteItem.value)
+		delete(r.m, key)
+	}
+	r.unlink(key)
+}
+
+func (r *remoteItems) unlink(key Key) {
+	if e, ok := r.lru[key]; ok {
+		r.order(e.Value.(lruEntry).cached).Remove(e)
+		delete(r.lru, key)
+	}
+}
+
+func (r *remoteItems) order(cached bool) *list.List {
+	if cached {
+		return r.cachedLRU
+	}
+	return r.storedLRU
 }
 
 // localItems holds multiple local items, and a Mutex lock for the datastructure.
 type localItems struct {
 	sync.RWMutex
-	m map[Key]localItem
+	m              map[Key]localItem
+	handedOff      int // Number of handed off items.
+	handedOffBytes int // Total size of the values of the handed off items.
 }
 
 // replicate stores the time at which to run the database replication event, protected by a Mutex lock.
@@ -52,6 +180,27 @@ type replicate struct {
 	time time.Time
 }
 
+// grace holds the grace period of expired items, protected by a Mutex lock.
+type grace struct {
+	sync.RWMutex
+	period time.Duration
+}
+
+// conflict holds the conflict policy of the database, protected by a Mutex
+// lock.
+type conflict struct {
+	sync.RWMutex
+	policy ConflictPolicy
+}
+
+// jitter randomizes the replication and republish intervals, protected by a
+// Mutex lock.
+type jitter struct {
+	sync.Mutex
+	fraction float64
+	rng      *rand.Rand
+}
+
 // Database object that contains the 2 datastructures holding remote and local items.
 // Time constants dictate the behaviour of the database according to the kademlia algorithm.
 // The channel enables the database to signal DHT when to send republish events.
@@ -61,26 +210,67 @@ type Database struct {
 	replicateCh chan Item
 	republishCh chan Item
 	replicate   replicate
+	jitter      jitter
+	grace       grace
+	conflict    conflict
+	done        chan struct{}
 	tExpire     time.Duration
 	tReplicate  time.Duration
 	tRepublish  time.Duration
+	limits      Limits
+	clock       clock.Clock
+}
+
+// Limits bounds the items that other nodes can store at this node, to protect
+// against floods of store requests. When a limit is exceeded the least recently
+// accessed items are evicted, cached copies before the items stored by their
+// publisher or replicated. Local items are never evicted. Zero values disables
+// the limit.
+type Limits struct {
+	MaxItems int // Maximum number of items.
+	MaxBytes int // Maximum total size of the values.
+
+	MaxHandoffItems int // Maximum number of local items handed off by leaving publishers.
+	MaxHandoffBytes int // Maximum total size of the values of the handed off local items.
 }
 
 // NewDatabase instantiates a new database object with the given time constants, returns a Database pointer and a channel.
 // Spins up the two governing handlers as go routines, responsible for maintaining the database.
 func NewDatabase(tExpire, tReplicate, tRepublish time.Duration, iHTicker, rHTicker *time.Ticker) *Database {
+	return NewDatabaseWithLimits(tExpire, tReplicate, tRepublish, Limits{}, iHTicker, rHTicker)
+}
+
+// NewDatabaseWithLimits instantiates a new database object like NewDatabase,
+// where the size of the remote items are bounded by the limits.
+func NewDatabaseWithLimits(tExpire, tReplicate, tRepublish time.Duration, limits Limits, iHTicker, rHTicker *time.Ticker) *Database {
+	return newDatabase(tExpire, tReplicate, tRepublish, limits, clock.Real, clock.FromTicker(iHTicker), clock.FromTicker(rHTicker))
+}
+
+// NewDatabaseWithClock instantiates a new database object like
+// NewDatabaseWithLimits, where the time is told by the clock. Expired items are
+// swept, and local items checked for republishing, at the given intervals of
+// the clock.
+func NewDatabaseWithClock(tExpire, tReplicate, tRepublish time.Duration, limits Limits, clk clock.Clock, sweepInterval, republishInterval time.Duration) *Database {
+	return newDatabase(tExpire, tReplicate, tRepublish, limits, clk, clk.NewTicker(sweepInterval), clk.NewTicker(republishInterval))
+}
+
+func newDatabase(tExpire, tReplicate, tRepublish time.Duration, limits Limits, clk clock.Clock, iHTicker, rHTicker clock.Ticker) *Database {
 	db := new(Database)
 
+	db.clock = clk
+	db.limits = limits
 	db.tExpire = tExpire
 	db.tReplicate = tReplicate
 	db.tRepublish = tRepublish
+	db.jitter.rng = rand.New(rand.NewSource(clk.Now().UnixNano()))
 	db.setReplicate()
 
-	db.remoteItems = remoteItems{m: make(map[Key]remoteItem)}
+	db.remoteItems = newRemoteItems()
 	db.localItems = localItems{m: make(map[Key]localItem)}
 
 	db.replicateCh = make(chan Item)
 	db.republishCh = make(chan Item)
+	db.done = make(chan struct{})
 
 	go db.itemHandler(iHTicker)
 	go db.republishHandler(rHTicker)
@@ -88,10 +278,121 @@ func NewDatabase(tExpire, tReplicate, tRepublish time.Duration, iHTicker, rHTick
 	return db
 }
 
+// SetJitter randomizes the replication and republish intervals by up to the
+// fraction of their length in either direction, so that nodes started at the
+// same time doesn't replicate and republish in lockstep. The next replication
+// event is rescheduled using the new jitter.
+func (db *Database) SetJitter(fraction float64) {
+	db.jitter.Lock()
+	db.jitter.fraction = fraction
+	db.jitter.Unlock()
+
+	db.setReplicate()
+}
+
+// SetGracePeriod keeps expired items that are republished or replicated, i.e.
+// items without an expiration set by the publisher and that are not cached,
+// for the grace period after they expire. A republish that arrives shortly
+// after the expiration then doesn't briefly lose the value. The items are
+// served during the grace period.
+func (db *Database) SetGracePeriod(period time.Duration) {
+	db.grace.Lock()
+	db.grace.period = period
+	db.grace.Unlock()
+}
+
+// SetConflictPolicy sets the policy that decides which value is kept when a
+// value is stored at a key already holding a different value. Cached copies are
+// always replaced. The default policy is LastWriteWins. The policy must not call
+// the database.
+func (db *Database) SetConflictPolicy(policy ConflictPolicy) {
+	db.conflict.Lock()
+	db.conflict.policy = policy
+	db.conflict.Unlock()
+}
+
+// replaces returns true if the incoming item replaces the stored item at the
+// key under the conflict policy.
+func (db *Database) replaces(key Key, stored, incoming remoteItem) bool {
+	if stored.cached || stored.value == incoming.value {
+		return true
+	}
+
+	db.conflict.RLock()
+	policy := db.conflict.policy
+	db.conflict.RUnlock()
+
+	if policy == nil {
+		policy = LastWriteWins
+	}
+	return policy(
+		Item{Key: key, Value: stored.value, Meta: stored.meta, Written: stored.written},
+		Item{Key: key, Value: incoming.value, Meta: incoming.meta, Written: incoming.written})
+}
+
+func (db *Database) gracePeriod() time.Duration {
+	db.grace.RLock()
+	defer db.grace.RUnlock()
+	return db.grace.period
+}
+
+// purge returns the time at which the item is removed, its expiration time
+// extended by the grace period if the item is republished or replicated.
+func (db *Database) purge(item remoteItem) time.Time {
+	if item.fixed || item.cached {
+		return item.expire
+	}
+	return item.expire.Add(db.gracePeriod())
+}
+
+// expired returns true if the item is removed at the time.
+func (db *Database) expired(item remoteItem, now time.Time) bool {
+	return now.After(db.purge(item))
+}
+
+// Expiry returns the effective expiration time of the item other nodes has
+// stored at this node, including the grace period. Returns false if the item is
+// not stored.
+func (db *Database) Expiry(key Key) (time.Time, bool) {
+	db.remoteItems.RLock()
+	defer db.remoteItems.RUnlock()
+
+	remoteItem, found := db.remoteItems.m[key]
+	if !found {
+		return time.Time{}, false
+	}
+	return db.purge(remoteItem), true
+}
+
+// nextRepublish returns the time of the next republish of a local item
+// republished at the time. The republish is scheduled ahead of the expiration
+// of the values stored at the other nodes, even if the republish interval is
+// jittered past it.
+func (db *Database) nextRepublish(now time.Time) time.Time {
+	d := db.jittered(db.tRepublish)
+	if d > db.tExpire {
+		d = db.tExpire
+	}
+	return now.Add(d)
+}
+
+// jittered returns the duration randomized by the jitter of the database.
+func (db *Database) jittered(d time.Duration) time.Duration {
+	db.jitter.Lock()
+	defer db.jitter.Unlock()
+
+	if db.jitter.fraction == 0 {
+		return d
+	}
+	return d + time.Duration((db.jitter.rng.Float64()*2-1)*db.jitter.fraction*float64(d))
+}
+
 // setReplicate, a set function for the replication interval time of the database.
 func (db *Database) setReplicate() {
+	t := db.clock.Now().Add(db.jittered(db.tReplicate))
+
 	db.replicate.Lock()
-	db.replicate.time = time.Now().Add(time.Duration(db.tReplicate))
+	db.replicate.time = t
 	db.replicate.Unlock()
 }
 
@@ -115,17 +416,22 @@ func (db *Database) RepublishCh() chan Item {
 }
 
 // AddItem adds an value to the remoteItems database that a node in the Kademlia network has sent to this node.
-func (db *Database) AddItem(key Key, value string, centrality int, k int, touch bool) {
-	db.remoteItems.RLock()
-	_, ok := db.remoteItems.m[key]
-	db.remoteItems.RUnlock()
+// If the item is already stored with the same value only its expiration is refreshed. Returns true if the value
+// is stored at the key, and false if it was rejected, e.g. by the conflict policy.
+func (db *Database) AddItem(key Key, value string, centrality int, k int, touch bool) (stored bool) {
+	return db.AddItemAt(key, value, time.Time{}, centrality, k, touch)
+}
 
-	if ok && !touch {
-		return
+// AddItemAt adds an item like AddItem, that the publisher wrote at the provided
+// time. A different value already stored at the key is only replaced if the
+// conflict policy allows it, see SetConflictPolicy.
+func (db *Database) AddItemAt(key Key, value string, written time.Time, centrality int, k int, touch bool) (stored bool) {
+	written = db.clampWritten(written)
+	if db.markStored(key) && !touch && !db.supersedes(key, value, written) {
+		return db.holds(key, value)
 	}
 
-	value = truncate(value)
-	t := time.Now()
+	t := db.clock.Now()
 
 	// The expiration time should be "exponentially inversely proportional to
 	// the number between the current node and the node whose ID closest to the
@@ -145,56 +451,503 @@ func (db *Database) AddItem(key Key, value string, centrality int, k int, touch
 	} else {
 		n := float64(db.tExpire.Seconds())
 		p := math.Exp(float64(k) / float64(centrality))
-		r := int64(n * p)
-		d := time.Duration(r) * time.Second
+
+		// Saturate instead of overflowing into a negative duration, which
+		// would expire the item immediately.
+		d := time.Duration(math.MaxInt64)
+		if s := n * p; s < d.Seconds() {
+			d = time.Duration(s * float64(time.Second))
+		}
 
 		expire = t.Add(d)
 	}
 
-	item := remoteItem{
+	return db.putRemoteItem(key, remoteItem{
+		value:   value,
+		written: written,
+		expire:  expire,
+		stored:  t,
+	})
+}
+
+// AddCachedItem adds a cached copy of a value to the remoteItems database that
+// expires after the provided TTL. Cached items are never replicated and will
+// not replace an item that is already stored. Returns true if the value is
+// held at the key.
+func (db *Database) AddCachedItem(key Key, value string, ttl time.Duration) (stored bool) {
+	if db.hasItem(key) {
+		return db.holds(key, value)
+	}
+
+	return db.putRemoteItem(key, remoteItem{
 		value:  value,
-		expire: expire,
+		expire: db.clock.Now().Add(ttl),
+		fixed:  true,
+		cached: true,
+	})
+}
+
+// AddItemWithTTL adds an value to the remoteItems database that expires after
+// the TTL provided by the publisher, instead of the default expiration. Returns
+// true if the value is stored at the key, see AddItem.
+func (db *Database) AddItemWithTTL(key Key, value string, ttl time.Duration, touch bool) (stored bool) {
+	return db.AddItemWithTTLAt(key, value, time.Time{}, ttl, touch)
+}
+
+// AddItemWithTTLAt adds an item like AddItemWithTTL, that the publisher wrote
+// at the provided time, see AddItemAt.
+func (db *Database) AddItemWithTTLAt(key Key, value string, written time.Time, ttl time.Duration, touch bool) (stored bool) {
+	written = db.clampWritten(written)
+	if db.markStored(key) && !touch && !db.supersedes(key, value, written) {
+		return db.holds(key, value)
 	}
 
+	t := db.clock.Now()
+
+	return db.putRemoteItem(key, remoteItem{
+		value:   value,
+		written: written,
+		expire:  t.Add(ttl),
+		fixed:   true,
+		stored:  t,
+	})
+}
+
+// clampWritten returns the write time told by a publisher, but at most
+// MaxClockSkew ahead of the clock of this node.
+func (db *Database) clampWritten(written time.Time) time.Time {
+	if max := db.clock.Now().Add(MaxClockSkew); written.After(max) {
+		return max
+	}
+	return written
+}
+
+// hasItem returns true if the key exists in the remoteItems database.
+func (db *Database) hasItem(key Key) bool {
+	db.remoteItems.RLock()
+	_, ok := db.remoteItems.m[key]
+	db.remoteItems.RUnlock()
+
+	return ok
+}
+
+// holds returns true if the value is stored at the key.
+func (db *Database) holds(key Key, value string) bool {
+	db.remoteItems.RLock()
+	remoteItem, ok := db.remoteItems.m[key]
+	db.remoteItems.RUnlock()
+
+	return ok && remoteItem.value == value
+}
+
+// supersedes returns true if the value was written after a different value
+// stored at the key and replaces it under the conflict policy, e.g. a newer
+// value replicated to a node that holds an older one.
+func (db *Database) supersedes(key Key, value string, written time.Time) bool {
+	db.remoteItems.RLock()
+	stored, found := db.remoteItems.m[key]
+	db.remoteItems.RUnlock()
+
+	return found && stored.value != value && written.After(stored.written) &&
+		db.replaces(key, stored, remoteItem{value: value, written: written})
+}
+
+// markStored records that another node just stored the item at this node, the
+// item then doesn't have to be replicated by this node during the next
+// replication event. Returns false if the key doesn't exist, or if it's only
+// held as a cached copy, which is to be replaced by the stored item so that it
+// gets the expiration of a stored item and is replicated.
+func (db *Database) markStored(key Key) bool {
+	db.remoteItems.Lock()
+	defer db.remoteItems.Unlock()
+
+	remoteItem, found := db.remoteItems.m[key]
+	if !found || remoteItem.cached {
+		return false
+	}
+
+	now := db.clock.Now()
+	remoteItem.stored = now
+	db.remoteItems.m[key] = remoteItem
+	db.remoteItems.accessed(key, remoteItem.cached)
+
+	return true
+}
+
+// putRemoteItem inserts or replaces an item in the remoteItems database, and
+// evicts items until the database is within its limits. An item already stored
+// with the same value is updated in place, keeping its publishers. A different
+// value is kept if the conflict policy rejects the item. Returns true if the
+// value is stored at the key.
+func (db *Database) putRemoteItem(key Key, item remoteItem) (stored bool) {
+	item.created = db.clock.Now()
+
 	db.remoteItems.Lock()
+	defer db.remoteItems.Unlock()
+
+	old, found := db.remoteItems.m[key]
+	if found && old.value == item.value {
+		item.publishers = old.publishers
+		item.created = old.created
+		if item.meta == nil {
+			item.meta = old.meta // Set separately, see SetMeta.
+		}
+		if item.written.Before(old.written) {
+			item.written = old.written
+		}
+		db.remoteItems.m[key] = item
+		db.remoteItems.accessed(key, item.cached)
+		return true
+	}
+
+	if found && !db.replaces(key, old, item) {
+		log.Debug().Msgf("Keeping conflicting value: %v", key)
+		return false
+	}
+
+	if found {
+		db.remoteItems.bytes -= len(old.value)
+	}
 	db.remoteItems.m[key] = item
-	db.remoteItems.Unlock()
+	db.remoteItems.bytes += len(item.value)
+	db.remoteItems.accessed(key, item.cached)
+
+	for db.overLimits() {
+		db.evictLeastRecentlyAccessed()
+	}
+
+	_, stored = db.remoteItems.m[key] // Unless evicted to stay within the limits.
+	return stored
+}
+
+// RefreshItem resets the expiration of an item that is read often, so that it
+// doesn't expire while popular. The total lifetime of the item is capped, and
+// items with an expiration set by the publisher are not refreshed. Returns
+// false if the item wasn't refreshed.
+func (db *Database) RefreshItem(key Key) bool {
+	db.remoteItems.Lock()
+	defer db.remoteItems.Unlock()
+
+	remoteItem, found := db.remoteItems.m[key]
+	if !found {
+		return false
+	}
+
+	now := db.clock.Now()
+	if !db.refresh(&remoteItem, now) {
+		return false
+	}
+
+	db.remoteItems.m[key] = remoteItem
+	db.remoteItems.accessed(key, remoteItem.cached)
+
+	return true
+}
+
+// refresh extends the expiration of the item that is read now, and returns
+// false if it's not extended. The expiration is never shortened, and items past
+// their expiration, e.g. during the grace period, are only revived by a
+// republish or a replication, not by reads.
+func (db *Database) refresh(item *remoteItem, now time.Time) bool {
+	if item.fixed || now.After(item.expire) {
+		return false
+	}
+
+	expire := db.refreshedExpire(*item, now)
+	if !expire.After(item.expire) {
+		return false // Already expires later, or reached the maximum age.
+	}
+
+	item.expire = expire
+	return true
+}
+
+// refreshedExpire returns the expiration of an item that is refreshed now,
+// capped by the maximum total lifetime of the item.
+func (db *Database) refreshedExpire(item remoteItem, now time.Time) time.Time {
+	expire := now.Add(db.tExpire)
+	if max := item.created.Add(maxRefreshedAge); expire.After(max) {
+		expire = max
+	}
+	return expire
+}
+
+// AddPublisher records that the node has stored the item at this node. Ignored
+// if the item doesn't exist.
+func (db *Database) AddPublisher(key Key, id node.ID) {
+	db.remoteItems.Lock()
+	defer db.remoteItems.Unlock()
+
+	remoteItem, found := db.remoteItems.m[key]
+	if !found {
+		return
+	}
+
+	if remoteItem.publishers == nil {
+		remoteItem.publishers = make(map[node.ID]struct{})
+		db.remoteItems.m[key] = remoteItem
+	}
+	remoteItem.publishers[id] = struct{}{}
+}
+
+// SetMeta sets the metadata of an item stored at this node. Ignored if the item
+// doesn't exist.
+func (db *Database) SetMeta(key Key, meta Meta) {
+	db.remoteItems.Lock()
+	defer db.remoteItems.Unlock()
+
+	remoteItem, found := db.remoteItems.m[key]
+	if !found {
+		return
+	}
+
+	remoteItem.meta = meta
+	db.remoteItems.m[key] = remoteItem
+}
+
+// HasPublisher returns true if the node has stored the item at this node.
+func (db *Database) HasPublisher(key Key, id node.ID) bool {
+	db.remoteItems.RLock()
+	defer db.remoteItems.RUnlock()
+
+	_, found := db.remoteItems.m[key].publishers[id]
+	return found
+}
+
+// Publishers returns the nodes that has stored the item at this node.
+func (db *Database) Publishers(key Key) (ids []node.ID) {
+	db.remoteItems.RLock()
+	defer db.remoteItems.RUnlock()
+
+	for id := range db.remoteItems.m[key].publishers {
+		ids = append(ids, id)
+	}
+	return
+}
+
+// overLimits returns true if the remote items exceeds any of the limits. The
+// remoteItems lock must be held.
+func (db *Database) overLimits() bool {
+	l := db.limits
+	return (l.MaxItems > 0 && len(db.remoteItems.m) > l.MaxItems) ||
+		(l.MaxBytes > 0 && db.remoteItems.bytes > l.MaxBytes)
+}
+
+// evictLeastRecentlyAccessed evicts the cached item that was least recently
+// accessed, or the least recently accessed stored item if there are no cached
+// items. The remoteItems lock must be held.
+func (db *Database) evictLeastRecentlyAccessed() {
+	e := db.remoteItems.cachedLRU.Front()
+	if e == nil {
+		e = db.remoteItems.storedLRU.Front()
+	}
+	if e == nil {
+		return
+	}
+
+	evictee := e.Value.(lruEntry).key
+	log.Debug().Msgf("Evicting to stay within limits: %v", evictee)
+	db.remoteItems.remove(evictee)
+	db.remoteItems.evictions++
+}
+
+// Size returns the number of items other nodes have stored at this node and
+// the total size of their values.
+func (db *Database) Size() (items int, bytes int) {
+	db.remoteItems.RLock()
+	defer db.remoteItems.RUnlock()
+	return len(db.remoteItems.m), db.remoteItems.bytes
+}
+
+// Evictions returns the number of items that has been evicted to keep the
+// database within its limits.
+func (db *Database) Evictions() uint64 {
+	db.remoteItems.RLock()
+	defer db.remoteItems.RUnlock()
+	return db.remoteItems.evictions
 }
 
 // AddLocalItem adds an value to the local item database that this node has requested to be stored on the kademlia network.
 func (db *Database) AddLocalItem(key Key, value string) {
-	value = truncate(value)
+	db.AddLocalItemWithMeta(key, value, nil)
+}
+
+// AddLocalItemWithMeta adds a local item like AddLocalItem, together with its
+// metadata which is republished with the value.
+func (db *Database) AddLocalItemWithMeta(key Key, value string, meta Meta) {
+	db.AddLocalItemAt(key, value, meta, db.clock.Now())
+}
 
-	t := time.Now()
+// AddLocalItemAt adds a local item like AddLocalItemWithMeta, written at the
+// provided time. The write time is republished with the value, e.g. the time
+// the original publisher wrote a value handed off to this node.
+func (db *Database) AddLocalItemAt(key Key, value string, meta Meta, written time.Time) {
+	t := db.clock.Now()
 
 	item := localItem{
 		value:     value,
-		republish: t.Add(db.tRepublish),
+		meta:      meta,
+		written:   written,
+		republish: db.nextRepublish(t),
 	}
 
 	db.localItems.Lock()
-	db.localItems.m[key] = item
+	db.putLocalItem(key, item)
 	db.localItems.Unlock()
 }
 
+// AddHandedOffItem adds a local item like AddLocalItemAt, for a value handed off
+// by a leaving publisher that this node republishes in its place. Returns false
+// if the item wasn't added, because the handed off items would exceed the
+// handoff limits, or because this node already publishes the key itself.
+func (db *Database) AddHandedOffItem(key Key, value string, meta Meta, written time.Time) bool {
+	t := db.clock.Now()
+	written = db.clampWritten(written)
+
+	db.localItems.Lock()
+	defer db.localItems.Unlock()
+
+	items, bytes := db.localItems.handedOff+1, db.localItems.handedOffBytes+len(value)
+	if old, found := db.localItems.m[key]; found {
+		if !old.handedOff {
+			return false // Published by this node.
+		}
+		items, bytes = items-1, bytes-len(old.value)
+	}
+
+	l := db.limits
+	if (l.MaxHandoffItems > 0 && items > l.MaxHandoffItems) ||
+		(l.MaxHandoffBytes > 0 && bytes > l.MaxHandoffBytes) {
+		return false
+	}
+
+	db.putLocalItem(key, localItem{
+		value:     value,
+		meta:      meta,
+		written:   written,
+		republish: db.nextRepublish(t),
+		handedOff: true,
+	})
+	return true
+}
+
+// putLocalItem adds or replaces the local item, and keeps count of the handed
+// off items. The localItems lock must be held.
+func (db *Database) putLocalItem(key Key, item localItem) {
+	db.deleteLocalItem(key)
+
+	db.localItems.m[key] = item
+	if item.handedOff {
+		db.localItems.handedOff++
+		db.localItems.handedOffBytes += len(item.value)
+	}
+}
+
+// deleteLocalItem removes the local item, if any, and keeps count of the handed
+// off items. The localItems lock must be held.
+func (db *Database) deleteLocalItem(key Key) {
+	old, found := db.localItems.m[key]
+	if !found {
+		return
+	}
+
+	delete(db.localItems.m, key)
+	if old.handedOff {
+		db.localItems.handedOff--
+		db.localItems.handedOffBytes -= len(old.value)
+	}
+}
+
+// RetryRepublish reschedules the republish of a local item to happen after the
+// provided duration, e.g. when the last republish failed to reach any nodes.
+// Items that are no longer published by this node are ignored.
+func (db *Database) RetryRepublish(key Key, after time.Duration) {
+	db.localItems.Lock()
+	defer db.localItems.Unlock()
+
+	localItem, found := db.localItems.m[key]
+	if !found {
+		return
+	}
+
+	localItem.republish = db.clock.Now().Add(after)
+	db.localItems.m[key] = localItem
+}
+
 // GetItem returns an item stored on this node that originated from the kademlia network.
-// Also updates the expiration time of the item.
+// Also updates the expiration time of the item, see RefreshItem. Expired items
+// that have not yet been evicted are not returned.
 func (db *Database) GetItem(key Key) (item Item, err error) {
-	newExpirationTime := time.Now().Add(db.tExpire)
+	now := db.clock.Now()
 
 	db.remoteItems.Lock()
 	defer db.remoteItems.Unlock()
 
 	remoteItem, found := db.remoteItems.m[key]
-	if !found {
+	if !found || db.expired(remoteItem, now) {
 		err = fmt.Errorf("no item matching key: %v", key)
 		return
 	}
 
-	remoteItem.expire = newExpirationTime
+	db.refresh(&remoteItem, now)
 	db.remoteItems.m[key] = remoteItem
+	db.remoteItems.accessed(key, remoteItem.cached)
 
-	item = Item{Key: key, Value: remoteItem.value}
+	item = Item{Key: key, Value: remoteItem.value, Meta: remoteItem.meta, Expire: remoteItem.expire, Written: remoteItem.written}
+	return
+}
+
+// GetLocalItem returns an item this node has published on the kademlia
+// network.
+func (db *Database) GetLocalItem(key Key) (item Item, err error) {
+	db.localItems.RLock()
+	defer db.localItems.RUnlock()
+
+	localItem, found := db.localItems.m[key]
+	if !found {
+		err = fmt.Errorf("no local item matching key: %v", key)
+		return
+	}
+
+	item = Item{Key: key, Value: localItem.value, Meta: localItem.meta, Written: localItem.written}
+	return
+}
+
+// Items returns the items other nodes has stored at this node, with their
+// expiration times. Expired items are left out. Unlike GetItem the expiration
+// times are not extended.
+func (db *Database) Items() (items []Item) {
+	now := db.clock.Now()
+
+	db.remoteItems.RLock()
+	defer db.remoteItems.RUnlock()
+
+	for key, remoteItem := range db.remoteItems.m {
+		if db.expired(remoteItem, now) {
+			continue
+		}
+		items = append(items, Item{Key: key, Value: remoteItem.value, Meta: remoteItem.meta, Expire: remoteItem.expire, Written: remoteItem.written})
+	}
+	return
+}
+
+// LocalLen returns the number of items this node has published on the kademlia
+// network.
+func (db *Database) LocalLen() int {
+	db.localItems.RLock()
+	defer db.localItems.RUnlock()
+	return len(db.localItems.m)
+}
+
+// LocalItems returns the items this node has published on the kademlia
+// network. Local items never expire.
+func (db *Database) LocalItems() (items []Item) {
+	db.localItems.RLock()
+	defer db.localItems.RUnlock()
+
+	for key, localItem := range db.localItems.m {
+		items = append(items, Item{Key: key, Value: localItem.value, Meta: localItem.meta, Written: localItem.written})
+	}
 	return
 }
 
@@ -203,7 +956,7 @@ func (db *Database) GetItem(key Key) (item Item, err error) {
 func (db *Database) evictRemoteItem(key Key) {
 	log.Debug().Msgf("Evicting: %v", key)
 	db.remoteItems.Lock()
-	delete(db.remoteItems.m, key)
+	db.remoteItems.remove(key)
 	db.remoteItems.Unlock()
 }
 
@@ -211,65 +964,171 @@ func (db *Database) evictRemoteItem(key Key) {
 // republished on the Kademlia network and eventually cease to exist.
 func (db *Database) ForgetItem(key Key) {
 	db.localItems.Lock()
-	delete(db.localItems.m, key)
+	db.deleteLocalItem(key)
 	db.localItems.Unlock()
 }
 
+// RemoveItem removes an item from both the remote and the local items, i.e.
+// the value is neither served to other nodes nor republished anymore.
+func (db *Database) RemoveItem(key Key) {
+	db.evictRemoteItem(key)
+	db.ForgetItem(key)
+}
+
 // itemHandler checks for expired items every second and remove them if they're outdated.
 // This function should be run as a goroutine.
-func (db *Database) itemHandler(ticker *time.Ticker) {
-	for now := range ticker.C {
-		var evictees []Key
-
-		db.remoteItems.RLock()
-		for key, item := range db.remoteItems.m {
-			if now.After(item.expire) {
-				evictees = append(evictees, key)
-			}
+func (db *Database) itemHandler(ticker clock.Ticker) {
+	defer ticker.Stop()
+
+	for {
+		var now time.Time
+		select {
+		case now = <-ticker.Chan():
+		case <-db.done:
+			return
 		}
-		db.remoteItems.RUnlock()
 
-		for _, key := range evictees {
-			db.evictRemoteItem(key)
+		db.pruneExpired(now)
+	}
+}
+
+// PruneExpired removes the items that has expired, instead of waiting for the
+// next sweep of the item handler. Returns the number of removed items.
+func (db *Database) PruneExpired() int {
+	return db.pruneExpired(db.clock.Now())
+}
+
+// pruneExpired removes the items that has expired at the time. The items are
+// collected under a read lock, and then removed one at a time so that the write
+// lock is only held briefly.
+func (db *Database) pruneExpired(now time.Time) (n int) {
+	var evictees []Key
+
+	db.remoteItems.RLock()
+	for key, item := range db.remoteItems.m {
+		if db.expired(item, now) {
+			evictees = append(evictees, key)
+		}
+	}
+	db.remoteItems.RUnlock()
+
+	for _, key := range evictees {
+		if db.evictExpiredItem(key, now) {
+			n++
 		}
 	}
+	return
+}
+
+// evictExpiredItem evicts an item if it's still expired at the time, it might
+// have been refreshed or stored again since it was found expired. Returns true
+// if the item was evicted.
+func (db *Database) evictExpiredItem(key Key, now time.Time) bool {
+	db.remoteItems.Lock()
+	defer db.remoteItems.Unlock()
+
+	remoteItem, found := db.remoteItems.m[key]
+	if !found || !db.expired(remoteItem, now) {
+		return false
+	}
+
+	log.Debug().Msgf("Evicting expired: %v", key)
+	db.remoteItems.remove(key)
+	return true
 }
 
 // republishHandler checks stored localItems that's due for renewal at remote nodes.
 // This function should be run as a goroutine.
-func (db *Database) republishHandler(ticker *time.Ticker) {
-	for now := range ticker.C {
+func (db *Database) republishHandler(ticker clock.Ticker) {
+	defer ticker.Stop()
+
+	for {
+		var now time.Time
+		select {
+		case now = <-ticker.Chan():
+		case <-db.done:
+			return
+		}
+
 		replicate := now.After(db.getReplicate())
 
+		var republish []Item
+
 		db.localItems.Lock()
 		for key, localItem := range db.localItems.m {
 			if now.After(localItem.republish) {
 
 				// Update republish timestamp.
-				localItem.republish = now.Add(db.tRepublish)
+				localItem.republish = db.nextRepublish(now)
 				db.localItems.m[key] = localItem
 
-				db.republishCh <- Item{Key: key, Value: localItem.value}
+				republish = append(republish, Item{Key: key, Value: localItem.value, Meta: localItem.meta, Written: localItem.written})
 			}
 		}
 		db.localItems.Unlock()
 
+		for _, item := range republish {
+			if !db.send(db.republishCh, item) {
+				return
+			}
+		}
+
 		// Replication event, replicate all stored values to k nodes.
 		if replicate {
+			var replicate []Item
+
 			db.remoteItems.RLock()
 			for key, remoteItem := range db.remoteItems.m {
-				db.replicateCh <- Item{Key: key, Value: remoteItem.value}
+				if remoteItem.cached {
+					continue // Cached copies are left to expire.
+				}
+
+				// Another node replicated the item recently, assume that the
+				// other k closest nodes already hold it as well.
+				if now.Sub(remoteItem.stored) < db.tReplicate {
+					continue
+				}
+
+				var ttl time.Duration
+				if remoteItem.fixed {
+					ttl = remoteItem.expire.Sub(now)
+					if ttl <= 0 {
+						continue // Expired, about to be evicted.
+					}
+				}
+				replicate = append(replicate, Item{Key: key, Value: remoteItem.value, Meta: remoteItem.meta, TTL: ttl, Written: remoteItem.written})
 			}
 			db.remoteItems.RUnlock()
-		}
 
-		// If a replication event just happened, reset the replication timer.
-		if replicate {
+			for _, item := range replicate {
+				if !db.send(db.replicateCh, item) {
+					return
+				}
+			}
+
+			// A replication event just happened, reset the replication timer.
 			db.setReplicate()
 		}
 	}
 }
 
+// send publishes the item to the channel, it returns false if the database was
+// closed before the item could be sent.
+func (db *Database) send(ch chan Item, item Item) bool {
+	select {
+	case ch <- item:
+		return true
+	case <-db.done:
+		return false
+	}
+}
+
+// Close stops the handlers maintaining the database. It must only be called
+// once.
+func (db *Database) Close() {
+	close(db.done)
+}
+
 // KeyFromString parses a hexadecimal representation of the key into a Key.
 func KeyFromString(str string) (key Key, err error) {
 	h, err := hex.DecodeString(str)
@@ -287,16 +1146,32 @@ func (k Key) String() string {
 	return hex.EncodeToString(k[:])
 }
 
+// KeyFromValue returns the key of a value, i.e. the blake2b256 hash of it.
 func KeyFromValue(value string) Key {
-	return blake2b.Sum256([]byte(truncate(value)))
+	return KeyFromBytes([]byte(value))
 }
 
-// truncate truncates supplied string to a maximum of a 1000 characters. Returns a string.
-func truncate(s string) string {
-	if len(s) > 1000 {
-		return s[:1000]
+// KeyFromBytes returns the key of a binary value.
+func KeyFromBytes(value []byte) Key {
+	return blake2b.Sum256(value)
+}
+
+// MaxNamespaceSize is the maximum size of a namespace in bytes.
+const MaxNamespaceSize = blake2b.Size
+
+// KeyFromBytesIn returns the key of a binary value in the namespace, i.e. the
+// blake2b256 hash of the value keyed with the namespace. The same value maps to
+// different keys in different namespaces, the empty namespace gives the same
+// key as KeyFromBytes.
+func KeyFromBytesIn(namespace, value []byte) (key Key, err error) {
+	h, err := blake2b.New256(namespace)
+	if err != nil {
+		return key, fmt.Errorf("invalid namespace: %w", err)
 	}
-	return s
+
+	h.Write(value)
+	copy(key[:], h.Sum(nil))
+	return key, nil
 }
 
 func (item Item) String() string {
@@ -5,6 +5,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/optmzr/d7024e-dht/clock"
 	"github.com/optmzr/d7024e-dht/node"
 )
 
@@ -81,19 +82,27 @@ func BenchmarkAddItem(b *testing.B) {
 	}
 }
 
-func TestTruncate(t *testing.T) {
+func TestAddItem_long(t *testing.T) {
+	iHTicker := time.NewTicker(time.Second)
+	rHTicker := time.NewTicker(time.Second)
+	db := NewDatabase(time.Second*86400, time.Second*3600, time.Second*86400, iHTicker, rHTicker)
+
 	tooLongString := "9Tf2YFM1NLOxCVWg3e5lclDBPqEV0yzQGHhc41ZUoWTy9maE5hzPyWBgmwMWhg1yM1hb572ZXdXEGjoQvyNT8exx6fikCiFmJQcPBdCcw9rzlR4BseKtyixbeRhh9NF0AWoltgMVPJdYPSgWHYEUlPAdYFCAvlRs5Vumziu2niuPWzhTfzy9RDAfB1Tqt6mHPu9Cxsq1oSZUxltamshva8N2qoc4Rt5qoOoVxMyRxq21WcJ7xXVTHmd1EzpyJ31bnvoiN8zdtc0zPKQ3ddNkuCnRoJzQ78FqPSsXM6DgpNeMcaGFpPwj65hLa2gga4L8N7POF7rZdJJY8vyKIc8b6fLVlrMBlAHuIrrVzjhYw1tuGr26p1TIiV6jfYHPZkZiF5vQCeuN95uCDuP7uJOQUlo4J19pUw2sNB18mMCA7XFYnH4Ys1esF4ordeWkaJ6jLlS3ZThFsfVAVhRzke70ZQUWsWJD6LPJQjILZoffj3hpxlw7FlOeTqpPeHvAyZXX6MTNv95hbU0dWDa6vaUrO3ICVyTHsAr46CpvQMA8kbnfU6szKe1kTgJHvSmL8N9sqcPzd4eMaBtfGUoMBZgHpx18NeaAmx3sZ8RM1gMLDMCO5R0CeW8EsiLkoal4W1bG2nOECi4sGzX22LWcEU1QeuQbn5uFj8oVA8qmCN1cBQreo5cx0AXT0oSMnnuvelJBavHMU8CUjsawq7mUDuzm0M9dBYnXb2INbctkduN5jzAmo1F4ZqAZBOUH2FIr9A8U7bBShtlynWiV8PXepDMXN22kCZ2MRZ7CDkbV4OdFey6MZvbXx9LHZQ8Q4EjQ4FGjV1S0vbrThMVHRNzrjcwWvvZMCDSjE5Ct5d08nJKQ7vZVSdAihVNCyXFVxQIXr8AeFMk6cJDS4E3fbOo9YKJrRWawxJ2h4Q87dLqszVyAo1yJSQawTtinRdq1pogY578J8iMbegqqgLYABrxxnEVU0J2prsx4kGkpMaQRtgggusjA1I46CUmVSsPU3vGB"
 
-	maxThousandCharString := truncate(tooLongString)
-	if len(maxThousandCharString) > 1000 {
-		t.Errorf("Truncate produces a too long string, more than 1000 chars")
-	}
+	// Values longer than 1000 characters must be stored intact.
+	key := KeyFromValue(tooLongString)
+	db.AddItem(key, tooLongString, 1, 1, false)
 
-	tenCharString := "0123456789"
+	item, err := db.GetItem(key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if item.Value != tooLongString {
+		t.Errorf("value was altered, got %d chars, exp: %d", len(item.Value), len(tooLongString))
+	}
 
-	sameString := truncate(tenCharString)
-	if len(sameString) != len(tenCharString) {
-		t.Errorf("Truncate truncates before 1000 chars")
+	if key == KeyFromValue(tooLongString[:1000]) {
+		t.Error("expected key of long value to differ from key of its prefix")
 	}
 }
 
@@ -274,6 +283,133 @@ func TestRepublisher(t *testing.T) {
 	}
 }
 
+func TestNewDatabaseWithClock(t *testing.T) {
+	clk := clock.NewMock(time.Now())
+	db := NewDatabaseWithClock(time.Hour*24, time.Hour, time.Hour*24, Limits{}, clk, time.Second, time.Second)
+	defer db.Close()
+
+	key := KeyFromValue("q")
+	db.AddItemWithTTL(key, "q", time.Hour, false)
+	db.AddLocalItem(key, "q")
+
+	clk.Advance(30 * time.Minute)
+	if _, err := db.GetItem(key); err != nil {
+		t.Error("item expired before its TTL")
+	}
+
+	clk.Advance(time.Hour)
+	for start := time.Now(); ; {
+		if _, err := db.GetItem(key); err != nil {
+			break // Done, item was removed.
+		}
+		if time.Since(start) > time.Second {
+			t.Fatal("item is still in db")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	clk.Advance(24 * time.Hour)
+	select {
+	case item := <-db.RepublishCh():
+		if item.Key != key {
+			t.Errorf("expected %v to be republished, got: %v", key, item.Key)
+		}
+	case <-time.After(time.Second):
+		t.Error("local item was not republished")
+	}
+}
+
+func TestSetGracePeriod(t *testing.T) {
+	// Long sweep intervals, the items are pruned explicitly.
+	clk := clock.NewMock(time.Now())
+	db := NewDatabaseWithClock(time.Hour, time.Hour, time.Hour, Limits{}, clk, time.Hour*24, time.Hour*24)
+	defer db.Close()
+	db.SetGracePeriod(time.Minute)
+
+	key := KeyFromValue("q")
+	fixedKey := KeyFromValue("fixed")
+	db.AddItem(key, "q", 2, 1, true) // Central, expires after tExpire.
+	db.AddItemWithTTL(fixedKey, "fixed", time.Hour, true)
+
+	expire, ok := db.Expiry(key)
+	if exp := clk.Now().Add(time.Hour + time.Minute); !ok || !expire.Equal(exp) {
+		t.Errorf("unexpected expiry, got: %v, exp: %v", expire, exp)
+	}
+
+	// Expired, but within the grace period.
+	clk.Advance(time.Hour + time.Second)
+	if n := db.PruneExpired(); n != 1 {
+		t.Errorf("unexpected number of pruned items, got: %d, exp: 1 (the item with a TTL)", n)
+	}
+	if _, err := db.GetItem(fixedKey); err == nil {
+		t.Error("expected the item with a TTL to expire without grace")
+	}
+
+	db.remoteItems.RLock()
+	_, found := db.remoteItems.m[key]
+	db.remoteItems.RUnlock()
+	if !found {
+		t.Fatal("expected the item to be kept during the grace period")
+	}
+
+	// Reads during the grace period don't revive the item.
+	if _, err := db.GetItem(key); err != nil {
+		t.Errorf("expected the item to be served during the grace period, got: %v", err)
+	}
+	if got, _ := db.Expiry(key); !got.Equal(expire) {
+		t.Errorf("unexpected expiry after a read during the grace period, got: %v, exp: %v", got, expire)
+	}
+
+	clk.Advance(time.Minute)
+	if n := db.PruneExpired(); n != 1 {
+		t.Errorf("unexpected number of pruned items, got: %d, exp: 1", n)
+	}
+	if _, ok := db.Expiry(key); ok {
+		t.Error("expected the item to be removed after the grace period")
+	}
+}
+
+func TestNextRepublish(t *testing.T) {
+	clk := clock.NewMock(time.Now())
+	db := NewDatabaseWithClock(time.Hour, time.Hour, 2*time.Hour, Limits{}, clk, time.Second, time.Second)
+	defer db.Close()
+
+	// Republished ahead of the expiration at the other nodes.
+	db.AddLocalItem(KeyFromValue("q"), "q")
+
+	db.localItems.RLock()
+	republish := db.localItems.m[KeyFromValue("q")].republish
+	db.localItems.RUnlock()
+
+	if exp := clk.Now().Add(time.Hour); republish.After(exp) {
+		t.Errorf("unexpected republish time, got: %v, exp before: %v", republish, exp)
+	}
+}
+
+func TestRetryRepublish(t *testing.T) {
+	iHTicker := time.NewTicker(time.Second)
+	rHTicker := time.NewTicker(time.Second)
+	db := NewDatabase(time.Second*86400, time.Second*3600, time.Second*86400, iHTicker, rHTicker)
+
+	testVal := "q"
+	key := KeyFromValue(testVal)
+
+	db.AddLocalItem(key, testVal)
+	db.RetryRepublish(key, time.Minute)
+
+	storedLocalItem, _ := getLocalItem(db, key)
+	if time.Until(storedLocalItem.republish) > time.Minute {
+		t.Errorf("republish was not rescheduled, got: %v", storedLocalItem.republish)
+	}
+
+	// Unknown keys must not be added.
+	unknown := KeyFromValue("r")
+	db.RetryRepublish(unknown, time.Minute)
+	if _, ok := getLocalItem(db, unknown); ok {
+		t.Error("unexpected local item for unknown key")
+	}
+}
+
 func TestReplication(t *testing.T) {
 	iHTicker := time.NewTicker(time.Second)
 
@@ -324,6 +460,35 @@ func TestKeyFromString(t *testing.T) {
 	}
 }
 
+func TestKeyFromBytesIn(t *testing.T) {
+	value := []byte("ABC, du är mina tankar")
+
+	key, err := KeyFromBytesIn(nil, value)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if key != KeyFromBytes(value) {
+		t.Errorf("unexpected key without namespace, got: %v, exp: %v", key, KeyFromBytes(value))
+	}
+
+	a, err := KeyFromBytesIn([]byte("a"), value)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	b, err := KeyFromBytesIn([]byte("b"), value)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if a == b || a == key {
+		t.Errorf("expected different keys in different namespaces, got: %v and %v", a, b)
+	}
+
+	_, err = KeyFromBytesIn(make([]byte, MaxNamespaceSize+1), value)
+	if err == nil {
+		t.Error("expected error for too large namespace")
+	}
+}
+
 func TestRepublishCh(t *testing.T) {
 	iHTicker := time.NewTicker(time.Second)
 	rHTicker := time.NewTicker(time.Second)
@@ -368,6 +533,226 @@ func TestForgetItem(t *testing.T) {
 	}
 }
 
+func TestAddHandedOffItem(t *testing.T) {
+	iHTicker := time.NewTicker(time.Second)
+	rHTicker := time.NewTicker(time.Second)
+	db := NewDatabaseWithLimits(time.Hour, time.Hour, time.Hour, Limits{MaxHandoffItems: 2, MaxHandoffBytes: 5}, iHTicker, rHTicker)
+	defer db.Close()
+
+	own := KeyFromValue("own")
+	db.AddLocalItem(own, "own")
+	if db.AddHandedOffItem(own, "own", nil, time.Time{}) {
+		t.Error("unexpected handoff of a value published by this node")
+	}
+
+	if !db.AddHandedOffItem(KeyFromValue("a"), "a", nil, time.Time{}) {
+		t.Error("expected the first handoff to be added")
+	}
+	if db.AddHandedOffItem(KeyFromValue("bcdef"), "bcdef", nil, time.Time{}) {
+		t.Error("expected the handoff over the byte limit to be dropped")
+	}
+	if !db.AddHandedOffItem(KeyFromValue("bc"), "bc", nil, time.Time{}) {
+		t.Error("expected the second handoff to be added")
+	}
+	if db.AddHandedOffItem(KeyFromValue("d"), "d", nil, time.Time{}) {
+		t.Error("expected the handoff over the item limit to be dropped")
+	}
+
+	// Replacing a handed off value, or forgetting one, makes room.
+	if !db.AddHandedOffItem(KeyFromValue("a"), "a", nil, time.Time{}) {
+		t.Error("expected the handed off value to be replaced")
+	}
+	db.ForgetItem(KeyFromValue("a"))
+	if !db.AddHandedOffItem(KeyFromValue("d"), "d", nil, time.Time{}) {
+		t.Error("expected a handoff to be added after one was forgotten")
+	}
+
+	// Published by this node again, no longer counted as handed off.
+	db.AddLocalItem(KeyFromValue("d"), "d")
+	if !db.AddHandedOffItem(KeyFromValue("e"), "e", nil, time.Time{}) {
+		t.Error("expected a handoff to be added after one was published by this node")
+	}
+	if n := db.LocalLen(); n != 4 {
+		t.Errorf("unexpected number of local items, got: %d, exp: %d", n, 4)
+	}
+}
+
+func TestSetMeta(t *testing.T) {
+	iHTicker := time.NewTicker(time.Second)
+	rHTicker := time.NewTicker(time.Second)
+	db := NewDatabase(time.Second*86400, time.Second*3600, time.Second*86400, iHTicker, rHTicker)
+	defer db.Close()
+
+	testVal := "q"
+	testKey := KeyFromValue(testVal)
+	meta := Meta{"content-type": "text/plain"}
+
+	// Ignored for missing items.
+	db.SetMeta(testKey, meta)
+	if _, err := db.GetItem(testKey); err == nil {
+		t.Error("expected no item to be stored")
+	}
+
+	db.AddItem(testKey, testVal, 1, 1, true)
+	db.SetMeta(testKey, meta)
+
+	// Stored again without metadata, e.g. replicated by another node.
+	db.AddItem(testKey, testVal, 1, 1, true)
+
+	item, err := db.GetItem(testKey)
+	if err != nil || item.Meta["content-type"] != "text/plain" {
+		t.Errorf("expected metadata to be kept, got: %v (%v)", item.Meta, err)
+	}
+
+	db.AddLocalItemWithMeta(testKey, testVal, meta)
+
+	item, err = db.GetLocalItem(testKey)
+	if err != nil || item.Meta["content-type"] != "text/plain" {
+		t.Errorf("expected local metadata, got: %v (%v)", item.Meta, err)
+	}
+
+	var buf bytes.Buffer
+	if err := db.SnapshotTo(&buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	iHTicker = time.NewTicker(time.Second)
+	rHTicker = time.NewTicker(time.Second)
+	restored := NewDatabase(time.Second*86400, time.Second*3600, time.Second*86400, iHTicker, rHTicker)
+	defer restored.Close()
+
+	if err := restored.RestoreFrom(&buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	item, err = restored.GetItem(testKey)
+	if err != nil || item.Meta["content-type"] != "text/plain" {
+		t.Errorf("expected restored metadata, got: %v (%v)", item.Meta, err)
+	}
+	item, err = restored.GetLocalItem(testKey)
+	if err != nil || item.Meta["content-type"] != "text/plain" {
+		t.Errorf("expected restored local metadata, got: %v (%v)", item.Meta, err)
+	}
+}
+
+func TestMeta_Size(t *testing.T) {
+	if size := (Meta{"ab": "cde", "f": ""}).Size(); size != 6 {
+		t.Errorf("unexpected size, got: %d, exp: %d", size, 6)
+	}
+}
+
+func TestRemoveItem(t *testing.T) {
+	iHTicker := time.NewTicker(time.Second)
+	rHTicker := time.NewTicker(time.Second)
+	db := NewDatabase(time.Second*86400, time.Second*3600, time.Second*86400, iHTicker, rHTicker)
+
+	testVal := "q"
+	testKey := KeyFromValue(testVal)
+
+	db.AddItem(testKey, testVal, 1, 1, false)
+	db.AddLocalItem(testKey, testVal)
+
+	db.RemoveItem(testKey)
+
+	_, err := db.GetItem(testKey)
+	if err == nil {
+		t.Error("expected item to be removed from remote items")
+	}
+
+	_, ok := getLocalItem(db, testKey)
+	if ok {
+		t.Error("expected item to be removed from local items")
+	}
+}
+
+func TestAddCachedItem(t *testing.T) {
+	iHTicker := time.NewTicker(time.Second)
+	rHTicker := time.NewTicker(time.Second)
+	db := NewDatabase(time.Second*86400, time.Second*3600, time.Second*86400, iHTicker, rHTicker)
+
+	testVal := "q"
+	testKey := KeyFromValue(testVal)
+
+	db.AddCachedItem(testKey, testVal, time.Hour)
+
+	db.remoteItems.RLock()
+	item, ok := db.remoteItems.m[testKey]
+	db.remoteItems.RUnlock()
+
+	if !ok {
+		t.Fatal("expected cached item to be in db")
+	}
+
+	if !item.cached {
+		t.Error("expected item to be marked as cached")
+	}
+
+	if item.expire.After(time.Now().Add(time.Hour)) {
+		t.Errorf("unexpected expiration time: %v", item.expire)
+	}
+
+	// Cached copies must not replace stored items.
+	otherKey := KeyFromValue("w")
+	db.AddItem(otherKey, "w", 1, 1, false)
+	db.AddCachedItem(otherKey, "w", time.Hour)
+
+	db.remoteItems.RLock()
+	item = db.remoteItems.m[otherKey]
+	db.remoteItems.RUnlock()
+
+	if item.cached {
+		t.Error("expected stored item to not be replaced by cached copy")
+	}
+}
+
+func TestAddItemWithTTL(t *testing.T) {
+	iHTicker := time.NewTicker(time.Second)
+	rHTicker := time.NewTicker(time.Second)
+	db := NewDatabase(time.Second*86400, time.Second*3600, time.Second*86400, iHTicker, rHTicker)
+
+	testVal := "q"
+	testKey := KeyFromValue(testVal)
+
+	db.AddItemWithTTL(testKey, testVal, time.Minute, false)
+
+	_, err := db.GetItem(testKey)
+	if err != nil {
+		t.Fatal("expected item to be in db")
+	}
+
+	db.remoteItems.RLock()
+	item := db.remoteItems.m[testKey]
+	db.remoteItems.RUnlock()
+
+	// Reads must not extend an expiration set by the publisher.
+	if item.expire.After(time.Now().Add(time.Minute)) {
+		t.Errorf("unexpected expiration time: %v", item.expire)
+	}
+}
+
+func TestReplication_ttl(t *testing.T) {
+	iHTicker := time.NewTicker(time.Second)
+
+	tch := make(chan time.Time)
+	rHTicker := &time.Ticker{
+		C: tch,
+	}
+
+	db := NewDatabase(time.Second*86400, time.Second*0, time.Second*86400, iHTicker, rHTicker)
+
+	testVal := "q"
+	db.AddItemWithTTL(KeyFromValue(testVal), testVal, time.Hour, false)
+
+	go func() {
+		tch <- time.Now()
+	}()
+
+	replicated := <-db.replicateCh
+	if replicated.TTL <= 0 || replicated.TTL > time.Hour {
+		t.Errorf("unexpected remaining TTL of replicated item: %v", replicated.TTL)
+	}
+}
+
 func TestItemString(t *testing.T) {
 	item := Item{Key: [32]byte{}, Value: "q"}
 	str := item.String()
@@ -375,3 +760,554 @@ func TestItemString(t *testing.T) {
 		t.Errorf("unexpected string: %s", str)
 	}
 }
+
+func TestReplication_recentlyStored(t *testing.T) {
+	iHTicker := time.NewTicker(time.Second)
+
+	tch := make(chan time.Time)
+	rHTicker := &time.Ticker{
+		C: tch,
+	}
+
+	db := NewDatabase(time.Second*86400, time.Second*3600, time.Second*86400, iHTicker, rHTicker)
+
+	recent, old := "q", "r"
+	db.AddItem(KeyFromValue(recent), recent, 1, 1, false)
+	db.AddItem(KeyFromValue(old), old, 1, 1, false)
+
+	now := time.Now().Add(time.Hour + time.Second)
+
+	// Pretend that another node replicated the item right before the
+	// replication event.
+	db.remoteItems.Lock()
+	item := db.remoteItems.m[KeyFromValue(recent)]
+	item.stored = now.Add(-time.Second)
+	db.remoteItems.m[KeyFromValue(recent)] = item
+	db.remoteItems.Unlock()
+
+	go func() {
+		tch <- now
+	}()
+
+	replicated := <-db.replicateCh
+	if replicated.Value != old {
+		t.Errorf("unexpected replicated item, got: %s, exp: %s", replicated.Value, old)
+	}
+
+	select {
+	case replicated = <-db.replicateCh:
+		t.Errorf("unexpected replication of recently stored item: %s", replicated.Value)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestAddItem_markStored(t *testing.T) {
+	iHTicker := time.NewTicker(time.Second)
+	rHTicker := time.NewTicker(time.Second)
+	db := NewDatabase(time.Second*86400, time.Second*3600, time.Second*86400, iHTicker, rHTicker)
+
+	testVal := "q"
+	key := KeyFromValue(testVal)
+	db.AddItem(key, testVal, 1, 1, false)
+
+	db.remoteItems.Lock()
+	item := db.remoteItems.m[key]
+	item.stored = time.Time{}
+	db.remoteItems.m[key] = item
+	db.remoteItems.Unlock()
+
+	// A replicated store of an existing item should only record the store.
+	db.AddItem(key, testVal, 1, 1, false)
+
+	db.remoteItems.RLock()
+	item = db.remoteItems.m[key]
+	db.remoteItems.RUnlock()
+
+	if item.stored.IsZero() {
+		t.Error("expected store of existing item to be recorded")
+	}
+}
+
+func TestAddItem_upgradeCached(t *testing.T) {
+	iHTicker := time.NewTicker(time.Second)
+	rHTicker := time.NewTicker(time.Second)
+	db := NewDatabase(time.Hour, time.Hour, time.Hour, iHTicker, rHTicker)
+	defer db.Close()
+
+	testVal := "q"
+	key := KeyFromValue(testVal)
+	db.AddCachedItem(key, testVal, time.Minute)
+
+	// A replicated store of a cached copy makes it a stored item.
+	db.AddItem(key, testVal, 30, 20, false)
+
+	db.remoteItems.RLock()
+	item := db.remoteItems.m[key]
+	db.remoteItems.RUnlock()
+
+	if item.cached || item.fixed {
+		t.Error("expected the cached copy to be upgraded to a stored item")
+	}
+	if item.stored.IsZero() {
+		t.Error("expected store of the cached copy to be recorded")
+	}
+	if exp := time.Now().Add(59 * time.Minute); item.expire.Before(exp) {
+		t.Errorf("unexpected expiration of the upgraded item, got: %v, exp: after %v", item.expire, exp)
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	iHTicker := time.NewTicker(time.Second)
+	rHTicker := time.NewTicker(time.Second)
+	db := NewDatabase(time.Second*86400, time.Second*3600, time.Second*86400, iHTicker, rHTicker)
+	defer db.Close()
+
+	remoteKey := KeyFromValue("remote")
+	cachedKey := KeyFromValue("cached")
+	expiredKey := KeyFromValue("expired")
+	localKey := KeyFromValue("local")
+
+	written := time.Now().Add(-time.Hour).Round(0)
+	publisher := node.NewID()
+
+	db.AddItemAt(remoteKey, "remote", written, 1, 1, true)
+	db.AddPublisher(remoteKey, publisher)
+	db.AddCachedItem(cachedKey, "cached", time.Minute)
+	db.AddItemWithTTL(expiredKey, "expired", -time.Second, true)
+	db.AddLocalItemAt(localKey, "local", nil, written)
+
+	var buf bytes.Buffer
+	err := db.SnapshotTo(&buf)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	iHTicker = time.NewTicker(time.Second)
+	rHTicker = time.NewTicker(time.Second)
+	restored := NewDatabase(time.Second*86400, time.Second*3600, time.Second*86400, iHTicker, rHTicker)
+	defer restored.Close()
+
+	err = restored.RestoreFrom(&buf)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	item, err := restored.GetItem(remoteKey)
+	if err != nil || item.Value != "remote" {
+		t.Errorf("expected remote item to be restored, got: %v (%v)", item, err)
+	}
+	if !item.Written.Equal(written) {
+		t.Errorf("unexpected write time of remote item, got: %v, exp: %v", item.Written, written)
+	}
+	if !restored.HasPublisher(remoteKey, publisher) {
+		t.Error("expected the publisher of the remote item to be restored")
+	}
+
+	restored.remoteItems.RLock()
+	cached := restored.remoteItems.m[cachedKey]
+	_, expired := restored.remoteItems.m[expiredKey]
+	restored.remoteItems.RUnlock()
+
+	if !cached.cached || !cached.fixed {
+		t.Errorf("expected cached item to be restored as cached, got: %+v", cached)
+	}
+	if cached.expire.After(time.Now().Add(time.Minute)) {
+		t.Errorf("unexpected expiration time of cached item: %v", cached.expire)
+	}
+	if expired {
+		t.Error("expected expired item to be skipped")
+	}
+
+	restored.localItems.RLock()
+	local, found := restored.localItems.m[localKey]
+	restored.localItems.RUnlock()
+
+	if !found || local.value != "local" || !local.written.Equal(written) {
+		t.Errorf("expected local item to be restored, got: %+v", local)
+	}
+
+	err = restored.RestoreFrom(bytes.NewBufferString("garbage"))
+	if err == nil {
+		t.Error("expected error for invalid snapshot")
+	}
+}
+
+func TestLimits_maxItems(t *testing.T) {
+	iHTicker := time.NewTicker(time.Second)
+	rHTicker := time.NewTicker(time.Second)
+	db := NewDatabaseWithLimits(time.Second*86400, time.Second*3600, time.Second*86400,
+		Limits{MaxItems: 2}, iHTicker, rHTicker)
+	defer db.Close()
+
+	a, b, c := KeyFromValue("a"), KeyFromValue("b"), KeyFromValue("c")
+
+	db.AddItem(a, "a", 1, 1, true)
+	db.AddItem(b, "b", 1, 1, true)
+
+	// Access a so that b becomes the least recently accessed item.
+	db.GetItem(a)
+
+	db.AddItem(c, "c", 1, 1, true)
+
+	if _, err := db.GetItem(b); err == nil {
+		t.Error("expected least recently accessed item to be evicted")
+	}
+	if _, err := db.GetItem(a); err != nil {
+		t.Error("expected recently accessed item to be kept")
+	}
+
+	if items, _ := db.Size(); items != 2 {
+		t.Errorf("unexpected number of items, got: %d, exp: %d", items, 2)
+	}
+	if evictions := db.Evictions(); evictions != 1 {
+		t.Errorf("unexpected number of evictions, got: %d, exp: %d", evictions, 1)
+	}
+}
+
+func TestLimits_maxBytes(t *testing.T) {
+	iHTicker := time.NewTicker(time.Second)
+	rHTicker := time.NewTicker(time.Second)
+	db := NewDatabaseWithLimits(time.Second*86400, time.Second*3600, time.Second*86400,
+		Limits{MaxBytes: 6}, iHTicker, rHTicker)
+	defer db.Close()
+
+	cached, stored, other := KeyFromValue("cached"), KeyFromValue("st"), KeyFromValue("ot")
+
+	db.AddItem(stored, "st", 1, 1, true)
+	db.AddCachedItem(cached, "cac", time.Minute)
+
+	// Cached copies are evicted before stored items, even if accessed later.
+	db.AddItem(other, "ot", 1, 1, true)
+
+	if _, err := db.GetItem(cached); err == nil {
+		t.Error("expected cached item to be evicted")
+	}
+	if _, err := db.GetItem(stored); err != nil {
+		t.Error("expected stored item to be kept")
+	}
+
+	if _, bytes := db.Size(); bytes != 4 {
+		t.Errorf("unexpected total size, got: %d, exp: %d", bytes, 4)
+	}
+
+	db.RemoveItem(stored)
+	if _, bytes := db.Size(); bytes != 2 {
+		t.Errorf("unexpected total size after removal, got: %d, exp: %d", bytes, 2)
+	}
+
+	// A cached copy replaced by a stored item is evicted as a stored item.
+	db.AddCachedItem(cached, "cac", time.Minute)
+	db.AddItem(cached, "cac", 1, 1, true)
+	if n, m := db.remoteItems.cachedLRU.Len(), db.remoteItems.storedLRU.Len(); n != 0 || m != 2 {
+		t.Errorf("unexpected number of cached and stored items, got: %d and %d, exp: 0 and 2", n, m)
+	}
+	if len(db.remoteItems.lru) != len(db.remoteItems.m) {
+		t.Errorf("unexpected number of accessed items, got: %d, exp: %d", len(db.remoteItems.lru), len(db.remoteItems.m))
+	}
+}
+
+func TestItems(t *testing.T) {
+	iHTicker := time.NewTicker(time.Second)
+	rHTicker := time.NewTicker(time.Second)
+	db := NewDatabase(time.Second*86400, time.Second*3600, time.Second*86400, iHTicker, rHTicker)
+	defer db.Close()
+
+	remoteKey := KeyFromValue("remote")
+	expiredKey := KeyFromValue("expired")
+	localKey := KeyFromValue("local")
+
+	db.AddItemWithTTL(remoteKey, "remote", time.Minute, true)
+	db.AddItemWithTTL(expiredKey, "expired", -time.Second, true)
+	db.AddLocalItem(localKey, "local")
+
+	items := db.Items()
+	if len(items) != 1 {
+		t.Fatalf("unexpected number of items, got: %d, exp: %d", len(items), 1)
+	}
+
+	item := items[0]
+	if item.Key != remoteKey || item.Value != "remote" {
+		t.Errorf("unexpected item, got: %v", item)
+	}
+	if item.Expire.IsZero() || item.Expire.After(time.Now().Add(time.Minute)) {
+		t.Errorf("unexpected expiration time: %v", item.Expire)
+	}
+
+	if _, err := db.GetItem(expiredKey); err == nil {
+		t.Error("expected expired item to be filtered from reads")
+	}
+
+	local := db.LocalItems()
+	if len(local) != 1 || local[0].Key != localKey {
+		t.Errorf("unexpected local items, got: %v", local)
+	}
+
+	if n := db.LocalLen(); n != 1 {
+		t.Errorf("unexpected number of local items, got: %d, exp: 1", n)
+	}
+}
+
+func TestAddItem_lowCentrality(t *testing.T) {
+	iHTicker := time.NewTicker(time.Second)
+	rHTicker := time.NewTicker(time.Second)
+	db := NewDatabase(time.Second*86400, time.Second*3600, time.Second*86400, iHTicker, rHTicker)
+	defer db.Close()
+
+	key := KeyFromValue("q")
+	db.AddItem(key, "q", 1, 20, true)
+
+	// The expiration must not overflow into the past.
+	if _, err := db.GetItem(key); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestAddItem_dedup(t *testing.T) {
+	iHTicker := time.NewTicker(time.Second)
+	rHTicker := time.NewTicker(time.Second)
+	db := NewDatabase(time.Second*86400, time.Second*3600, time.Second*86400, iHTicker, rHTicker)
+	defer db.Close()
+
+	key := KeyFromValue("q")
+
+	if !db.AddItemWithTTL(key, "q", time.Minute, true) {
+		t.Error("expected first store to store the item")
+	}
+
+	a, b := node.NewID(), node.NewID()
+	db.AddPublisher(key, a)
+
+	if !db.AddItemWithTTL(key, "q", time.Hour, true) {
+		t.Error("expected store of the same value to store the item")
+	}
+	db.AddPublisher(key, b)
+	db.AddPublisher(key, b)
+
+	db.remoteItems.RLock()
+	item := db.remoteItems.m[key]
+	db.remoteItems.RUnlock()
+
+	if item.expire.Before(time.Now().Add(time.Minute)) {
+		t.Errorf("expected expiration to be refreshed, got: %v", item.expire)
+	}
+
+	if publishers := db.Publishers(key); len(publishers) != 2 {
+		t.Errorf("unexpected number of publishers, got: %d, exp: %d", len(publishers), 2)
+	}
+
+	if items, bytes := db.Size(); items != 1 || bytes != 1 {
+		t.Errorf("unexpected size, got: %d items and %d bytes", items, bytes)
+	}
+}
+
+func TestAddItemAt_lastWriteWins(t *testing.T) {
+	iHTicker := time.NewTicker(time.Second)
+	rHTicker := time.NewTicker(time.Second)
+	db := NewDatabase(time.Second*86400, time.Second*3600, time.Second*86400, iHTicker, rHTicker)
+	defer db.Close()
+
+	key := Key{1}
+	now := time.Now()
+
+	db.AddItemAt(key, "new", now, 1, 1, true)
+	if db.AddItemAt(key, "old", now.Add(-time.Second), 1, 1, true) {
+		t.Error("expected an older value to not be stored")
+	}
+	if item, _ := db.GetItem(key); item.Value != "new" || !item.Written.Equal(now) {
+		t.Errorf("expected the newest value to be kept, got: %v written at %v", item, item.Written)
+	}
+
+	if db.AddItemWithTTLAt(key, "older", now.Add(-time.Second), time.Minute, false) {
+		t.Error("expected an older replicated value to not be stored")
+	}
+
+	// A newer value replaces the item even if replicated.
+	db.AddItemWithTTLAt(key, "newer", now.Add(time.Second), time.Minute, false)
+	if item, _ := db.GetItem(key); item.Value != "newer" {
+		t.Errorf("expected the newer value to replace the item, got: %v", item)
+	}
+
+	if items, bytes := db.Size(); items != 1 || bytes != len("newer") {
+		t.Errorf("unexpected size, got: %d items and %d bytes", items, bytes)
+	}
+
+	// Values written at the same time, or without write times, keep the stored
+	// value.
+	db.AddItemAt(key, "tie", now.Add(time.Second), 1, 1, true)
+	if item, _ := db.GetItem(key); item.Value != "newer" {
+		t.Errorf("expected the stored value to be kept on a tie, got: %v", item)
+	}
+
+	unknown := Key{2}
+	db.AddItem(unknown, "first", 1, 1, true)
+	db.AddItem(unknown, "second", 1, 1, true)
+	if item, _ := db.GetItem(unknown); item.Value != "first" {
+		t.Errorf("expected the value without a write time to be kept, got: %v", item)
+	}
+}
+
+func TestAddItemAt_clampWritten(t *testing.T) {
+	clk := clock.NewMock(time.Now())
+	db := NewDatabaseWithClock(time.Hour*24, time.Hour, time.Hour*24, Limits{}, clk, time.Second, time.Second)
+	defer db.Close()
+
+	// Write times far ahead are clamped, so that later writes still win.
+	key := Key{1}
+	db.AddItemAt(key, "future", clk.Now().Add(24*time.Hour), 1, 1, true)
+	if item, _ := db.GetItem(key); !item.Written.Equal(clk.Now().Add(MaxClockSkew)) {
+		t.Errorf("expected the write time to be clamped, got: %v", item.Written)
+	}
+
+	clk.Advance(2 * MaxClockSkew)
+	db.AddItemAt(key, "later", clk.Now(), 1, 1, true)
+	if item, _ := db.GetItem(key); item.Value != "later" {
+		t.Errorf("expected the later value to replace the clamped value, got: %v", item)
+	}
+}
+
+func TestSetConflictPolicy(t *testing.T) {
+	iHTicker := time.NewTicker(time.Second)
+	rHTicker := time.NewTicker(time.Second)
+	db := NewDatabase(time.Second*86400, time.Second*3600, time.Second*86400, iHTicker, rHTicker)
+	defer db.Close()
+
+	db.SetConflictPolicy(RejectConflicts)
+
+	key := Key{1}
+	now := time.Now()
+
+	db.AddItemAt(key, "first", now, 1, 1, true)
+	db.AddItemAt(key, "second", now.Add(time.Second), 1, 1, true)
+	if item, _ := db.GetItem(key); item.Value != "first" {
+		t.Errorf("expected the first value to be kept, got: %v", item)
+	}
+
+	// Cached copies are replaced regardless of the policy.
+	cached := Key{2}
+	db.AddCachedItem(cached, "cached", time.Minute)
+	db.AddItemAt(cached, "stored", now, 1, 1, true)
+	if item, _ := db.GetItem(cached); item.Value != "stored" {
+		t.Errorf("expected the cached copy to be replaced, got: %v", item)
+	}
+}
+
+func TestRefreshItem(t *testing.T) {
+	iHTicker := time.NewTicker(time.Second)
+	rHTicker := time.NewTicker(time.Second)
+	db := NewDatabase(time.Hour, time.Hour, time.Hour, iHTicker, rHTicker)
+	defer db.Close()
+
+	key := KeyFromValue("q")
+	db.AddItem(key, "q", 30, 20, true)
+
+	// Expires within the minute.
+	item := db.remoteItems.m[key]
+	item.expire = time.Now().Add(time.Minute)
+	db.remoteItems.m[key] = item
+
+	if !db.RefreshItem(key) {
+		t.Error("expected item to be refreshed")
+	}
+	if exp := db.remoteItems.m[key].expire; time.Until(exp) < 59*time.Minute {
+		t.Errorf("unexpected expiration after refresh: %v", exp)
+	}
+
+	// Stored long ago, the lifetime can't be extended any further.
+	item = db.remoteItems.m[key]
+	item.created = time.Now().Add(-maxRefreshedAge)
+	item.expire = time.Now().Add(time.Minute)
+	db.remoteItems.m[key] = item
+
+	if db.RefreshItem(key) {
+		t.Error("expected item past the maximum age to not be refreshed")
+	}
+
+	if db.RefreshItem(KeyFromValue("missing")) {
+		t.Error("expected missing item to not be refreshed")
+	}
+}
+
+func TestGetItem_laterExpiry(t *testing.T) {
+	iHTicker := time.NewTicker(time.Second)
+	rHTicker := time.NewTicker(time.Second)
+	db := NewDatabase(time.Hour, time.Hour, time.Hour, iHTicker, rHTicker)
+	defer db.Close()
+
+	key := KeyFromValue("q")
+	db.AddItem(key, "q", 30, 20, true)
+
+	// Expires later than a read would extend it to, e.g. replicated with a
+	// longer expiration.
+	later := time.Now().Add(3 * time.Hour)
+	item := db.remoteItems.m[key]
+	item.expire = later
+	db.remoteItems.m[key] = item
+
+	got, err := db.GetItem(key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !got.Expire.Equal(later) {
+		t.Errorf("unexpected expiration after a read, got: %v, exp: %v", got.Expire, later)
+	}
+}
+
+func TestPruneExpired(t *testing.T) {
+	iHTicker := time.NewTicker(time.Hour)
+	rHTicker := time.NewTicker(time.Hour)
+	db := NewDatabase(time.Hour, time.Hour, time.Hour, iHTicker, rHTicker)
+	defer db.Close()
+
+	expiredKey := KeyFromValue("expired")
+	db.AddItemWithTTL(expiredKey, "expired", time.Nanosecond, true)
+	db.AddItem(KeyFromValue("q"), "q", 30, 20, true)
+
+	time.Sleep(time.Millisecond)
+
+	if n := db.PruneExpired(); n != 1 {
+		t.Errorf("unexpected number of pruned items, got: %d, exp: 1", n)
+	}
+	if items, _ := db.Size(); items != 1 {
+		t.Errorf("unexpected number of items, got: %d, exp: 1", items)
+	}
+	if n := db.PruneExpired(); n != 0 {
+		t.Errorf("unexpected number of pruned items, got: %d, exp: 0", n)
+	}
+}
+
+func TestSetJitter(t *testing.T) {
+	const interval = time.Hour
+
+	var dbs []*Database
+	for i := 0; i < 2; i++ {
+		iHTicker := time.NewTicker(time.Hour)
+		rHTicker := time.NewTicker(time.Hour)
+		db := NewDatabase(time.Hour, interval, interval, iHTicker, rHTicker)
+		defer db.Close()
+
+		db.SetJitter(0.5)
+		db.AddLocalItem(KeyFromValue("q"), "q")
+		dbs = append(dbs, db)
+	}
+
+	// Two nodes started together should neither replicate nor republish at
+	// the same time.
+	a, b := dbs[0].getReplicate(), dbs[1].getReplicate()
+	if a.Equal(b) {
+		t.Errorf("replication events in lockstep, both at: %v", a)
+	}
+
+	key := KeyFromValue("q")
+	ra := dbs[0].localItems.m[key].republish
+	rb := dbs[1].localItems.m[key].republish
+	if ra.Equal(rb) {
+		t.Errorf("republish events in lockstep, both at: %v", ra)
+	}
+
+	for i := 0; i < 100; i++ {
+		d := dbs[0].jittered(interval)
+		if d < interval/2 || d > interval*3/2 {
+			t.Fatalf("jittered interval out of bounds, got: %v", d)
+		}
+	}
+}